@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Stores that keep an access log let us check who read our shares. Reads
+// outside of our own restores mean someone else is collecting shares, which
+// is the first step of an attack on secret sharing. Peer daemons log every
+// request to the objects they host for us, and S3 buckets can have their
+// requests logged to another bucket, see s3_access.go.
+
+// StoreAccess is one logged request to a share object
+type StoreAccess struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Object string    `json:"object"`
+	Remote string    `json:"remote,omitempty"`
+}
+
+// accessLogging is implemented by stores that can report accesses
+type accessLogging interface {
+	AccessLog(since time.Time) ([]StoreAccess, error)
+}
+
+// name of the access log in a hosted peer's directory, and the size at
+// which it is rotated
+const (
+	peerAccessLog     = ".chasm-access.log"
+	peerAccessLogSize = 4 << 20
+)
+
+var peerAccessMutex sync.Mutex
+
+// hostLogFile tells if a name in a hosted peer's directory is the access
+// log or its rotated copy, which are the host's and not the peer's objects
+func hostLogFile(name string) bool {
+	return strings.HasPrefix(name, peerAccessLog)
+}
+
+// logAccess appends a request for object to the peer's access log
+func (h HostedPeer) logAccess(r *http.Request, object string) {
+	peerAccessMutex.Lock()
+	defer peerAccessMutex.Unlock()
+
+	logPath := filepath.Join(h.Dir, peerAccessLog)
+	if fi, err := os.Stat(logPath); err == nil && fi.Size() > peerAccessLogSize {
+		os.Rename(logPath, logPath+".1")
+	}
+
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		color.Red("Error: cannot log access for peer %s: %s", h.Name, err)
+		return
+	}
+	defer file.Close()
+
+	line, _ := json.Marshal(StoreAccess{Time: time.Now().UTC(), Method: r.Method, Object: object, Remote: r.RemoteAddr})
+	file.Write(append(line, '\n'))
+}
+
+// accessLog reads the peer's logged accesses since a time, oldest first
+func (h HostedPeer) accessLog(since time.Time) []StoreAccess {
+	peerAccessMutex.Lock()
+	defer peerAccessMutex.Unlock()
+
+	accesses := []StoreAccess{}
+	for _, name := range []string{peerAccessLog + ".1", peerAccessLog} {
+		file, err := os.Open(filepath.Join(h.Dir, name))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var access StoreAccess
+			if json.Unmarshal(scanner.Bytes(), &access) == nil && !access.Time.Before(since) {
+				accesses = append(accesses, access)
+			}
+		}
+		file.Close()
+	}
+	return accesses
+}
+
+// apiPeerAccess serves GET /api/peer/access?since=<RFC 3339> to hosted
+// peers, listing the accesses to their objects
+func apiPeerAccess(w http.ResponseWriter, r *http.Request) {
+	peer := requestPeer(w, r)
+	if peer == nil {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "invalid since time", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, peer.accessLog(since))
+}
+
+// AccessLog fetches the peer daemon's log of requests to our objects
+func (p PeerStore) AccessLog(since time.Time) ([]StoreAccess, error) {
+	endpoint := strings.TrimSuffix(p.URL, "/") + "/api/peer/access?since=" + url.QueryEscape(since.UTC().Format(time.RFC3339))
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer answered %s, it may predate access logs", resp.Status)
+	}
+
+	var accesses []StoreAccess
+	err = json.NewDecoder(resp.Body).Decode(&accesses)
+	return accesses, err
+}
+
+// AccessAnomaly is a read of a share that none of our restores made
+type AccessAnomaly struct {
+	Store  string
+	Access StoreAccess
+}
+
+// restoreRead checks if one of our restores or decoy rounds, give or take
+// slack for clock skew, made the read. Uploads and removals are not checked,
+// reads are what an attacker collecting shares needs
+func restoreRead(access StoreAccess, runs []RunStats, slack time.Duration) bool {
+	for _, run := range runs {
+		if (run.Command == "restore" || run.Command == "decoy") && !access.Time.Before(run.Start.Add(-slack)) && !access.Time.After(run.Start.Add(run.Duration+slack)) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckAccess pulls the access logs of every store that has one since a
+// time, returning the reads none of our restores account for and the number
+// of stores checked
+func CheckAccess(since time.Time, slack time.Duration) ([]AccessAnomaly, int) {
+	var anomalies []AccessAnomaly
+	checked := 0
+	for i, cs := range preferences.cloudStores() {
+		logging, ok := storeRef(i + 1).(accessLogging)
+		if !ok {
+			continue
+		}
+		accesses, err := logging.AccessLog(since)
+		if err != nil {
+			color.Red("Error: cannot get the access log of %s: %s", cs.ShortDescription(), err)
+			continue
+		}
+		checked++
+
+		for _, access := range accesses {
+			if access.Method == "GET" && !restoreRead(access, state.Runs, slack) {
+				anomalies = append(anomalies, AccessAnomaly{Store: cs.ShortDescription(), Access: access})
+			}
+		}
+	}
+
+	sort.Slice(anomalies, func(i, j int) bool {
+		return anomalies[i].Access.Time.Before(anomalies[j].Access.Time)
+	})
+	return anomalies, checked
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Besides the vault's token, which may do anything, the daemon API takes
+// named tokens limited to a scope, so that a monitoring dashboard can read
+// the status without being able to start a restore or add files. Scopes
+// nest: status reads the status, runs and tasks; restore also lists and
+// downloads files and starts restores and verifies; full is everything the
+// vault's token may do.
+//
+// Served with --tls-client-ca, the API also wants a client certificate
+// signed by that CA with every token, and a token bound to a client only
+// works with that client's certificate. Hosted peers sign in with their own
+// tokens and need no certificate.
+
+const (
+	scopeStatus  = "status"
+	scopeRestore = "restore"
+	scopeFull    = "full"
+)
+
+// apiScopes from the narrowest
+var apiScopes = []string{scopeStatus, scopeRestore, scopeFull}
+
+// ScopedToken is a named token of the daemon API
+type ScopedToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Scope string `json:"scope"`
+
+	// common name of the client certificate the token is bound to, any
+	// client if empty
+	Client string `json:"client,omitempty"`
+}
+
+// CAs signing the client certificates the API wants, nil for none
+var apiClientCAs *x509.CertPool
+
+type scopeKey struct{}
+
+// AddAPIToken creates a named token of scope
+func AddAPIToken(name, scope, client string) (ScopedToken, error) {
+	if name == "" {
+		return ScopedToken{}, errors.New("missing token name")
+	}
+	if scopeIndex(scope) < 0 {
+		return ScopedToken{}, errors.New("scope must be " + strings.Join(apiScopes, ", "))
+	}
+	for _, t := range state.APITokens {
+		if t.Name == name {
+			return ScopedToken{}, errors.New("a token named " + name + " exists")
+		}
+	}
+
+	token := ScopedToken{Name: name, Token: string(RandomShareID()), Scope: scope, Client: client}
+	state.APITokens = append(state.APITokens, token)
+	state.Save()
+	return token, nil
+}
+
+// RemoveAPIToken revokes a named token
+func RemoveAPIToken(name string) bool {
+	for i, t := range state.APITokens {
+		if t.Name == name {
+			state.APITokens = append(state.APITokens[:i], state.APITokens[i+1:]...)
+			state.Save()
+			return true
+		}
+	}
+	return false
+}
+
+func scopeIndex(scope string) int {
+	for i, s := range apiScopes {
+		if s == scope {
+			return i
+		}
+	}
+	return -1
+}
+
+// scopeAllows tells if a token of scope may do what needs want
+func scopeAllows(scope, want string) bool {
+	return scopeIndex(scope) >= 0 && scopeIndex(scope) >= scopeIndex(want)
+}
+
+// clientName is the common name of the verified client certificate of r,
+// "" if it has none
+func clientName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// tokenScope is the scope of the token r carries, "" if it carries none
+// that works from its client
+func tokenScope(r *http.Request) string {
+	if apiClientCAs != nil && clientName(r) == "" {
+		return ""
+	}
+
+	token := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	scope := ""
+	if subtle.ConstantTimeCompare(token, []byte(state.APIToken)) == 1 {
+		scope = scopeFull
+	}
+	for _, t := range state.APITokens {
+		if subtle.ConstantTimeCompare(token, []byte(t.Token)) == 1 && (t.Client == "" || t.Client == clientName(r)) {
+			scope = t.Scope
+		}
+	}
+	return scope
+}
+
+// requestScope is the scope checkScope found for r
+func requestScope(r *http.Request) string {
+	scope, _ := r.Context().Value(scopeKey{}).(string)
+	return scope
+}
+
+// checkScope rejects requests without a token of at least scope, for
+// handlers that must answer while a task holds the preferences lock
+func checkScope(want string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scope := tokenScope(r)
+		if scope == "" {
+			http.Error(w, "invalid api token", http.StatusUnauthorized)
+			return
+		}
+		if !scopeAllows(scope, want) {
+			http.Error(w, "api token lacks the "+want+" scope", http.StatusForbidden)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), scopeKey{}, scope)))
+	}
+}
+
+// requireScope rejects requests without a token of at least scope, and
+// runs the handler holding the preferences lock
+func requireScope(want string, handler http.HandlerFunc) http.HandlerFunc {
+	return checkScope(want, func(w http.ResponseWriter, r *http.Request) {
+		prefsLock.Lock()
+		defer prefsLock.Unlock()
+		handler(w, r)
+	})
+}
+
+// apiTLSConfig asks clients for certificates signed by the CAs in
+// clientCAFile, if given. They are checked per request, as hosted peers
+// connect without one
+func apiTLSConfig(clientCAFile string) (*tls.Config, error) {
+	if clientCAFile == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates in " + clientCAFile)
+	}
+	apiClientCAs = pool
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}, nil
+}
+
+// apiClient is an HTTP client presenting the certificate in certFile, if
+// given, to a daemon API wanting one
+func apiClient(certFile, keyFile string) (*http.Client, error) {
+	if certFile == "" {
+		return http.DefaultClient, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return &http.Client{Transport: transport}, nil
+}
+
+// printAPITokens lists the named tokens, without the tokens themselves
+func printAPITokens() {
+	if len(state.APITokens) == 0 {
+		color.Yellow("No named API tokens. The vault's token is printed by chasm token.")
+		return
+	}
+	for _, t := range state.APITokens {
+		client := "any client"
+		if t.Client != "" {
+			client = "client " + t.Client
+		}
+		color.Green("- %-16s %-8s %s", t.Name, t.Scope, client)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AWS requests are signed with Signature Version 4, using credentials found
+// the way the AWS tools find them: the AWS_ACCESS_KEY_ID environment
+// variables, then the profile in the shared credentials file, then the
+// container or EC2 instance role. Credentials are never kept in the
+// preferences, which are shared to the stores.
+
+// awsCredentials are an access key, with a session token if temporary
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// zero for long-term keys
+	Expires time.Time
+}
+
+// credentials fetched from a role, until shortly before they expire
+var (
+	awsCredentialsLock  sync.Mutex
+	awsCachedCredential = make(map[string]awsCredentials)
+)
+
+// loadAWSCredentials finds credentials for profile, the AWS_PROFILE or
+// default profile if empty
+func loadAWSCredentials(profile string) (awsCredentials, error) {
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	awsCredentialsLock.Lock()
+	defer awsCredentialsLock.Unlock()
+	if cached, ok := awsCachedCredential[profile]; ok && time.Until(cached.Expires) > 5*time.Minute {
+		return cached, nil
+	}
+
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{AccessKeyID: id, SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	if creds, err := sharedAWSCredentials(profile); err == nil {
+		return creds, nil
+	}
+
+	creds, err := roleAWSCredentials()
+	if err != nil {
+		return creds, errors.New("no AWS credentials in the environment, the shared credentials file or an instance role")
+	}
+	awsCachedCredential[profile] = creds
+	return creds, nil
+}
+
+// sharedAWSCredentials reads profile from the shared credentials file
+func sharedAWSCredentials(profile string) (awsCredentials, error) {
+	credentialsPath := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, err
+		}
+		credentialsPath = filepath.Join(home, ".aws", "credentials")
+	}
+	file, err := os.Open(credentialsPath)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer file.Close()
+
+	var creds awsCredentials
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if creds.AccessKeyID == "" {
+		return creds, fmt.Errorf("no profile %s in %s", profile, credentialsPath)
+	}
+	return creds, scanner.Err()
+}
+
+// roleAWSCredentials fetches the temporary credentials of the container's
+// task role or the EC2 instance's role
+func roleAWSCredentials() (awsCredentials, error) {
+	client := &http.Client{Timeout: 2 * time.Second}
+
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return fetchRoleCredentials(client, "http://169.254.170.2"+uri, nil)
+	}
+
+	// IMDSv2 needs a session token first
+	const imds = "http://169.254.169.254/latest/"
+	req, err := http.NewRequest("PUT", imds+"api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	resp, err := client.Do(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	token, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+
+	req, err = http.NewRequest("GET", imds+"meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header = header
+	resp, err = client.Do(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, errors.New("no instance role")
+	}
+	return fetchRoleCredentials(client, imds+"meta-data/iam/security-credentials/"+strings.TrimSpace(string(role)), header)
+}
+
+func fetchRoleCredentials(client *http.Client, endpoint string, header http.Header) (awsCredentials, error) {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if header != nil {
+		req.Header = header
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, errors.New(resp.Status)
+	}
+
+	var role struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&role); err != nil {
+		return awsCredentials{}, err
+	}
+	return awsCredentials{AccessKeyID: role.AccessKeyID, SecretAccessKey: role.SecretAccessKey, SessionToken: role.Token, Expires: role.Expiration}, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEscape escapes s as SigV4 canonical requests do, keeping slashes
+// unless escapeSlash
+func awsURIEscape(s string, escapeSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			escaped.WriteByte(b)
+		case b == '/' && !escapeSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// signAWS signs req for service in region with Signature Version 4. The
+// request URL path must already be escaped as awsURIEscape does
+func signAWS(req *http.Request, body []byte, creds awsCredentials, region, service string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+	if creds.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", creds.SessionToken)
+	}
+
+	// the host and every x-amz- header are signed
+	signed := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") || lower == "content-md5" || lower == "range" || lower == "if-none-match" {
+			signed[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var canonicalQuery []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			canonicalQuery = append(canonicalQuery, awsURIEscape(key, true)+"="+awsURIEscape(value, true))
+		}
+	}
+
+	canonicalPath := req.URL.EscapedPath()
+	if canonicalPath == "" {
+		canonicalPath = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath,
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// awsEscapedURL builds a URL whose path is escaped for signing
+func awsEscapedURL(base, rawPath string, query url.Values) (*url.URL, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = rawPath
+	u.RawPath = awsURIEscape(rawPath, false)
+	u.RawQuery = query.Encode()
+	return u, nil
+}
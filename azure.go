@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// AzureBlobStore keeps shares as block blobs in an Azure Storage container.
+// Requests are signed with the account key of a connection string, or carry
+// a shared access signature (SAS) limited to the container
+type AzureBlobStore struct {
+	// blob service URL, like https://ACCOUNT.blob.core.windows.net
+	Endpoint  string `json:"endpoint"`
+	Container string `json:"container"`
+
+	// shared key authorization
+	AccountName string `json:"account_name,omitempty"`
+	AccountKey  string `json:"-"`
+
+	// SAS query string, without the leading ?
+	SAS string `json:"-"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (a *AzureBlobStore) credentials() map[string]*string {
+	return map[string]*string{
+		"account_key": &a.AccountKey,
+		"sas":         &a.SAS,
+	}
+}
+
+const (
+	// REST API version requests are made with
+	azureVersion = "2021-08-06"
+
+	// largest block blob uploaded with one Put Blob
+	azureMaxObjectSize = 5000 << 20
+)
+
+// ParseAzureConnectionString sets the endpoint and credentials of a store
+// from a storage account connection string
+func ParseAzureConnectionString(connection string) (AzureBlobStore, error) {
+	fields := make(map[string]string)
+	for _, part := range strings.Split(connection, ";") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+
+	a := AzureBlobStore{
+		Endpoint:    strings.TrimSuffix(fields["BlobEndpoint"], "/"),
+		AccountName: fields["AccountName"],
+		AccountKey:  fields["AccountKey"],
+		SAS:         strings.TrimPrefix(fields["SharedAccessSignature"], "?"),
+	}
+	if a.Endpoint == "" && a.AccountName != "" {
+		protocol, suffix := fields["DefaultEndpointsProtocol"], fields["EndpointSuffix"]
+		if protocol == "" {
+			protocol = "https"
+		}
+		if suffix == "" {
+			suffix = "core.windows.net"
+		}
+		a.Endpoint = protocol + "://" + a.AccountName + ".blob." + suffix
+	}
+	if a.Endpoint == "" {
+		return a, errors.New("no AccountName or BlobEndpoint")
+	}
+	if a.SAS == "" && (a.AccountName == "" || a.AccountKey == "") {
+		return a, errors.New("no AccountKey or SharedAccessSignature")
+	}
+	if a.SAS != "" {
+		a.AccountKey = ""
+	}
+	return a, nil
+}
+
+// ParseAzureSASURL sets the endpoint, container and SAS of a store from a
+// container SAS URL
+func ParseAzureSASURL(sasURL string) (AzureBlobStore, error) {
+	u, err := url.Parse(sasURL)
+	if err != nil {
+		return AzureBlobStore{}, err
+	}
+	container := strings.Trim(u.Path, "/")
+	if u.Scheme == "" || u.Host == "" || container == "" || strings.Contains(container, "/") {
+		return AzureBlobStore{}, errors.New("not a container SAS URL")
+	}
+	if u.RawQuery == "" {
+		return AzureBlobStore{}, errors.New("no shared access signature in the URL")
+	}
+	return AzureBlobStore{Endpoint: u.Scheme + "://" + u.Host, Container: container, SAS: u.RawQuery}, nil
+}
+
+// Setup checks that the container can be listed, creating it if it does not
+// exist and the credentials allow
+func (a AzureBlobStore) Setup() bool {
+	for _, as := range preferences.AzureBlobStores {
+		if as.location() == a.location() {
+			color.Red("Azure container %s already exists.", a.location())
+			return false
+		}
+	}
+
+	// a SAS for the container cannot create it
+	if a.SAS == "" {
+		_, err := a.do("GET", "", url.Values{"restype": {"container"}}, nil, nil)
+		var azureErr azureError
+		if errors.As(err, &azureErr) && azureErr.Code == "ContainerNotFound" {
+			color.Yellow("Creating container %s", a.location())
+			_, err = a.do("PUT", "", url.Values{"restype": {"container"}}, nil, nil)
+		}
+		if err != nil {
+			color.Red("Error: cannot access %s: %s", a.location(), err)
+			return false
+		}
+	}
+
+	if _, err := a.list(); err != nil {
+		color.Red("Error: cannot list %s: %s", a.location(), err)
+		return false
+	}
+	return true
+}
+
+func (a AzureBlobStore) location() string {
+	return a.Endpoint + "/" + a.Container
+}
+
+type azureError struct {
+	Status  string
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e azureError) Error() string {
+	if e.Message == "" {
+		return e.Status
+	}
+	return fmt.Sprintf("%s: %s", e.Status, strings.SplitN(e.Message, "\n", 2)[0])
+}
+
+// do sends an authorized request for blob, or the container if blob is
+// empty, returning the response body
+func (a AzureBlobStore) do(method, blob string, query url.Values, body []byte, header http.Header) ([]byte, error) {
+	resource := "/" + a.Container
+	if blob != "" {
+		resource += "/" + url.PathEscape(blob)
+	}
+	target := a.Endpoint + resource
+	rawQuery := query.Encode()
+	if a.SAS != "" {
+		if rawQuery != "" {
+			rawQuery += "&"
+		}
+		rawQuery += a.SAS
+	}
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("x-ms-version", azureVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	if a.SAS == "" {
+		signAzure(req, len(body), a.AccountName, a.AccountKey, query)
+	}
+
+	resp, err := storeHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		azureErr := azureError{Status: resp.Status, Code: resp.Header.Get("x-ms-error-code")}
+		xml.Unmarshal(data, &azureErr)
+		return nil, azureErr
+	}
+	return data, nil
+}
+
+// signAzure adds the Shared Key authorization of the request
+func signAzure(req *http.Request, contentLength int, account, key string, query url.Values) {
+	length := ""
+	if contentLength > 0 {
+		length = strconv.Itoa(contentLength)
+	}
+
+	var msHeaders []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower)
+		}
+	}
+	sort.Strings(msHeaders)
+	var canonicalHeaders strings.Builder
+	for _, name := range msHeaders {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	canonicalResource := "/" + account + req.URL.EscapedPath()
+	var params []string
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		canonicalResource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is used
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + canonicalHeaders.String() + canonicalResource
+
+	decoded, _ := base64.StdEncoding.DecodeString(key)
+	signature := base64.StdEncoding.EncodeToString(hmacSHA256(decoded, stringToSign))
+	req.Header.Set("Authorization", "SharedKey "+account+":"+signature)
+}
+
+// Upload writes the share as a new block blob, refusing to overwrite one
+func (a AzureBlobStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading %s/%s...", a.location(), share.ObjectName()))
+
+	sum := md5.Sum(share.Data)
+	header := http.Header{
+		"If-None-Match":  {"*"},
+		"X-Ms-Blob-Type": {"BlockBlob"},
+		"Content-Md5":    {base64.StdEncoding.EncodeToString(sum[:])},
+		"Content-Type":   {"application/octet-stream"},
+	}
+	if _, err := a.do("PUT", share.ObjectName(), nil, share.Data, header); err != nil {
+		color.Red("%s/%s upload failed: %v", a.location(), share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// Remove permanently deletes a single object, with its snapshots
+func (a AzureBlobStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting %s/%s...", a.location(), object))
+	if _, err := a.do("DELETE", object, nil, nil, http.Header{"X-Ms-Delete-Snapshots": {"include"}}); err != nil {
+		color.Red("Error: could not delete %s from %s: %s", object, a.location(), err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+type azureBlobListing struct {
+	Blobs []struct {
+		Name string `xml:"Name"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// list returns the names of all blobs in the container
+func (a AzureBlobStore) list() ([]string, error) {
+	var objects []string
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		data, err := a.do("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var listing azureBlobListing
+		if err := xml.Unmarshal(data, &listing); err != nil {
+			return nil, err
+		}
+		for _, blob := range listing.Blobs {
+			objects = append(objects, blob.Name)
+		}
+		if listing.NextMarker == "" {
+			return objects, nil
+		}
+		marker = listing.NextMarker
+	}
+}
+
+// List returns the names of all objects in the container
+func (a AzureBlobStore) List() []string {
+	objects, err := a.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", a.location(), err)
+		return nil
+	}
+	return objects
+}
+
+// Read downloads a single object
+func (a AzureBlobStore) Read(object string) ([]byte, error) {
+	return a.do("GET", object, nil, nil, nil)
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (a AzureBlobStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	header := http.Header{"X-Ms-Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	return a.do("GET", object, nil, nil, header)
+}
+
+// Restore downloads shares to local restore path
+func (a AzureBlobStore) Restore() string {
+	objects, err := a.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", a.location(), err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_azure_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from %s...", a.location())
+	for _, object := range objects {
+		data, err := a.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects in the container
+func (a AzureBlobStore) Description() string {
+	objects, err := a.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", a.ShortDescription(), err)
+	}
+
+	label := a.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (a AzureBlobStore) ShortDescription() string {
+	return "Azure Blob Store: " + a.location()
+}
+
+// Clean deletes all shares from the container
+func (a AzureBlobStore) Clean() {
+	for _, object := range a.List() {
+		color.Yellow("Removing Azure Blob Store: %v", object)
+		a.do("DELETE", object, nil, nil, http.Header{"X-Ms-Delete-Snapshots": {"include"}})
+	}
+}
+
+// MaxObjectSize of a single Put Blob
+func (a AzureBlobStore) MaxObjectSize() int64 {
+	return azureMaxObjectSize
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// B2Store keeps shares as files in a Backblaze B2 bucket, through the native
+// B2 API, authorized with an application key. A key restricted to the bucket
+// is enough
+type B2Store struct {
+	Bucket         string `json:"bucket"`
+	BucketID       string `json:"bucket_id"`
+	KeyID          string `json:"key_id"`
+	ApplicationKey string `json:"-"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (b *B2Store) credentials() map[string]*string {
+	return map[string]*string{"application_key": &b.ApplicationKey}
+}
+
+const (
+	b2Authorize = "https://api.backblazeb2.com/b2api/v2/b2_authorize_account"
+
+	// largest file uploaded in one request
+	b2MaxObjectSize = 5000000000
+)
+
+// b2Session is an account authorization, valid for a day
+type b2Session struct {
+	AccountID          string `json:"accountId"`
+	APIURL             string `json:"apiUrl"`
+	DownloadURL        string `json:"downloadUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+// sessions by key id, authorized once per run
+var (
+	b2SessionsLock sync.Mutex
+	b2Sessions     = make(map[string]b2Session)
+)
+
+type b2Error struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e b2Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+type b2File struct {
+	FileName string `json:"fileName"`
+	FileID   string `json:"fileId"`
+	Action   string `json:"action"`
+}
+
+type b2FileListing struct {
+	Files        []b2File `json:"files"`
+	NextFileName *string  `json:"nextFileName"`
+	NextFileID   *string  `json:"nextFileId"`
+}
+
+// Setup finds the bucket with the application key
+func (b *B2Store) Setup() bool {
+	for _, bs := range preferences.B2Stores {
+		if bs.Bucket == b.Bucket {
+			color.Red("B2 bucket %s already exists.", b.Bucket)
+			return false
+		}
+	}
+
+	session, err := b.session(false)
+	if err != nil {
+		color.Red("Unable to authorize with B2 %v", err)
+		return false
+	}
+
+	var buckets struct {
+		Buckets []struct {
+			BucketID   string `json:"bucketId"`
+			BucketName string `json:"bucketName"`
+		} `json:"buckets"`
+	}
+	arg := map[string]string{"accountId": session.AccountID, "bucketName": b.Bucket}
+	if err := b.call("b2_list_buckets", arg, &buckets); err != nil {
+		color.Red("Unable to list B2 buckets %v", err)
+		return false
+	}
+	for _, bucket := range buckets.Buckets {
+		if bucket.BucketName == b.Bucket {
+			b.BucketID = bucket.BucketID
+			return true
+		}
+	}
+	color.Red("No B2 bucket %s for this application key", b.Bucket)
+	return false
+}
+
+// session authorizes the account, again if renew
+func (b B2Store) session(renew bool) (b2Session, error) {
+	b2SessionsLock.Lock()
+	defer b2SessionsLock.Unlock()
+	if session, ok := b2Sessions[b.KeyID]; ok && !renew {
+		return session, nil
+	}
+
+	req, err := http.NewRequest("GET", b2Authorize, nil)
+	if err != nil {
+		return b2Session{}, err
+	}
+	req.SetBasicAuth(b.KeyID, b.ApplicationKey)
+	data, err := b2Do(req)
+	if err != nil {
+		return b2Session{}, err
+	}
+	var session b2Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return session, err
+	}
+	b2Sessions[b.KeyID] = session
+	return session, nil
+}
+
+// authorized sends the request build makes with a session, authorizing
+// again once if the session expired
+func (b B2Store) authorized(build func(session b2Session) (*http.Request, error)) ([]byte, error) {
+	for renew := false; ; renew = true {
+		session, err := b.session(renew)
+		if err != nil {
+			return nil, err
+		}
+		req, err := build(session)
+		if err != nil {
+			return nil, err
+		}
+		data, err := b2Do(req)
+		var b2Err b2Error
+		if errors.As(err, &b2Err) && b2Err.Code == "expired_auth_token" && !renew {
+			continue
+		}
+		return data, err
+	}
+}
+
+// call posts a JSON request to the B2 API, decoding the result into out
+// unless it is nil
+func (b B2Store) call(endpoint string, arg interface{}, out interface{}) error {
+	body, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+	data, err := b.authorized(func(session b2Session) (*http.Request, error) {
+		req, err := http.NewRequest("POST", session.APIURL+"/b2api/v2/"+endpoint, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Authorization", session.AuthorizationToken)
+		}
+		return req, err
+	})
+	if err != nil || out == nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+func b2Do(req *http.Request) ([]byte, error) {
+	resp, err := storeHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		b2Err := b2Error{Status: resp.StatusCode}
+		if json.Unmarshal(data, &b2Err) != nil || b2Err.Code == "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+		}
+		return nil, b2Err
+	}
+	return data, nil
+}
+
+// b2FileName escapes a file name for headers and download URLs
+func b2FileName(object string) string {
+	return strings.Replace(url.PathEscape(object), "%2F", "/", -1)
+}
+
+// versions lists the versions of the file named object, newest first
+func (b B2Store) versions(object string) ([]b2File, error) {
+	var listing b2FileListing
+	arg := map[string]interface{}{"bucketId": b.BucketID, "startFileName": object, "prefix": object, "maxFileCount": 100}
+	if err := b.call("b2_list_file_versions", arg, &listing); err != nil {
+		return nil, err
+	}
+	var versions []b2File
+	for _, file := range listing.Files {
+		if file.FileName == object {
+			versions = append(versions, file)
+		}
+	}
+	return versions, nil
+}
+
+// Upload adds the share as a new file, refusing to replace one
+func (b B2Store) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading b2://%s/%s...", b.Bucket, share.ObjectName()))
+	if err := b.upload(share.ObjectName(), share.Data); err != nil {
+		color.Red("b2://%s/%s upload failed: %v", b.Bucket, share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+func (b B2Store) upload(object string, data []byte) error {
+	// B2 keeps a new version instead of refusing, so check first
+	versions, err := b.versions(object)
+	if err != nil {
+		return err
+	}
+	if len(versions) > 0 && versions[0].Action == "upload" {
+		return errors.New("file exists")
+	}
+
+	var target struct {
+		UploadURL          string `json:"uploadUrl"`
+		AuthorizationToken string `json:"authorizationToken"`
+	}
+	if err := b.call("b2_get_upload_url", map[string]string{"bucketId": b.BucketID}, &target); err != nil {
+		return err
+	}
+	sum := sha1.Sum(data)
+	req, err := http.NewRequest("POST", target.UploadURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", target.AuthorizationToken)
+	req.Header.Set("X-Bz-File-Name", b2FileName(object))
+	req.Header.Set("Content-Type", "b2/x-auto")
+	req.Header.Set("X-Bz-Content-Sha1", hex.EncodeToString(sum[:]))
+	_, err = b2Do(req)
+	return err
+}
+
+// remove deletes every version of a file, so none is left
+func (b B2Store) remove(object string) error {
+	versions, err := b.versions(object)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return errors.New("no such file")
+	}
+	for _, version := range versions {
+		if err := b.call("b2_delete_file_version", map[string]string{"fileName": version.FileName, "fileId": version.FileID}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove permanently deletes a single object
+func (b B2Store) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting b2://%s/%s...", b.Bucket, object))
+	if err := b.remove(object); err != nil {
+		color.Red("Error: could not delete %s from b2://%s: %s", object, b.Bucket, err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all files in the bucket
+func (b B2Store) list() ([]string, error) {
+	var objects []string
+	arg := map[string]interface{}{"bucketId": b.BucketID, "maxFileCount": 1000}
+	for {
+		var listing b2FileListing
+		if err := b.call("b2_list_file_names", arg, &listing); err != nil {
+			return nil, err
+		}
+		for _, file := range listing.Files {
+			if file.Action == "upload" {
+				objects = append(objects, file.FileName)
+			}
+		}
+		if listing.NextFileName == nil {
+			return objects, nil
+		}
+		arg["startFileName"] = *listing.NextFileName
+	}
+}
+
+// List returns the names of all objects in the bucket
+func (b B2Store) List() []string {
+	objects, err := b.list()
+	if err != nil {
+		color.Red("Error listing b2://%s: %s", b.Bucket, err)
+		return nil
+	}
+	return objects
+}
+
+func (b B2Store) download(object string, header http.Header) ([]byte, error) {
+	return b.authorized(func(session b2Session) (*http.Request, error) {
+		req, err := http.NewRequest("GET", session.DownloadURL+"/file/"+url.PathEscape(b.Bucket)+"/"+b2FileName(object), nil)
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Authorization", session.AuthorizationToken)
+		return req, nil
+	})
+}
+
+// Read downloads a single object
+func (b B2Store) Read(object string) ([]byte, error) {
+	return b.download(object, nil)
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (b B2Store) ReadRange(object string, offset, length int64) ([]byte, error) {
+	return b.download(object, http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}})
+}
+
+// Restore downloads shares to local restore path
+func (b B2Store) Restore() string {
+	objects, err := b.list()
+	if err != nil {
+		color.Red("Error listing b2://%s: %s", b.Bucket, err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_b2_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from b2://%s...", b.Bucket)
+	for _, object := range objects {
+		data, err := b.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects in the bucket
+func (b B2Store) Description() string {
+	objects, err := b.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", b.ShortDescription(), err)
+	}
+
+	label := b.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (b B2Store) ShortDescription() string {
+	return "B2 Store: b2://" + b.Bucket
+}
+
+// Clean deletes all shares from the bucket
+func (b B2Store) Clean() {
+	for _, object := range b.List() {
+		color.Yellow("Removing B2 Store: %v", object)
+		b.remove(object)
+	}
+}
+
+// MaxObjectSize of a single B2 upload
+func (b B2Store) MaxObjectSize() int64 {
+	return b2MaxObjectSize
+}
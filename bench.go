@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/TheLisztomaniac/chasmOriginal/gf256"
+	"github.com/fatih/color"
+)
+
+// BenchSharing prints the throughput of sharing and combining size bytes
+// across n stores, with the vector kernel if the CPU has one and with the
+// lookup tables alone
+func BenchSharing(size, n int) {
+	secret := make([]byte, size)
+	rand.Read(secret)
+
+	simd := gf256.SIMD
+	defer func() { gf256.SIMD = simd }()
+
+	kernels := []bool{false}
+	if simd {
+		kernels = append(kernels, true)
+	}
+	for _, vector := range kernels {
+		gf256.SIMD = vector
+		name := "table"
+		if vector {
+			name = "simd"
+		}
+
+		start := time.Now()
+		shares := CreateShares(secret, RandomShareID(), n)
+		split := time.Since(start)
+
+		start = time.Now()
+		CombineShares(shares)
+		combine := time.Since(start)
+
+		fmt.Printf("%s %-6s share %8.1f MB/s  combine %8.1f MB/s\n", color.GreenString("-"), name, throughput(size, split), throughput(size, combine))
+	}
+	if !simd {
+		color.Yellow("No vector kernel on this CPU, sharing uses lookup tables only.")
+	}
+}
+
+func throughput(size int, d time.Duration) float64 {
+	return float64(size) / 1e6 / d.Seconds()
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/fatih/color"
+	"github.com/toqueteos/webbrowser"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// BoxStore keeps shares in a folder of a Box account, through the Box API,
+// signed in with OAuth to an app the user creates in the Box developer
+// console. Box refresh tokens are good for one use only, so every refreshed
+// token is saved right away
+type BoxStore struct {
+	// the client secret and tokens are left out of the JSON, see MarshalJSON
+	Config     oauth2.Config `json:"oauth_config"`
+	OAuthToken oauth2.Token  `json:"oauth_token"`
+	UserID     string        `json:"user_id"`
+	Login      string        `json:"login"`
+
+	FolderID   string `json:"folder_id"`
+	FolderName string `json:"folder_name"`
+}
+
+// credentials are kept in the local state, see credentials.go. Without the
+// access token every run refreshes it once
+func (b *BoxStore) credentials() map[string]*string {
+	return map[string]*string{
+		"client_secret": &b.Config.ClientSecret,
+		"refresh_token": &b.OAuthToken.RefreshToken,
+	}
+}
+
+// MarshalJSON leaves the client secret and tokens out of the preferences
+func (b BoxStore) MarshalJSON() ([]byte, error) {
+	type boxStore BoxStore
+	plain := boxStore(b)
+	plain.Config.ClientSecret = ""
+	plain.OAuthToken.AccessToken = ""
+	plain.OAuthToken.RefreshToken = ""
+	return json.Marshal(plain)
+}
+
+const (
+	boxAPI    = "https://api.box.com/2.0/"
+	boxUpload = "https://upload.box.com/api/2.0/files/content"
+
+	// id of the root folder of every account
+	boxRootFolder = "0"
+
+	// largest file uploaded without an upload session
+	boxMaxObjectSize = 50 << 20
+)
+
+var boxEndpoint = oauth2.Endpoint{
+	AuthURL:  "https://account.box.com/api/oauth2/authorize",
+	TokenURL: "https://api.box.com/oauth2/token",
+}
+
+// token sources by user id, shared so a refresh token is only used once
+var (
+	boxTokensLock sync.Mutex
+	boxTokens     = make(map[string]oauth2.TokenSource)
+)
+
+type boxItem struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type boxListing struct {
+	Entries    []boxItem `json:"entries"`
+	NextMarker string    `json:"next_marker"`
+}
+
+type boxError struct {
+	Status  string
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e boxError) Error() string {
+	if e.Message == "" {
+		return e.Status
+	}
+	return fmt.Sprintf("%s: %s", e.Status, e.Message)
+}
+
+// Setup Box with the client id and secret of the user's app, keeping shares
+// in the folder with folderID, or else in folderName at the root, created if
+// missing
+func (b *BoxStore) Setup(clientID, clientSecret, redirectURL, folderID, folderName string) bool {
+	b.Config = oauth2.Config{ClientID: clientID, ClientSecret: clientSecret, Endpoint: boxEndpoint, RedirectURL: redirectURL}
+
+	authURL := b.Config.AuthCodeURL("state-token")
+	webbrowser.Open(authURL)
+	fmt.Println(authURL)
+	color.Yellow("Enter the code parameter of the page Box redirects to: ")
+
+	var code string
+	if _, err := fmt.Scan(&code); err != nil {
+		color.Red("Unable to read authorization code %v", err)
+		return false
+	}
+	tok, err := b.Config.Exchange(storeContext(context.Background()), code)
+	if err != nil {
+		color.Red("Unable to retrieve token from web %v", err)
+		return false
+	}
+	b.OAuthToken = *tok
+
+	var me struct {
+		ID    string `json:"id"`
+		Login string `json:"login"`
+	}
+	if err := b.call("GET", boxAPI+"users/me?fields=id,login", nil, &me); err != nil {
+		color.Red("Unable to retrieve Box account %v", err)
+		return false
+	}
+	b.UserID, b.Login = me.ID, me.Login
+
+	if folderID != "" {
+		var folder boxItem
+		if err := b.call("GET", boxAPI+"folders/"+url.PathEscape(folderID)+"?fields=id,name", nil, &folder); err != nil {
+			color.Red("Unable to find Box folder %s %v", folderID, err)
+			return false
+		}
+		b.FolderID, b.FolderName = folder.ID, folder.Name
+	} else if err := b.findOrCreateFolder(folderName); err != nil {
+		color.Red("Unable to set up Box folder %s %v", folderName, err)
+		return false
+	}
+
+	for _, bs := range preferences.BoxStores {
+		if bs.UserID == b.UserID && bs.FolderID == b.FolderID {
+			color.Red("Box folder %s of %s already exists.", b.FolderName, b.Login)
+			return false
+		}
+	}
+	return true
+}
+
+// findOrCreateFolder sets the folder to the one named name at the root
+func (b *BoxStore) findOrCreateFolder(name string) error {
+	items, err := b.items(boxRootFolder)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if item.Type == "folder" && item.Name == name {
+			b.FolderID, b.FolderName = item.ID, item.Name
+			return nil
+		}
+	}
+
+	color.Yellow("Creating Box folder %s", name)
+	var folder boxItem
+	create := map[string]interface{}{"name": name, "parent": map[string]string{"id": boxRootFolder}}
+	if err := b.call("POST", boxAPI+"folders?fields=id,name", create, &folder); err != nil {
+		return err
+	}
+	b.FolderID, b.FolderName = folder.ID, folder.Name
+	return nil
+}
+
+// tokenSource is the shared token source of the account, saving every
+// token it refreshes to the local state with the preferences
+func (b BoxStore) tokenSource() oauth2.TokenSource {
+	boxTokensLock.Lock()
+	defer boxTokensLock.Unlock()
+	if source, ok := boxTokens[b.UserID]; ok && b.UserID != "" {
+		return source
+	}
+
+	ctx := storeContext(context.Background())
+	source := &boxSavingSource{userID: b.UserID, source: b.Config.TokenSource(ctx, &b.OAuthToken), saved: b.OAuthToken.RefreshToken}
+	if b.UserID != "" {
+		boxTokens[b.UserID] = source
+	}
+	return source
+}
+
+// boxSavingSource saves tokens of userID whose refresh token changed
+type boxSavingSource struct {
+	lock   sync.Mutex
+	userID string
+	source oauth2.TokenSource
+	saved  string
+}
+
+func (s *boxSavingSource) Token() (*oauth2.Token, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tok, err := s.source.Token()
+	if err != nil || tok.RefreshToken == s.saved || s.userID == "" {
+		return tok, err
+	}
+
+	s.saved = tok.RefreshToken
+	for i := range preferences.BoxStores {
+		if preferences.BoxStores[i].UserID == s.userID {
+			preferences.BoxStores[i].OAuthToken = *tok
+		}
+	}
+	preferences.Save()
+	return tok, nil
+}
+
+func (b BoxStore) client() *http.Client {
+	ctx := storeContext(context.Background())
+	return oauth2.NewClient(ctx, b.tokenSource())
+}
+
+// do sends req with the account's token, returning the body of a successful
+// response
+func (b BoxStore) do(req *http.Request) ([]byte, error) {
+	resp, err := b.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		boxErr := boxError{Status: resp.Status}
+		json.Unmarshal(data, &boxErr)
+		return nil, boxErr
+	}
+	return data, nil
+}
+
+// call sends a request with a JSON body, decoding the result into out
+// unless it is nil
+func (b BoxStore) call(method, endpoint string, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	data, err := b.do(req)
+	if err != nil || out == nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// items lists the items of a folder
+func (b BoxStore) items(folderID string) ([]boxItem, error) {
+	var items []boxItem
+	marker := ""
+	for {
+		query := url.Values{"fields": {"id,type,name"}, "limit": {"1000"}, "usemarker": {"true"}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		var listing boxListing
+		if err := b.call("GET", boxAPI+"folders/"+url.PathEscape(folderID)+"/items?"+query.Encode(), nil, &listing); err != nil {
+			return nil, err
+		}
+		items = append(items, listing.Entries...)
+		if listing.NextMarker == "" {
+			return items, nil
+		}
+		marker = listing.NextMarker
+	}
+}
+
+// fileID finds the id of an object in the folder
+func (b BoxStore) fileID(object string) (string, error) {
+	items, err := b.items(b.FolderID)
+	if err != nil {
+		return "", err
+	}
+	for _, item := range items {
+		if item.Type == "file" && item.Name == object {
+			return item.ID, nil
+		}
+	}
+	return "", errors.New("not found")
+}
+
+// Upload adds the share as a new file, which Box refuses if one exists
+func (b BoxStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading Box/%s/%s...", b.FolderName, share.ObjectName()))
+	if err := b.upload(share.ObjectName(), share.Data); err != nil {
+		color.Red("Box/%s/%s upload failed: %v", b.FolderName, share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+func (b BoxStore) upload(object string, data []byte) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	attributes, _ := json.Marshal(map[string]interface{}{"name": object, "parent": map[string]string{"id": b.FolderID}})
+	form.WriteField("attributes", string(attributes))
+	file, err := form.CreateFormFile("file", object)
+	if err != nil {
+		return err
+	}
+	file.Write(data)
+	form.Close()
+
+	req, err := http.NewRequest("POST", boxUpload, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	_, err = b.do(req)
+	return err
+}
+
+// remove moves an object to the Box trash
+func (b BoxStore) remove(object string) error {
+	id, err := b.fileID(object)
+	if err != nil {
+		return err
+	}
+	return b.call("DELETE", boxAPI+"files/"+url.PathEscape(id), nil, nil)
+}
+
+// Remove deletes a single object, into the Box trash
+func (b BoxStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting Box/%s/%s...", b.FolderName, object))
+	if err := b.remove(object); err != nil {
+		color.Red("Error: could not delete %s from Box: %s", object, err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all files in the folder
+func (b BoxStore) list() ([]string, error) {
+	items, err := b.items(b.FolderID)
+	if err != nil {
+		return nil, err
+	}
+	var objects []string
+	for _, item := range items {
+		if item.Type == "file" {
+			objects = append(objects, item.Name)
+		}
+	}
+	return objects, nil
+}
+
+// List returns the names of all objects in the folder
+func (b BoxStore) List() []string {
+	objects, err := b.list()
+	if err != nil {
+		color.Red("Error listing Box: %s", err)
+		return nil
+	}
+	return objects
+}
+
+// download fetches an object, or part of it with a Range header
+func (b BoxStore) download(object string, header http.Header) ([]byte, error) {
+	id, err := b.fileID(object)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", boxAPI+"files/"+url.PathEscape(id)+"/content", nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return b.do(req)
+}
+
+// Read downloads a single object
+func (b BoxStore) Read(object string) ([]byte, error) {
+	return b.download(object, nil)
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (b BoxStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	data, err := b.download(object, http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}})
+	if err == nil && int64(len(data)) > length {
+		// the whole object, when the range was ignored
+		if end := offset + length; end <= int64(len(data)) {
+			data = data[offset:end]
+		}
+	}
+	return data, err
+}
+
+// Restore downloads shares to local restore path
+func (b BoxStore) Restore() string {
+	objects, err := b.list()
+	if err != nil {
+		color.Red("Error listing Box: %s", err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_box_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from Box...")
+	for _, object := range objects {
+		data, err := b.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects in the folder
+func (b BoxStore) Description() string {
+	objects, err := b.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", b.ShortDescription(), err)
+	}
+
+	label := b.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (b BoxStore) ShortDescription() string {
+	return "Box Store: " + b.Login + "/" + b.FolderName
+}
+
+// Clean deletes all shares from the folder
+func (b BoxStore) Clean() {
+	items, err := b.items(b.FolderID)
+	if err != nil {
+		color.Red("Error listing Box: %s", err)
+		return
+	}
+	for _, item := range items {
+		if item.Type == "file" {
+			color.Yellow("Removing Box: %v", item.Name)
+			b.call("DELETE", boxAPI+"files/"+url.PathEscape(item.ID), nil, nil)
+		}
+	}
+}
+
+// MaxObjectSize of a single Box upload
+func (b BoxStore) MaxObjectSize() int64 {
+	return boxMaxObjectSize
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// The manifest can be browsed as a tree of directories and files, so that
+// single files, subtrees or older versions are restored instead of the whole
+// vault. The API serves one level of the tree at a time, and `chasm browse`
+// is a small shell over the same tree. On a machine without a local
+// manifest, the latest one is read from the stores.
+
+// TreeNode is a directory or a file of the tree
+type TreeNode struct {
+	Path string `json:"path"`
+	Name string `json:"name"`
+	Dir  bool   `json:"dir"`
+
+	// for directories, the total of every file below
+	Size  int64 `json:"size"`
+	Files int   `json:"files,omitempty"`
+
+	Protected bool          `json:"protected,omitempty"`
+	Versions  []NodeVersion `json:"versions,omitempty"` // newest first
+	Children  []TreeNode    `json:"children,omitempty"`
+}
+
+// NodeVersion is a version of a file the stores hold shares of
+type NodeVersion struct {
+	Version string    `json:"version"`
+	Time    time.Time `json:"time"`
+	Stores  int       `json:"stores"`
+	Current bool      `json:"current,omitempty"`
+}
+
+// storeVersions lists the versions of every share id on the stores, with
+// the number of stores holding each
+func storeVersions() map[ShareID]map[string]int {
+	versions := make(map[ShareID]map[string]int)
+	for _, cs := range preferences.AllCloudStores() {
+		for _, object := range cs.List() {
+			sid, version, tombstone := ParseObjectName(object)
+			if tombstone || version == "" {
+				continue
+			}
+			if versions[sid] == nil {
+				versions[sid] = make(map[string]int)
+			}
+			versions[sid][version]++
+		}
+	}
+	return versions
+}
+
+// browsableFiles are the tracked files without the manifest
+func browsableFiles(fileMap map[string]FileShare) map[string]FileShare {
+	files := make(map[string]FileShare, len(fileMap))
+	for filePath, fileShare := range fileMap {
+		if fileShare.SID != ShareID(chasmPrefFile) {
+			files[filePath] = fileShare
+		}
+	}
+	return files
+}
+
+// remoteFileMap reads the latest manifest every store holds, with its
+// deltas, using the stores that can download single objects
+func remoteFileMap(versions map[ShareID]map[string]int) (map[string]FileShare, error) {
+	stores := len(preferences.AllCloudStores())
+	complete := func(sid ShareID, after string) []string {
+		var found []string
+		for version, count := range versions[sid] {
+			if count == stores && version > after {
+				found = append(found, version)
+			}
+		}
+		sort.Strings(found)
+		return found
+	}
+
+	manifests := complete(ShareID(chasmPrefFile), "")
+	if len(manifests) == 0 {
+		return nil, errors.New("no manifest on the stores")
+	}
+	base := manifests[len(manifests)-1]
+	restoredPrefs, err := readManifest(base)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, version := range complete(ShareID(chasmDeltaSID), base) {
+		deltaBytes, err := RestoreSingleFile(FileShare{SID: ShareID(chasmDeltaSID), Version: version})
+		if err != nil {
+			color.Red("Skipping unreadable manifest delta %s: %s", version, err)
+			continue
+		}
+		var delta ManifestDelta
+		if json.Unmarshal(deltaBytes, &delta) == nil && delta.Base == base {
+			delta.Apply(&restoredPrefs)
+		}
+	}
+	return restoredPrefs.FileMap, nil
+}
+
+// within checks if filePath is dir or below it
+func within(filePath, dir string) bool {
+	return dir == "/" || filePath == dir || strings.HasPrefix(filePath, dir+"/")
+}
+
+// treeRoot is the deepest directory holding every file
+func treeRoot(files map[string]FileShare) string {
+	root := ""
+	for filePath := range files {
+		if root == "" {
+			root = path.Dir(filePath)
+		}
+		for !within(filePath, root) && root != "." {
+			root = path.Dir(root)
+		}
+	}
+	if root == "" {
+		return preferences.root
+	}
+	return root
+}
+
+// fileSize is the recorded size of a file, or its size on disk for entries
+// recorded before sizes were
+func fileSize(filePath string, fileShare FileShare) int64 {
+	if fileShare.Size > 0 {
+		return fileShare.Size
+	}
+	if fi, err := os.Stat(filePath); err == nil && !fi.IsDir() {
+		return fi.Size()
+	}
+	return 0
+}
+
+func fileNode(filePath string, fileShare FileShare, versions map[ShareID]map[string]int) TreeNode {
+	node := TreeNode{Path: filePath, Name: path.Base(filePath), Size: fileSize(filePath, fileShare), Protected: fileShare.Protection != ""}
+	for version, count := range versions[fileShare.SID] {
+		created, _ := VersionTime(version)
+		node.Versions = append(node.Versions, NodeVersion{Version: version, Time: created, Stores: count, Current: version == fileShare.Version})
+	}
+	sort.Slice(node.Versions, func(i, j int) bool {
+		return node.Versions[i].Version > node.Versions[j].Version
+	})
+	return node
+}
+
+// BrowseTree returns the node at nodePath, with its children for a
+// directory
+func BrowseTree(files map[string]FileShare, nodePath string, versions map[ShareID]map[string]int) (TreeNode, error) {
+	nodePath = path.Clean(nodePath)
+	if fileShare, ok := files[nodePath]; ok {
+		return fileNode(nodePath, fileShare, versions), nil
+	}
+
+	node := TreeNode{Path: nodePath, Name: path.Base(nodePath), Dir: true}
+	dirs := make(map[string]*TreeNode)
+	for filePath, fileShare := range files {
+		if !within(filePath, nodePath) {
+			continue
+		}
+		size := fileSize(filePath, fileShare)
+		node.Size += size
+		node.Files++
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(filePath, nodePath), "/")
+		name := strings.SplitN(rel, "/", 2)[0]
+		if name == rel {
+			node.Children = append(node.Children, fileNode(filePath, fileShare, versions))
+			continue
+		}
+		dir, ok := dirs[name]
+		if !ok {
+			dir = &TreeNode{Path: path.Join(nodePath, name), Name: name, Dir: true}
+			dirs[name] = dir
+		}
+		dir.Size += size
+		dir.Files++
+		dir.Protected = dir.Protected || fileShare.Protection != ""
+	}
+	if node.Files == 0 {
+		return node, fmt.Errorf("nothing tracked under %s", nodePath)
+	}
+
+	for _, dir := range dirs {
+		node.Children = append(node.Children, *dir)
+	}
+	sort.Slice(node.Children, func(i, j int) bool {
+		return node.Children[i].Name < node.Children[j].Name
+	})
+	return node, nil
+}
+
+// olderVersion is the file share of an earlier version of a file. Only the
+// current version's hash is known
+func olderVersion(fileShare FileShare, version string) FileShare {
+	return FileShare{SID: fileShare.SID, Version: version, Protection: fileShare.Protection}
+}
+
+// RestoreNode restores the file or every file under the directory at
+// nodePath to its original path, returning the number restored. A version
+// can only be given for a single file
+func RestoreNode(files map[string]FileShare, nodePath, version string) int {
+	nodePath = path.Clean(nodePath)
+	restored := 0
+	for filePath, fileShare := range files {
+		if !within(filePath, nodePath) {
+			continue
+		}
+		if version != "" && version != fileShare.Version {
+			fileShare = olderVersion(fileShare, version)
+		}
+		if skipLocked(fileShare) {
+			continue
+		}
+
+		contents, err := RestoreSingleFile(fileShare)
+		if err != nil {
+			color.Red("Error restoring %s: %s", filePath, err)
+			countError()
+			continue
+		}
+		contents, ok := unprotect(filePath, fileShare, contents)
+		if !ok {
+			continue
+		}
+
+		os.MkdirAll(path.Dir(filePath), 0770)
+		err = ioutil.WriteFile(filePath, contents, 0660)
+		size := int64(len(contents))
+		wipe(contents)
+		if err != nil {
+			color.Red("Error writing restored file %s: %s", filePath, err)
+			countError()
+			continue
+		}
+		countFile(size, false)
+		color.Green("Restored %s", filePath)
+		restored++
+	}
+	if len(lockedSkipped) > 0 {
+		reportLocked()
+	}
+	return restored
+}
+
+// apiTree serves GET /api/tree?path= with the node at path, the common
+// directory of the tracked files by default
+func apiTree(w http.ResponseWriter, r *http.Request) {
+	files := browsableFiles(preferences.FileMap)
+	nodePath := r.URL.Query().Get("path")
+	if nodePath == "" {
+		nodePath = treeRoot(files)
+	}
+
+	node, err := BrowseTree(files, nodePath, storeVersions())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, node)
+}
+
+/// chasm browse ///
+
+const browseHelp = `Commands:
+  ls [path]                list a directory, or the versions of a file
+  cd <path>                change directory, .. for the parent
+  restore <path> [version] restore a file or directory to its original path
+  help                     show this help
+  quit                     leave`
+
+func printNode(node TreeNode) {
+	if !node.Dir {
+		fmt.Printf("%s  %s\n", node.Path, formatBytes(node.Size))
+		for _, v := range node.Versions {
+			line := fmt.Sprintf("  %s  %s  on %v stores", v.Version, v.Time.Format(time.RFC3339), v.Stores)
+			if v.Current {
+				color.Green(line + "  (current)")
+			} else {
+				fmt.Println(line)
+			}
+		}
+		return
+	}
+
+	for _, child := range node.Children {
+		lock := ""
+		if child.Protected {
+			lock = "  (protected)"
+		}
+		if child.Dir {
+			color.Cyan("%s/  %s in %v files%s", child.Name, formatBytes(child.Size), child.Files, lock)
+		} else {
+			fmt.Printf("%s  %s, %v versions%s\n", child.Name, formatBytes(child.Size), len(child.Versions), lock)
+		}
+	}
+}
+
+// Browse runs the browse shell from dir over in, until quit or the end of
+// input
+func Browse(files map[string]FileShare, dir string, in io.Reader) {
+	versions := storeVersions()
+	resolve := func(arg string) string {
+		if path.IsAbs(arg) {
+			return path.Clean(arg)
+		}
+		return path.Join(dir, arg)
+	}
+
+	fmt.Println(browseHelp)
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Print(color.CyanString("%s> ", dir))
+		if !scanner.Scan() {
+			fmt.Println()
+			return
+		}
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+
+		switch args[0] {
+		case "ls":
+			target := dir
+			if len(args) > 1 {
+				target = resolve(args[1])
+			}
+			node, err := BrowseTree(files, target, versions)
+			if err != nil {
+				color.Red("%s", err)
+				continue
+			}
+			printNode(node)
+		case "cd":
+			if len(args) < 2 {
+				color.Red("cd needs a directory")
+				continue
+			}
+			node, err := BrowseTree(files, resolve(args[1]), versions)
+			if err != nil || !node.Dir {
+				color.Red("%s is not a tracked directory", resolve(args[1]))
+				continue
+			}
+			dir = node.Path
+		case "restore":
+			if len(args) < 2 {
+				color.Red("restore needs a file or directory")
+				continue
+			}
+			target, version := resolve(args[1]), ""
+			if len(args) > 2 {
+				if _, ok := files[target]; !ok {
+					color.Red("a version can only be restored for a single file")
+					continue
+				}
+				version = args[2]
+			}
+			if RestoreNode(files, target, version) == 0 {
+				color.Yellow("Nothing restored.")
+			}
+		case "help":
+			fmt.Println(browseHelp)
+		case "quit", "exit":
+			return
+		default:
+			color.Red("Unknown command %s", args[0])
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// ChaosConfig injects faults into store operations, for testing how chasm
+// behaves when stores misbehave. Set through hidden flags or CHASM_CHAOS_*
+type ChaosConfig struct {
+	// fraction of operations that fail
+	FailRate float64
+
+	// fraction of uploaded shares that get a flipped byte
+	CorruptRate float64
+
+	// maximum random delay before each operation
+	MaxDelay time.Duration
+}
+
+var chaos ChaosConfig
+
+// Enabled checks if any fault is injected
+func (c ChaosConfig) Enabled() bool {
+	return c.FailRate > 0 || c.CorruptRate > 0 || c.MaxDelay > 0
+}
+
+// chaosStore wraps a cloud store and injects faults
+type chaosStore struct {
+	CloudStore
+}
+
+func withChaos(cloudStores []CloudStore) []CloudStore {
+	if !chaos.Enabled() {
+		return cloudStores
+	}
+
+	wrapped := make([]CloudStore, len(cloudStores))
+	for i, cs := range cloudStores {
+		wrapped[i] = chaosStore{cs}
+	}
+	return wrapped
+}
+
+// inject delays the operation, and reports whether it should fail
+func (c chaosStore) inject(op string) bool {
+	if chaos.MaxDelay > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(chaos.MaxDelay))))
+	}
+
+	if rand.Float64() < chaos.FailRate {
+		color.Red("(chaos) %s failed on %s", op, c.CloudStore.ShortDescription())
+		return true
+	}
+	return false
+}
+
+func (c chaosStore) Upload(share Share) {
+	if c.inject("Upload " + share.ObjectName()) {
+		return
+	}
+
+	if len(share.Data) > 0 && rand.Float64() < chaos.CorruptRate {
+		corrupted := append([]byte(nil), share.Data...)
+		corrupted[rand.Intn(len(corrupted))] ^= 0xff
+		share.Data = corrupted
+		color.Red("(chaos) corrupted %s on %s", share.ObjectName(), c.CloudStore.ShortDescription())
+	}
+
+	c.CloudStore.Upload(share)
+}
+
+func (c chaosStore) Remove(object string) {
+	if c.inject("Remove " + object) {
+		return
+	}
+	c.CloudStore.Remove(object)
+}
+
+func (c chaosStore) List() []string {
+	if c.inject("List") {
+		return nil
+	}
+	return c.CloudStore.List()
+}
+
+func (c chaosStore) Restore() string {
+	if c.inject("Restore") {
+		return ""
+	}
+	return c.CloudStore.Restore()
+}
@@ -2,14 +2,19 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"sync"
 
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
 	"github.com/fatih/color"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 /// Chasm Types ///
@@ -17,8 +22,15 @@ import (
 // CloudStore represents an external cloud storage service that is compatible
 // with Chasm
 type CloudStore interface {
+	// Upload writes the share as a new object. Existing objects are never
+	// overwritten, so stores can use bucket-level object lock/retention
 	Upload(share Share)
-	Delete(sid ShareID)
+
+	// Remove permanently deletes a single object, only used by compaction
+	Remove(object string)
+
+	// List returns the names of all objects in the store
+	List() []string
 
 	//Restore downloads shares to local restore path
 	Restore() string
@@ -32,8 +44,29 @@ type CloudStore interface {
 // FileShare represents a file share with id shareID, and
 // sha2 checksum Hash
 type FileShare struct {
-	SID  ShareID `json:"sid"`
-	Hash string  `json:"hash"` //base64URL encoded SHA2 has
+	SID     ShareID `json:"sid"`
+	Hash    string  `json:"hash"` //base64URL encoded SHA2 has
+	Version string  `json:"version,omitempty"`
+
+	// generation of the vault the version was written in, see clock.go
+	Generation uint64 `json:"generation,omitempty"`
+
+	// protected directory whose key the contents are sealed to, if any
+	Protection string `json:"protection,omitempty"`
+
+	// size of the file's contents, 0 for entries recorded before sizes were
+	Size int64 `json:"size,omitempty"`
+
+	// hashes of the uploaded shares by x coordinate, see share_hash.go
+	Shares []string `json:"shares,omitempty"`
+
+	// shares restore needs, see redundancy.go
+	Threshold int `json:"threshold,omitempty"`
+}
+
+// ObjectName is the remote name of the current shares of the file
+func (fs FileShare) ObjectName() string {
+	return ObjectName(fs.SID, fs.Version, false)
 }
 
 // ChasmPref represents user/application preferences
@@ -46,25 +79,190 @@ type ChasmPref struct {
 	// the cloud services sharing across
 	GDriveStores []GDriveStore `json:"gdrive_stores"`
 
+	// other chasm daemons hosting our shares
+	PeerStores []PeerStore `json:"peer_stores,omitempty"`
+
+	// Dropbox app folders
+	DropboxStores []DropboxStore `json:"dropbox_stores,omitempty"`
+
+	// S3 buckets
+	S3Stores []S3Store `json:"s3_stores,omitempty"`
+
+	// OneDrive app folders
+	OneDriveStores []OneDriveStore `json:"onedrive_stores,omitempty"`
+
+	// Backblaze B2 buckets
+	B2Stores []B2Store `json:"b2_stores,omitempty"`
+
+	// directories on hosts reached over SSH
+	SFTPStores []SFTPStore `json:"sftp_stores,omitempty"`
+
+	// folders on WebDAV servers, such as Nextcloud
+	WebDAVStores []WebDAVStore `json:"webdav_stores,omitempty"`
+
+	// Azure Storage containers
+	AzureBlobStores []AzureBlobStore `json:"azure_stores,omitempty"`
+
+	// Google Cloud Storage buckets
+	GCSStores []GCSStore `json:"gcs_stores,omitempty"`
+
+	// stores of store agents, holding their credentials
+	AgentStores []AgentStore `json:"agent_stores,omitempty"`
+
+	// folders of Box accounts
+	BoxStores []BoxStore `json:"box_stores,omitempty"`
+
+	// folders of Mega accounts
+	MegaStores []MegaStore `json:"mega_stores,omitempty"`
+
+	// folders of pCloud accounts
+	PCloudStores []PCloudStore `json:"pcloud_stores,omitempty"`
+
+	// folders of Yandex Disks
+	YandexDiskStores []YandexDiskStore `json:"yandex_stores,omitempty"`
+
+	// directories on FTP servers
+	FTPStores []FTPStore `json:"ftp_stores,omitempty"`
+
+	// directories of Windows or Samba network shares
+	SMBStores []SMBStore `json:"smb_stores,omitempty"`
+
+	// directories of rclone remotes
+	RcloneStores []RcloneStore `json:"rclone_stores,omitempty"`
+
+	// IPFS nodes, with the CIDs of their objects
+	IPFSStores []IPFSStore `json:"ipfs_stores,omitempty"`
+
+	// buckets of Storj DCS projects
+	StorjStores []StorjStore `json:"storj_stores,omitempty"`
+
+	// private folders of Keybase users on the mounted KBFS
+	KBFSStores []KBFSStore `json:"kbfs_stores,omitempty"`
+
+	// folders of mailboxes shares are mailed to
+	EmailStores []EmailStore `json:"email_stores,omitempty"`
+
+	// private Telegram channels a bot posts shares to
+	TelegramStores []TelegramStore `json:"telegram_stores,omitempty"`
+
+	// orphan branches of git repositories shares are committed to
+	GitStores []GitStore `json:"git_stores,omitempty"`
+
+	// OpenStack Swift containers, authenticated with Keystone
+	SwiftStores []SwiftStore `json:"swift_stores,omitempty"`
+
+	// tables of PostgreSQL or SQLite databases shares are rows of
+	DBStores []DBStore `json:"db_stores,omitempty"`
+
+	// store written to only while a primary store is down
+	Standby *StandbyStore `json:"standby,omitempty"`
+
+	// generation of the newest file version, see clock.go
+	Generation uint64 `json:"generation,omitempty"`
+
 	// maps files to their shareId
 	FileMap map[string]FileShare `json:"files"`
 
 	// keep track of dirs tracked
 	DirMap map[string]bool `json:"dirs"`
+
+	// only files matching these patterns are tracked within the dir
+	IncludeRules map[string][]string `json:"include_rules,omitempty"`
+
+	// built-in exclusion sets toggled for this vault, missing ones are enabled
+	ExcludeSets map[string]bool `json:"exclude_sets,omitempty"`
+
+	// git repositories backed up as a bundle plus uncommitted files
+	GitBundles map[string]bool `json:"git_bundles,omitempty"`
+
+	// presets added with --preset, rescanned on sync
+	Presets map[string]bool `json:"presets,omitempty"`
+
+	// superseded and deleted shares are kept this long before compaction,
+	// defaultRetentionDays unless set
+	RetentionDays int `json:"retention_days"`
+
+	// files deleted locally stay restorable this long after their deletion,
+	// 0 drops them at once
+	DeletedRetentionDays int `json:"deleted_retention_days,omitempty"`
+
+	// deleted files kept for DeletedRetentionDays, by path
+	Deleted map[string]*DeletedFile `json:"deleted,omitempty"`
+
+	// run statistics are kept this long, 0 keeps them forever
+	StatsRetentionDays int `json:"stats_retention_days"`
+
+	// what is printed at the end of a run, see run_summary.go
+	RunSummary string `json:"run_summary,omitempty"`
+
+	// file the summary of every run is appended to, as a JSON line
+	RunLog string `json:"run_log,omitempty"`
+
+	// larger files are skipped unless --allow-large is set. 0 uses
+	// defaultMaxFileSize, negative disables the limit
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+
+	// files whose shares need more bytes than this are shared a chunk at a
+	// time, 0 holds files whole. --memory-mb overrides it
+	MaxMemory int64 `json:"max_memory,omitempty"`
+
+	// sharing scheme of new uploads, shamir if empty. Objects keep the
+	// scheme they were uploaded with
+	SharingScheme string `json:"sharing_scheme,omitempty"`
+
+	// random decoy rounds per day while watching, 0 for none
+	DecoyRoundsPerDay int `json:"decoy_rounds_per_day,omitempty"`
+
+	// directories whose files also need a passphrase to restore
+	Protected map[string]ProtectedPath `json:"protected,omitempty"`
 }
 
 // RegisteredServices counts all services
 func (p ChasmPref) RegisteredServices() int {
-	return len(p.FolderStores) + len(p.GDriveStores)
+	return len(p.FolderStores) + len(p.GDriveStores) + len(p.PeerStores) + len(p.DropboxStores) + len(p.S3Stores) + len(p.OneDriveStores) + len(p.B2Stores) + len(p.SFTPStores) + len(p.WebDAVStores) + len(p.AzureBlobStores) + len(p.GCSStores) + len(p.AgentStores) + len(p.BoxStores) + len(p.MegaStores) + len(p.PCloudStores) + len(p.YandexDiskStores) + len(p.FTPStores) + len(p.SMBStores) + len(p.RcloneStores) + len(p.IPFSStores) + len(p.StorjStores) + len(p.KBFSStores) + len(p.EmailStores) + len(p.TelegramStores) + len(p.GitStores) + len(p.SwiftStores) + len(p.DBStores)
 }
 
-// NeedSetup checks if there are enough services to run
+// MaxTrackedFileSize is the size limit for tracked files, or -1 if there is none
+func (p ChasmPref) MaxTrackedFileSize() int64 {
+	if allowLargeFiles || p.MaxFileSize < 0 {
+		return -1
+	}
+	if p.MaxFileSize == 0 {
+		return defaultMaxFileSize
+	}
+	return p.MaxFileSize
+}
+
+// NeedSetup checks if the stores are too few for the vault to upload, or
+// for the policy's redundancy, see SetupProblem
 func (p ChasmPref) NeedSetup() bool {
-	return p.RegisteredServices() < 2
+	return p.SetupProblem() != nil
 }
 
 // AllCloudStores combines all the cloud stores
 func (p ChasmPref) AllCloudStores() []CloudStore {
+	return withTelemetry(withChaos(withTrace(withSplitting(withRangeSums(p.cloudStores())))))
+}
+
+// cloudStores are the configured stores, without the wrappers adding range
+// checksums, splitting, tracing, fault injection and spans. A standby store takes
+// the place of a primary store that is failed over, and a seed directory
+// that of a store being seeded
+func (p ChasmPref) cloudStores() []CloudStore {
+	cloudStores := p.primaryStores()
+	if k := p.failoverIndex(); k >= 0 {
+		cloudStores[k] = p.Standby.store()
+	}
+	for i, cs := range cloudStores {
+		if seed := seedStore(cs); seed != nil {
+			cloudStores[i] = *seed
+		}
+	}
+	return cloudStores
+}
+
+// primaryStores are the configured stores, never the standby store
+func (p ChasmPref) primaryStores() []CloudStore {
 
 	// adjust length for new store types
 	cloudStores := make([]CloudStore, p.RegisteredServices())
@@ -81,22 +279,190 @@ func (p ChasmPref) AllCloudStores() []CloudStore {
 		ind += 1
 	}
 
+	for _, ps := range p.PeerStores {
+		cloudStores[ind] = CloudStore(ps)
+		ind += 1
+	}
+
+	for _, ds := range p.DropboxStores {
+		cloudStores[ind] = CloudStore(ds)
+		ind += 1
+	}
+
+	for _, ss := range p.S3Stores {
+		cloudStores[ind] = CloudStore(ss)
+		ind += 1
+	}
+
+	for _, ods := range p.OneDriveStores {
+		cloudStores[ind] = CloudStore(ods)
+		ind += 1
+	}
+
+	for _, bs := range p.B2Stores {
+		cloudStores[ind] = CloudStore(bs)
+		ind += 1
+	}
+
+	for _, ss := range p.SFTPStores {
+		cloudStores[ind] = CloudStore(ss)
+		ind += 1
+	}
+
+	for _, ws := range p.WebDAVStores {
+		cloudStores[ind] = CloudStore(ws)
+		ind += 1
+	}
+
+	for _, as := range p.AzureBlobStores {
+		cloudStores[ind] = CloudStore(as)
+		ind += 1
+	}
+
+	for _, gs := range p.GCSStores {
+		cloudStores[ind] = CloudStore(gs)
+		ind += 1
+	}
+
+	for _, as := range p.AgentStores {
+		cloudStores[ind] = CloudStore(as)
+		ind += 1
+	}
+
+	for _, bs := range p.BoxStores {
+		cloudStores[ind] = CloudStore(bs)
+		ind += 1
+	}
+
+	for _, ms := range p.MegaStores {
+		cloudStores[ind] = CloudStore(ms)
+		ind += 1
+	}
+
+	for _, ps := range p.PCloudStores {
+		cloudStores[ind] = CloudStore(ps)
+		ind += 1
+	}
+
+	for _, ys := range p.YandexDiskStores {
+		cloudStores[ind] = CloudStore(ys)
+		ind += 1
+	}
+
+	for _, fs := range p.FTPStores {
+		cloudStores[ind] = CloudStore(fs)
+		ind += 1
+	}
+
+	for _, ss := range p.SMBStores {
+		cloudStores[ind] = CloudStore(ss)
+		ind += 1
+	}
+
+	for _, rs := range p.RcloneStores {
+		cloudStores[ind] = CloudStore(rs)
+		ind += 1
+	}
+
+	for _, is := range p.IPFSStores {
+		cloudStores[ind] = CloudStore(is)
+		ind += 1
+	}
+
+	for _, ss := range p.StorjStores {
+		cloudStores[ind] = CloudStore(ss)
+		ind += 1
+	}
+
+	for _, ks := range p.KBFSStores {
+		cloudStores[ind] = CloudStore(ks)
+		ind += 1
+	}
+
+	for _, es := range p.EmailStores {
+		cloudStores[ind] = CloudStore(es)
+		ind += 1
+	}
+
+	for _, ts := range p.TelegramStores {
+		cloudStores[ind] = CloudStore(ts)
+		ind += 1
+	}
+
+	for _, gs := range p.GitStores {
+		cloudStores[ind] = CloudStore(gs)
+		ind += 1
+	}
+
+	for _, ss := range p.SwiftStores {
+		cloudStores[ind] = CloudStore(ss)
+		ind += 1
+	}
+
+	for _, ds := range p.DBStores {
+		cloudStores[ind] = CloudStore(ds)
+		ind += 1
+	}
+
 	return cloudStores
 }
 
-// Save saves the chasm preferences
+// Save saves the chasm preferences, merging changes another process saved
+// since they were loaded. If another process keeps the manifest locked
+// nothing is written, the changes are saved with the next Save
 func (p ChasmPref) Save() {
+	unlock, err := lockManifest(p.root)
+	if err != nil {
+		color.Red("Error: cannot save %s: %s", chasmPrefFile, err)
+		countError()
+		return
+	}
+	defer unlock()
+	saveStoreCredentials()
+
 	chasmFilePath := path.Join(p.root, chasmPrefFile)
 	chasmFileBytes, err := json.MarshalIndent(preferences, "", "    ")
 	check(err)
 
+	diskBytes, err := ioutil.ReadFile(chasmFilePath)
+	if err == nil && savedManifest != nil && !bytes.Equal(diskBytes, savedManifest) {
+		merged, err := mergeManifestJSON(savedManifest, chasmFileBytes, diskBytes)
+		if err != nil {
+			color.Red("Error: cannot merge with changes to %s, overwriting them: %s", chasmFilePath, err)
+		} else {
+			root := preferences.root
+			preferences = ChasmPref{}
+			check(json.Unmarshal(merged, &preferences))
+			preferences.root = root
+			loadStoreCredentials()
+			observeManifest(&preferences)
+
+			chasmFileBytes, err = json.MarshalIndent(preferences, "", "    ")
+			check(err)
+		}
+	}
+
 	ioutil.WriteFile(chasmFilePath, chasmFileBytes, 0660)
+	savedManifest = chasmFileBytes
 }
 
 /// Chasm Functions ///
 
 var preferences ChasmPref
 
+// guards preferences when the daemon API runs alongside the watcher
+var prefsLock sync.Mutex
+
+// files are read into memory to be shared, keep them well below that
+const defaultMaxFileSize = 1 << 30
+
+// superseded shares are kept a month unless set, so that compacting a
+// vault never drops its history at once
+const defaultRetentionDays = 30
+
+// set by --allow-large to track files of any size
+var allowLargeFiles bool
+
 const chasmPrefFile = ".chasm"
 const chasmIgnoreFile = ".chasmignore"
 
@@ -107,7 +473,16 @@ func CreateOrLoadChasmDir(root string) {
 	os.MkdirAll(root, 0777)
 
 	chasmFilePath := path.Join(root, chasmPrefFile)
+	unlock, err := lockManifest(root)
+	if err != nil {
+		color.Red("Error: cannot load %s: %s", chasmFilePath, err)
+		os.Exit(1)
+	}
 	chasmFileBytes, err := ioutil.ReadFile(chasmFilePath)
+	unlock()
+
+	// manifests from before retention_days keep the default too
+	preferences.RetentionDays = defaultRetentionDays
 	if err != nil {
 		color.Green("Creating new .chasm secure folder")
 		preferences.DirMap = make(map[string]bool)
@@ -115,6 +490,7 @@ func CreateOrLoadChasmDir(root string) {
 		preferences.FileMap[chasmFilePath] = FileShare{SID: ShareID(chasmPrefFile), Hash: ""}
 	} else {
 		json.Unmarshal(chasmFileBytes, &preferences)
+		savedManifest = chasmFileBytes
 	}
 
 	chasmIgnorePath := path.Join(root, chasmIgnoreFile)
@@ -132,13 +508,43 @@ func CreateOrLoadChasmDir(root string) {
 	}
 
 	preferences.root = root
+	LoadState(root)
+	loadStoreCredentials()
+	observeManifest(&preferences)
+	relocateRemovableStores()
+	preferences.Save()
+
+	if state.PlainOutput {
+		SetPlainOutput(true)
+	}
+	loadFleet()
+	loadPolicy(root)
+}
+
+// ReloadChasm takes in changes to the preferences, fleet config and policy
+// made since the vault was loaded, keeping the local state of the run
+func ReloadChasm() {
 	preferences.Save()
+	loadFleet()
+	loadPolicy(preferences.root)
 }
 
 // IsValidPath checks if a file path is vaild, i.e. it doesn't match any patterns
-// in the .chasmignore file
+// in the .chasmignore file or the enabled exclusion sets, and the policy does
+// not ignore it
 func IsValidPath(filePath string) bool {
 	base := filepath.Base(filePath)
+
+	// local state and the manifest lock are never shared, nor is what chasm
+	// writes elsewhere
+	if base == chasmStateFile || base == chasmLockFile || ownPath(filePath) != "" {
+		return false
+	}
+
+	if isExcludedBySet(filePath) || policyIgnores(filePath) {
+		return false
+	}
+
 	chasmIgnorePath := path.Join(preferences.root, chasmIgnoreFile)
 	chasmIgnore, err := os.Open(chasmIgnorePath)
 	if err != nil {
@@ -169,21 +575,46 @@ func IsValidPath(filePath string) bool {
 // AddFile secret shares the file, and uploads each share to corresponding services
 // if the file exists already, we delete the remote share first by its shareId
 func AddFile(filePath string) {
+	if taskCanceled() {
+		return
+	}
+	if own := ownPath(filePath); own != "" {
+		color.Blue("Path %s is %s, which chasm never tracks.", filePath, own)
+		trace(TraceEvent{Op: "add", Path: tracePath(filePath), Detail: "own"})
+		return
+	}
 	if !IsValidPath(filePath) {
-		color.Blue("Path %s is in .chasmignore. No actions will be performed.", filePath)
+		color.Blue("Path %s is in .chasmignore, an exclusion set or ignored by the policy. No actions will be performed.", filePath)
+		trace(TraceEvent{Op: "add", Path: tracePath(filePath), Detail: "ignored"})
 		return
 	}
+	defer startSpan("add", spanPath(filePath))()
 	file, _ := os.Open(filePath)
 	fi, err := file.Stat()
 	if err != nil {
 		color.Red("Cannot get file info: %s", err)
+		countError()
+		trace(TraceEvent{Op: "add", Path: tracePath(filePath), Detail: "stat failed"})
 		return
 	}
 
 	switch mode := fi.Mode(); {
 	case mode.IsDir():
+		if preferences.GitBundles[path.Clean(filePath)] && isGitRepo(filePath) {
+			addGitBundle(path.Clean(filePath))
+			return
+		}
+
+		if innerVault(filePath) {
+			warn("Warning: skipping %s, it is the root of another vault. Use --allow-nested to track it.", filePath)
+			trace(TraceEvent{Op: "add", Path: tracePath(filePath), Detail: "nested vault"})
+			return
+		}
+
 		files, _ := ioutil.ReadDir(filePath)
 		preferences.DirMap[path.Clean(filePath)] = true
+		recordDirChange(path.Clean(filePath), true)
+		trace(TraceEvent{Op: "add", Path: tracePath(filePath), Detail: "dir", Size: len(files)})
 
 		for _, f := range files {
 			AddFile(path.Join(filePath, f.Name()))
@@ -193,40 +624,209 @@ func AddFile(filePath string) {
 		break
 	}
 
+	// the manifest is shared through here too, but is not one of the files
+	if path.Base(filePath) != chasmPrefFile {
+		countExamined()
+	}
+
+	if limit := preferences.MaxTrackedFileSize(); limit >= 0 && fi.Size() > limit {
+		warn("Warning: skipping %s, %v bytes is over the %v byte limit. Use --allow-large to track it.", filePath, fi.Size(), limit)
+		countDecision("skipped")
+		trace(TraceEvent{Op: "add", Path: tracePath(filePath), Detail: "too large", Size: int(fi.Size())})
+		return
+	}
+
+	if !IsIncluded(filePath) {
+		color.Blue("Path %s does not match the include rules. No actions will be performed.", filePath)
+		trace(TraceEvent{Op: "add", Path: tracePath(filePath), Detail: "not included"})
+		return
+	}
+
+	// read the file, or only hash it if it is shared a chunk at a time
+	var fileBytes []byte
+	var hash string
+	streamed := !fitsMemory(fi.Size(), preferences.RegisteredServices())
+	endRead := startSpan("read", spanBytes(fi.Size()), attribute.Bool("chasm.streamed", streamed))
+	if streamed {
+		hash, err = hashFile(filePath)
+	} else {
+		fileBytes, err = ioutil.ReadFile(filePath)
+		hash = SHA256Base64URL(fileBytes)
+	}
+	endRead()
+	defer wipe(fileBytes)
+	if err != nil {
+		color.Red("Cannot read file: %s", err)
+		countError()
+		trace(TraceEvent{Op: "add", Path: tracePath(filePath), Detail: "read failed"})
+		return
+	}
+
+	// unchanged files stay stored
+	protection := protectionFor(filePath)
+	existing, tracked := preferences.FileMap[filePath]
+	if tracked && existing.Hash == hash && existing.Version != "" && existing.Protection == protection {
+		countFile(fi.Size(), true)
+		countDecision("unchanged")
+		rememberFileID(filePath, fi)
+		delete(state.PendingUploads, filePath)
+		spanAttributes(attribute.String("chasm.decision", "unchanged"))
+		trace(TraceEvent{Op: "add", Path: tracePath(filePath), Object: existing.ObjectName(), Detail: "unchanged"})
+		return
+	}
+
+	// a renamed file keeps its share id, and unchanged contents stay stored
+	if !tracked {
+		if oldPath, ok := findRenameSource(filePath, fi, hash); ok {
+			color.Green("Detected rename of %s to %s", oldPath, filePath)
+			moveFileShare(oldPath, filePath)
+			moved := preferences.FileMap[filePath]
+			if moved.Hash == hash && moved.Version != "" && moved.Protection == protection {
+				countFile(fi.Size(), true)
+				countDecision("unchanged")
+				rememberFileID(filePath, fi)
+				delete(state.PendingUploads, filePath)
+				spanAttributes(attribute.String("chasm.decision", "renamed"))
+				trace(TraceEvent{Op: "add", Path: tracePath(filePath), Object: preferences.FileMap[filePath].ObjectName(), Detail: "renamed"})
+				return
+			}
+		}
+	}
+
+	if deferUpload(filePath) {
+		return
+	}
+
+	if streamed {
+		// protected files are sealed to a temp file, which is shared instead
+		sharePath := filePath
+		if protection != "" {
+			endSeal := startSpan("seal")
+			sharePath, err = sealProtectedFile(protection, filePath)
+			endSeal()
+			if err != nil {
+				color.Red("Error sealing protected %s: %s", filePath, err)
+				countError()
+				return
+			}
+			defer os.Remove(sharePath)
+		}
+		shareFile(filePath, hash, fi.Size(), func(sid ShareID, version string) uploadedShares {
+			return uploadSharesStreamed(schemeFor(filePath), sid, version, sharePath)
+		})
+	} else {
+		shareFileBytes(filePath, fileBytes)
+	}
+	rememberFileID(filePath, fi)
+	delete(state.PendingUploads, filePath)
+}
+
+// shareFileBytes secret shares fileBytes as the contents of filePath and
+// records the new version in the preferences
+func shareFileBytes(filePath string, fileBytes []byte) {
+	data := fileBytes
+	if protection := protectionFor(filePath); protection != "" {
+		var sealed bytes.Buffer
+		endSeal := startSpan("seal")
+		err := sealProtected(protection, &sealed, bytes.NewReader(fileBytes))
+		endSeal()
+		if err != nil {
+			color.Red("Error sealing protected %s: %s", filePath, err)
+			countError()
+			return
+		}
+		data = sealed.Bytes()
+	}
+
+	shareFile(filePath, SHA256Base64URL(fileBytes), int64(len(fileBytes)), func(sid ShareID, version string) uploadedShares {
+		return uploadSharesWith(schemeFor(filePath), sid, version, data)
+	})
+}
+
+// shareFile records a new version of filePath with contents hash, and
+// uploads its shares with upload
+func shareFile(filePath string, hash string, size int64, upload func(sid ShareID, version string) uploadedShares) {
 	var sid ShareID
+	decision := "update"
 	if existingFileShare, ok := preferences.FileMap[filePath]; ok {
 		sid = existingFileShare.SID
 	} else {
 		// create unique share_id
 		sid = RandomShareID()
+		decision = "new"
 	}
 
-	// read the file
-	fileBytes, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		color.Red("Cannot read file: %s", err)
-		return
+	countFile(size, preferences.FileMap[filePath].Hash == hash)
+
+	// every upload is a new version, old versions are left for compaction
+	version := NewShareVersion()
+	fileShare := FileShare{SID: sid, Hash: hash, Version: version, Generation: NextGeneration(), Protection: protectionFor(filePath), Size: size}
+	preferences.FileMap[filePath] = fileShare
+
+	uploaded := upload(sid, version)
+	fileShare.Shares = uploaded.Hashes
+	fileShare.Threshold = uploadThreshold(filePath, len(uploaded.Hashes))
+	preferences.FileMap[filePath] = fileShare
+	countPipeline(filePath, size, uploaded)
+	spanAttributes(attribute.String("chasm.decision", decision), spanBytes(size))
+	trace(TraceEvent{Op: "add", Path: tracePath(filePath), Object: fileShare.ObjectName(), Size: int(size), Detail: decision})
+
+	// only save pref if it's not a .chasm
+	if sid != ShareID(".chasm") {
+		countDecision(decision)
+		recordFileChange(filePath, &fileShare)
+		preferences.Save()
 	}
 
-	preferences.FileMap[filePath] = FileShare{SID: sid, Hash: SHA256Base64URL(fileBytes)}
+}
+
+// uploadedShares describes the shares of one object as uploaded
+type uploadedShares struct {
+	// hashes of the shares, by x coordinate
+	Hashes []string
 
+	// bytes shared, sealed if protected, and the bytes of the share
+	// uploaded to each store
+	Shared int64
+	Sizes  []int64
+}
+
+// uploadShares secret shares data with the vault's scheme, and uploads each
+// share to corresponding services as version of sid
+func uploadShares(sid ShareID, version string, data []byte) uploadedShares {
+	return uploadSharesWith(preferences.Scheme(), sid, version, data)
+}
+
+// uploadSharesWith is uploadShares sharing with scheme
+func uploadSharesWith(scheme SharingScheme, sid ShareID, version string, data []byte) uploadedShares {
 	// create the shares
 	allCloudStores := preferences.AllCloudStores()
-	shares := CreateShares(fileBytes, sid, len(allCloudStores))
+	endShare := startSpan("share", spanBytes(int64(len(data))))
+	shares := CreateSharesWith(scheme, data, sid, len(allCloudStores))
+	endShare()
+	uploaded := uploadedShares{Hashes: make([]string, len(shares)), Shared: int64(len(data)), Sizes: make([]int64, len(shares))}
+	if sid == ShareID(chasmPrefFile) {
+		embedManifest(version, data)
+	}
 
 	// iteratively upload shares with each cloud store
 	for i, cs := range allCloudStores {
+		shares[i].Version = version
+		if sid != ShareID(chasmPrefFile) {
+			shares[i].Data = append(shares[i].Data, manifestTrailer(i+1, len(shares))...)
+		}
+		if x := shareX(shares[i].Data); x >= 1 && x <= len(uploaded.Hashes) {
+			uploaded.Hashes[x-1] = shareHash(shares[i].ObjectName(), shares[i].Data)
+		}
+		uploaded.Sizes[i] = int64(len(shares[i].Data))
 		cs.Upload(shares[i])
+		wipe(shares[i].Data)
 	}
-
-	// only save pref if it's not a .chasm
-	if sid != ShareID(".chasm") {
-		preferences.Save()
-	}
-
+	return uploaded
 }
 
-// DeleteFile deletes the remote share of this path by its shareId
+// DeleteFile writes a tombstone for the remote shares of this path. The shares
+// themselves are removed later by compaction
 func DeleteFile(filePath string) {
 	if !IsValidPath(filePath) {
 		color.Red("Path %s is in .chasmignore. No actions will be performed.", filePath)
@@ -235,6 +835,7 @@ func DeleteFile(filePath string) {
 
 	potenDirPath := path.Clean(filePath)
 	if _, ok := preferences.DirMap[potenDirPath]; ok {
+		trace(TraceEvent{Op: "delete", Path: tracePath(filePath), Detail: "dir"})
 		DeleteDir(potenDirPath)
 		return
 	}
@@ -242,25 +843,32 @@ func DeleteFile(filePath string) {
 	allCloudStores := preferences.AllCloudStores()
 
 	if fileShare, ok := preferences.FileMap[filePath]; ok {
-		// iteratively delete shares from each cloud store
+		// iteratively upload tombstones to each cloud store
+		tombstone := Share{SID: fileShare.SID, Version: NewShareVersion(), Tombstone: true}
 		for _, cs := range allCloudStores {
-			cs.Delete(fileShare.SID)
+			cs.Upload(tombstone)
 		}
 
 		delete(preferences.FileMap, filePath)
+		delete(state.FileIDs, filePath)
+		recordFileChange(filePath, nil)
+		retainDeleted(filePath, fileShare)
 		preferences.Save()
+		trace(TraceEvent{Op: "delete", Path: tracePath(filePath), Object: tombstone.ObjectName(), Detail: "tombstone"})
 
-		color.Yellow("Deleted share from all cloud stores.")
+		color.Yellow("Marked share deleted in all cloud stores.")
 		return
 	}
 
 	color.Red("Path %s is not tracked. Cannot find share id.", filePath)
+	trace(TraceEvent{Op: "delete", Path: tracePath(filePath), Detail: "untracked"})
 }
 
 func DeleteDir(dirPath string) {
 
 	//remove dir path
 	delete(preferences.DirMap, dirPath)
+	recordDirChange(dirPath, false)
 
 	for filePath, _ := range preferences.FileMap {
 		dirMatch, _ := path.Split(filePath)
@@ -274,72 +882,264 @@ func DeleteDir(dirPath string) {
 // Restore shares to the original files
 func Restore() {
 	allCloudStores := preferences.AllCloudStores()
-	sharePaths := make([]string, len(allCloudStores))
+	sharePaths := make([]string, 0, len(allCloudStores))
 
-	// (1) first get all shares
-	for i, cs := range allCloudStores {
+	// (1) first get all shares, objects only need a threshold of the stores
+	endDownload := startSpan("download")
+	for _, cs := range allCloudStores {
 		sp := cs.Restore()
 		if sp == "" {
-			color.Red("Restore failed for %v", cs)
-			return
+			color.Red(T("Restore failed for %v"), cs)
+			countError()
+			continue
 		}
-		sharePaths[i] = sp
+		sharePaths = append(sharePaths, sp)
+	}
+	endDownload()
+	defer removeStaging(sharePaths)
+	if len(sharePaths) == 0 {
+		spanFailed()
+		return
 	}
 
-	// (2) next restore .chasm file
-	chasmFileBytes := restoreShareID(ShareID(chasmPrefFile), sharePaths)
+	// (2) next restore the latest .chasm file
+	endManifest := startSpan("manifest")
+	chasmObject := latestObject(ShareID(chasmPrefFile), sharePaths)
+	chasmFileBytes := restoreObject(chasmObject, sharePaths)
+	_, manifestVersion, _ := ParseObjectName(chasmObject)
 
 	var restoredPrefs ChasmPref
 	err := json.Unmarshal(chasmFileBytes, &restoredPrefs)
 	if err != nil {
-		color.Red("Cannot restore chasm preferences file from cloud services.")
-		return
+		// the manifest objects are lost, reassemble it from ordinary shares
+		embedded, version, embeddedErr := recovery.ReadEmbeddedManifestFrom(sharePaths, readStagedObject)
+		if embeddedErr != nil || json.Unmarshal(embedded, &restoredPrefs) != nil {
+			color.Red(T("Cannot restore chasm preferences file from cloud services."))
+			spanFailed()
+			endManifest()
+			return
+		}
+		color.Yellow(T("Restored the manifest from fragments embedded in shares."))
+		manifestVersion = version
 	}
 
+	// apply the deltas uploaded since that manifest, oldest first
+	for _, delta := range restoreManifestDeltas(manifestVersion, sharePaths) {
+		delta.Apply(&restoredPrefs)
+	}
+	endManifest()
+
 	// (3) create necessary directories, update in prefs.
 	for dirPath, _ := range restoredPrefs.DirMap {
 		os.MkdirAll(dirPath, 0770)
 		preferences.DirMap[dirPath] = true
 	}
 
-	// (4) finally, for the remaining files, restore and save
+	// protected directories stay protected, and are only restored unlocked
+	for dirPath, protected := range restoredPrefs.Protected {
+		if preferences.Protected == nil {
+			preferences.Protected = make(map[string]ProtectedPath)
+		}
+		preferences.Protected[dirPath] = protected
+	}
+	agentKeys(restoredPrefs.Protected)
+	if unlockRestore {
+		unlockProtected(restoredPrefs.Protected)
+	}
+
+	// deleted files are not restored, but stay available to undelete
+	for filePath, deleted := range restoredPrefs.Deleted {
+		if preferences.Deleted == nil {
+			preferences.Deleted = make(map[string]*DeletedFile)
+		}
+		preferences.Deleted[filePath] = deleted
+	}
+
+	// the manifest was read above, its entry names a superseded version
+	for filePath, fileShare := range restoredPrefs.FileMap {
+		if fileShare.SID == ShareID(chasmPrefFile) {
+			delete(restoredPrefs.FileMap, filePath)
+		}
+	}
+	taskTotal(len(restoredPrefs.FileMap))
+
+	// (4) clone git bundles first, so restored uncommitted files land on top
+	endBundles := startSpan("git bundles")
 	for filePath, fileShare := range restoredPrefs.FileMap {
-		fileBytes := restoreShareID(fileShare.SID, sharePaths)
-		if len(fileBytes) == 0 {
+		if path.Base(filePath) != gitBundleName {
+			continue
+		}
+		delete(restoredPrefs.FileMap, filePath)
+		if taskCanceled() {
+			break
+		}
+		if skipLocked(fileShare) {
 			continue
 		}
 
-		if fileShare.SID != ShareID(chasmPrefFile) && checkSHA2(fileShare.Hash, fileBytes) == false {
-			color.Red("Error: invalid SHA2 checksum for share %s. Skipping.", fileShare.SID)
+		fileBytes, ok := unprotect(filePath, fileShare, restoreFileObject(fileShare, sharePaths))
+		if !ok || len(fileBytes) == 0 || checkSHA2(fileShare.Hash, fileBytes) == false {
+			color.Red(T("Error: cannot restore git bundle for %s. Skipping."), path.Dir(filePath))
+			countError()
+			continue
+		}
+		err := ioutil.WriteFile(filePath, fileBytes, 0660)
+		size := int64(len(fileBytes))
+		wipe(fileBytes)
+		if err != nil || !restoreGitBundle(filePath) {
+			countError()
 			continue
 		}
+		countFile(size, false)
+	}
+	endBundles()
 
-		err := ioutil.WriteFile(filePath, fileBytes, 0770)
-		if err != nil {
-			color.Red("Error writing restored file %s: %s", filePath, err)
+	// (5) finally, for the remaining files, restore and save
+	for filePath, fileShare := range restoredPrefs.FileMap {
+		if taskCanceled() {
+			color.Yellow(T("Restore canceled."))
+			return
+		}
+		restoreTrackedFile(filePath, fileShare, sharePaths)
+	}
+	if len(lockedSkipped) > 0 {
+		reportLocked()
+		return
+	}
+	color.Green(T("Done. Restored all files!"))
+}
+
+// restoreTrackedFile combines the shares of fileShare in sharePaths and
+// writes the file to filePath
+func restoreTrackedFile(filePath string, fileShare FileShare, sharePaths []string) {
+	defer startSpan("restore", spanPath(filePath), spanBytes(fileShare.Size))()
+	if skipLocked(fileShare) {
+		return
+	}
+
+	// shares too large for the memory budget are combined a chunk at a time
+	if size, err := stagedSize(path.Join(sharePaths[0], fileShare.ObjectName())); err == nil && !fitsMemory(size-1, len(sharePaths)) {
+		restoreFileStreamed(filePath, fileShare, sharePaths)
+		return
+	}
+
+	endCombine := startSpan("combine")
+	fileBytes, ok := unprotect(filePath, fileShare, restoreFileObject(fileShare, sharePaths))
+	endCombine()
+	if !ok || len(fileBytes) == 0 {
+		return
+	}
+
+	if checkSHA2(fileShare.Hash, fileBytes) == false {
+		color.Red(T("Error: invalid SHA2 checksum for share %s. Skipping."), fileShare.SID)
+		wipe(fileBytes)
+		countError()
+		return
+	}
+
+	endWrite := startSpan("write")
+	err := ioutil.WriteFile(filePath, fileBytes, 0770)
+	endWrite()
+	wipe(fileBytes)
+	if err != nil {
+		color.Red(T("Error writing restored file %s: %s"), filePath, err)
+		countError()
+		return
+	}
+	countFile(int64(len(fileBytes)), false)
+}
+
+// latestObject finds the newest version of sid that enough stores hold to
+// restore, falling back to the unversioned object name
+func latestObject(sid ShareID, sharePaths []string) string {
+	latest := ""
+	if versions := restorableVersions(sid, sharePaths); len(versions) > 0 {
+		latest = versions[len(versions)-1]
+	}
+	return ObjectName(sid, latest, false)
+}
+
+// restorableVersions are the versions of sid held by at least the threshold
+// of stores their shares name, oldest first. Legacy shares need every store
+func restorableVersions(sid ShareID, sharePaths []string) []string {
+	counts := make(map[string]int)
+	thresholds := make(map[string]int)
+	for _, sp := range sharePaths {
+		files, _ := ioutil.ReadDir(sp)
+		for _, f := range files {
+			objSID, version, tombstone := ParseObjectName(f.Name())
+			if objSID != sid || tombstone {
+				continue
+			}
+			counts[version]++
+			if _, ok := thresholds[version]; !ok {
+				thresholds[version] = objectThreshold(path.Join(sp, f.Name()))
+			}
 		}
 	}
-	color.Green("Done. Restored all files!")
+
+	versions := make([]string, 0, len(counts))
+	for version, count := range counts {
+		if count >= thresholds[version] {
+			versions = append(versions, version)
+		}
+	}
+	sort.Strings(versions)
+	return versions
 }
 
-func restoreShareID(sid ShareID, sharePaths []string) []byte {
-	fileShares := make([]Share, len(sharePaths))
+// objectThreshold is how many shares restore needs of the object whose
+// share is at sharePath: the threshold in its header, or every store
+func objectThreshold(sharePath string) int {
+	if share, err := openShare(sharePath); err == nil {
+		share.file.Close()
+		if share.share.Threshold > 0 {
+			return int(share.share.Threshold)
+		}
+	}
+	return preferences.RegisteredServices()
+}
 
-	sharesFound := 0
+func restoreObject(object string, sharePaths []string) []byte {
+	return restoreCheckedObject(object, sharePaths, func([]byte) error { return nil })
+}
+
+// restoreFileObject restores the current object of fileShare, leaving out
+// shares that do not match their hashes in the manifest
+func restoreFileObject(fileShare FileShare, sharePaths []string) []byte {
+	return restoreCheckedObject(fileShare.ObjectName(), sharePaths, func(data []byte) error {
+		return checkShare(fileShare, data)
+	})
+}
+
+func restoreCheckedObject(object string, sharePaths []string, check func(data []byte) error) []byte {
+	fileShares := make([]Share, 0, len(sharePaths))
+	sid, version, _ := ParseObjectName(object)
+
+	legacy := false
 	for i, sp := range sharePaths {
-		file := path.Join(sp, string(sid))
-		dataBytes, err := ioutil.ReadFile(file)
+		file := path.Join(sp, object)
+		dataBytes, err := readStaged(file)
 		if err != nil {
 			color.Red("(Skipping share) Cannot read file %s: %s", file, err)
 			continue
 		}
+		if err := check(dataBytes); err != nil {
+			color.Red("(Skipping share) %s from store %v is corrupt: %s", object, i+1, err)
+			wipe(dataBytes)
+			countError()
+			continue
+		}
 
-		fileShares[i] = Share{SID: sid, Data: dataBytes}
-		sharesFound++
+		fileShares = append(fileShares, Share{SID: sid, Data: dataBytes, Version: version})
+		legacy = legacy || !bytes.HasPrefix(dataBytes, []byte(recovery.Magic))
 	}
 
-	if sharesFound < preferences.RegisteredServices() {
+	// shares in the current format know their threshold, legacy ones need
+	// every store
+	if len(fileShares) == 0 || legacy && len(fileShares) < preferences.RegisteredServices() {
 		color.Red("Couldn't retrieve enough shares to restore %s", sid)
+		countError()
 		return []byte{}
 	} else {
 		return CombineShares(fileShares)
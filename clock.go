@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Versions are wall-clock timestamps, so a machine whose clock is behind
+// would make the versions it writes older than those it replaces. Each new
+// file version therefore also takes the next generation of the vault, a
+// counter carried in the manifest and raised to the highest one seen when
+// manifests are merged or files replicated, which decides which version is
+// newer whatever the clocks say. Version stamps themselves never go back
+// past the newest version the vault knows, so the history stays in order
+
+// versions dated further ahead of the local clock are reported
+const maxClockSkew = 5 * time.Minute
+
+var (
+	versionClockLock sync.Mutex
+
+	// newest version stamp issued or seen, in nanoseconds
+	versionClock int64
+)
+
+// nextVersionStamp is the current time, or just after the newest version
+// seen if the clock is behind it
+func nextVersionStamp() int64 {
+	versionClockLock.Lock()
+	defer versionClockLock.Unlock()
+	now := time.Now().UnixNano()
+	if now <= versionClock {
+		now = versionClock + 1
+	}
+	versionClock = now
+	return now
+}
+
+// observeVersion keeps later version stamps after version
+func observeVersion(version string) {
+	t, ok := VersionTime(version)
+	if !ok {
+		return
+	}
+	versionClockLock.Lock()
+	defer versionClockLock.Unlock()
+	if t.UnixNano() > versionClock {
+		versionClock = t.UnixNano()
+	}
+}
+
+// observeManifest takes in the versions and generations of the files of p
+func observeManifest(p *ChasmPref) {
+	for _, fileShare := range p.FileMap {
+		observeGeneration(p, fileShare)
+	}
+}
+
+// observeGeneration keeps later versions and generations of p after those
+// of fileShare
+func observeGeneration(p *ChasmPref, fileShare FileShare) {
+	observeVersion(fileShare.Version)
+	if fileShare.Generation > p.Generation {
+		p.Generation = fileShare.Generation
+	}
+}
+
+// NextGeneration returns the generation of a new file version
+func NextGeneration() uint64 {
+	preferences.Generation++
+	return preferences.Generation
+}
+
+// newerShare tells if a is a later version of a file than b. Generations
+// decide when both have one, as versions recorded before generations were
+// have none
+func newerShare(a, b FileShare) bool {
+	if a.Generation != 0 && b.Generation != 0 && a.Generation != b.Generation {
+		return a.Generation > b.Generation
+	}
+	return a.Version > b.Version
+}
+
+// warnClockSkew reports files of source whose versions are dated too far
+// ahead of the local clock, meaning this machine's clock or that of the one
+// writing them is wrong. Returns the largest skew
+func warnClockSkew(source string, files map[string]FileShare) time.Duration {
+	var skew time.Duration
+	var newest string
+	now := time.Now()
+	for filePath, fileShare := range files {
+		t, ok := VersionTime(fileShare.Version)
+		if ok && t.Sub(now) > skew {
+			skew, newest = t.Sub(now), filePath
+		}
+	}
+	if skew > maxClockSkew {
+		warn("Warning: %s has versions dated up to %s ahead of this machine's clock, such as that of %s. Check the clocks of the machines sharing this vault.", source, skew.Round(time.Second), newest)
+	}
+	return skew
+}
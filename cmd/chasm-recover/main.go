@@ -0,0 +1,79 @@
+// Command chasm-recover reconstructs files from raw chasm share objects.
+//
+// Download the objects of every store into its own directory, then run
+//
+//	chasm-recover -out restored store1/ store2/ ...
+//
+// It only needs the recovery package, not a working chasm setup.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+)
+
+func main() {
+	out := flag.String("out", "restored", "directory to write recovered files to")
+	only := flag.String("file", "", "only recover this tracked path")
+	list := flag.Bool("list", false, "list the tracked paths instead of recovering")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: chasm-recover [flags] share-dir...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	dirs := flag.Args()
+	if len(dirs) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	manifest, err := recovery.ReadManifest(dirs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot recover manifest:", err)
+		os.Exit(1)
+	}
+
+	failed := 0
+	for path, entry := range manifest.Files {
+		if entry.SID == recovery.ManifestSID {
+			continue
+		}
+		if *list {
+			fmt.Println(path)
+			continue
+		}
+		if *only != "" && path != *only {
+			continue
+		}
+
+		fileBytes, err := recovery.ReadFile(dirs, entry)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "skipping %s: %v\n", path, err)
+			failed++
+			continue
+		}
+
+		// tracked paths are absolute, recreate them under out
+		dest := filepath.Join(*out, strings.TrimPrefix(filepath.FromSlash(path), filepath.VolumeName(path)))
+		if err := os.MkdirAll(filepath.Dir(dest), 0700); err == nil {
+			err = ioutil.WriteFile(dest, fileBytes, 0600)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot write %s: %v\n", dest, err)
+			failed++
+			continue
+		}
+		fmt.Println("recovered", path)
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
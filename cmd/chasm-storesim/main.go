@@ -0,0 +1,31 @@
+// Command chasm-storesim runs the storesim object store emulator, for
+// integration testing store backends without cloud accounts:
+//
+//	chasm-storesim -addr 127.0.0.1:9000
+//
+// then point an S3-compatible store at http://127.0.0.1:9000 with path-style
+// addressing.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/TheLisztomaniac/chasmOriginal/storesim"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9000", "address to listen on")
+	flag.Parse()
+
+	log.Printf("store emulator listening on http://%s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, logRequests(storesim.NewServer())))
+}
+
+func logRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.Method, r.URL)
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,74 @@
+//go:build js && wasm
+
+// Command chasm-wasm exposes the recovery package to JavaScript so a static
+// web page can reconstruct files from downloaded shares entirely client-side.
+//
+// Build it with
+//
+//	GOOS=js GOARCH=wasm go build -o chasm.wasm ./cmd/chasm-wasm
+//	cp "$(go env GOROOT)/lib/wasm/wasm_exec.js" .   # misc/wasm before Go 1.24
+//
+// and serve chasm.wasm, wasm_exec.js, recover.js and index.html from any
+// static host, or open them from a local web server.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"syscall/js"
+
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+)
+
+func main() {
+	js.Global().Set("chasmCombine", js.FuncOf(combine))
+	js.Global().Set("chasmHash", js.FuncOf(hash))
+
+	// keep the exported functions alive
+	select {}
+}
+
+// combine(shares: Uint8Array[]) -> {data: Uint8Array} | {error: string}
+func combine(this js.Value, args []js.Value) interface{} {
+	if len(args) != 1 {
+		return jsError("expected an array of shares")
+	}
+
+	shares := make([]recovery.Share, 0, args[0].Length())
+	for i := 0; i < args[0].Length(); i++ {
+		share, err := recovery.Decode(bytesFromJS(args[0].Index(i)))
+		if err != nil {
+			return jsError(err.Error())
+		}
+		shares = append(shares, share)
+	}
+
+	secret, err := recovery.Combine(shares)
+	if err != nil {
+		return jsError(err.Error())
+	}
+
+	data := js.Global().Get("Uint8Array").New(len(secret))
+	js.CopyBytesToJS(data, secret)
+	return map[string]interface{}{"data": data}
+}
+
+// hash(data: Uint8Array) -> base64URL SHA-256, as stored in the manifest
+func hash(this js.Value, args []js.Value) interface{} {
+	if len(args) != 1 {
+		return jsError("expected file data")
+	}
+
+	sum := sha256.Sum256(bytesFromJS(args[0]))
+	return base64.URLEncoding.EncodeToString(sum[:])
+}
+
+func bytesFromJS(v js.Value) []byte {
+	b := make([]byte, v.Get("length").Int())
+	js.CopyBytesToGo(b, v)
+	return b
+}
+
+func jsError(message string) interface{} {
+	return map[string]interface{}{"error": message}
+}
@@ -0,0 +1,27 @@
+// JS wrapper around chasm.wasm. Load wasm_exec.js first.
+const chasm = {
+    ready: (async () => {
+        const go = new Go();
+        const result = await WebAssembly.instantiateStreaming(fetch("chasm.wasm"), go.importObject);
+        go.run(result.instance);
+    })(),
+
+    // combine reconstructs a file from one share File/Blob per store
+    async combine(shareFiles) {
+        await chasm.ready;
+        const shares = await Promise.all(
+            Array.from(shareFiles, async (f) => new Uint8Array(await f.arrayBuffer())));
+
+        const result = chasmCombine(shares);
+        if (result.error) {
+            throw new Error(result.error);
+        }
+        return result.data;
+    },
+
+    // verify checks data against the manifest hash of the file
+    async verify(data, expectedHash) {
+        await chasm.ready;
+        return chasmHash(data) === expectedHash;
+    },
+};
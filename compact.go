@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// liveObjects returns the object names still referenced by the preferences,
+// including retained deleted files, plus the manifest objects and deltas
+// still needed to restore from the stores listed in listings. The newest
+// manifest version every store holds is kept with everything newer, as a
+// partial upload may leave the stores without a newer version in common
+func liveObjects(listings [][]string) map[string]bool {
+	live := make(map[string]bool)
+	for _, fs := range preferences.FileMap {
+		live[fs.ObjectName()] = true
+	}
+	for _, deleted := range preferences.Deleted {
+		live[deleted.ObjectName()] = true
+	}
+
+	held := make(map[string]int)
+	for _, objects := range listings {
+		for _, object := range objects {
+			if sid, version, tombstone := ParseObjectName(object); sid == ShareID(chasmPrefFile) && !tombstone {
+				held[version]++
+			}
+		}
+	}
+	common := ""
+	for version, stores := range held {
+		if stores == len(listings) && version > common {
+			common = version
+		}
+	}
+
+	for _, objects := range listings {
+		for _, object := range objects {
+			sid, version, tombstone := ParseObjectName(object)
+			switch {
+			case sid == ShareID(chasmPrefFile) && !tombstone && version >= common:
+				live[object] = true
+			case sid == ShareID(chasmDeltaSID) && version > common:
+				live[object] = true
+			}
+		}
+	}
+
+	return live
+}
+
+// policyRetentions returns the retention in days of the files whose
+// retention the policy sets, by share id
+func policyRetentions() map[ShareID]int {
+	retentions := make(map[ShareID]int)
+	if len(policy.Rules) == 0 {
+		return retentions
+	}
+	for filePath, fs := range preferences.FileMap {
+		if days := policyFor(filePath).RetentionDays; days != nil {
+			retentions[fs.SID] = *days
+		}
+	}
+	for filePath, deleted := range preferences.Deleted {
+		if days := policyFor(filePath).RetentionDays; days != nil {
+			retentions[deleted.SID] = *days
+		}
+	}
+	return retentions
+}
+
+// Compact removes superseded share versions and tombstones from every cloud
+// store once they are older than the retention period, or the one the
+// policy sets for their file. Objects still under provider-side retention
+// simply fail to delete and are retried next time. Superseded versions of
+// files whose current version is on too few stores are kept
+func Compact(retention time.Duration) {
+	now := time.Now()
+	cutoff := now.Add(-retention)
+
+	if purged := purgeDeleted(); purged > 0 {
+		color.Yellow("Purged %v deleted files past their retention", purged)
+	}
+
+	retentions := policyRetentions()
+
+	// an idle standby store still holds shares from past failovers
+	cloudStores := preferences.AllCloudStores()
+	if standby := preferences.idleStandby(); standby != nil {
+		cloudStores = append(cloudStores, standby)
+	}
+
+	listings := make([][]string, len(cloudStores))
+	for i, cs := range cloudStores {
+		listings[i] = cs.List()
+	}
+
+	// an idle standby comes after the primary stores
+	short := compactionShortfalls(listings[:preferences.RegisteredServices()])
+	if len(short) > 0 {
+		color.Yellow("Keeping the superseded shares of %v files whose current version is on too few stores, see chasm verify and chasm repair:", len(short))
+		var shortfalls []RedundancyShortfall
+		for _, s := range short {
+			shortfalls = append(shortfalls, s)
+		}
+		sort.Slice(shortfalls, func(i, j int) bool { return shortfalls[i].Path < shortfalls[j].Path })
+		printShortfalls(shortfalls)
+	}
+
+	// the manifest versions kept are those restorable from the primary
+	// stores
+	live := liveObjects(listings[:preferences.RegisteredServices()])
+	for i, cs := range cloudStores {
+		objects := listings[i]
+
+		removed := 0
+		for _, object := range objects {
+			if live[object] {
+				continue
+			}
+
+			// objects from the unversioned layout have no age, compact them
+			sid, version, _ := ParseObjectName(object)
+			if _, ok := short[sid]; ok {
+				continue
+			}
+			objectCutoff := cutoff
+			if days, ok := retentions[sid]; ok {
+				objectCutoff = now.AddDate(0, 0, -days)
+			}
+			if created, ok := VersionTime(version); ok && created.After(objectCutoff) {
+				continue
+			}
+
+			cs.Remove(object)
+			removed++
+		}
+
+		color.Green("Compacted %v: removed %v objects", cs.ShortDescription(), removed)
+	}
+}
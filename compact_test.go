@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestLiveManifests checks compaction keeps the newest manifest version all
+// the stores hold, and the newer ones and deltas partial uploads left
+func TestLiveManifests(t *testing.T) {
+	preferences = ChasmPref{}
+	defer func() { preferences = ChasmPref{} }()
+
+	manifest := func(version string) string { return ObjectName(ShareID(chasmPrefFile), version, false) }
+	delta := func(version string) string { return ObjectName(ShareID(chasmDeltaSID), version, false) }
+
+	// versions as NewShareVersion makes them, a day apart
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var versions []string
+	for day := 0; day < 4; day++ {
+		created := start.AddDate(0, 0, day)
+		version := fmt.Sprintf("%016x", created.UnixNano())
+		if at, ok := VersionTime(version); !ok || !at.Equal(created) {
+			t.Fatalf("version %s dated %v, want %v", version, at, created)
+		}
+		versions = append(versions, version)
+	}
+	v1, v2, v3, v4 := versions[0], versions[1], versions[2], versions[3]
+
+	// v3 reached the first store only, v4 the second only
+	listings := [][]string{
+		{manifest(v1), manifest(v2), manifest(v3), delta(v1), delta(v3)},
+		{manifest(v1), manifest(v2), manifest(v4), delta(v1), delta(v4)},
+		{manifest(v1), manifest(v2), delta(v1)},
+	}
+	live := liveObjects(listings)
+	for object, want := range map[string]bool{
+		manifest(v1): false,
+		manifest(v2): true,
+		manifest(v3): true,
+		manifest(v4): true,
+		delta(v1):    false,
+		delta(v3):    true,
+		delta(v4):    true,
+	} {
+		if live[object] != want {
+			t.Errorf("%s live %v, want %v", object, live[object], want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+)
+
+// Passwords, keys and tokens of stores are kept in the local state, never
+// in the preferences: the preferences are uploaded to every store as the
+// manifest, so anyone able to read one store would find the credentials of
+// all the others. The fields holding them are left out of the preferences'
+// JSON, filled in from the local state when the vault loads, and saved to
+// it with the preferences. Like the AWS credentials of aws.go, a vault set
+// up on another machine needs them given again, or a recovery kit.
+
+// credentialed is a store with credentials, by the names they had in the
+// store's JSON
+type credentialed interface {
+	credentials() map[string]*string
+}
+
+// storeCredentials are the credentials of every store, by the store's short
+// description
+func storeCredentials() map[string]map[string]*string {
+	all := make(map[string]map[string]*string)
+	for i, cs := range preferences.primaryStores() {
+		if store, ok := storeRef(i + 1).(credentialed); ok {
+			all[cs.ShortDescription()] = store.credentials()
+		}
+	}
+	if standby := preferences.Standby; standby != nil && standby.Peer != nil {
+		all[standby.Peer.ShortDescription()] = standby.Peer.credentials()
+	}
+	return all
+}
+
+// loadStoreCredentials fills in the credentials of the stores from the local
+// state. Those of a store another process added are in the state it saved
+func loadStoreCredentials() {
+	var saved map[string]map[string]string
+	for store, fields := range storeCredentials() {
+		for name, secret := range fields {
+			if *secret != "" {
+				continue
+			}
+			value, ok := state.StoreCredentials[store][name]
+			if !ok {
+				if saved == nil {
+					saved = savedCredentials()
+				}
+				value = saved[store][name]
+			}
+			*secret = value
+		}
+	}
+}
+
+// savedCredentials are the store credentials of the local state on disk
+func savedCredentials() map[string]map[string]string {
+	var saved LocalState
+	stateBytes, err := ioutil.ReadFile(path.Join(state.root, chasmStateFile))
+	if err == nil {
+		json.Unmarshal(stateBytes, &saved)
+	}
+	if saved.StoreCredentials == nil {
+		return make(map[string]map[string]string)
+	}
+	return saved.StoreCredentials
+}
+
+// saveStoreCredentials keeps the credentials of the stores in the local
+// state, forgetting those of removed stores
+func saveStoreCredentials() {
+	if state.root == "" {
+		return
+	}
+
+	saved := storeCredentialValues()
+	if !sameCredentials(saved, state.StoreCredentials) {
+		state.StoreCredentials = saved
+		state.Save()
+	}
+}
+
+// setStoreCredentials sets credentials of the stores given by short
+// description, as a recovery kit holds them
+func setStoreCredentials(credentials map[string]map[string]string) {
+	for store, fields := range storeCredentials() {
+		for name, secret := range fields {
+			if value, ok := credentials[store][name]; ok {
+				*secret = value
+			}
+		}
+	}
+}
+
+// storeCredentialValues are the credentials of the stores set, by store
+// short description
+func storeCredentialValues() map[string]map[string]string {
+	values := make(map[string]map[string]string)
+	for store, fields := range storeCredentials() {
+		for name, secret := range fields {
+			if *secret == "" {
+				continue
+			}
+			if values[store] == nil {
+				values[store] = make(map[string]string)
+			}
+			values[store][name] = *secret
+		}
+	}
+	return values
+}
+
+func sameCredentials(a, b map[string]map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for store, fields := range a {
+		if len(fields) != len(b[store]) {
+			return false
+		}
+		for name, secret := range fields {
+			if b[store][name] != secret {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+//go:build cshared
+
+package main
+
+// C ABI for embedding chasm in desktop apps without spawning subprocesses:
+//
+//	go build -tags cshared -buildmode=c-shared -o libchasm.so .
+//
+// which also generates libchasm.h. Functions only take and return C ints
+// and NUL-terminated strings; strings returned by chasm must be released
+// with ChasmFree. New functions may be added, existing signatures and
+// return codes only change together with ChasmABIVersion.
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"unsafe"
+)
+
+const chasmABIVersion = 1
+
+// return codes, failed runs return the number of errors instead
+const (
+	chasmOK         = 0
+	chasmNotLoaded  = -1
+	chasmNeedsSetup = -2
+)
+
+var chasmLoaded bool
+
+//export ChasmABIVersion
+func ChasmABIVersion() C.int {
+	return chasmABIVersion
+}
+
+// ChasmLoad creates or loads the chasm folder at root
+//
+//export ChasmLoad
+func ChasmLoad(root *C.char) C.int {
+	prefsLock.Lock()
+	defer prefsLock.Unlock()
+
+	CreateOrLoadChasmDir(C.GoString(root))
+	chasmLoaded = true
+	return chasmOK
+}
+
+// ChasmAdd shares the file or directory at path to every cloud store and
+// returns the number of errors
+//
+//export ChasmAdd
+func ChasmAdd(path *C.char) C.int {
+	prefsLock.Lock()
+	defer prefsLock.Unlock()
+
+	if code := checkLoaded(); code != chasmOK {
+		return code
+	}
+
+	StartRun("add")
+	AddFile(C.GoString(path))
+	UploadManifest()
+	return finishCRun()
+}
+
+// ChasmRestore restores every file from the cloud stores and returns the
+// number of errors
+//
+//export ChasmRestore
+func ChasmRestore() C.int {
+	prefsLock.Lock()
+	defer prefsLock.Unlock()
+
+	if code := checkLoaded(); code != chasmOK {
+		return code
+	}
+
+	StartRun("restore")
+	Restore()
+	return finishCRun()
+}
+
+// ChasmStatus returns the status as JSON, or NULL if chasm is not loaded
+//
+//export ChasmStatus
+func ChasmStatus() *C.char {
+	prefsLock.Lock()
+	defer prefsLock.Unlock()
+
+	if !chasmLoaded {
+		return nil
+	}
+
+	statusBytes, err := json.Marshal(currentStatus())
+	if err != nil {
+		return nil
+	}
+	return C.CString(string(statusBytes))
+}
+
+// ChasmFree releases a string returned by chasm
+//
+//export ChasmFree
+func ChasmFree(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+func checkLoaded() C.int {
+	if !chasmLoaded {
+		return chasmNotLoaded
+	}
+	if preferences.NeedSetup() {
+		return chasmNeedsSetup
+	}
+	return chasmOK
+}
+
+func finishCRun() C.int {
+	errors := currentRun.Errors
+	FinishRun()
+	return C.int(errors)
+}
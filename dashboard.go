@@ -0,0 +1,172 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// The dashboard is a single page served by the daemon for headless servers.
+// The page itself is public and holds no data, it asks for the API token and
+// sends it with every request to the dashboard endpoints, which require it
+// like the rest of the API.
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// most search results returned at once
+const maxDashboardResults = 500
+
+// StoreHealth is the state of one store on the dashboard
+type StoreHealth struct {
+	Store   string `json:"store"`
+	Objects int    `json:"objects"`
+
+	// current objects of tracked files the store is missing
+	Missing int `json:"missing"`
+}
+
+// DashboardResponse is returned by GET /api/dashboard
+type DashboardResponse struct {
+	Status StatusResponse `json:"status"`
+	Runs   []RunStats     `json:"runs"`
+	Stores []StoreHealth  `json:"stores"`
+}
+
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write(dashboardPage)
+}
+
+// apiDashboard serves GET /api/dashboard with the status, the last runs and
+// the health of every store
+func apiDashboard(w http.ResponseWriter, r *http.Request) {
+	resp := DashboardResponse{Status: currentStatus(), Runs: state.Runs, Stores: []StoreHealth{}}
+	if len(resp.Runs) > 10 {
+		resp.Runs = resp.Runs[len(resp.Runs)-10:]
+	}
+
+	for _, cs := range preferences.AllCloudStores() {
+		listing := make(map[string]bool)
+		for _, object := range cs.List() {
+			listing[object] = true
+		}
+		health := StoreHealth{Store: cs.ShortDescription(), Objects: len(listing)}
+		for _, fileShare := range preferences.FileMap {
+			if !listing[fileShare.ObjectName()] {
+				health.Missing++
+			}
+		}
+		resp.Stores = append(resp.Stores, health)
+	}
+
+	writeJSON(w, resp)
+}
+
+// apiFiles serves GET /api/files?q= with the tracked paths containing q,
+// case insensitively
+func apiFiles(w http.ResponseWriter, r *http.Request) {
+	query := strings.ToLower(r.URL.Query().Get("q"))
+
+	paths := []string{}
+	for filePath, fileShare := range preferences.FileMap {
+		if fileShare.SID != ShareID(chasmPrefFile) && strings.Contains(strings.ToLower(filePath), query) {
+			paths = append(paths, filePath)
+		}
+	}
+	sort.Strings(paths)
+	if len(paths) > maxDashboardResults {
+		paths = paths[:maxDashboardResults]
+	}
+
+	writeJSON(w, paths)
+}
+
+// apiFileDownload serves GET /api/files/download?path=[&version=] with the
+// contents of a tracked file, restored from the stores. Without a version
+// the current one is downloaded
+func apiFileDownload(w http.ResponseWriter, r *http.Request) {
+	filePath := r.URL.Query().Get("path")
+	fileShare, ok := preferences.FileMap[filePath]
+	if !ok {
+		http.Error(w, "not a tracked file", http.StatusNotFound)
+		return
+	}
+	if version := r.URL.Query().Get("version"); version != "" && version != fileShare.Version {
+		fileShare = olderVersion(fileShare, version)
+	}
+	if fileShare.Protection != "" {
+		http.Error(w, "file is protected, restore it with --unlock", http.StatusForbidden)
+		return
+	}
+
+	contents, err := RestoreSingleFile(fileShare)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer wipe(contents)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(filePath)))
+	w.Write(contents)
+}
+
+// RestoreSingleFile reads the shares of one version of a file from the
+// stores that can download single objects and combines them, without
+// restoring anything else. The contents are checked against the hash when
+// fileShare has one
+func RestoreSingleFile(fileShare FileShare) ([]byte, error) {
+	object := fileShare.ObjectName()
+	sid, version, _ := ParseObjectName(object)
+
+	var shares []Share
+	for i, cs := range preferences.cloudStores() {
+		reader, ok := storeRef(i + 1).(objectReader)
+		if !ok {
+			continue
+		}
+		data, err := reader.Read(object)
+		if err != nil {
+			// split objects are only joined by a full restore
+			continue
+		}
+		if err := checkShare(fileShare, data); err != nil {
+			color.Red("(Skipping share) %s from %s is corrupt: %s", object, cs.ShortDescription(), err)
+			wipe(data)
+			continue
+		}
+		shares = append(shares, Share{SID: sid, Data: data, Version: version})
+		trace(TraceEvent{Op: "read", Store: i + 1, Object: object, Size: len(data)})
+	}
+	if len(shares) == 0 {
+		return nil, errors.New("no store could read the file's shares")
+	}
+
+	contents := CombineShares(shares)
+	for _, share := range shares {
+		wipe(share.Data)
+	}
+	// without a hash, failing to combine is all we can detect. The hash of
+	// protected files is of their contents once opened
+	ok := len(contents) > 0
+	if fileShare.Hash != "" && fileShare.Protection == "" {
+		ok = checkSHA2(fileShare.Hash, contents)
+	}
+	if !ok {
+		wipe(contents)
+		return nil, errors.New("not enough shares to restore the file")
+	}
+	return contents, nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// DBStore keeps shares as rows of a table in a PostgreSQL or SQLite
+// database, one BLOB per object, so a database a team already runs and
+// backs up can hold one of the shares. The table is created if missing.
+// Both databases cap values at about a gigabyte and hand them over whole,
+// so larger shares are split into parts
+type DBStore struct {
+	// postgres or sqlite
+	Driver string `json:"driver"`
+
+	// postgres://user@host/db?sslmode=require, or the file of a SQLite
+	// database
+	DSN string `json:"dsn"`
+
+	// password of the DSN, kept out of it and in the local state, see
+	// credentials.go
+	Password string `json:"-"`
+
+	Table string `json:"table"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (d *DBStore) credentials() map[string]*string {
+	return map[string]*string{"password": &d.Password}
+}
+
+const (
+	defaultDBTable = "chasm_shares"
+
+	dbMaxObjectSize = 512 << 20
+)
+
+var (
+	dbTableName     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	dbPasswordParam = regexp.MustCompile(`password=\S+`)
+	dbPlaceholder   = regexp.MustCompile(`\$\d+`)
+)
+
+// connections by store, kept for the run
+var (
+	dbConnsLock sync.Mutex
+	dbConns     = make(map[string]*sql.DB)
+)
+
+// Setup connects to the database and creates the table if missing
+func (d DBStore) Setup() bool {
+	for _, ds := range preferences.DBStores {
+		if ds.Driver == d.Driver && ds.DSN == d.DSN && ds.Table == d.Table {
+			color.Red("DB store at %s already exists.", d.location())
+			return false
+		}
+	}
+	if d.Driver != "postgres" && d.Driver != "sqlite" {
+		color.Red("Error: the database must be postgres or sqlite, not %q.", d.Driver)
+		return false
+	}
+	if !dbTableName.MatchString(d.Table) {
+		color.Red("Error: invalid table name %q.", d.Table)
+		return false
+	}
+
+	blob := "BLOB"
+	if d.Driver == "postgres" {
+		blob = "BYTEA"
+	}
+	err := d.exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (object TEXT PRIMARY KEY, data %s NOT NULL)", d.Table, blob))
+	if err != nil {
+		color.Red("Error: cannot set up %s: %s", d.location(), err)
+		return false
+	}
+	return true
+}
+
+// location is the database and table, without any password
+func (d DBStore) location() string {
+	dsn := d.DSN
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		dsn = u.Redacted()
+	}
+	dsn = dbPasswordParam.ReplaceAllString(dsn, "password=xxxxx")
+	return d.Driver + ":" + dsn + "#" + d.Table
+}
+
+// splitDSNPassword takes the password out of a DSN, a URL or key=value
+// pairs
+func splitDSNPassword(dsn string) (string, string) {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		password, ok := u.User.Password()
+		if !ok {
+			return dsn, ""
+		}
+		u.User = url.User(u.User.Username())
+		return u.String(), password
+	}
+	param := dbPasswordParam.FindString(dsn)
+	if param == "" {
+		return dsn, ""
+	}
+	return strings.Join(strings.Fields(strings.Replace(dsn, param, "", 1)), " "), strings.TrimPrefix(param, "password=")
+}
+
+// dsn is the DSN to connect with, its password put back
+func (d DBStore) dsn() string {
+	if d.Password == "" {
+		return d.DSN
+	}
+	if u, err := url.Parse(d.DSN); err == nil && u.User != nil {
+		u.User = url.UserPassword(u.User.Username(), d.Password)
+		return u.String()
+	}
+	return d.DSN + " password=" + d.Password
+}
+
+// db is the run's connection pool for the database
+func (d DBStore) db() (*sql.DB, error) {
+	dbConnsLock.Lock()
+	defer dbConnsLock.Unlock()
+	id := d.Driver + "\n" + d.dsn()
+	if db, ok := dbConns[id]; ok {
+		return db, nil
+	}
+	db, err := sql.Open(d.Driver, d.dsn())
+	if err != nil {
+		return nil, err
+	}
+	dbConns[id] = db
+	return db, nil
+}
+
+// query writes the statement with the driver's placeholders, $1 for
+// PostgreSQL and ? for SQLite
+func (d DBStore) query(format string) string {
+	statement := fmt.Sprintf(format, d.Table)
+	if d.Driver == "sqlite" {
+		statement = dbPlaceholder.ReplaceAllString(statement, "?")
+	}
+	return statement
+}
+
+func (d DBStore) exec(statement string, args ...interface{}) error {
+	db, err := d.db()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(statement, args...)
+	return err
+}
+
+func (d DBStore) upload(object string, data []byte) error {
+	db, err := d.db()
+	if err != nil {
+		return err
+	}
+	// the row is only written if none exists
+	result, err := db.Exec(d.query("INSERT INTO %s (object, data) VALUES ($1, $2) ON CONFLICT (object) DO NOTHING"), object, data)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errors.New("object exists")
+	}
+	return nil
+}
+
+// Upload inserts the share as a new row, refusing to replace one
+func (d DBStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading %s/%s...", d.location(), share.ObjectName()))
+	if err := d.upload(share.ObjectName(), share.Data); err != nil {
+		color.Red("%s/%s upload failed: %v", d.location(), share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// Remove permanently deletes a single row
+func (d DBStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting %s/%s...", d.location(), object))
+	if err := d.exec(d.query("DELETE FROM %s WHERE object = $1"), object); err != nil {
+		color.Red("Error: could not delete %s from %s: %s", object, d.location(), err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all objects in the table
+func (d DBStore) list() ([]string, error) {
+	db, err := d.db()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(d.query("SELECT object FROM %s ORDER BY object"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var objects []string
+	for rows.Next() {
+		var object string
+		if err := rows.Scan(&object); err != nil {
+			return nil, err
+		}
+		objects = append(objects, object)
+	}
+	return objects, rows.Err()
+}
+
+// List returns the names of all objects in the table
+func (d DBStore) List() []string {
+	objects, err := d.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", d.location(), err)
+		return nil
+	}
+	return objects
+}
+
+// Read reads a single object
+func (d DBStore) Read(object string) ([]byte, error) {
+	db, err := d.db()
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	err = db.QueryRow(d.query("SELECT data FROM %s WHERE object = $1"), object).Scan(&data)
+	return data, err
+}
+
+// ReadRange reads length bytes of an object from offset, cut out by the
+// database
+func (d DBStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	db, err := d.db()
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	err = db.QueryRow(d.query("SELECT substr(data, $2, $3) FROM %s WHERE object = $1"), object, offset+1, length).Scan(&data)
+	return data, err
+}
+
+// MaxObjectSize of a row, well below the databases' limits
+func (d DBStore) MaxObjectSize() int64 {
+	return dbMaxObjectSize
+}
+
+// Restore downloads shares to local restore path
+func (d DBStore) Restore() string {
+	objects, err := d.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", d.location(), err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_db_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from %s...", d.location())
+	for _, object := range objects {
+		data, err := d.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects in the table
+func (d DBStore) Description() string {
+	objects, err := d.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", d.ShortDescription(), err)
+	}
+
+	label := d.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (d DBStore) ShortDescription() string {
+	return "DB Store: " + d.location()
+}
+
+// Clean deletes all shares from the table, leaving the table
+func (d DBStore) Clean() {
+	color.Yellow("Removing DB Store: %v", d.location())
+	if err := d.exec(d.query("DELETE FROM %s")); err != nil {
+		color.Red("Error: cannot empty %s: %s", d.location(), err)
+	}
+}
+
+// dbDSNPath is the file of a SQLite DSN, without the file: scheme and
+// parameters
+func dbDSNPath(dsn string) string {
+	dsn = strings.TrimPrefix(dsn, "file:")
+	if i := strings.Index(dsn, "?"); i >= 0 {
+		dsn = dsn[:i]
+	}
+	return dsn
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// A sync can be given a deadline, to fit a backup window or finish before a
+// laptop is closed. Once it passes, the file being uploaded is finished and
+// the remaining ones are left in the local state for the next sync. Their
+// manifest entries keep naming the previous versions, which stay stored
+// until compaction, so a stopped sync leaves them restorable as before.
+
+// exit status of a sync stopped by its deadline, EX_TEMPFAIL
+const exitPartialSync = 75
+
+// when the current sync stops uploading, zero for never
+var syncDeadline time.Time
+
+// SetSyncDeadline stops uploads after d from now, 0 for no deadline
+func SetSyncDeadline(d time.Duration) {
+	syncDeadline = time.Time{}
+	if d > 0 {
+		syncDeadline = time.Now().Add(d)
+	}
+}
+
+// deferUpload leaves filePath for the next sync once the deadline passed,
+// returning false before it
+func deferUpload(filePath string) bool {
+	if syncDeadline.IsZero() || time.Now().Before(syncDeadline) {
+		return false
+	}
+
+	if state.PendingUploads == nil {
+		state.PendingUploads = make(map[string]bool)
+	}
+	if currentRun != nil && !currentRun.Partial {
+		color.Yellow("Deadline reached. Leaving the remaining files for the next sync.")
+		currentRun.Partial = true
+	}
+	state.PendingUploads[filePath] = true
+	trace(TraceEvent{Op: "add", Path: tracePath(filePath), Detail: "deferred"})
+	return true
+}
+
+// pendingUploads returns the paths earlier syncs left that still exist
+func pendingUploads() []string {
+	var paths []string
+	for filePath := range state.PendingUploads {
+		if _, err := os.Stat(filePath); err != nil {
+			delete(state.PendingUploads, filePath)
+			continue
+		}
+		paths = append(paths, filePath)
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// logs store API calls when --debug-http is set, nil otherwise
+var debugHTTPLog *log.Logger
+
+// query parameters and headers that carry credentials, sig being the
+// signature of an Azure SAS
+var redactedNames = []string{"token", "key", "secret", "sig", "password", "code", "credential", "auth"}
+
+// path segments that carry credentials, like the bot token of Telegram
+var redactedPath = regexp.MustCompile(`/bot[0-9]+:[A-Za-z0-9_-]+`)
+
+// EnableDebugHTTP starts logging request/response metadata of every store
+// API call to logPath
+func EnableDebugHTTP(logPath string) error {
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	debugHTTPLog = log.New(logFile, "", log.LstdFlags|log.Lmicroseconds)
+	return nil
+}
+
+// storeHTTPClient is the http client store backends should use
+func storeHTTPClient() *http.Client {
+	if debugHTTPLog == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: debugTransport{base: http.DefaultTransport}}
+}
+
+// storeContext makes oauth2 use storeHTTPClient, including for token refreshes
+func storeContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, storeHTTPClient())
+}
+
+type debugTransport struct {
+	base http.RoundTripper
+}
+
+func (t debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	line := req.Method + " " + redactURL(req.URL) + " " + redactHeaders(req.Header)
+	if err != nil {
+		debugHTTPLog.Printf("%s -> error after %v: %v", line, elapsed, err)
+		return resp, err
+	}
+
+	debugHTTPLog.Printf("%s -> %s in %v %s", line, resp.Status, elapsed, redactHeaders(resp.Header))
+	return resp, err
+}
+
+func isSecret(name string) bool {
+	name = strings.ToLower(name)
+	for _, redacted := range redactedNames {
+		if strings.Contains(name, redacted) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	redacted.Path = redactedPath.ReplaceAllString(redacted.Path, "/botREDACTED")
+	redacted.RawPath = ""
+
+	query := redacted.Query()
+	for name := range query {
+		if isSecret(name) {
+			query.Set(name, "REDACTED")
+		}
+	}
+	redacted.RawQuery = query.Encode()
+
+	return redacted.String()
+}
+
+func redactHeaders(header http.Header) string {
+	fields := make([]string, 0, len(header))
+	for name, values := range header {
+		value := strings.Join(values, ",")
+		if isSecret(name) || strings.EqualFold(name, "Cookie") || strings.EqualFold(name, "Set-Cookie") {
+			value = "REDACTED"
+		}
+		fields = append(fields, name+"="+value)
+	}
+	sort.Strings(fields)
+	return "[" + strings.Join(fields, " ") + "]"
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRedactURL(t *testing.T) {
+	for _, raw := range []string{
+		"https://account.blob.core.windows.net/c/blob?sv=2021-08-06&sp=rwdl&sig=c2VjcmV0",
+		"https://api.example.com/files?access_token=c2VjcmV0",
+		"https://api.telegram.org/bot123:c2VjcmV0/getUpdates",
+	} {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if redacted := redactURL(u); strings.Contains(redacted, "c2VjcmV0") {
+			t.Errorf("%s logged as %s", raw, redacted)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Decoy traffic hides when we work from store operators. A decoy round
+// either uploads the shares of a random file sized like our real ones,
+// followed by an empty manifest delta as a real change would be, or reads
+// back one of our objects from every store. Decoy shares are not in the
+// manifest, so compaction removes them like superseded versions. Rounds run
+// at random times while watching, or from cron with `chasm decoy`.
+
+// largest decoy file, so a round never takes long
+const maxDecoySize = 16 << 20
+
+// objectReader is implemented by stores that can download a single object
+type objectReader interface {
+	Read(object string) ([]byte, error)
+}
+
+// Read downloads a single object
+func (f FolderStore) Read(object string) ([]byte, error) {
+	if !f.present() {
+		return nil, fmt.Errorf("%s is not mounted", f.volumeName())
+	}
+	return ioutil.ReadFile(path.Join(f.Path, object))
+}
+
+// Read downloads a single object
+func (g GDriveStore) Read(object string) ([]byte, error) {
+	svc, err := g.service()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := g.objectID(svc, object)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := svc.Files.Get(id).Download()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Read downloads a single object
+func (p PeerStore) Read(object string) ([]byte, error) {
+	return p.do("GET", object, nil)
+}
+
+// nextDecoyRound is a random wait for the next round, so that rounds come
+// at perDay on average without a pattern
+func nextDecoyRound(rng *rand.Rand, perDay int) time.Duration {
+	mean := float64(24*time.Hour) / float64(perDay)
+	return time.Duration(-math.Log(1-rng.Float64()) * mean)
+}
+
+// DecoyRound uploads a decoy file or reads back a random object
+func DecoyRound(rng *rand.Rand) {
+	if rng.Intn(2) == 0 {
+		decoyUpload(rng)
+	} else {
+		decoyRead(rng)
+	}
+}
+
+// decoySize picks the size of a random tracked file
+func decoySize(rng *rand.Rand) int {
+	paths := make([]string, 0, len(preferences.FileMap))
+	for filePath := range preferences.FileMap {
+		paths = append(paths, filePath)
+	}
+	size := 1 + rng.Intn(64<<10)
+	if len(paths) > 0 {
+		if fi, err := os.Stat(paths[rng.Intn(len(paths))]); err == nil {
+			size = int(fi.Size())
+		}
+	}
+	if size > maxDecoySize {
+		size = maxDecoySize
+	}
+	return size
+}
+
+func decoyUpload(rng *rand.Rand) {
+	data := make([]byte, decoySize(rng))
+	rng.Read(data)
+
+	sid := RandomShareID()
+	version := NewShareVersion()
+	color.Magenta("Uploading decoy shares")
+	uploadShares(sid, version, data)
+	trace(TraceEvent{Op: "decoy", Object: ObjectName(sid, version, false), Size: len(data)})
+
+	// real changes are followed by a manifest delta, this one changes nothing
+	deltaBytes, err := json.Marshal(ManifestDelta{Base: manifestVersion(), Files: map[string]*FileShare{}, Dirs: map[string]bool{}})
+	check(err)
+	uploadShares(ShareID(chasmDeltaSID), NewShareVersion(), deltaBytes)
+}
+
+func decoyRead(rng *rand.Rand) {
+	for i, cs := range preferences.cloudStores() {
+		reader, ok := storeRef(i + 1).(objectReader)
+		if !ok {
+			continue
+		}
+		objects := cs.List()
+		if len(objects) == 0 {
+			continue
+		}
+
+		object := objects[rng.Intn(len(objects))]
+		data, err := reader.Read(object)
+		if err != nil {
+			color.Red("Error reading decoy object %s from %s: %s", object, cs.ShortDescription(), err)
+			countError()
+			continue
+		}
+		wipe(data)
+		trace(TraceEvent{Op: "decoy", Store: i + 1, Object: object, Size: len(data)})
+	}
+}
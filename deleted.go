@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// With a deleted-file retention, files deleted locally are moved to the
+// manifest's deleted list instead of being dropped. Their shares stay live
+// for compaction until the retention from the time of deletion has passed,
+// so `chasm undelete` can bring them back, and compaction then purges them.
+// Without it, deleted shares only last the ordinary retention counted from
+// their upload, which for an old file may already be over.
+
+// DeletedFile is a file deleted locally whose shares are still kept
+type DeletedFile struct {
+	FileShare
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// retainDeleted moves a deleted file to the deleted list, if deleted files
+// are retained
+func retainDeleted(filePath string, fileShare FileShare) {
+	if deletedRetentionFor(filePath) <= 0 || fileShare.SID == ShareID(chasmPrefFile) {
+		return
+	}
+	if preferences.Deleted == nil {
+		preferences.Deleted = make(map[string]*DeletedFile)
+	}
+	deleted := &DeletedFile{FileShare: fileShare, DeletedAt: time.Now().UTC()}
+	preferences.Deleted[filePath] = deleted
+	recordDeletedChange(filePath, deleted)
+}
+
+func recordDeletedChange(filePath string, deleted *DeletedFile) {
+	if pendingDelta.Deleted == nil {
+		pendingDelta.Deleted = make(map[string]*DeletedFile)
+	}
+	pendingDelta.Deleted[filePath] = deleted
+	flushDeltaIfFull()
+}
+
+// deletedExpired checks if the retention of a deleted file has passed
+func deletedExpired(filePath string, deleted *DeletedFile, now time.Time) bool {
+	return now.Sub(deleted.DeletedAt) > time.Duration(deletedRetentionFor(filePath))*24*time.Hour
+}
+
+// purgeDeleted drops the deleted files whose retention has passed, so that
+// compaction removes their shares. Returns the number dropped
+func purgeDeleted() int {
+	now := time.Now()
+	purged := 0
+	for filePath, deleted := range preferences.Deleted {
+		if deletedExpired(filePath, deleted, now) {
+			delete(preferences.Deleted, filePath)
+			recordDeletedChange(filePath, nil)
+			purged++
+		}
+	}
+	if purged > 0 {
+		preferences.Save()
+		UploadManifestDelta()
+	}
+	return purged
+}
+
+// DeletedPaths lists the deleted files still retained, by path
+func DeletedPaths() []string {
+	paths := make([]string, 0, len(preferences.Deleted))
+	for filePath := range preferences.Deleted {
+		paths = append(paths, filePath)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Undelete restores a retained deleted file to its path from the stores and
+// tracks it again under its old share id
+func Undelete(filePath string, force bool) error {
+	deleted, ok := preferences.Deleted[filePath]
+	if !ok {
+		return fmt.Errorf("%s is not a retained deleted file", filePath)
+	}
+	if _, err := os.Stat(filePath); err == nil && !force {
+		return fmt.Errorf("%s exists, use --force to overwrite it", filePath)
+	}
+	if _, tracked := preferences.FileMap[filePath]; tracked && !force {
+		return fmt.Errorf("%s is tracked again, use --force to replace it", filePath)
+	}
+	fileShare := deleted.FileShare
+	if skipLocked(fileShare) {
+		return fmt.Errorf("%s is protected, undelete it with --unlock", filePath)
+	}
+
+	contents, err := RestoreSingleFile(fileShare)
+	if err != nil {
+		return err
+	}
+	contents, ok = unprotect(filePath, fileShare, contents)
+	if !ok {
+		return fmt.Errorf("cannot open protected %s", filePath)
+	}
+	defer wipe(contents)
+
+	if err := os.MkdirAll(path.Dir(filePath), 0770); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filePath, contents, 0660); err != nil {
+		return err
+	}
+	countFile(int64(len(contents)), false)
+
+	delete(preferences.Deleted, filePath)
+	recordDeletedChange(filePath, nil)
+	preferences.FileMap[filePath] = fileShare
+	recordFileChange(filePath, &fileShare)
+	preferences.Save()
+	if fi, err := os.Stat(filePath); err == nil {
+		rememberFileID(filePath, fi)
+	}
+	trace(TraceEvent{Op: "add", Path: tracePath(filePath), Object: fileShare.ObjectName(), Size: len(contents), Detail: "undeleted"})
+	return nil
+}
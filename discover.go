@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Discovery finds candidates for folder stores during setup: network and
+// removable volumes mounted on this machine, and file servers announcing
+// themselves on the LAN over mDNS or WS-Discovery, which need mounting first.
+
+// StoreCandidate is a place a folder store could live
+type StoreCandidate struct {
+	Kind string // mounted, smb, nfs, afp or wsd
+	Name string
+	Host string
+
+	// mount point, empty for servers that are not mounted yet
+	Path string
+
+	// file size limit of the volume's file system, 0 for none
+	MaxFileSize int64
+}
+
+// how long to wait for LAN announcements
+const discoverTimeout = 2 * time.Second
+
+// mDNS service types of file servers
+var mdnsServices = map[string]string{
+	"_smb._tcp.local":        "smb",
+	"_nfs._tcp.local":        "nfs",
+	"_afpovertcp._tcp.local": "afp",
+}
+
+// DiscoverStores lists mounted volumes first, then file servers on the LAN
+func DiscoverStores() []StoreCandidate {
+	candidates := mountedVolumes()
+
+	found := make(chan []StoreCandidate)
+	go func() { found <- discoverMDNS() }()
+	go func() { found <- discoverWSD() }()
+
+	var lan []StoreCandidate
+	for i := 0; i < 2; i++ {
+		lan = append(lan, <-found...)
+	}
+	sort.Slice(lan, func(i, j int) bool { return lan[i].Host+lan[i].Kind < lan[j].Host+lan[j].Kind })
+	return append(candidates, lan...)
+}
+
+/// mDNS ///
+
+func discoverMDNS() []StoreCandidate {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	group := &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	for service := range mdnsServices {
+		conn.WriteToUDP(mdnsQuery(service), group)
+	}
+
+	seen := make(map[string]bool)
+	var candidates []StoreCandidate
+	conn.SetReadDeadline(time.Now().Add(discoverTimeout))
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return candidates
+		}
+		for _, instance := range mdnsInstances(buf[:n]) {
+			service := instance[strings.Index(instance, ".")+1:]
+			key := from.IP.String() + instance
+			if kind, ok := mdnsServices[service]; ok && !seen[key] {
+				seen[key] = true
+				name := instance[:len(instance)-len(service)-1]
+				candidates = append(candidates, StoreCandidate{Kind: kind, Name: name, Host: from.IP.String()})
+			}
+		}
+	}
+}
+
+// mdnsQuery builds a PTR question asking for unicast responses
+func mdnsQuery(service string) []byte {
+	msg := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(service, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0, 0, 12, 0x80, 1)
+}
+
+// mdnsInstances returns the PTR targets of the answer and additional
+// records of a response, ignoring anything malformed
+func mdnsInstances(msg []byte) []string {
+	if len(msg) < 12 {
+		return nil
+	}
+	u16 := func(i int) int { return int(msg[i])<<8 | int(msg[i+1]) }
+	questions := u16(4)
+	records := u16(6) + u16(8) + u16(10)
+
+	off := 12
+	for i := 0; i < questions; i++ {
+		var ok bool
+		if _, off, ok = dnsName(msg, off); !ok || off+4 > len(msg) {
+			return nil
+		}
+		off += 4
+	}
+
+	var instances []string
+	for i := 0; i < records; i++ {
+		var ok bool
+		if _, off, ok = dnsName(msg, off); !ok || off+10 > len(msg) {
+			return instances
+		}
+		rtype := u16(off)
+		length := u16(off + 8)
+		off += 10
+		if off+length > len(msg) {
+			return instances
+		}
+		if rtype == 12 {
+			if target, _, ok := dnsName(msg, off); ok {
+				instances = append(instances, target)
+			}
+		}
+		off += length
+	}
+	return instances
+}
+
+// dnsName decodes a possibly compressed name at off, returning the offset
+// after it
+func dnsName(msg []byte, off int) (string, int, bool) {
+	var labels []string
+	end := -1
+	for jumps := 0; jumps < 16; {
+		if off >= len(msg) {
+			return "", 0, false
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, true
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, false
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = (length&0x3f)<<8 | int(msg[off+1])
+			jumps++
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, false
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+	return "", 0, false
+}
+
+/// WS-Discovery ///
+
+const wsdProbe = `<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:wsd="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:wsdp="http://schemas.xmlsoap.org/ws/2006/02/devprof">
+<soap:Header><wsa:To>urn:schemas-xmlsoap-org:ws:2005:04:discovery</wsa:To><wsa:Action>http://schemas.xmlsoap.org/ws/2005/04/discovery/Probe</wsa:Action><wsa:MessageID>urn:uuid:%s</wsa:MessageID></soap:Header>
+<soap:Body><wsd:Probe><wsd:Types>wsdp:Device</wsd:Types></wsd:Probe></soap:Body>
+</soap:Envelope>`
+
+var wsdXAddrs = regexp.MustCompile(`<[^>]*XAddrs>([^<]*)<`)
+
+// discoverWSD finds Windows hosts and NAS devices, which announce themselves
+// with WS-Discovery rather than mDNS
+func discoverWSD() []StoreCandidate {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	uuid := make([]byte, 16)
+	rand.Read(uuid)
+	probe := fmt.Sprintf(wsdProbe, fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]))
+	conn.WriteToUDP([]byte(probe), &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 3702})
+
+	seen := make(map[string]bool)
+	var candidates []StoreCandidate
+	conn.SetReadDeadline(time.Now().Add(discoverTimeout))
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return candidates
+		}
+
+		host := from.IP.String()
+		if seen[host] || !strings.Contains(string(buf[:n]), "ProbeMatch") {
+			continue
+		}
+		seen[host] = true
+
+		name := ""
+		if m := wsdXAddrs.FindSubmatch(buf[:n]); m != nil {
+			name = strings.TrimSpace(string(m[1]))
+		}
+		candidates = append(candidates, StoreCandidate{Kind: "wsd", Name: name, Host: host})
+	}
+}
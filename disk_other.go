@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+
+package main
+
+import "errors"
+
+// freeSpace is unsupported on this platform
+func freeSpace(dirPath string) (uint64, error) {
+	return 0, errors.New("free space unknown on this platform")
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// freeSpace is how many bytes may still be written to the file system
+// holding dirPath, without the blocks reserved for root
+func freeSpace(dirPath string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dirPath, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// freeSpace is how many bytes the user may still write to the volume
+// holding dirPath, within any quota
+func freeSpace(dirPath string) (uint64, error) {
+	name, err := windows.UTF16PtrFromString(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &available, &total, &free); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/toqueteos/webbrowser"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// DropboxStore keeps shares in the app folder of a Dropbox account, through
+// the HTTP API. The app is registered by the user with "App folder" access,
+// so chasm never sees the rest of the account
+type DropboxStore struct {
+	// the app secret and tokens are left out of the JSON, see MarshalJSON
+	Config     oauth2.Config `json:"oauth_config"`
+	OAuthToken oauth2.Token  `json:"oauth_token"`
+	AccountID  string        `json:"account_id"`
+	Email      string        `json:"email"`
+}
+
+// credentials are kept in the local state, see credentials.go. Without the
+// access token every run refreshes it once
+func (d *DropboxStore) credentials() map[string]*string {
+	return map[string]*string{
+		"app_secret":    &d.Config.ClientSecret,
+		"refresh_token": &d.OAuthToken.RefreshToken,
+	}
+}
+
+// MarshalJSON leaves the app secret and tokens out of the preferences
+func (d DropboxStore) MarshalJSON() ([]byte, error) {
+	type dropboxStore DropboxStore
+	plain := dropboxStore(d)
+	plain.Config.ClientSecret = ""
+	plain.OAuthToken.AccessToken = ""
+	plain.OAuthToken.RefreshToken = ""
+	return json.Marshal(plain)
+}
+
+const (
+	dropboxAPI     = "https://api.dropboxapi.com/2/"
+	dropboxContent = "https://content.dropboxapi.com/2/"
+
+	// largest single upload the API takes
+	dropboxMaxObjectSize = 150 << 20
+)
+
+var dropboxEndpoint = oauth2.Endpoint{
+	AuthURL:  "https://www.dropbox.com/oauth2/authorize",
+	TokenURL: "https://api.dropboxapi.com/oauth2/token",
+}
+
+type dropboxAccount struct {
+	AccountID string `json:"account_id"`
+	Email     string `json:"email"`
+	Name      struct {
+		DisplayName string `json:"display_name"`
+	} `json:"name"`
+}
+
+type dropboxEntry struct {
+	Tag  string `json:".tag"`
+	Name string `json:"name"`
+}
+
+type dropboxListing struct {
+	Entries []dropboxEntry `json:"entries"`
+	Cursor  string         `json:"cursor"`
+	HasMore bool           `json:"has_more"`
+}
+
+// Setup Dropbox with the key and secret of the user's app
+func (d *DropboxStore) Setup(appKey, appSecret string) bool {
+	d.Config = oauth2.Config{ClientID: appKey, ClientSecret: appSecret, Endpoint: dropboxEndpoint}
+
+	// without a redirect URL Dropbox shows the code to paste
+	authURL := d.Config.AuthCodeURL("state-token", oauth2.SetAuthURLParam("token_access_type", "offline"))
+	webbrowser.Open(authURL)
+	fmt.Println(authURL)
+	color.Yellow("Enter Auth Code: ")
+
+	var code string
+	if _, err := fmt.Scan(&code); err != nil {
+		color.Red("Unable to read authorization code %v", err)
+		return false
+	}
+	tok, err := d.Config.Exchange(storeContext(context.Background()), code)
+	if err != nil {
+		color.Red("Unable to retrieve token from web %v", err)
+		return false
+	}
+	d.OAuthToken = *tok
+
+	var account dropboxAccount
+	if err := d.call("users/get_current_account", nil, &account); err != nil {
+		color.Red("Unable to retrieve Dropbox account %v", err)
+		return false
+	}
+	for _, ds := range preferences.DropboxStores {
+		if ds.AccountID == account.AccountID {
+			color.Red("Dropbox account %v (%v) already exists.", account.Name.DisplayName, account.Email)
+			return false
+		}
+	}
+
+	d.AccountID = account.AccountID
+	d.Email = account.Email
+	return true
+}
+
+func (d DropboxStore) client() *http.Client {
+	ctx := storeContext(context.Background())
+	return oauth2.NewClient(ctx, d.Config.TokenSource(ctx, &d.OAuthToken))
+}
+
+// call posts an RPC request with a JSON argument, decoding the result into
+// out unless it is nil
+func (d DropboxStore) call(endpoint string, arg interface{}, out interface{}) error {
+	var body []byte
+	if arg != nil {
+		var err error
+		if body, err = json.Marshal(arg); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest("POST", dropboxAPI+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if arg != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	data, err := d.do(req)
+	if err != nil || out == nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// content posts a content request, with its argument in the Dropbox-API-Arg
+// header
+func (d DropboxStore) content(endpoint string, arg interface{}, body []byte, header http.Header) ([]byte, error) {
+	argJSON, err := json.Marshal(arg)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", dropboxContent+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Dropbox-API-Arg", string(argJSON))
+	// downloads must not declare a body type
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	return d.do(req)
+}
+
+func (d DropboxStore) do(req *http.Request) ([]byte, error) {
+	resp, err := d.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// dropboxPath is where an object is kept in the app folder
+func dropboxPath(object string) string {
+	return "/" + object
+}
+
+// Upload adds the share as a new file, never overwriting one
+func (d DropboxStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading Dropbox/%s...", share.ObjectName()))
+
+	arg := map[string]interface{}{"path": dropboxPath(share.ObjectName()), "mode": "add", "autorename": false, "mute": true}
+	if _, err := d.content("files/upload", arg, share.Data, nil); err != nil {
+		color.Red("Dropbox/%s upload failed: %v", share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// Remove permanently deletes a single object
+func (d DropboxStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting Dropbox/%s...", object))
+	if err := d.call("files/delete_v2", map[string]string{"path": dropboxPath(object)}, nil); err != nil {
+		color.Red("Error: could not delete %s from Dropbox: %s", object, err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all files in the app folder
+func (d DropboxStore) list() ([]string, error) {
+	var listing dropboxListing
+	if err := d.call("files/list_folder", map[string]string{"path": ""}, &listing); err != nil {
+		return nil, err
+	}
+
+	var objects []string
+	for {
+		for _, entry := range listing.Entries {
+			if entry.Tag == "file" {
+				objects = append(objects, entry.Name)
+			}
+		}
+		if !listing.HasMore {
+			return objects, nil
+		}
+		cursor := listing.Cursor
+		listing = dropboxListing{}
+		if err := d.call("files/list_folder/continue", map[string]string{"cursor": cursor}, &listing); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// List returns the names of all objects in the app folder
+func (d DropboxStore) List() []string {
+	objects, err := d.list()
+	if err != nil {
+		color.Red("Error listing Dropbox: %s", err)
+		return nil
+	}
+	return objects
+}
+
+// Read downloads a single object
+func (d DropboxStore) Read(object string) ([]byte, error) {
+	return d.content("files/download", map[string]string{"path": dropboxPath(object)}, nil, nil)
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (d DropboxStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	return d.content("files/download", map[string]string{"path": dropboxPath(object)}, nil, header)
+}
+
+// Restore downloads shares to local restore path
+func (d DropboxStore) Restore() string {
+	objects, err := d.list()
+	if err != nil {
+		color.Red("Error listing Dropbox: %s", err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_dropbox_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from Dropbox...")
+	for _, object := range objects {
+		data, err := d.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects in the app folder
+func (d DropboxStore) Description() string {
+	objects, err := d.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", d.ShortDescription(), err)
+	}
+
+	label := d.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (d DropboxStore) ShortDescription() string {
+	return "Dropbox Store: " + d.Email
+}
+
+// Clean deletes all shares from the app folder
+func (d DropboxStore) Clean() {
+	for _, object := range d.List() {
+		color.Yellow("Removing Dropbox: %v", object)
+		d.call("files/delete_v2", map[string]string{"path": dropboxPath(object)}, nil)
+	}
+}
+
+// MaxObjectSize of a single Dropbox upload
+func (d DropboxStore) MaxObjectSize() int64 {
+	return dropboxMaxObjectSize
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+
+package main
+
+// disableEcho is unsupported on this platform
+func disableEcho(fd uintptr) (func(), bool) {
+	return nil, false
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// disableEcho stops the terminal at fd from echoing typed input, returning
+// a func that turns it back on
+func disableEcho(fd uintptr) (func(), bool) {
+	termios, err := unix.IoctlGetTermios(int(fd), ioctlGetTermios)
+	if err != nil {
+		return nil, false
+	}
+	saved := *termios
+	termios.Lflag &^= unix.ECHO
+	if err := unix.IoctlSetTermios(int(fd), ioctlSetTermios, termios); err != nil {
+		return nil, false
+	}
+	return func() { unix.IoctlSetTermios(int(fd), ioctlSetTermios, &saved) }, true
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// disableEcho stops the console at fd from echoing typed input, returning
+// a func that turns it back on
+func disableEcho(fd uintptr) (func(), bool) {
+	var mode uint32
+	if err := windows.GetConsoleMode(windows.Handle(fd), &mode); err != nil {
+		return nil, false
+	}
+	if err := windows.SetConsoleMode(windows.Handle(fd), mode&^windows.ENABLE_ECHO_INPUT); err != nil {
+		return nil, false
+	}
+	return func() { windows.SetConsoleMode(windows.Handle(fd), mode) }, true
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/fatih/color"
+)
+
+// EmailStore keeps each share as the attachment of a mail in a folder of a
+// mailbox. Shares are mailed to the mailbox over SMTP, filed from the inbox
+// into the folder, and read back and deleted over IMAP. Most accounts come
+// with a mailbox that keeps mail for years, but servers cap the size of a
+// mail, so larger shares are split into parts. Providers that keep a copy
+// of sent mail keep one of every share too, which Remove does not delete
+type EmailStore struct {
+	// address shares are mailed from and to
+	Address  string `json:"address"`
+	User     string `json:"user"`
+	Password string `json:"-"`
+
+	// host:port of the servers, with TLS from the start on ports 465 and
+	// 993 and STARTTLS on others
+	SMTPHost string `json:"smtp_host"`
+	IMAPHost string `json:"imap_host"`
+
+	Folder string `json:"folder"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (e *EmailStore) credentials() map[string]*string {
+	return map[string]*string{"password": &e.Password}
+}
+
+const (
+	defaultEmailFolder = "Chasm"
+	emailInbox         = "INBOX"
+
+	// subject of share mails, followed by the object name
+	emailSubjectPrefix = "chasm share "
+
+	// 10 MB grows to under 14 MB in base64, below the limit of common
+	// providers
+	emailMaxObjectSize = 10 << 20
+
+	// how long a mailed share may take to reach the inbox
+	emailDeliveryTimeout = 2 * time.Minute
+	emailDeliveryPoll    = 5 * time.Second
+)
+
+// IMAP connections by store, kept for the run and dropped on error
+var (
+	emailConnsLock sync.Mutex
+	emailConns     = make(map[string]*client.Client)
+)
+
+// Setup signs in to the IMAP server and creates the folder
+func (e EmailStore) Setup() bool {
+	for _, es := range preferences.EmailStores {
+		if es.IMAPHost == e.IMAPHost && es.User == e.User {
+			color.Red("Email store at %s already exists.", e.location())
+			return false
+		}
+	}
+
+	err := e.with(func(c *client.Client) error {
+		if e.Folder != emailInbox {
+			// fails if the folder exists, selecting it tells
+			c.Create(e.Folder)
+		}
+		_, err := c.Select(e.Folder, true)
+		return err
+	})
+	if err != nil {
+		color.Red("Error: cannot set up %s: %s", e.location(), err)
+		return false
+	}
+	return true
+}
+
+func (e EmailStore) location() string {
+	return "imap://" + e.User + "@" + e.IMAPHost + "/" + e.Folder
+}
+
+// emailTLSConfig is the TLS configuration for a mail server at hostPort,
+// and whether it speaks TLS from the start
+func emailTLSConfig(hostPort string) (*tls.Config, bool, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, false, err
+	}
+	return &tls.Config{ServerName: host}, port == "465" || port == "993", nil
+}
+
+// conn is the run's IMAP connection, opened if needed. Callers hold
+// emailConnsLock
+func (e EmailStore) conn() (*client.Client, error) {
+	if c, ok := emailConns[e.location()]; ok {
+		return c, nil
+	}
+
+	config, implicit, err := emailTLSConfig(e.IMAPHost)
+	if err != nil {
+		return nil, err
+	}
+	var c *client.Client
+	if implicit {
+		c, err = client.DialTLS(e.IMAPHost, config)
+	} else {
+		c, err = client.Dial(e.IMAPHost)
+		if err == nil {
+			err = e.startTLS(c, config)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Timeout = 30 * time.Second
+	if err := c.Login(e.User, e.Password); err != nil {
+		c.Logout()
+		return nil, err
+	}
+	emailConns[e.location()] = c
+	return c, nil
+}
+
+// startTLS upgrades a plain connection, refusing to sign in without TLS
+func (e EmailStore) startTLS(c *client.Client, config *tls.Config) error {
+	ok, err := c.SupportStartTLS()
+	if err == nil && !ok {
+		err = errors.New("the server does not offer STARTTLS")
+	}
+	if err == nil {
+		err = c.StartTLS(config)
+	}
+	if err != nil {
+		c.Logout()
+	}
+	return err
+}
+
+// with runs op with the IMAP connection, dropping it if op fails so the
+// next operation connects again
+func (e EmailStore) with(op func(c *client.Client) error) error {
+	emailConnsLock.Lock()
+	defer emailConnsLock.Unlock()
+	c, err := e.conn()
+	if err != nil {
+		return err
+	}
+	if err := op(c); err != nil {
+		c.Logout()
+		delete(emailConns, e.location())
+		return err
+	}
+	return nil
+}
+
+// shareMails finds the share mails of the selected mailbox, by object name
+func shareMails(c *client.Client) (map[string]uint32, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Subject", emailSubjectPrefix)
+	uids, err := c.UidSearch(criteria)
+	if err != nil || len(uids) == 0 {
+		return nil, err
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	messages := make(chan *imap.Message, len(uids))
+	if err := c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}, messages); err != nil {
+		return nil, err
+	}
+
+	// the search matches the prefix anywhere in the subject
+	mails := make(map[string]uint32)
+	for msg := range messages {
+		if msg.Envelope != nil && strings.HasPrefix(msg.Envelope.Subject, emailSubjectPrefix) {
+			mails[strings.TrimPrefix(msg.Envelope.Subject, emailSubjectPrefix)] = msg.Uid
+		}
+	}
+	return mails, nil
+}
+
+// folderMails files the share mails delivered to the inbox into the folder,
+// then finds the share mails of the folder, selected for writing if
+// writable
+func (e EmailStore) folderMails(c *client.Client, writable bool) (map[string]uint32, error) {
+	if e.Folder != emailInbox {
+		if _, err := c.Select(emailInbox, false); err != nil {
+			return nil, err
+		}
+		delivered, err := shareMails(c)
+		if err != nil {
+			return nil, err
+		}
+		if len(delivered) > 0 {
+			seqset := new(imap.SeqSet)
+			for _, uid := range delivered {
+				seqset.AddNum(uid)
+			}
+			if err := c.UidMove(seqset, e.Folder); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if _, err := c.Select(e.Folder, !writable); err != nil {
+		return nil, err
+	}
+	return shareMails(c)
+}
+
+// message is the mail carrying data as an attachment named object
+func (e EmailStore) message(object string, data []byte) ([]byte, error) {
+	var msg bytes.Buffer
+	body := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", e.Address, e.Address, emailSubjectPrefix+object, time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n", body.Boundary())
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Transfer-Encoding", "base64")
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": object}))
+	part, err := body.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+
+	// mail lines are limited to 998 characters
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		fmt.Fprintf(part, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(part, "%s\r\n", encoded)
+
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// send mails msg to the store's address over SMTP
+func (e EmailStore) send(msg []byte) error {
+	config, implicit, err := emailTLSConfig(e.SMTPHost)
+	if err != nil {
+		return err
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	if implicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", e.SMTPHost, config)
+	} else {
+		conn, err = dialer.Dial("tcp", e.SMTPHost)
+	}
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, config.ServerName)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if !implicit {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("the SMTP server does not offer STARTTLS")
+		}
+		if err := c.StartTLS(config); err != nil {
+			return err
+		}
+	}
+	if err := c.Auth(smtp.PlainAuth("", e.User, e.Password, config.ServerName)); err != nil {
+		return err
+	}
+	if err := c.Mail(e.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(e.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// upload mails the share and waits for it to reach the folder, so a share
+// counts as uploaded only once it can be read back
+func (e EmailStore) upload(object string, data []byte) error {
+	objects, err := e.list()
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if o == object {
+			return errors.New("object exists")
+		}
+	}
+
+	msg, err := e.message(object, data)
+	if err != nil {
+		return err
+	}
+	if err := e.send(msg); err != nil {
+		return err
+	}
+
+	for deadline := time.Now().Add(emailDeliveryTimeout); time.Now().Before(deadline); {
+		time.Sleep(emailDeliveryPoll)
+		objects, err := e.list()
+		if err != nil {
+			return err
+		}
+		for _, o := range objects {
+			if o == object {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("mailed, but not delivered within %v", emailDeliveryTimeout)
+}
+
+// Upload mails the share as a new attachment, refusing to replace one
+func (e EmailStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading %s/%s...", e.location(), share.ObjectName()))
+	if err := e.upload(share.ObjectName(), share.Data); err != nil {
+		color.Red("%s/%s upload failed: %v", e.location(), share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// Remove permanently deletes the mail of a single object
+func (e EmailStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting %s/%s...", e.location(), object))
+	if err := e.remove(object); err != nil {
+		color.Red("Error: could not delete %s from %s: %s", object, e.location(), err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// remove flags the mail of object deleted and expunges the folder
+func (e EmailStore) remove(object string) error {
+	return e.with(func(c *client.Client) error {
+		mails, err := e.folderMails(c, true)
+		if err != nil {
+			return err
+		}
+		uid, ok := mails[object]
+		if !ok {
+			return nil
+		}
+		seqset := new(imap.SeqSet)
+		seqset.AddNum(uid)
+		if err := c.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); err != nil {
+			return err
+		}
+		return c.Expunge(nil)
+	})
+}
+
+// list returns the names of all objects mailed to the folder
+func (e EmailStore) list() ([]string, error) {
+	var objects []string
+	err := e.with(func(c *client.Client) error {
+		mails, err := e.folderMails(c, false)
+		for object := range mails {
+			objects = append(objects, object)
+		}
+		return err
+	})
+	return objects, err
+}
+
+// List returns the names of all objects mailed to the folder
+func (e EmailStore) List() []string {
+	objects, err := e.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", e.location(), err)
+		return nil
+	}
+	return objects
+}
+
+// Read downloads the mail of a single object and decodes its attachment
+func (e EmailStore) Read(object string) ([]byte, error) {
+	var raw []byte
+	err := e.with(func(c *client.Client) error {
+		mails, err := e.folderMails(c, false)
+		if err != nil {
+			return err
+		}
+		uid, ok := mails[object]
+		if !ok {
+			return fmt.Errorf("no mail of %s", object)
+		}
+
+		seqset := new(imap.SeqSet)
+		seqset.AddNum(uid)
+		section := &imap.BodySectionName{Peek: true}
+		messages := make(chan *imap.Message, 1)
+		if err := c.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, messages); err != nil {
+			return err
+		}
+		for msg := range messages {
+			if body := msg.GetBody(section); body != nil {
+				raw, err = ioutil.ReadAll(body)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attachment(raw, object)
+}
+
+// attachment decodes the attachment named object of a raw mail
+func attachment(raw []byte, object string) ([]byte, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no attachment %s in its mail", object)
+		} else if err != nil {
+			return nil, err
+		}
+		if part.FileName() == object {
+			return ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+		}
+	}
+}
+
+// ReadRange downloads length bytes of an object from offset. IMAP can only
+// fetch ranges of the encoded mail, so the whole object is read
+func (e EmailStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	data, err := e.Read(object)
+	if err != nil {
+		return nil, err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if end := offset + length; end < int64(len(data)) {
+		data = data[:end]
+	}
+	return data[offset:], nil
+}
+
+// MaxObjectSize of a single attachment
+func (e EmailStore) MaxObjectSize() int64 {
+	return emailMaxObjectSize
+}
+
+// Restore downloads shares to local restore path
+func (e EmailStore) Restore() string {
+	objects, err := e.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", e.location(), err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_email_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from %s...", e.location())
+	for _, object := range objects {
+		data, err := e.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects mailed to the folder
+func (e EmailStore) Description() string {
+	objects, err := e.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", e.ShortDescription(), err)
+	}
+
+	label := e.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (e EmailStore) ShortDescription() string {
+	return "Email Store: " + e.location()
+}
+
+// Clean deletes the mails of all shares from the folder
+func (e EmailStore) Clean() {
+	for _, object := range e.List() {
+		color.Yellow("Removing Email Store: %v", object)
+		e.remove(object)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ExcludeSet is a built-in group of name patterns for regenerable junk. A
+// pattern of one name matches the file or directory name, one of several
+// names, like Library/Caches, matches consecutive directories anywhere in
+// the path, so common names are only excluded where the OS puts them
+type ExcludeSet struct {
+	Description string
+	Patterns    []string
+}
+
+// built-in exclusion sets, all enabled unless disabled per vault
+var excludeSets = map[string]ExcludeSet{
+	"os-metadata": {
+		Description: "OS metadata files",
+		Patterns:    []string{".DS_Store", "._*", ".Spotlight-V100", ".fseventsd", ".TemporaryItems", "Thumbs.db", "ehthumbs.db", "desktop.ini"},
+	},
+	"trash": {
+		Description: "Trash and recycle bins",
+		Patterns:    []string{".Trash", ".Trash-*", ".Trashes", "$RECYCLE.BIN", ".local/share/Trash"},
+	},
+	"vcs": {
+		Description: "Version control metadata",
+		Patterns:    []string{".git", ".hg", ".svn"},
+	},
+	"dependencies": {
+		Description: "Package manager dependencies",
+		Patterns:    []string{"node_modules", "bower_components", ".venv", "venv"},
+	},
+	"build-caches": {
+		Description: "Build and interpreter caches",
+		Patterns:    []string{"__pycache__", "*.pyc", ".pytest_cache", ".mypy_cache", ".tox", ".gradle", ".cache"},
+	},
+	"browser-caches": {
+		Description: "Browser caches",
+		Patterns:    []string{"Library/Caches", "User Data/*/Cache", "google-chrome/*/Cache", "chromium/*/Cache", "Code Cache", "GPUCache", "ShaderCache", "cache2", "startupCache"},
+	},
+}
+
+// ExcludeSetNames lists the built-in exclusion sets, sorted
+func ExcludeSetNames() []string {
+	names := make([]string, 0, len(excludeSets))
+	for name := range excludeSets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ExcludeSetEnabled checks if the exclusion set applies to the vault
+func (p ChasmPref) ExcludeSetEnabled(name string) bool {
+	enabled, ok := p.ExcludeSets[name]
+	return !ok || enabled
+}
+
+// isExcludedBySet checks if a path matches any enabled exclusion set
+func isExcludedBySet(filePath string) bool {
+	base := filepath.Base(filePath)
+	dirs := strings.Split(filepath.ToSlash(filePath), "/")
+	for name, set := range excludeSets {
+		if !preferences.ExcludeSetEnabled(name) {
+			continue
+		}
+		for _, pattern := range set.Patterns {
+			if strings.Contains(pattern, "/") {
+				if matchDirs(strings.Split(pattern, "/"), dirs) {
+					return true
+				}
+			} else if ok, _ := filepath.Match(pattern, base); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchDirs checks if the names of pattern match consecutive names of dirs
+func matchDirs(pattern, dirs []string) bool {
+	for i := 0; i+len(pattern) <= len(dirs); i++ {
+		matched := true
+		for j, name := range pattern {
+			if ok, _ := filepath.Match(name, dirs[i+j]); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
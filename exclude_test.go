@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestExcludedBySet(t *testing.T) {
+	for filePath, excluded := range map[string]bool{
+		"/home/me/.local/share/Trash":                                     true,
+		"/home/me/.local/share/Trash/files/old.txt":                       true,
+		"/home/me/Documents/Trash":                                        false,
+		"/home/me/Documents/Cache/notes.txt":                              false,
+		"/Users/me/Library/Caches/com.apple.Safari":                       true,
+		"/home/me/.config/google-chrome/Default/Cache":                    true,
+		"C:/Users/me/AppData/Local/Google/Chrome/User Data/Default/Cache": true,
+		"/home/me/projects/node_modules":                                  true,
+		"/home/me/projects/main.go":                                       false,
+	} {
+		if got := isExcludedBySet(filePath); got != excluded {
+			t.Errorf("isExcludedBySet(%s) = %v, want %v", filePath, got, excluded)
+		}
+	}
+}
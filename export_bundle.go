@@ -0,0 +1,244 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+	"github.com/fatih/color"
+)
+
+// An export bundle is one file holding everything a full recovery needs,
+// for cold archiving on an external disk: the live share objects of every
+// store, or of the chosen ones, the newest manifest objects and a
+// description of what is inside. It is a tar archive sealed under a
+// passphrase as
+//
+//	"CHBN" | version | salt (16) | PBKDF2 rounds (4) | segments
+//
+// with AES-GCM segments of bundleSegment bytes numbered like the segments of
+// protected files. The archive holds bundle.json, README.txt and the objects
+// as stores/<store number>/<object>, split objects joined.
+
+const bundleMagic = "CHBN"
+
+const bundleVersion = 1
+
+// plaintext bytes per sealed segment
+const bundleSegment = 1 << 20
+
+var bundleContext = []byte("chasm export bundle")
+
+const bundleReadme = `This is a chasm export bundle, sealed under its passphrase.
+
+Recover the vault with
+
+	chasm import --bundle <this file>
+
+or open it and recover by hand as described in the recovery package of
+chasm: every store directory holds the shares that store kept, and the
+shares of an object combine across stores to its contents.
+`
+
+// BundleInfo describes the contents of an export bundle
+type BundleInfo struct {
+	Created time.Time     `json:"created"`
+	Stores  []BundleStore `json:"stores"`
+
+	// stores an object needs shares from, 0 if unknown
+	Threshold int `json:"threshold"`
+	Total     int `json:"total_stores"`
+}
+
+// BundleStore is the part of a bundle from one store
+type BundleStore struct {
+	Number      int    `json:"number"`
+	Description string `json:"description"`
+	Objects     int    `json:"objects"`
+	Bytes       int64  `json:"bytes"`
+
+	// live objects the store could not provide
+	Missing int `json:"missing"`
+}
+
+// bundleWriter seals what is written to it into bundle segments
+type bundleWriter struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	segment []byte
+	release func()
+	n       int
+	i       uint64
+	sealed  []byte
+}
+
+func newBundleWriter(dst io.Writer, passphrase []byte) (*bundleWriter, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := passphraseAEAD(passphrase, nil, salt, protectIterations)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(bundleMagic), bundleVersion)
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, protectIterations)
+	if _, err := dst.Write(header); err != nil {
+		return nil, err
+	}
+
+	segment, release := lockedBuffer(bundleSegment)
+	return &bundleWriter{dst: dst, aead: aead, segment: segment, release: release}, nil
+}
+
+func (w *bundleWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		copied := copy(w.segment[w.n:], p)
+		w.n += copied
+		written += copied
+		p = p[copied:]
+		if w.n == len(w.segment) {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *bundleWriter) seal(final bool) error {
+	w.sealed = w.aead.Seal(w.sealed[:0], segmentNonce(w.i, final), w.segment[:w.n], bundleContext)
+	w.i++
+	w.n = 0
+	_, err := w.dst.Write(w.sealed)
+	return err
+}
+
+// Close seals the final segment, always shorter than the others
+func (w *bundleWriter) Close() error {
+	defer w.release()
+	return w.seal(true)
+}
+
+// ExportBundle writes the live objects of the stores numbered in stores,
+// every store if empty, to a bundle at bundlePath sealed under passphrase
+func ExportBundle(bundlePath string, stores []int, passphrase []byte) (BundleInfo, error) {
+	cloudStores := preferences.cloudStores()
+	info := BundleInfo{Created: time.Now().UTC(), Total: len(cloudStores)}
+	if len(stores) == 0 {
+		for i := range cloudStores {
+			stores = append(stores, i+1)
+		}
+	}
+
+	// written next to the bundle, and only renamed once complete
+	tmp, err := ioutil.TempFile(filepath.Dir(bundlePath), ".chasm-export")
+	if err != nil {
+		return info, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sealer, err := newBundleWriter(tmp, passphrase)
+	if err != nil {
+		return info, err
+	}
+	archive := tar.NewWriter(sealer)
+	if err := writeBundleFile(archive, "README.txt", []byte(bundleReadme)); err != nil {
+		return info, err
+	}
+
+	// the bundle needs a manifest version every exported store holds
+	stored := make([]map[string][]string, len(stores))
+	listings := make([][]string, len(stores))
+	for i, number := range stores {
+		stored[i] = storedNames(cloudStores[number-1].List())
+		for object := range stored[i] {
+			listings[i] = append(listings[i], object)
+		}
+	}
+	live := liveObjects(listings)
+
+	for i, number := range stores {
+		if taskCanceled() {
+			return info, fmt.Errorf("export canceled")
+		}
+		store := BundleStore{Number: number, Description: cloudStores[number-1].ShortDescription()}
+		names := stored[i]
+		objects := make([]string, 0, len(live))
+		for object := range live {
+			// entries without a version are only objects in the original
+			// layout, .chasmignore has none. Newer manifests and deltas
+			// only some stores hold are not missing from the others
+			sid, version, _ := ParseObjectName(object)
+			partial := sid == ShareID(chasmPrefFile) || sid == ShareID(chasmDeltaSID)
+			if (version != "" && !partial) || names[object] != nil {
+				objects = append(objects, object)
+			}
+		}
+		sort.Strings(objects)
+
+		for _, object := range objects {
+			data, err := readStored(storeRef(number), names, object)
+			if err != nil {
+				color.Red("%s: cannot export %s: %s", store.Description, object, err)
+				store.Missing++
+				countError()
+				continue
+			}
+			if decoded, err := recovery.Decode(data); err == nil && decoded.Threshold > 0 {
+				info.Threshold = int(decoded.Threshold)
+			}
+			err = writeBundleFile(archive, fmt.Sprintf("stores/%d/%s", number, object), data)
+			size := int64(len(data))
+			wipe(data)
+			if err != nil {
+				return info, err
+			}
+			store.Objects++
+			store.Bytes += size
+			countFile(size, false)
+		}
+		info.Stores = append(info.Stores, store)
+	}
+
+	infoJSON, err := json.MarshalIndent(info, "", "    ")
+	if err != nil {
+		return info, err
+	}
+	if err := writeBundleFile(archive, "bundle.json", infoJSON); err != nil {
+		return info, err
+	}
+	if err := archive.Close(); err != nil {
+		return info, err
+	}
+	if err := sealer.Close(); err != nil {
+		return info, err
+	}
+	if err := tmp.Close(); err != nil {
+		return info, err
+	}
+	return info, os.Rename(tmp.Name(), bundlePath)
+}
+
+func writeBundleFile(archive *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: time.Now()}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := archive.Write(data)
+	return err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// A standby store sits outside the vault while the primary stores are up.
+// Uploading runs probe the primaries, and once one has been down for the
+// failover period the standby takes its place, receiving the shares the
+// primary would have, so new uploads keep the full number of shares. When
+// the primary comes back the shares it missed are copied back to it from
+// the standby, as `chasm repair --store` does, and only then is it used
+// again. Until the copy succeeds the standby keeps its place, since with
+// Shamir every share is needed and restore does not read an idle standby.
+// Only one primary is stood in for at a time.
+
+// failover period of a standby store added without one
+const defaultFailoverMinutes = 60
+
+// StandbyStore is the store failed over to, with one of its store types set
+type StandbyStore struct {
+	Folder *FolderStore `json:"folder,omitempty"`
+	Peer   *PeerStore   `json:"peer,omitempty"`
+
+	// a primary store is failed over once down this long
+	FailoverMinutes int `json:"failover_minutes"`
+}
+
+func (s StandbyStore) store() CloudStore {
+	if s.Folder != nil {
+		return *s.Folder
+	}
+	return *s.Peer
+}
+
+func (s StandbyStore) period() time.Duration {
+	if s.FailoverMinutes <= 0 {
+		return defaultFailoverMinutes * time.Minute
+	}
+	return time.Duration(s.FailoverMinutes) * time.Minute
+}
+
+// failoverIndex is the index of the primary store the standby store stands
+// in for, -1 if none is failed over
+func (p ChasmPref) failoverIndex() int {
+	if p.Standby == nil || len(state.StoreDownSince) == 0 {
+		return -1
+	}
+	now := time.Now()
+	for i, cs := range p.primaryStores() {
+		if since, down := state.StoreDownSince[cs.ShortDescription()]; down && now.Sub(since) >= p.Standby.period() {
+			return i
+		}
+	}
+	return -1
+}
+
+// idleStandby is the standby store while it stands in for no primary, nil
+// otherwise
+func (p ChasmPref) idleStandby() CloudStore {
+	if p.Standby == nil || p.failoverIndex() >= 0 {
+		return nil
+	}
+	return p.Standby.store()
+}
+
+// storeUp checks that a store answers and still holds a manifest
+func storeUp(cs CloudStore) bool {
+	for _, object := range cs.List() {
+		if strings.HasPrefix(object, chasmPrefFile+"~") {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckFailover probes the primary stores when there is a standby store,
+// recording which are down and since when
+func CheckFailover() {
+	if preferences.Standby == nil {
+		return
+	}
+	if state.StoreDownSince == nil {
+		state.StoreDownSince = make(map[string]time.Time)
+	}
+
+	// with every store down the problem is likely local, or the vault has
+	// no manifest yet, and failing over would not help
+	primaryStores := preferences.primaryStores()
+	up := make([]bool, len(primaryStores))
+	anyUp := false
+	for i, cs := range primaryStores {
+		up[i] = storeUp(cs)
+		anyUp = anyUp || up[i]
+	}
+	if !anyUp {
+		color.Red("Error: no store could be reached, not failing over")
+		return
+	}
+
+	failedOver := preferences.failoverIndex()
+	for i, cs := range primaryStores {
+		name := cs.ShortDescription()
+		_, down := state.StoreDownSince[name]
+		switch {
+		case !up[i] && !down:
+			state.StoreDownSince[name] = time.Now().UTC()
+			color.Yellow("%s is down, failing over to the standby store if it is still down in %v", name, preferences.Standby.period())
+		case up[i] && down && i == failedOver:
+			since := state.StoreDownSince[name]
+			delete(state.StoreDownSince, name)
+			color.Yellow("%s is back, copying back the shares the standby store took in its place", name)
+			if result := Repair(i); result.Failed > 0 || taskCanceled() {
+				state.StoreDownSince[name] = since
+				color.Red("Error: %v shares could not be written to %s, the standby store stays in its place until the next run or chasm repair --store %v", result.Failed, name, i+1)
+			} else {
+				color.Green("%s is back: %v healthy, %v copied back or regenerated, %v shared again", name, result.Healthy, result.Regenerated, result.Reshared)
+			}
+		case up[i] && down:
+			delete(state.StoreDownSince, name)
+			color.Green("%s is back", name)
+		}
+	}
+
+	if k := preferences.failoverIndex(); k >= 0 && k != failedOver {
+		color.Yellow("Failed over %s to the standby store %s", primaryStores[k].ShortDescription(), preferences.Standby.store().ShortDescription())
+	}
+	state.Save()
+}
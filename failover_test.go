@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestFailback checks a primary store coming back gets the shares the
+// standby store took in its place before it is used again
+func TestFailback(t *testing.T) {
+	root := t.TempDir()
+	LoadState(root)
+	primaries := []FolderStore{{Path: t.TempDir()}, {Path: t.TempDir()}}
+	standby := FolderStore{Path: t.TempDir()}
+	preferences = ChasmPref{root: root, FolderStores: primaries, Standby: &StandbyStore{Folder: &standby}, FileMap: map[string]FileShare{}}
+	defer func() { preferences = ChasmPref{} }()
+
+	// both primaries hold a manifest, so they answer as up
+	manifest := ObjectName(ShareID(chasmPrefFile), NewShareVersion(), false)
+	for _, fs := range primaries {
+		if err := os.WriteFile(filepath.Join(fs.Path, manifest), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first primary has been down past the failover period
+	down := primaries[0].ShortDescription()
+	state.StoreDownSince = map[string]time.Time{down: time.Now().Add(-2 * defaultFailoverMinutes * time.Minute)}
+	if preferences.failoverIndex() != 0 {
+		t.Fatal("not failed over")
+	}
+
+	data := []byte("contents")
+	fileShare := FileShare{SID: RandomShareID(), Version: NewShareVersion(), Hash: SHA256Base64URL(data), Size: int64(len(data))}
+	uploaded := uploadShares(fileShare.SID, fileShare.Version, data)
+	fileShare.Shares = uploaded.Hashes
+	preferences.FileMap[filepath.Join(root, "file")] = fileShare
+	object := filepath.Join(primaries[0].Path, fileShare.ObjectName())
+	if _, err := os.Stat(object); !os.IsNotExist(err) {
+		t.Fatalf("share written to the store that is down: %v", err)
+	}
+
+	CheckFailover()
+	if _, err := os.Stat(object); err != nil {
+		t.Fatalf("share not copied back from the standby store: %v", err)
+	}
+	if _, ok := state.StoreDownSince[down]; ok || preferences.failoverIndex() >= 0 {
+		t.Fatal("still failed over after the shares were copied back")
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+	"gopkg.in/yaml.v2"
+)
+
+// Chasm can be rolled out to many machines from one configuration. An admin
+// writes a fleet config holding the stores, settings and policy every
+// machine uses, signs it with `chasm fleet sign`, and puts it on a file
+// share or a web server. Each machine joins with `chasm fleet join SOURCE
+// --key PUBLIC_KEY`, pinning the admin's key. From then on every command
+// fetches the config, checks its signature and serial, and applies it over
+// the vault's own settings, which can no longer be changed locally.
+//
+// The config leaves out secrets. What a machine needs to sign in to a store,
+// its own access keys or tokens, it adds with `chasm fleet credential`,
+// kept in its local state and merged into the store's configuration.
+//
+// A fleet config is JSON:
+//
+//	{
+//	    "serial": 3,
+//	    "preferences": { "s3_stores": [ ... ], "retention_days": 30 },
+//	    "policy": "rules:\n  - path: \"*.iso\"\n    ignore: true\n"
+//	}
+//
+// where preferences are in the manifest's format, limited to fleetKeys, and
+// policy replaces the vault's policy file. Configs with a lower serial than
+// the one applied last are refused, so an old config cannot be replayed.
+
+// FleetConfig is the configuration an admin signs for every machine
+type FleetConfig struct {
+	// raised with every change
+	Serial int64 `json:"serial"`
+
+	// settings in the manifest's format, limited to fleetKeys
+	Preferences json.RawMessage `json:"preferences"`
+
+	// contents of the policy file every machine uses
+	Policy string `json:"policy,omitempty"`
+}
+
+// FleetEnrollment is where a machine's configuration comes from
+type FleetEnrollment struct {
+	// path or http(s) URL of the config, its signature next to it as .sig
+	Source string `json:"source"`
+
+	// base64 Ed25519 key the config must be signed with
+	PublicKey string `json:"public_key"`
+
+	// serial of the config applied last
+	Serial int64 `json:"serial"`
+
+	// policy of the config applied last
+	Policy string `json:"policy,omitempty"`
+
+	// fields of this machine merged into store configurations, by store
+	Credentials map[string]map[string]json.RawMessage `json:"credentials,omitempty"`
+}
+
+// fleetKeys are the preferences a fleet config sets, replacing the vault's
+var fleetKeys = map[string]bool{
+	"folder_stores":          true,
+	"gdrive_stores":          true,
+	"peer_stores":            true,
+	"dropbox_stores":         true,
+	"s3_stores":              true,
+	"onedrive_stores":        true,
+	"b2_stores":              true,
+	"sftp_stores":            true,
+	"webdav_stores":          true,
+	"azure_stores":           true,
+	"gcs_stores":             true,
+	"box_stores":             true,
+	"mega_stores":            true,
+	"pcloud_stores":          true,
+	"yandex_stores":          true,
+	"ftp_stores":             true,
+	"smb_stores":             true,
+	"rclone_stores":          true,
+	"ipfs_stores":            true,
+	"storj_stores":           true,
+	"kbfs_stores":            true,
+	"email_stores":           true,
+	"telegram_stores":        true,
+	"git_stores":             true,
+	"swift_stores":           true,
+	"db_stores":              true,
+	"standby":                true,
+	"exclude_sets":           true,
+	"retention_days":         true,
+	"deleted_retention_days": true,
+	"stats_retention_days":   true,
+	"max_file_size":          true,
+	"max_memory":             true,
+	"sharing_scheme":         true,
+	"decoy_rounds_per_day":   true,
+}
+
+// setFleetPreferences replaces the settings of fleetKeys with managed's
+func setFleetPreferences(managed ChasmPref) {
+	preferences.FolderStores = managed.FolderStores
+	preferences.GDriveStores = managed.GDriveStores
+	preferences.PeerStores = managed.PeerStores
+	preferences.DropboxStores = managed.DropboxStores
+	preferences.S3Stores = managed.S3Stores
+	preferences.OneDriveStores = managed.OneDriveStores
+	preferences.B2Stores = managed.B2Stores
+	preferences.SFTPStores = managed.SFTPStores
+	preferences.WebDAVStores = managed.WebDAVStores
+	preferences.AzureBlobStores = managed.AzureBlobStores
+	preferences.GCSStores = managed.GCSStores
+	preferences.BoxStores = managed.BoxStores
+	preferences.MegaStores = managed.MegaStores
+	preferences.PCloudStores = managed.PCloudStores
+	preferences.YandexDiskStores = managed.YandexDiskStores
+	preferences.FTPStores = managed.FTPStores
+	preferences.SMBStores = managed.SMBStores
+	preferences.RcloneStores = managed.RcloneStores
+	preferences.IPFSStores = keepIPFSCIDs(managed.IPFSStores)
+	preferences.StorjStores = managed.StorjStores
+	preferences.KBFSStores = managed.KBFSStores
+	preferences.EmailStores = managed.EmailStores
+	preferences.TelegramStores = managed.TelegramStores
+	preferences.GitStores = managed.GitStores
+	preferences.SwiftStores = managed.SwiftStores
+	preferences.DBStores = managed.DBStores
+	preferences.Standby = managed.Standby
+	preferences.ExcludeSets = managed.ExcludeSets
+	preferences.RetentionDays = managed.RetentionDays
+	preferences.DeletedRetentionDays = managed.DeletedRetentionDays
+	preferences.StatsRetentionDays = managed.StatsRetentionDays
+	preferences.MaxFileSize = managed.MaxFileSize
+	preferences.MaxMemory = managed.MaxMemory
+	preferences.SharingScheme = managed.SharingScheme
+	preferences.DecoyRoundsPerDay = managed.DecoyRoundsPerDay
+}
+
+// ParseFleetConfig parses a fleet config and checks what it sets
+func ParseFleetConfig(data []byte) (FleetConfig, error) {
+	var config FleetConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, err
+	}
+
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(config.Preferences, &keys); err != nil {
+		return config, fmt.Errorf("preferences: %s", err)
+	}
+	for key := range keys {
+		if !fleetKeys[key] {
+			return config, fmt.Errorf("preferences: %s is not set by fleet configs", key)
+		}
+	}
+	var managed ChasmPref
+	if err := json.Unmarshal(config.Preferences, &managed); err != nil {
+		return config, fmt.Errorf("preferences: %s", err)
+	}
+
+	if config.Policy != "" {
+		var parsed Policy
+		if err := yaml.UnmarshalStrict([]byte(config.Policy), &parsed); err != nil {
+			return config, fmt.Errorf("policy: %s", err)
+		}
+	}
+	return config, nil
+}
+
+// SignFleetConfig returns the contents of the .sig file for a config, signed
+// with the base64 Ed25519 seed in keyFile
+func SignFleetConfig(config []byte, keyFile string) ([]byte, error) {
+	encoded, err := readSecretFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(string(encoded))
+	wipe(encoded)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("not a fleet signing key")
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+	wipe(seed)
+	defer wipe(key)
+	return signDetached(key, config), nil
+}
+
+// GenerateFleetKey returns a new base64 signing key seed and its public key
+func GenerateFleetKey() (string, string, error) {
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	defer wipe(key)
+	return base64.StdEncoding.EncodeToString(key.Seed()), base64.StdEncoding.EncodeToString(public), nil
+}
+
+// checkFleetSignature checks that sig is publicKey's signature of config
+func checkFleetSignature(config, sig []byte, publicKey string) error {
+	signer, err := checkDetached(config, sig, "fleet config")
+	if err != nil {
+		return err
+	}
+	if signer != publicKey {
+		return fmt.Errorf("signed by %s, not the fleet key", signer)
+	}
+	return nil
+}
+
+// fetchFleetFile reads source, a path or an http(s) URL
+func fetchFleetFile(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "https://") && !strings.HasPrefix(source, "http://") {
+		return ioutil.ReadFile(source)
+	}
+	resp, err := storeHTTPClient().Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", source, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// fetchFleetConfig gets the config of enrollment and checks its signature
+// and serial
+func fetchFleetConfig(enrollment FleetEnrollment) (FleetConfig, error) {
+	data, err := fetchFleetFile(enrollment.Source)
+	if err != nil {
+		return FleetConfig{}, err
+	}
+	sig, err := fetchFleetFile(enrollment.Source + ".sig")
+	if err != nil {
+		return FleetConfig{}, fmt.Errorf("cannot read signature: %s", err)
+	}
+	if err := checkFleetSignature(data, sig, enrollment.PublicKey); err != nil {
+		return FleetConfig{}, err
+	}
+	config, err := ParseFleetConfig(data)
+	if err != nil {
+		return config, err
+	}
+	if config.Serial < enrollment.Serial {
+		return config, fmt.Errorf("serial %d is older than the applied %d", config.Serial, enrollment.Serial)
+	}
+	return config, nil
+}
+
+// applyFleetConfig sets the vault's settings to config's, with this
+// machine's credentials
+func applyFleetConfig(config FleetConfig) {
+	managed := ChasmPref{RetentionDays: defaultRetentionDays}
+	json.Unmarshal(config.Preferences, &managed)
+	setFleetPreferences(managed)
+	loadStoreCredentials()
+	for index := 1; index <= preferences.RegisteredServices(); index++ {
+		mergeCredentials(index)
+	}
+
+	state.Fleet.Serial = config.Serial
+	state.Fleet.Policy = config.Policy
+}
+
+// mergeCredentials sets this machine's fields of the store numbered index
+func mergeCredentials(index int) {
+	store := preferences.primaryStores()[index-1].ShortDescription()
+	fields, ok := state.Fleet.Credentials[store]
+	if !ok {
+		return
+	}
+
+	ref := storeRef(index)
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return
+	}
+	var merged map[string]json.RawMessage
+	json.Unmarshal(data, &merged)
+	secrets := make(map[string]*string)
+	if store, ok := ref.(credentialed); ok {
+		secrets = store.credentials()
+	}
+	for field, value := range fields {
+		// credentials are left out of the store's JSON
+		if secret, ok := secrets[field]; ok {
+			if json.Unmarshal(value, secret) != nil {
+				*secret = string(value)
+			}
+			continue
+		}
+		merged[field] = value
+	}
+	data, _ = json.Marshal(merged)
+	if err := json.Unmarshal(data, ref); err != nil {
+		color.Red("Error: cannot set the credentials of %s: %s", store, err)
+	}
+}
+
+// loadFleet applies the fleet config, if the vault is enrolled. A config
+// that cannot be fetched or verified leaves the last applied one in place
+func loadFleet() {
+	if state.Fleet == nil {
+		return
+	}
+	config, err := fetchFleetConfig(*state.Fleet)
+	if err != nil {
+		color.Red("Error: cannot apply the fleet config %s: %s. Keeping serial %d.", state.Fleet.Source, err, state.Fleet.Serial)
+		return
+	}
+	applyFleetConfig(config)
+	preferences.Save()
+	state.Save()
+}
+
+// JoinFleet enrolls the vault with the config at source signed by publicKey,
+// and applies it
+func JoinFleet(source, publicKey string) (FleetConfig, error) {
+	enrollment := FleetEnrollment{Source: source, PublicKey: publicKey}
+	config, err := fetchFleetConfig(enrollment)
+	if err != nil {
+		return config, err
+	}
+	state.Fleet = &enrollment
+	applyFleetConfig(config)
+	preferences.Save()
+	state.Save()
+	loadPolicy(preferences.root)
+	return config, nil
+}
+
+// SetFleetCredential sets field of the store numbered index to value, JSON
+// or else a string, on this machine
+func SetFleetCredential(index int, field, value string) {
+	raw := json.RawMessage(value)
+	if !json.Valid(raw) {
+		raw, _ = json.Marshal(value)
+	}
+
+	store := preferences.primaryStores()[index-1].ShortDescription()
+	if state.Fleet.Credentials == nil {
+		state.Fleet.Credentials = make(map[string]map[string]json.RawMessage)
+	}
+	if state.Fleet.Credentials[store] == nil {
+		state.Fleet.Credentials[store] = make(map[string]json.RawMessage)
+	}
+	state.Fleet.Credentials[store][field] = raw
+	mergeCredentials(index)
+	preferences.Save()
+	state.Save()
+}
+
+// fleetCredentialFields lists the fields this machine sets for store
+func fleetCredentialFields(store string) []string {
+	var fields []string
+	for field := range state.Fleet.Credentials[store] {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/fatih/color"
+)
+
+// Folder stores on a NAS or removable volume are not always mounted. While
+// their mount point is missing, shares are queued in the local cache and
+// moved over the next time the store is used with the volume present.
+
+// present checks if the folder store's volume is mounted
+func (f FolderStore) present() bool {
+	if f.Volume != "" {
+		v, ok := findVolume(f.Volume)
+		return ok && v.Mount == f.Mount
+	}
+	if f.Mount == "" {
+		return true
+	}
+
+	fi, err := os.Stat(f.Mount)
+	if err != nil {
+		return false
+	}
+
+	// an unmounted mount point is a plain directory on its parent's device
+	parent := filepath.Dir(f.Mount)
+	if parent == f.Mount {
+		return true
+	}
+	parentInfo, err := os.Stat(parent)
+	if err != nil {
+		return false
+	}
+	id, ok := fileIdentity(f.Mount, fi)
+	parentID, parentOK := fileIdentity(parent, parentInfo)
+	return !ok || !parentOK || id.Device != parentID.Device
+}
+
+// chasmCacheDir holds what chasm keeps locally besides the vault
+func chasmCacheDir() string {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		cache = os.TempDir()
+	}
+	return filepath.Join(cache, "chasm")
+}
+
+// queueDir holds the shares waiting for the store's volume
+func (f FolderStore) queueDir() string {
+	key := f.Path
+	if f.Volume != "" {
+		key = f.Volume + ":" + f.VolumePath
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(chasmCacheDir(), "queue", hex.EncodeToString(sum[:8]))
+}
+
+// queue keeps a share until the store's volume is mounted again
+func (f FolderStore) queue(share Share) {
+	queueDir := f.queueDir()
+	if err := os.MkdirAll(queueDir, 0700); err != nil {
+		color.Red("Error: cannot queue share for %s: %s", f.Path, err)
+		return
+	}
+
+	queuePath := filepath.Join(queueDir, share.ObjectName())
+	if err := ioutil.WriteFile(queuePath, share.Data, 0600); err != nil {
+		color.Red("Error: cannot queue share for %s: %s", f.Path, err)
+		return
+	}
+	color.Yellow("%s is not mounted, queued share %s.", f.volumeName(), share.ObjectName())
+}
+
+// flushQueue moves queued shares to the store once its volume is present
+func (f FolderStore) flushQueue() {
+	queueDir := f.queueDir()
+	queued, _ := ioutil.ReadDir(queueDir)
+	if len(queued) == 0 || !f.present() {
+		return
+	}
+
+	os.MkdirAll(f.Path, 0777)
+	for _, q := range queued {
+		queuePath := filepath.Join(queueDir, q.Name())
+		data, err := ioutil.ReadFile(queuePath)
+		if err != nil {
+			continue
+		}
+
+		sharePath := filepath.Join(f.Path, q.Name())
+		if _, err := os.Lstat(sharePath); err != nil {
+			err = f.checkSpace(int64(len(data)))
+			if err == nil {
+				err = f.write(sharePath, data)
+			}
+			if err != nil {
+				color.Red("Error: cannot move queued share %s: %s", q.Name(), err)
+				continue
+			}
+		}
+		os.Remove(queuePath)
+	}
+	color.Green("Moved %v queued shares to %s.", len(queued), f.Path)
+}
+
+// unqueue drops a queued share, returning false if none was queued
+func (f FolderStore) unqueue(object string) bool {
+	return os.Remove(filepath.Join(f.queueDir(), object)) == nil
+}
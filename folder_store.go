@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/fatih/color"
 )
@@ -13,6 +14,19 @@ import (
 // shares to the folder
 type FolderStore struct {
 	Path string `json:"path"`
+
+	// mount point of the NAS or removable volume holding Path, if any.
+	// Shares are queued locally while it is not mounted
+	Mount string `json:"mount,omitempty"`
+
+	// UUID or label of the removable drive holding the store, and Path
+	// relative to the drive's root. Path and Mount follow the drive to
+	// wherever it is mounted
+	Volume     string `json:"volume,omitempty"`
+	VolumePath string `json:"volume_path,omitempty"`
+
+	// larger shares are split into parts, 0 for no limit
+	MaxObjectBytes int64 `json:"max_object_size,omitempty"`
 }
 
 // Setup the folder store
@@ -27,11 +41,33 @@ func (f FolderStore) Setup() bool {
 	return true
 }
 
-// Upload writes a share to to the folder
+// uploads are written under a temporary name, then renamed into place, so
+// a share cut short by a full disk is never taken for a whole one
+const folderUploadSuffix = ".uploading"
+
+// space left free on the folder's drive beyond the shares written to it,
+// for the vault and everything else on a shared drive
+const folderSpaceMargin = 64 << 20
+
+// Upload writes a share to to the folder, refusing to overwrite an
+// existing object or to fill the drive
 func (f FolderStore) Upload(share Share) {
-	sharePath := path.Join(f.Path, string(share.SID))
-	err := ioutil.WriteFile(sharePath, share.Data, 0770)
-	if err != nil {
+	if !f.present() {
+		f.queue(share)
+		return
+	}
+	f.flushQueue()
+
+	sharePath := path.Join(f.Path, share.ObjectName())
+	if _, err := os.Lstat(sharePath); err == nil {
+		color.Red("Error: share %s already exists", sharePath)
+		return
+	}
+	if err := f.checkSpace(int64(len(share.Data))); err != nil {
+		color.Red("Error: cannot save share %s: %s", sharePath, err)
+		return
+	}
+	if err := f.write(sharePath, share.Data); err != nil {
 		color.Red("Error: %s", err)
 		return
 	}
@@ -39,9 +75,67 @@ func (f FolderStore) Upload(share Share) {
 	color.Magenta("Share %s saved successfully!", sharePath)
 }
 
-// Delete deletes the share by its shareID
-func (f FolderStore) Delete(sid ShareID) {
-	sharePath := f.Path + "/" + string(sid)
+// write saves data at sharePath through a temporary file, which is removed
+// if not all of data made it to the drive
+func (f FolderStore) write(sharePath string, data []byte) error {
+	tmp := sharePath + folderUploadSuffix
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0770)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		// network and delayed allocation file systems may only report a
+		// full drive here
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, sharePath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// checkSpace refuses a write of size bytes that would leave less than the
+// margin free on the folder's drive. Drives whose free space is unknown
+// are written to, a write that does not fit fails by itself
+func (f FolderStore) checkSpace(size int64) error {
+	free, err := freeSpace(f.Path)
+	if err != nil {
+		return nil
+	}
+	if needed := size + folderSpaceMargin; uint64(needed) > free {
+		return fmt.Errorf("%s free on its drive, %s needed", formatBytes(int64(free)), formatBytes(needed))
+	}
+	return nil
+}
+
+// onVaultDevice checks if the folder is on the drive of the vault, where
+// one failing drive loses both the files and their shares
+func (f FolderStore) onVaultDevice() bool {
+	fi, err := os.Stat(f.Path)
+	rootInfo, rootErr := os.Stat(chasmRoot)
+	if err != nil || rootErr != nil {
+		return false
+	}
+	id, ok := fileIdentity(f.Path, fi)
+	rootID, rootOK := fileIdentity(chasmRoot, rootInfo)
+	return ok && rootOK && id.Device == rootID.Device
+}
+
+// Remove permanently deletes a single object
+func (f FolderStore) Remove(object string) {
+	if f.unqueue(object) {
+		color.Yellow("Queued share %s deleted successfully!", object)
+		return
+	}
+
+	sharePath := path.Join(f.Path, object)
 	if _, err := os.Stat(sharePath); err != nil {
 		color.Red("Share %s does not exist.", sharePath)
 		return
@@ -53,11 +147,36 @@ func (f FolderStore) Delete(sid ShareID) {
 		return
 	}
 
-	color.Yellow("Share %s deleted successfully!", sid)
+	color.Yellow("Share %s deleted successfully!", object)
+}
+
+// List returns the names of all objects in the folder
+func (f FolderStore) List() []string {
+	if !f.present() {
+		color.Yellow("%s is not mounted, cannot list %s.", f.volumeName(), f.Path)
+		return nil
+	}
+	f.flushQueue()
+
+	files, _ := ioutil.ReadDir(f.Path)
+	objects := make([]string, 0, len(files))
+	for _, file := range files {
+		// writes cut short
+		if !strings.HasSuffix(file.Name(), folderUploadSuffix) {
+			objects = append(objects, file.Name())
+		}
+	}
+	return objects
 }
 
 // Restore downloads the shares
 func (f FolderStore) Restore() string {
+	if !f.present() {
+		color.Red("%s is not mounted, mount it to restore from %s.", f.volumeName(), f.Path)
+		return ""
+	}
+	f.flushQueue()
+
 	// do nothing, folder store exists locally already
 	// return the existing path
 	return f.Path
@@ -67,6 +186,12 @@ func (f FolderStore) Restore() string {
 // about the folder store path
 func (f FolderStore) Description() string {
 	label := "Folder store at " + f.Path
+	if f.Volume != "" {
+		label = fmt.Sprintf("Folder store on drive %s at %s", f.Volume, f.Path)
+		if !f.present() {
+			label += " (not connected)"
+		}
+	}
 
 	files, _ := ioutil.ReadDir(f.Path)
 	for _, f := range files {
@@ -77,6 +202,9 @@ func (f FolderStore) Description() string {
 }
 
 func (f FolderStore) ShortDescription() string {
+	if f.Volume != "" {
+		return "Folder store: drive " + f.Volume + ":" + f.VolumePath
+	}
 	return "Folder store: " + f.Path
 }
 
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"path"
+	"sync"
+
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+)
+
+// Losing the .chasm objects on enough stores loses the map from paths to
+// shares, even though every share is still there. So every uploaded share
+// carries a fragment of the manifest after its checksum: share x of the
+// manifest under the vault's scheme, which recovery reassembles from any
+// threshold of ordinary shares. The fragments are split once per manifest
+// version, and only small manifests are embedded so shares stay small.
+
+// maxEmbeddedManifest is the largest manifest embedded in shares
+const maxEmbeddedManifest = 256 << 10
+
+var embeddedManifest struct {
+	sync.Mutex
+	loaded   bool
+	n        int
+	trailers [][]byte // by x - 1
+}
+
+// embedManifest splits manifest at version into the fragments appended to
+// the shares uploaded from now on
+func embedManifest(version string, manifest []byte) {
+	embeddedManifest.Lock()
+	defer embeddedManifest.Unlock()
+	embeddedManifest.loaded = true
+	embeddedManifest.n = len(preferences.AllCloudStores())
+	embeddedManifest.trailers = manifestTrailers(version, manifest, embeddedManifest.n)
+}
+
+// manifestTrailers splits manifest into one fragment trailer per store, nil
+// if it is too large to embed
+func manifestTrailers(version string, manifest []byte, n int) [][]byte {
+	if version == "" || len(manifest) == 0 || len(manifest) > maxEmbeddedManifest || n == 0 {
+		return nil
+	}
+
+	var set [8]byte
+	if _, err := rand.Read(set[:]); err != nil {
+		return nil
+	}
+
+	scheme := preferences.Scheme()
+	payloads, err := scheme.Split(manifest, n, true)
+	if err != nil {
+		return nil
+	}
+	trailers := make([][]byte, n)
+	for i, y := range payloads {
+		share := recovery.Share{Scheme: scheme.ID(), X: byte(i + 1), Threshold: byte(scheme.Threshold(n)), Data: y}
+		trailers[i] = recovery.EncodeFragment(recovery.Fragment{Version: version, Set: set, Share: share})
+	}
+	wipeAll(payloads)
+	return trailers
+}
+
+// manifestTrailer is the fragment trailer for share x of n, nil if there
+// is none. Until a manifest is uploaded this run, the last saved manifest
+// is embedded as the last uploaded version
+func manifestTrailer(x, n int) []byte {
+	embeddedManifest.Lock()
+	defer embeddedManifest.Unlock()
+
+	if !embeddedManifest.loaded || embeddedManifest.n != n {
+		embeddedManifest.loaded = true
+		embeddedManifest.n = n
+		embeddedManifest.trailers = nil
+		if manifest, err := ioutil.ReadFile(path.Join(preferences.root, chasmPrefFile)); err == nil {
+			embeddedManifest.trailers = manifestTrailers(manifestVersion(), manifest, n)
+			wipe(manifest)
+		}
+	}
+
+	if x < 1 || x > len(embeddedManifest.trailers) {
+		return nil
+	}
+	return embeddedManifest.trailers[x-1]
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/jlaffaye/ftp"
+)
+
+// FTPStore keeps shares in a directory of an FTP server, such as the web
+// space of a hosting plan or an ISP, in the clear or over TLS. FTP sends the
+// password as is unless TLS is on, but shares are useless on their own
+type FTPStore struct {
+	// host:port
+	Host     string `json:"host"`
+	User     string `json:"user"`
+	Password string `json:"-"`
+	Path     string `json:"path"`
+
+	// explicit (AUTH TLS on port 21), implicit (port 990), or empty for
+	// plain FTP
+	TLS string `json:"tls,omitempty"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (f *FTPStore) credentials() map[string]*string {
+	return map[string]*string{"password": &f.Password}
+}
+
+// uploads are written under a temporary name, then renamed into place
+const ftpUploadSuffix = ".uploading"
+
+// connections by store, kept for the run and dropped on error. An FTP
+// connection runs one command at a time
+var (
+	ftpConnsLock sync.Mutex
+	ftpConns     = make(map[string]*ftp.ServerConn)
+)
+
+// Setup signs in and creates the share directory
+func (f FTPStore) Setup() bool {
+	for _, fs := range preferences.FTPStores {
+		if fs.Host == f.Host && fs.Path == f.Path {
+			color.Red("FTP store at %s already exists.", f.location())
+			return false
+		}
+	}
+	switch f.TLS {
+	case "", "explicit", "implicit":
+	default:
+		color.Red("Error: unknown TLS mode %s, use explicit or implicit", f.TLS)
+		return false
+	}
+
+	err := f.with(func(conn *ftp.ServerConn) error {
+		// create each missing directory along the path
+		dir := ""
+		for _, part := range strings.Split(strings.Trim(f.Path, "/"), "/") {
+			dir += "/" + part
+			conn.MakeDir(dir)
+		}
+		return conn.ChangeDir(f.Path)
+	})
+	if err != nil {
+		color.Red("Error: cannot set up %s: %s", f.location(), err)
+		return false
+	}
+	return true
+}
+
+func (f FTPStore) location() string {
+	scheme := "ftp"
+	if f.TLS != "" {
+		scheme = "ftps"
+	}
+	return scheme + "://" + f.User + "@" + f.Host + "/" + strings.TrimPrefix(f.Path, "/")
+}
+
+// conn is the run's connection to the server, opened if needed. Callers
+// hold ftpConnsLock
+func (f FTPStore) conn() (*ftp.ServerConn, error) {
+	if conn, ok := ftpConns[f.location()]; ok {
+		return conn, nil
+	}
+
+	options := []ftp.DialOption{ftp.DialWithTimeout(30 * time.Second)}
+	host, _, err := net.SplitHostPort(f.Host)
+	if err != nil {
+		return nil, err
+	}
+	switch f.TLS {
+	case "explicit":
+		options = append(options, ftp.DialWithExplicitTLS(&tls.Config{ServerName: host}))
+	case "implicit":
+		options = append(options, ftp.DialWithTLS(&tls.Config{ServerName: host}))
+	}
+
+	conn, err := ftp.Dial(f.Host, options...)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Login(f.User, f.Password); err != nil {
+		conn.Quit()
+		return nil, err
+	}
+	ftpConns[f.location()] = conn
+	return conn, nil
+}
+
+// with runs op with the connection, dropping it if op fails so the next
+// operation connects again
+func (f FTPStore) with(op func(conn *ftp.ServerConn) error) error {
+	ftpConnsLock.Lock()
+	defer ftpConnsLock.Unlock()
+	conn, err := f.conn()
+	if err != nil {
+		return err
+	}
+	if err := op(conn); err != nil {
+		conn.Quit()
+		delete(ftpConns, f.location())
+		return err
+	}
+	return nil
+}
+
+// Upload writes the share under a temporary name and renames it into place,
+// refusing to replace an existing object
+func (f FTPStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading %s/%s...", f.location(), share.ObjectName()))
+
+	objectPath := path.Join(f.Path, share.ObjectName())
+	err := f.with(func(conn *ftp.ServerConn) error {
+		if _, err := conn.FileSize(objectPath); err == nil {
+			return errors.New("object exists")
+		}
+		tmp := objectPath + ftpUploadSuffix
+		err := conn.Stor(tmp, bytes.NewReader(share.Data))
+		if err == nil {
+			err = conn.Rename(tmp, objectPath)
+		}
+		if err != nil {
+			conn.Delete(tmp)
+		}
+		return err
+	})
+	if err != nil {
+		color.Red("%s/%s upload failed: %v", f.location(), share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// Remove permanently deletes a single object
+func (f FTPStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting %s/%s...", f.location(), object))
+	err := f.with(func(conn *ftp.ServerConn) error {
+		return conn.Delete(path.Join(f.Path, object))
+	})
+	if err != nil {
+		color.Red("Error: could not delete %s from %s: %s", object, f.location(), err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all objects in the share directory
+func (f FTPStore) list() ([]string, error) {
+	var objects []string
+	err := f.with(func(conn *ftp.ServerConn) error {
+		entries, err := conn.List(f.Path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			// uploads interrupted before their rename
+			if entry.Type == ftp.EntryTypeFile && !strings.HasSuffix(entry.Name, ftpUploadSuffix) {
+				objects = append(objects, entry.Name)
+			}
+		}
+		return nil
+	})
+	return objects, err
+}
+
+// List returns the names of all objects in the share directory
+func (f FTPStore) List() []string {
+	objects, err := f.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", f.location(), err)
+		return nil
+	}
+	return objects
+}
+
+// Read downloads a single object
+func (f FTPStore) Read(object string) ([]byte, error) {
+	var data []byte
+	err := f.with(func(conn *ftp.ServerConn) error {
+		resp, err := conn.Retr(path.Join(f.Path, object))
+		if err != nil {
+			return err
+		}
+		data, err = ioutil.ReadAll(resp)
+		if cerr := resp.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+	return data, err
+}
+
+// ReadRange downloads length bytes of an object from offset. Closing the
+// transfer early aborts it, which some servers answer with an error that
+// leaves the connection unusable, so the connection is dropped then
+func (f FTPStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	var data []byte
+	var aborted error
+	err := f.with(func(conn *ftp.ServerConn) error {
+		resp, err := conn.RetrFrom(path.Join(f.Path, object), uint64(offset))
+		if err != nil {
+			return err
+		}
+		data, err = ioutil.ReadAll(io.LimitReader(resp, length))
+		aborted = resp.Close()
+		return err
+	})
+	if err == nil && aborted != nil {
+		f.with(func(*ftp.ServerConn) error { return aborted })
+	}
+	return data, err
+}
+
+// Restore pulls the share directory to a local temp dir
+func (f FTPStore) Restore() string {
+	objects, err := f.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", f.location(), err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_ftp_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from %s...", f.location())
+	for _, object := range objects {
+		data, err := f.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects in the share directory
+func (f FTPStore) Description() string {
+	objects, err := f.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", f.ShortDescription(), err)
+	}
+
+	label := f.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (f FTPStore) ShortDescription() string {
+	return "FTP Store: " + f.location()
+}
+
+// Clean deletes all shares from the share directory
+func (f FTPStore) Clean() {
+	for _, object := range f.List() {
+		color.Yellow("Removing FTP Store: %v", object)
+		f.with(func(conn *ftp.ServerConn) error {
+			return conn.Delete(path.Join(f.Path, object))
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// GCSStore keeps shares as objects in a Google Cloud Storage bucket, through
+// the JSON API, authorized as a service account with its JSON key. Unlike
+// Drive, a bucket can have lifecycle rules, such as moving shares to a colder
+// storage class, set on the bucket itself. The Storage Object Admin role on
+// the bucket is enough
+type GCSStore struct {
+	Bucket string `json:"bucket"`
+
+	// from the service account's JSON key
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"-"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (g *GCSStore) credentials() map[string]*string {
+	return map[string]*string{"private_key": &g.PrivateKey}
+}
+
+const (
+	gcsAPI    = "https://storage.googleapis.com"
+	gcsScope  = "https://www.googleapis.com/auth/devstorage.read_write"
+	gcsGrant  = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	gcsTokens = "https://oauth2.googleapis.com/token"
+
+	// largest object in a bucket
+	gcsMaxObjectSize = 5 << 40
+)
+
+// gcsToken is an access token of a service account, valid for an hour
+type gcsToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	expiry      time.Time
+}
+
+// tokens by service account, requested again shortly before they expire
+var (
+	gcsTokensLock sync.Mutex
+	gcsTokenCache = make(map[string]gcsToken)
+)
+
+// ParseGCSKey sets the credentials of a store from a service account's JSON
+// key
+func ParseGCSKey(key []byte) (GCSStore, error) {
+	var account struct {
+		Type string `json:"type"`
+		GCSStore
+	}
+	if err := json.Unmarshal(key, &account); err != nil {
+		return GCSStore{}, err
+	}
+	if account.Type != "service_account" || account.ClientEmail == "" || account.PrivateKey == "" {
+		return GCSStore{}, errors.New("not a service account key")
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = gcsTokens
+	}
+	return account.GCSStore, nil
+}
+
+// Setup checks that the bucket can be listed with the service account
+func (g GCSStore) Setup() bool {
+	for _, gs := range preferences.GCSStores {
+		if gs.Bucket == g.Bucket {
+			color.Red("GCS bucket %s already exists.", g.Bucket)
+			return false
+		}
+	}
+
+	if _, err := g.list(); err != nil {
+		color.Red("Error: cannot list gs://%s as %s: %s", g.Bucket, g.ClientEmail, err)
+		return false
+	}
+	return true
+}
+
+type gcsError struct {
+	Status string
+	Err    struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (e gcsError) Error() string {
+	if e.Err.Message == "" {
+		return e.Status
+	}
+	return fmt.Sprintf("%s: %s", e.Status, e.Err.Message)
+}
+
+// token returns an access token of the service account, signing in with a
+// JWT signed by its key
+func (g GCSStore) token() (string, error) {
+	gcsTokensLock.Lock()
+	defer gcsTokensLock.Unlock()
+	if token, ok := gcsTokenCache[g.ClientEmail]; ok && time.Now().Before(token.expiry) {
+		return token.AccessToken, nil
+	}
+
+	block, _ := pem.Decode([]byte(g.PrivateKey))
+	if block == nil {
+		return "", errors.New("invalid service account private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("service account private key is not RSA")
+	}
+
+	now := time.Now()
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   g.ClientEmail,
+		"scope": gcsScope,
+		"aud":   g.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + encoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := storeHTTPClient().PostForm(g.TokenURI, url.Values{
+		"grant_type": {gcsGrant},
+		"assertion":  {unsigned + "." + encoding.EncodeToString(signature)},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("signing in as %s: %s %s", g.ClientEmail, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var token gcsToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return "", err
+	}
+	token.expiry = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	gcsTokenCache[g.ClientEmail] = token
+	return token.AccessToken, nil
+}
+
+// do sends an authorized request to the JSON API, returning the response
+// body
+func (g GCSStore) do(method, target string, body []byte, header http.Header) ([]byte, error) {
+	token, err := g.token()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := storeHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		gcsErr := gcsError{Status: resp.Status}
+		json.Unmarshal(data, &gcsErr)
+		return nil, gcsErr
+	}
+	return data, nil
+}
+
+func (g GCSStore) objectURL(object string) string {
+	return gcsAPI + "/storage/v1/b/" + url.PathEscape(g.Bucket) + "/o/" + url.PathEscape(object)
+}
+
+// Upload writes the share as a new object, refusing to overwrite one
+func (g GCSStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading gs://%s/%s...", g.Bucket, share.ObjectName()))
+
+	query := url.Values{"uploadType": {"media"}, "name": {share.ObjectName()}, "ifGenerationMatch": {"0"}}
+	target := gcsAPI + "/upload/storage/v1/b/" + url.PathEscape(g.Bucket) + "/o?" + query.Encode()
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	if _, err := g.do("POST", target, share.Data, header); err != nil {
+		color.Red("gs://%s/%s upload failed: %v", g.Bucket, share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// Remove permanently deletes a single object
+func (g GCSStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting gs://%s/%s...", g.Bucket, object))
+	if _, err := g.do("DELETE", g.objectURL(object), nil, nil); err != nil {
+		color.Red("Error: could not delete %s from gs://%s: %s", object, g.Bucket, err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all objects in the bucket
+func (g GCSStore) list() ([]string, error) {
+	var objects []string
+	pageToken := ""
+	for {
+		query := url.Values{"fields": {"items(name),nextPageToken"}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		data, err := g.do("GET", gcsAPI+"/storage/v1/b/"+url.PathEscape(g.Bucket)+"/o?"+query.Encode(), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var listing struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(data, &listing); err != nil {
+			return nil, err
+		}
+		for _, item := range listing.Items {
+			objects = append(objects, item.Name)
+		}
+		if listing.NextPageToken == "" {
+			return objects, nil
+		}
+		pageToken = listing.NextPageToken
+	}
+}
+
+// List returns the names of all objects in the bucket
+func (g GCSStore) List() []string {
+	objects, err := g.list()
+	if err != nil {
+		color.Red("Error listing gs://%s: %s", g.Bucket, err)
+		return nil
+	}
+	return objects
+}
+
+// Read downloads a single object
+func (g GCSStore) Read(object string) ([]byte, error) {
+	return g.do("GET", g.objectURL(object)+"?alt=media", nil, nil)
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (g GCSStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	return g.do("GET", g.objectURL(object)+"?alt=media", nil, header)
+}
+
+// Restore downloads shares to local restore path
+func (g GCSStore) Restore() string {
+	objects, err := g.list()
+	if err != nil {
+		color.Red("Error listing gs://%s: %s", g.Bucket, err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_gcs_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from gs://%s...", g.Bucket)
+	for _, object := range objects {
+		data, err := g.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects in the bucket
+func (g GCSStore) Description() string {
+	objects, err := g.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", g.ShortDescription(), err)
+	}
+
+	label := g.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (g GCSStore) ShortDescription() string {
+	return "GCS Store: gs://" + g.Bucket
+}
+
+// Clean deletes all shares from the bucket
+func (g GCSStore) Clean() {
+	for _, object := range g.List() {
+		color.Yellow("Removing GCS Store: %v", object)
+		g.do("DELETE", g.objectURL(object), nil, nil)
+	}
+}
+
+// MaxObjectSize of a single object
+func (g GCSStore) MaxObjectSize() int64 {
+	return gcsMaxObjectSize
+}
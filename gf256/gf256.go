@@ -0,0 +1,132 @@
+/*
+Package gf256 implements Shamir secret sharing over GF(2^8) with the field
+and share layout of github.com/agrinman/sss, so shares made by either combine
+with the other, but with the inner loops vectorized.
+
+Sharing and combining come down to one kernel, MulAdd, which multiplies a
+whole slice by a field constant and adds it to another. It runs with AVX2 on
+amd64 and NEON on arm64, looking products up 32 or 16 bytes at a time in two
+16 entry tables (one per nibble of the input byte). Elsewhere, or if the
+vector kernel fails its check at startup, a 256 entry table per constant is
+used instead.
+*/
+package gf256
+
+// the AES field, x^8 + x^4 + x^3 + x + 1, as in agrinman/sss
+const polynomial = 0x11b
+
+var (
+	expTable [510]byte
+	logTable [256]byte
+
+	// mulTable[c][b] is c*b
+	mulTable [256][256]byte
+
+	// mulLow[c][b] is c*b and mulHigh[c][b] is c*(b<<4), for the nibbles b
+	mulLow  [256][16]byte
+	mulHigh [256][16]byte
+)
+
+func init() {
+	// 3 generates the multiplicative group
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+
+		x ^= x << 1
+		if x&0x100 != 0 {
+			x ^= polynomial
+		}
+	}
+
+	for c := 0; c < 256; c++ {
+		for b := 0; b < 256; b++ {
+			mulTable[c][b] = mul(byte(c), byte(b))
+		}
+		for b := 0; b < 16; b++ {
+			mulLow[c][b] = mulTable[c][b]
+			mulHigh[c][b] = mulTable[c][b<<4]
+		}
+	}
+
+	SIMD = hasSIMD && checkSIMD()
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+// Mul multiplies a and b
+func Mul(a, b byte) byte {
+	return mulTable[a][b]
+}
+
+// Div divides a by b, which must not be 0
+func Div(a, b byte) byte {
+	if b == 0 {
+		panic("gf256: division by zero")
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
+
+// SIMD reports whether MulAdd uses the vector kernel. It can be turned off,
+// e.g. to compare speeds
+var SIMD bool
+
+// MulAdd sets out[i] ^= c*in[i], for the first len(in) bytes of out
+func MulAdd(c byte, in, out []byte) {
+	out = out[:len(in)]
+	switch c {
+	case 0:
+		return
+	case 1:
+		for i, b := range in {
+			out[i] ^= b
+		}
+		return
+	}
+
+	done := 0
+	if SIMD {
+		done = mulAddVector(&mulLow[c], &mulHigh[c], in, out)
+	}
+	mulAddTable(c, in[done:], out[done:])
+}
+
+func mulAddTable(c byte, in, out []byte) {
+	table := &mulTable[c]
+	out = out[:len(in)]
+	for i, b := range in {
+		out[i] ^= table[b]
+	}
+}
+
+// checkSIMD compares the vector kernel with the tables for every constant
+func checkSIMD() bool {
+	in := make([]byte, 256)
+	for i := range in {
+		in[i] = byte(i)
+	}
+
+	got := make([]byte, len(in))
+	for c := 0; c < 256; c++ {
+		for i := range got {
+			got[i] = byte(c)
+		}
+		done := mulAddVector(&mulLow[c], &mulHigh[c], in, got)
+		for i := range got[:done] {
+			if got[i] != byte(c)^mulTable[c][in[i]] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,213 @@
+package gf256
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// slowMul multiplies by shifting and reducing, without the tables
+func slowMul(a, b byte) byte {
+	var p byte
+	for b != 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= polynomial & 0xff
+		}
+		b >>= 1
+	}
+	return p
+}
+
+func TestMul(t *testing.T) {
+	for _, tt := range []struct {
+		a, b, want byte
+	}{
+		{0, 0, 0},
+		{0, 0x53, 0},
+		{1, 0x53, 0x53},
+		{2, 0x80, 0x1b},
+		{3, 0x80, 0x9b},
+		{0x53, 0xca, 0x01},
+		{0x57, 0x83, 0xc1},
+		{0x57, 0x13, 0xfe},
+		{0xff, 0xff, 0x13},
+	} {
+		if got := Mul(tt.a, tt.b); got != tt.want {
+			t.Errorf("Mul(%#x, %#x) = %#x, want %#x", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	for a := 0; a < 256; a++ {
+		for b := 0; b < 256; b++ {
+			if got, want := Mul(byte(a), byte(b)), slowMul(byte(a), byte(b)); got != want {
+				t.Fatalf("Mul(%#x, %#x) = %#x, want %#x", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestDiv(t *testing.T) {
+	for _, tt := range []struct {
+		a, b, want byte
+	}{
+		{0, 1, 0},
+		{0, 0x53, 0},
+		{0x53, 1, 0x53},
+		{0x53, 0x53, 1},
+		{1, 0x53, 0xca},
+		{0xc1, 0x83, 0x57},
+		{0x13, 0xff, 0xff},
+	} {
+		if got := Div(tt.a, tt.b); got != tt.want {
+			t.Errorf("Div(%#x, %#x) = %#x, want %#x", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	for a := 0; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			if got := Mul(Div(byte(a), byte(b)), byte(b)); got != byte(a) {
+				t.Fatalf("Div(%#x, %#x) * %#x = %#x", a, b, b, got)
+			}
+		}
+	}
+}
+
+func TestDivByZero(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Div by 0 did not panic")
+		}
+	}()
+	Div(1, 0)
+}
+
+func TestInverse(t *testing.T) {
+	seen := make(map[byte]bool)
+	for a := 1; a < 256; a++ {
+		inverse := Div(1, byte(a))
+		if Mul(byte(a), inverse) != 1 || Mul(inverse, byte(a)) != 1 {
+			t.Fatalf("%#x has no inverse, got %#x", a, inverse)
+		}
+		if seen[inverse] {
+			t.Fatalf("%#x is the inverse of two elements", inverse)
+		}
+		seen[inverse] = true
+	}
+}
+
+func TestFieldAxioms(t *testing.T) {
+	for a := 0; a < 256; a++ {
+		x := byte(a)
+		if Mul(x, 1) != x || Mul(x, 0) != 0 || x^x != 0 {
+			t.Fatalf("identities fail for %#x", a)
+		}
+		for b := 0; b < 256; b++ {
+			y := byte(b)
+			if Mul(x, y) != Mul(y, x) {
+				t.Fatalf("Mul(%#x, %#x) is not commutative", a, b)
+			}
+		}
+	}
+
+	// associativity and distributivity over a sample of the triples
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		x, y, z := byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256))
+		if Mul(Mul(x, y), z) != Mul(x, Mul(y, z)) {
+			t.Fatalf("Mul is not associative for %#x, %#x, %#x", x, y, z)
+		}
+		if Mul(x, y^z) != Mul(x, y)^Mul(x, z) {
+			t.Fatalf("Mul does not distribute for %#x, %#x, %#x", x, y, z)
+		}
+	}
+}
+
+// withSIMD runs f with the vector kernel on or off, restoring it after
+func withSIMD(on bool, f func()) {
+	saved := SIMD
+	SIMD = on
+	defer func() { SIMD = saved }()
+	f()
+}
+
+func TestMulAdd(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	lengths := []int{1000, 4096, 4097}
+	for n := 0; n <= 100; n++ {
+		lengths = append(lengths, n)
+	}
+
+	for _, simd := range []bool{false, true} {
+		if simd && !SIMD {
+			t.Log("no vector kernel on this CPU")
+			continue
+		}
+		for _, n := range lengths {
+			// start in and out off any alignment, tails of every length
+			for _, offset := range []int{0, 1, 7, 15, 31} {
+				in := make([]byte, n+offset)
+				out := make([]byte, n+offset+1)
+				r.Read(in)
+				r.Read(out)
+				for _, c := range []byte{0, 1, 2, 0x53, 0x80, 0xff, byte(r.Intn(256))} {
+					want := make([]byte, len(out))
+					copy(want, out)
+					for i, b := range in[offset:] {
+						want[offset+i] ^= slowMul(c, b)
+					}
+
+					got := make([]byte, len(out))
+					copy(got, out)
+					withSIMD(simd, func() { MulAdd(c, in[offset:], got[offset:]) })
+					if !bytes.Equal(got, want) {
+						t.Fatalf("SIMD %v: MulAdd(%#x) of %d bytes at offset %d differs", simd, c, n, offset)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSIMDMatchesTable(t *testing.T) {
+	if !SIMD {
+		t.Skip("no vector kernel on this CPU")
+	}
+	in := make([]byte, 256+31)
+	rand.New(rand.NewSource(1)).Read(in)
+	for c := 0; c < 256; c++ {
+		vector := make([]byte, len(in))
+		table := make([]byte, len(in))
+		withSIMD(true, func() { MulAdd(byte(c), in, vector) })
+		mulAddTable(byte(c), in, table)
+		if !bytes.Equal(vector, table) {
+			t.Fatalf("vector kernel and tables differ for %#x", c)
+		}
+	}
+}
+
+func BenchmarkMulAdd(b *testing.B) {
+	for _, size := range []int{64, 4 << 10, 1 << 20} {
+		for _, simd := range []bool{false, true} {
+			if simd && !SIMD {
+				continue
+			}
+			in := make([]byte, size)
+			out := make([]byte, size)
+			rand.New(rand.NewSource(1)).Read(in)
+			b.Run(fmt.Sprintf("size=%d/simd=%v", size, simd), func(b *testing.B) {
+				withSIMD(simd, func() {
+					b.SetBytes(int64(size))
+					for i := 0; i < b.N; i++ {
+						MulAdd(0x53, in, out)
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package gf256
+
+import "golang.org/x/sys/cpu"
+
+var hasSIMD = cpu.X86.HasAVX2
+
+//go:noescape
+func mulAddAVX2(low, high *[16]byte, in, out []byte)
+
+// mulAddVector handles whole 32 byte blocks, returning how many bytes it did
+func mulAddVector(low, high *[16]byte, in, out []byte) int {
+	done := len(in) &^ 31
+	if done > 0 {
+		mulAddAVX2(low, high, in[:done], out[:done])
+	}
+	return done
+}
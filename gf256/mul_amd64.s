@@ -0,0 +1,39 @@
+#include "textflag.h"
+
+// func mulAddAVX2(low, high *[16]byte, in, out []byte)
+// out ^= c*in, 32 bytes at a time, with the nibble tables of c
+TEXT ·mulAddAVX2(SB), NOSPLIT, $0-64
+	MOVQ low+0(FP), AX
+	MOVQ high+8(FP), BX
+	MOVQ in_base+16(FP), SI
+	MOVQ in_len+24(FP), CX
+	MOVQ out_base+40(FP), DI
+
+	VBROADCASTI128 (AX), Y6
+	VBROADCASTI128 (BX), Y7
+	MOVQ $15, DX
+	MOVQ DX, X5
+	VPBROADCASTB X5, Y5
+
+	SHRQ $5, CX
+	JZ done
+
+loop:
+	VMOVDQU (SI), Y0
+	VMOVDQU (DI), Y4
+	VPSRLQ $4, Y0, Y1
+	VPAND Y5, Y0, Y0
+	VPAND Y5, Y1, Y1
+	VPSHUFB Y0, Y6, Y2
+	VPSHUFB Y1, Y7, Y3
+	VPXOR Y2, Y3, Y2
+	VPXOR Y2, Y4, Y4
+	VMOVDQU Y4, (DI)
+	ADDQ $32, SI
+	ADDQ $32, DI
+	DECQ CX
+	JNZ loop
+
+done:
+	VZEROUPPER
+	RET
@@ -0,0 +1,16 @@
+package gf256
+
+// NEON is part of every ARMv8 core
+const hasSIMD = true
+
+//go:noescape
+func mulAddNEON(low, high *[16]byte, in, out []byte)
+
+// mulAddVector handles whole 16 byte blocks, returning how many bytes it did
+func mulAddVector(low, high *[16]byte, in, out []byte) int {
+	done := len(in) &^ 15
+	if done > 0 {
+		mulAddNEON(low, high, in[:done], out[:done])
+	}
+	return done
+}
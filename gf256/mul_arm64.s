@@ -0,0 +1,33 @@
+#include "textflag.h"
+
+// func mulAddNEON(low, high *[16]byte, in, out []byte)
+// out ^= c*in, 16 bytes at a time, with the nibble tables of c
+TEXT ·mulAddNEON(SB), NOSPLIT, $0-64
+	MOVD low+0(FP), R0
+	MOVD high+8(FP), R1
+	MOVD in_base+16(FP), R2
+	MOVD in_len+24(FP), R3
+	MOVD out_base+40(FP), R4
+
+	VLD1 (R0), [V6.B16]
+	VLD1 (R1), [V7.B16]
+	VMOVI $15, V5.B16
+
+	LSR $4, R3, R3
+	CBZ R3, done
+
+loop:
+	VLD1.P 16(R2), [V0.B16]
+	VLD1 (R4), [V4.B16]
+	VUSHR $4, V0.B16, V1.B16
+	VAND V5.B16, V0.B16, V0.B16
+	VTBL V0.B16, [V6.B16], V2.B16
+	VTBL V1.B16, [V7.B16], V3.B16
+	VEOR V2.B16, V3.B16, V2.B16
+	VEOR V2.B16, V4.B16, V4.B16
+	VST1.P [V4.B16], 16(R4)
+	SUBS $1, R3, R3
+	BNE loop
+
+done:
+	RET
@@ -0,0 +1,9 @@
+//go:build !amd64 && !arm64
+
+package gf256
+
+const hasSIMD = false
+
+func mulAddVector(low, high *[16]byte, in, out []byte) int {
+	return 0
+}
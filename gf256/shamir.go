@@ -0,0 +1,113 @@
+package gf256
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// secret bytes shared at a time, bounding the random coefficients held
+const blockSize = 32 << 10
+
+// Split creates n shares of secret, any k of which reconstruct it. Share i
+// is the polynomial evaluated at x = i+1, one byte per secret byte
+func Split(secret []byte, n, k int, random io.Reader) ([][]byte, error) {
+	if k < 1 || k > n || n > 255 {
+		return nil, errors.New("gf256: need 1 <= k <= n <= 255")
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+
+	// x^j of every share's x, for the coefficient of degree j
+	powers := make([][]byte, n)
+	for i := range powers {
+		powers[i] = make([]byte, k)
+		powers[i][0] = 1
+		for j := 1; j < k; j++ {
+			powers[i][j] = Mul(powers[i][j-1], byte(i+1))
+		}
+	}
+
+	coefficients := make([]byte, (k-1)*blockSize)
+	for start := 0; start < len(secret); start += blockSize {
+		end := start + blockSize
+		if end > len(secret) {
+			end = len(secret)
+		}
+		block := end - start
+		if _, err := io.ReadFull(random, coefficients[:(k-1)*block]); err != nil {
+			return nil, err
+		}
+
+		for i, share := range shares {
+			y := share[start:end]
+			copy(y, secret[start:end])
+			for j := 1; j < k; j++ {
+				MulAdd(powers[i][j], coefficients[(j-1)*block:j*block], y)
+			}
+		}
+	}
+	return shares, nil
+}
+
+// Combine reconstructs the secret from shares ys at distinct nonzero xs, by
+// Lagrange interpolation at 0. All shares must have the same length
+func Combine(xs []byte, ys [][]byte) ([]byte, error) {
+	if len(xs) != len(ys) || len(ys) == 0 {
+		return nil, errors.New("gf256: need one x for every share")
+	}
+
+	secret := make([]byte, len(ys[0]))
+	for i, y := range ys {
+		if len(y) != len(secret) {
+			return nil, errors.New("gf256: shares differ in length")
+		}
+
+		// basis polynomial of share i at 0
+		l := byte(1)
+		for j, xj := range xs {
+			if j == i {
+				continue
+			}
+			if xj == xs[i] || xj == 0 {
+				return nil, errors.New("gf256: x coordinates must be distinct and nonzero")
+			}
+			l = Mul(l, Div(xj, xj^xs[i]))
+		}
+		MulAdd(l, y, secret)
+	}
+	return secret, nil
+}
+
+// NewRandom returns a fast source of coefficients: AES-256 in counter mode
+// under a fresh key from crypto/rand, which generates far faster than the
+// system source on CPUs with AES instructions
+func NewRandom() io.Reader {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		panic(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	// the cipher keeps its own key schedule
+	for i := range key {
+		key[i] = 0
+	}
+	return cipher.StreamReader{S: cipher.NewCTR(block, make([]byte, aes.BlockSize)), R: zeroReader{}}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
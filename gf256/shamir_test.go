@@ -0,0 +1,87 @@
+package gf256
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	for _, size := range []int{0, 1, 31, 33, blockSize + 5} {
+		secret := make([]byte, size)
+		rand.Read(secret)
+		for _, nk := range [][2]int{{1, 1}, {2, 2}, {3, 2}, {5, 3}, {255, 4}} {
+			n, k := nk[0], nk[1]
+			shares, err := Split(secret, n, k, NewRandom())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the last k shares, in reverse
+			xs := make([]byte, 0, k)
+			ys := make([][]byte, 0, k)
+			for i := n - 1; i >= n-k; i-- {
+				xs = append(xs, byte(i+1))
+				ys = append(ys, shares[i])
+			}
+			got, err := Combine(xs, ys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, secret) {
+				t.Fatalf("%d of %d shares of %d bytes combine into another secret", k, n, size)
+			}
+		}
+	}
+}
+
+func TestSplitLimits(t *testing.T) {
+	for _, nk := range [][2]int{{2, 0}, {2, 3}, {256, 2}} {
+		if _, err := Split([]byte("secret"), nk[0], nk[1], NewRandom()); err == nil {
+			t.Errorf("Split into %d shares with threshold %d did not fail", nk[0], nk[1])
+		}
+	}
+}
+
+func TestCombineErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		xs   []byte
+		ys   [][]byte
+	}{
+		{"no shares", nil, nil},
+		{"missing x", []byte{1}, [][]byte{{1}, {2}}},
+		{"lengths differ", []byte{1, 2}, [][]byte{{1}, {2, 3}}},
+		{"repeated x", []byte{1, 1}, [][]byte{{1}, {2}}},
+		{"zero x", []byte{0, 1}, [][]byte{{1}, {2}}},
+	} {
+		if _, err := Combine(tt.xs, tt.ys); err == nil {
+			t.Errorf("%s: Combine did not fail", tt.name)
+		}
+	}
+}
+
+func BenchmarkSplit(b *testing.B) {
+	secret := make([]byte, 1<<20)
+	rand.Read(secret)
+	for _, nk := range [][2]int{{3, 3}, {5, 3}} {
+		b.Run(fmt.Sprintf("n=%d/k=%d", nk[0], nk[1]), func(b *testing.B) {
+			random := NewRandom()
+			b.SetBytes(int64(len(secret)))
+			for i := 0; i < b.N; i++ {
+				Split(secret, nk[0], nk[1], random)
+			}
+		})
+	}
+}
+
+func BenchmarkCombine(b *testing.B) {
+	secret := make([]byte, 1<<20)
+	rand.Read(secret)
+	shares, _ := Split(secret, 5, 3, NewRandom())
+	b.SetBytes(int64(len(secret)))
+	for i := 0; i < b.N; i++ {
+		Combine([]byte{1, 3, 5}, [][]byte{shares[0], shares[2], shares[4]})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Directories in git bundle mode are backed up as a single `git bundle` of
+// all refs, plus the untracked and modified files, instead of every file
+// and object. Restoring clones the bundle back into the directory.
+
+// name of the virtual tracked file holding a directory's bundle
+const gitBundleName = ".chasm-git.bundle"
+
+// gitBundleDir returns the git bundle mode directory containing filePath,
+// if any
+func gitBundleDir(filePath string) (string, bool) {
+	filePath = path.Clean(filePath)
+	for dir := range preferences.GitBundles {
+		if filePath == dir || strings.HasPrefix(filePath, dir+"/") {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// isGitRepo checks if dirPath is the top level of a git working tree
+func isGitRepo(dirPath string) bool {
+	_, err := os.Stat(path.Join(dirPath, ".git"))
+	return err == nil
+}
+
+func git(dirPath string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", dirPath}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil && stderr.Len() > 0 {
+		color.Red("git %s: %s", strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+	return out, err
+}
+
+// addGitBundle shares a bundle of dirPath's repository and the files git
+// does not have committed
+func addGitBundle(dirPath string) {
+	preferences.DirMap[dirPath] = true
+	recordDirChange(dirPath, true)
+
+	bundleFile, err := ioutil.TempFile("", "chasm-bundle")
+	if err != nil {
+		color.Red("Error: cannot create temp file: %s", err)
+		countError()
+		return
+	}
+	bundleFile.Close()
+	defer os.Remove(bundleFile.Name())
+
+	color.Cyan("Bundling git repository %s", dirPath)
+	if _, err := git(dirPath, "bundle", "create", bundleFile.Name(), "--all"); err != nil {
+		color.Red("Error: cannot bundle %s: %s", dirPath, err)
+		countError()
+		return
+	}
+
+	bundleBytes, err := ioutil.ReadFile(bundleFile.Name())
+	if err != nil {
+		color.Red("Cannot read file: %s", err)
+		countError()
+		return
+	}
+	shareFileBytes(path.Join(dirPath, gitBundleName), bundleBytes)
+
+	// untracked and modified files are not in the bundle
+	out, err := git(dirPath, "ls-files", "-z", "--others", "--modified", "--exclude-standard")
+	if err != nil {
+		color.Red("Error: cannot list uncommitted files in %s: %s", dirPath, err)
+		countError()
+		return
+	}
+
+	for _, name := range strings.Split(string(out), "\x00") {
+		filePath := path.Join(dirPath, name)
+		if name == "" || isDir(filePath) {
+			continue
+		}
+		if _, err := os.Stat(filePath); err != nil {
+			// modified includes deleted files
+			continue
+		}
+		AddFile(filePath)
+	}
+}
+
+// restoreGitBundle clones the restored bundle at bundlePath into its
+// directory, leaving restored uncommitted files in place
+func restoreGitBundle(bundlePath string) bool {
+	dirPath := path.Dir(bundlePath)
+	cloneDir := path.Join(dirPath, ".chasm-git-clone")
+	defer os.RemoveAll(cloneDir)
+
+	if _, err := git(dirPath, "clone", "--no-checkout", bundlePath, cloneDir); err != nil {
+		return false
+	}
+	if err := os.Rename(path.Join(cloneDir, ".git"), path.Join(dirPath, ".git")); err != nil {
+		color.Red("Error restoring git repository %s: %s", dirPath, err)
+		return false
+	}
+
+	// check out the committed files, then drop the bundle as a remote
+	if _, err := git(dirPath, "checkout", "--force", "HEAD", "--", "."); err != nil {
+		return false
+	}
+	git(dirPath, "remote", "remove", "origin")
+
+	os.Remove(bundlePath)
+	color.Green("Restored git repository %s", dirPath)
+	return true
+}
+
+// SetGitBundle persists whether dirPath is backed up in git bundle mode
+func SetGitBundle(dirPath string, enable bool) {
+	if preferences.GitBundles == nil {
+		preferences.GitBundles = make(map[string]bool)
+	}
+
+	dirPath = path.Clean(dirPath)
+	if !enable {
+		delete(preferences.GitBundles, dirPath)
+		return
+	}
+
+	preferences.GitBundles[dirPath] = true
+	color.Green("Backing up %s as a git bundle", dirPath)
+}
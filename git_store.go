@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// GitStore keeps shares as files of an orphan branch of a remote git
+// repository, such as a private repository on GitHub or GitLab, running
+// the git command with the credentials it is configured with. Uploads and
+// deletes are committed in a working copy in the cache and pushed, and a
+// push another machine got in first is retried on top of it. Removed
+// shares stay in the branch's history until Clean replaces the branch with
+// an empty commit. Hosts refuse or warn about large files, so larger
+// shares are split into parts
+type GitStore struct {
+	// URL of the repository, as git clone takes it
+	Remote string `json:"remote"`
+
+	Branch string `json:"branch"`
+}
+
+const (
+	defaultGitBranch = "chasm-shares"
+
+	// GitHub warns about files over 50 MB and refuses those over 100 MB
+	gitMaxObjectSize = 50 << 20
+)
+
+// working copies brought up to date this run, by location. Operations on
+// working copies hold the lock
+var (
+	gitStoresLock   sync.Mutex
+	gitStoresSynced = make(map[string]bool)
+)
+
+// Setup checks that git can reach the repository, and creates the branch
+// if missing
+func (g GitStore) Setup() bool {
+	for _, gs := range preferences.GitStores {
+		if gs.Remote == g.Remote && gs.Branch == g.Branch {
+			color.Red("Git store at %s already exists.", g.location())
+			return false
+		}
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		color.Red("Error: git store needs git on the PATH: %s", err)
+		return false
+	}
+
+	gitStoresLock.Lock()
+	defer gitStoresLock.Unlock()
+	if err := g.sync(); err != nil {
+		color.Red("Error: cannot set up %s: %s", g.location(), err)
+		return false
+	}
+	return true
+}
+
+// location is the repository and branch, without any password in the URL
+func (g GitStore) location() string {
+	remote := g.Remote
+	if u, err := url.Parse(remote); err == nil && u.User != nil {
+		remote = u.Redacted()
+	}
+	return remote + "#" + g.Branch
+}
+
+// dir is the store's working copy in the cache
+func (g GitStore) dir() string {
+	sum := sha256.Sum256([]byte(g.Remote + "#" + g.Branch))
+	return filepath.Join(chasmCacheDir(), "git", hex.EncodeToString(sum[:8]))
+}
+
+// run runs git in the working copy, returning its output. Errors carry
+// what git printed to stderr
+func (g GitStore) run(stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", g.dir()}, args...)...)
+	cmd.Stdin = stdin
+	// commits are chasm's, whatever the user's git config, and a missing
+	// credential fails rather than waits for input
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=chasm", "GIT_AUTHOR_EMAIL=chasm@localhost",
+		"GIT_COMMITTER_NAME=chasm", "GIT_COMMITTER_EMAIL=chasm@localhost",
+		"GIT_TERMINAL_PROMPT=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			lines := strings.Split(msg, "\n")
+			return nil, errors.New(lines[len(lines)-1])
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// newRoot pushes a commit without files or history as the branch,
+// replacing the branch if force
+func (g GitStore) newRoot(force bool) error {
+	tree, err := g.run(strings.NewReader(""), "mktree")
+	if err != nil {
+		return err
+	}
+	commit, err := g.run(nil, "commit-tree", strings.TrimSpace(string(tree)), "-m", "chasm shares")
+	if err != nil {
+		return err
+	}
+	ref := strings.TrimSpace(string(commit)) + ":refs/heads/" + g.Branch
+	if force {
+		ref = "+" + ref
+	}
+	_, err = g.run(nil, "push", "--quiet", "origin", ref)
+	return err
+}
+
+// sync brings the working copy to the branch on the remote, creating
+// either if missing. Callers hold gitStoresLock
+func (g GitStore) sync() error {
+	if _, err := os.Stat(filepath.Join(g.dir(), ".git")); err != nil {
+		if err := os.MkdirAll(g.dir(), 0700); err != nil {
+			return err
+		}
+		if _, err := g.run(nil, "init", "--quiet"); err != nil {
+			return err
+		}
+		if _, err := g.run(nil, "remote", "add", "origin", g.Remote); err != nil {
+			return err
+		}
+	}
+
+	heads, err := g.run(nil, "ls-remote", "--heads", "origin", g.Branch)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(heads)) == 0 {
+		if err := g.newRoot(false); err != nil {
+			return err
+		}
+	}
+
+	if _, err := g.run(nil, "fetch", "--quiet", "origin", g.Branch); err != nil {
+		return err
+	}
+	if _, err := g.run(nil, "checkout", "--quiet", "--force", "-B", g.Branch, "FETCH_HEAD"); err != nil {
+		return err
+	}
+	if _, err := g.run(nil, "clean", "--quiet", "-d", "--force"); err != nil {
+		return err
+	}
+	gitStoresSynced[g.location()] = true
+	return nil
+}
+
+// synced brings the working copy up to date once per run. Callers hold
+// gitStoresLock
+func (g GitStore) synced() error {
+	if gitStoresSynced[g.location()] {
+		return nil
+	}
+	return g.sync()
+}
+
+// change applies edit to the working copy, then commits and pushes it. A
+// push rejected because another machine pushed first is tried again on top
+// of it, once
+func (g GitStore) change(message string, edit func() error) error {
+	gitStoresLock.Lock()
+	defer gitStoresLock.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		err := g.synced()
+		if err == nil {
+			err = edit()
+		}
+		if err != nil {
+			return err
+		}
+
+		status, err := g.run(nil, "status", "--porcelain")
+		if err != nil || len(status) == 0 {
+			return err
+		}
+		if _, err := g.run(nil, "add", "--all"); err != nil {
+			return err
+		}
+		if _, err := g.run(nil, "commit", "--quiet", "-m", message); err != nil {
+			return err
+		}
+		_, err = g.run(nil, "push", "--quiet", "origin", "HEAD:refs/heads/"+g.Branch)
+		if err == nil {
+			return nil
+		}
+
+		// start over from the remote, dropping the commit
+		delete(gitStoresSynced, g.location())
+		if attempt == 1 {
+			return err
+		}
+	}
+}
+
+// Upload commits the share as a new file and pushes it, refusing to
+// replace an existing object
+func (g GitStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading %s/%s...", g.location(), share.ObjectName()))
+	objectPath := filepath.Join(g.dir(), share.ObjectName())
+	err := g.change("Add "+share.ObjectName(), func() error {
+		if _, err := os.Lstat(objectPath); err == nil {
+			return errors.New("object exists")
+		}
+		return ioutil.WriteFile(objectPath, share.Data, 0600)
+	})
+	if err != nil {
+		color.Red("%s/%s upload failed: %v", g.location(), share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+func (g GitStore) remove(object string) error {
+	return g.change("Remove "+object, func() error {
+		err := os.Remove(filepath.Join(g.dir(), object))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// Remove deletes a single object from the branch. Its history keeps it
+func (g GitStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting %s/%s...", g.location(), object))
+	if err := g.remove(object); err != nil {
+		color.Red("Error: could not delete %s from %s: %s", object, g.location(), err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all objects on the branch, as pushed by any
+// machine
+func (g GitStore) list() ([]string, error) {
+	gitStoresLock.Lock()
+	defer gitStoresLock.Unlock()
+	if err := g.sync(); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(g.dir())
+	if err != nil {
+		return nil, err
+	}
+	var objects []string
+	for _, file := range files {
+		if file.Mode().IsRegular() {
+			objects = append(objects, file.Name())
+		}
+	}
+	return objects, nil
+}
+
+// List returns the names of all objects on the branch
+func (g GitStore) List() []string {
+	objects, err := g.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", g.location(), err)
+		return nil
+	}
+	return objects
+}
+
+// ReadRange reads length bytes of an object from offset out of the working
+// copy, brought up to date if the object is not in it
+func (g GitStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	gitStoresLock.Lock()
+	defer gitStoresLock.Unlock()
+	if err := g.synced(); err != nil {
+		return nil, err
+	}
+
+	objectPath := filepath.Join(g.dir(), object)
+	if _, err := os.Lstat(objectPath); os.IsNotExist(err) {
+		if err := g.sync(); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.Open(objectPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if length < 0 {
+		file.Seek(offset, io.SeekStart)
+		return ioutil.ReadAll(file)
+	}
+	data := make([]byte, length)
+	n, err := file.ReadAt(data, offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return data[:n], err
+}
+
+// Read reads a single object out of the working copy
+func (g GitStore) Read(object string) ([]byte, error) {
+	return g.ReadRange(object, 0, -1)
+}
+
+// MaxObjectSize of a file hosts take without complaint
+func (g GitStore) MaxObjectSize() int64 {
+	return gitMaxObjectSize
+}
+
+// Restore downloads shares to local restore path, out of the working copy
+// brought up to date
+func (g GitStore) Restore() string {
+	objects, err := g.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", g.location(), err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_git_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from %s...", g.location())
+	for _, object := range objects {
+		data, err := g.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+	return restoreDir
+}
+
+// Description lists the objects on the branch
+func (g GitStore) Description() string {
+	objects, err := g.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", g.ShortDescription(), err)
+	}
+
+	label := g.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (g GitStore) ShortDescription() string {
+	return "Git Store: " + g.location()
+}
+
+// Clean replaces the branch with an empty commit, dropping the shares and
+// their history
+func (g GitStore) Clean() {
+	color.Yellow("Removing Git Store: %v", g.location())
+	gitStoresLock.Lock()
+	defer gitStoresLock.Unlock()
+	err := g.synced()
+	if err == nil {
+		err = g.newRoot(true)
+	}
+	if err != nil {
+		color.Red("Error: cannot empty %s: %s", g.location(), err)
+	}
+	delete(gitStoresSynced, g.location())
+}
@@ -2,11 +2,12 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"google.golang.org/api/option"
 	"io/ioutil"
 	"log"
-	"path"
 	"time"
 
 	"github.com/fatih/color"
@@ -18,9 +19,33 @@ import (
 )
 
 type GDriveStore struct {
+	// the client secret and tokens are left out of the JSON, see MarshalJSON
 	Config     oauth2.Config `json:"oauth_config"`
 	OAuthToken oauth2.Token  `json:"oauth_token"`
 	UserID     string        `json:"user_id"`
+
+	// names the store without a request, as its credentials are kept by
+	// its short description. Empty for stores set up before
+	Email string `json:"email,omitempty"`
+}
+
+// credentials are kept in the local state, see credentials.go. Without the
+// access token every run refreshes it once
+func (g *GDriveStore) credentials() map[string]*string {
+	return map[string]*string{
+		"client_secret": &g.Config.ClientSecret,
+		"refresh_token": &g.OAuthToken.RefreshToken,
+	}
+}
+
+// MarshalJSON leaves the client secret and tokens out of the preferences
+func (g GDriveStore) MarshalJSON() ([]byte, error) {
+	type gDriveStore GDriveStore
+	plain := gDriveStore(g)
+	plain.Config.ClientSecret = ""
+	plain.OAuthToken.AccessToken = ""
+	plain.OAuthToken.RefreshToken = ""
+	return json.Marshal(plain)
 }
 
 // Setup GDrive
@@ -42,10 +67,7 @@ func (g *GDriveStore) Setup() bool {
 	g.Config = *config
 	g.OAuthToken = *tok
 
-	ctx := context.Background()
-	//client := config.Client(ctx, &g.OAuthToken)
-
-	svc, err := drive.NewService(ctx, option.WithTokenSource(config.TokenSource(ctx, &g.OAuthToken)))
+	svc, err := g.service()
 	if err != nil {
 		color.Red("Unable to retrieve drive Client %v", err)
 		return false
@@ -66,67 +88,74 @@ func (g *GDriveStore) Setup() bool {
 	}
 
 	g.UserID = userID
+	g.Email = account.User.EmailAddress
 	return true
 }
 
 func (g GDriveStore) Upload(share Share) {
-	ctx := context.Background()
-	config := &g.Config
-	//client := config.Client(ctx, &g.OAuthToken)
-
-	svc, err := drive.NewService(ctx, option.WithTokenSource(config.TokenSource(ctx, &g.OAuthToken)))
+	svc, err := g.service()
 	if err != nil {
 		color.Red("Unable to retrieve drive Client %v", err)
 		return
 	}
 
-	fmt.Print(color.MagentaString("Uploading GoogleDrive/%s...", share.SID))
-
-	// delete existing share
-	deleteFilesForShareID(share.SID, svc)
+	fmt.Print(color.MagentaString("Uploading GoogleDrive/%s...", share.ObjectName()))
 
-	// now create and upload share
+	// create and upload share, existing versions are left in place
 	file := drive.File{}
 	now, err := time.Now().MarshalText()
 	file.ModifiedTime = string(now)
-	file.Name = string(share.SID)
+	file.Name = share.ObjectName()
 	file.Parents = []string{"appDataFolder"}
 
 	_, err = svc.Files.Create(&file).Media(bytes.NewReader(share.Data)).Do()
 	if err != nil {
-		color.Red("GoogleDrive/%s upload failed: %v", share.SID, err)
+		color.Red("GoogleDrive/%s upload failed: %v", share.ObjectName(), err)
 	} else {
 		//print check mark
-		fmt.Print(color.MagentaString("\u2713\n"))
+		fmt.Print(color.MagentaString(doneMark()))
 	}
 }
 
-func (g GDriveStore) Delete(sid ShareID) {
-	ctx := context.Background()
-	config := &g.Config
-	//client := config.Client(ctx, &g.OAuthToken)
-
-	svc, err := drive.NewService(ctx, option.WithTokenSource(config.TokenSource(ctx, &g.OAuthToken)))
+// Remove permanently deletes a single object
+func (g GDriveStore) Remove(object string) {
+	svc, err := g.service()
 	if err != nil {
 		color.Red("Unable to retrieve drive Client %v", err)
 		return
 	}
 
-	fmt.Print(color.YellowString("Deleting GoogleDrive/%s...", sid))
-	// delete existing share
-	deleteFilesForShareID(sid, svc)
+	fmt.Print(color.YellowString("Deleting GoogleDrive/%s...", object))
+	deleteFilesNamed(object, svc)
 
 	//print check mark
-	fmt.Print(color.YellowString("\u2713\n"))
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// List returns the names of all objects in the app data folder
+func (g GDriveStore) List() []string {
+	svc, err := g.service()
+	if err != nil {
+		color.Red("Unable to retrieve drive Client %v", err)
+		return nil
+	}
+
+	r, err := svc.Files.List().Spaces("appDataFolder").Do()
+	if err != nil {
+		color.Red("Unable to iterate names %v", err)
+		return nil
+	}
+
+	objects := make([]string, 0, len(r.Files))
+	for _, i := range r.Files {
+		objects = append(objects, i.Name)
+	}
+	return objects
 }
 
 //Restore downloads shares to local restore path
 func (g GDriveStore) Restore() string {
-	ctx := context.Background()
-	config := &g.Config
-	//client := config.Client(ctx, &g.OAuthToken)
-
-	svc, err := drive.NewService(ctx, option.WithTokenSource(config.TokenSource(ctx, &g.OAuthToken)))
+	svc, err := g.service()
 	if err != nil {
 		color.Red("Unable to retrieve drive Client %v", err)
 		return ""
@@ -166,7 +195,7 @@ func (g GDriveStore) Restore() string {
 		}
 
 		// write file to temp dir
-		ioutil.WriteFile(path.Join(restoreDir, i.Name), fileBytes, 0770)
+		stageShare(restoreDir, i.Name, fileBytes)
 		fmt.Println("\t - got share ", i.Name)
 	}
 
@@ -174,11 +203,8 @@ func (g GDriveStore) Restore() string {
 }
 
 func (g GDriveStore) Description() string {
-	ctx := context.Background()
-	config := &g.Config
-	//client := config.Client(ctx, &g.OAuthToken)
 	label := "Google Drive Store"
-	svc, err := drive.NewService(ctx, option.WithTokenSource(config.TokenSource(ctx, &g.OAuthToken)))
+	svc, err := g.service()
 	if err != nil {
 		color.Red("Unable to retrieve drive Client %v", err)
 		return label
@@ -207,33 +233,15 @@ func (g GDriveStore) Description() string {
 }
 
 func (g GDriveStore) ShortDescription() string {
-	ctx := context.Background()
-	config := &g.Config
-	//client := config.Client(ctx, &g.OAuthToken)
-	label := "Google Drive Store"
-	svc, err := drive.NewService(ctx, option.WithTokenSource(config.TokenSource(ctx, &g.OAuthToken)))
-	if err != nil {
-		color.Red("Unable to retrieve drive Client %v", err)
-		return label
-	}
-
-	account, err := svc.About.Get().Fields("user").Do()
-	if err != nil {
-		color.Red("Unable to retrieve drive information %v", err)
-		return label
+	if g.Email == "" {
+		return "Google Drive Store: " + g.UserID
 	}
-
-	return fmt.Sprintf("Google Drive Store: %v (%v)", account.User.DisplayName, account.User.EmailAddress)
+	return "Google Drive Store: " + g.Email
 }
 
 // Clean deletes all shares from the folder store
 func (g GDriveStore) Clean() {
-
-	ctx := context.Background()
-	config := &g.Config
-	//client := config.Client(ctx, &g.OAuthToken)
-
-	svc, err := drive.NewService(ctx, option.WithTokenSource(config.TokenSource(ctx, &g.OAuthToken)))
+	svc, err := g.service()
 	if err != nil {
 		color.Red("Unable to retrieve drive Client %v", err)
 		return
@@ -252,6 +260,26 @@ func (g GDriveStore) Clean() {
 }
 
 /// MARK: Helper Methods ///
+
+// service creates a drive client, logging calls when --debug-http is set
+func (g GDriveStore) service() (*drive.Service, error) {
+	ctx := storeContext(context.Background())
+	client := oauth2.NewClient(ctx, g.Config.TokenSource(ctx, &g.OAuthToken))
+	return drive.NewService(ctx, option.WithHTTPClient(client))
+}
+
+// objectID finds the Drive file id of an object
+func (g GDriveStore) objectID(svc *drive.Service, object string) (string, error) {
+	r, err := svc.Files.List().Spaces("appDataFolder").Q(fmt.Sprintf("name = '%s'", object)).Do()
+	if err != nil {
+		return "", err
+	}
+	if len(r.Files) == 0 {
+		return "", errors.New("no such object")
+	}
+	return r.Files[0].Id, nil
+}
+
 func getConfig() (*oauth2.Config, error) {
 	json, err := ioutil.ReadFile(GoogleDriveClientSecret)
 	if err != nil {
@@ -274,7 +302,7 @@ func getGDriveTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
 		return nil, err
 	}
 
-	tok, err := config.Exchange(oauth2.NoContext, code)
+	tok, err := config.Exchange(storeContext(context.Background()), code)
 	if err != nil {
 		color.Red("Unable to retrieve token from web %v", err)
 		return tok, err
@@ -283,9 +311,9 @@ func getGDriveTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
 	return tok, nil
 }
 
-func deleteFilesForShareID(sid ShareID, svc *drive.Service) {
+func deleteFilesNamed(name string, svc *drive.Service) {
 	// get all chasm files from drive
-	q := fmt.Sprintf("name = '%s'", string(sid))
+	q := fmt.Sprintf("name = '%s'", name)
 
 	r, err := svc.Files.List().Spaces("appDataFolder").Q(q).Do()
 	if err != nil {
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// Messages of restoring, importing and verifying, the commands run by
+// whoever recovers a vault, are translated. The English format strings are
+// the keys of each catalog, so T(format) takes the place of a format string
+// and the arguments stay as they were. Missing translations fall back to
+// English. The language is that of --lang, or else of the locale in LC_ALL,
+// LC_MESSAGES or LANG
+
+// catalogs of translated messages by language
+var catalogs = map[string]map[string]string{
+	"de": {
+		"Warning: not enough services. Cannot Restore.":                            "Warnung: nicht genug Dienste. Wiederherstellung nicht möglich.",
+		"Preparing to restore chasm to %s":                                         "Wiederherstellung von chasm nach %s wird vorbereitet",
+		"Restore failed for %v":                                                    "Wiederherstellung fehlgeschlagen für %v",
+		"Cannot restore chasm preferences file from cloud services.":               "Die chasm-Einstellungsdatei kann nicht aus den Cloud-Diensten wiederhergestellt werden.",
+		"Restored the manifest from fragments embedded in shares.":                 "Das Manifest wurde aus den in Anteilen eingebetteten Fragmenten wiederhergestellt.",
+		"Error: cannot restore git bundle for %s. Skipping.":                       "Fehler: Git-Bundle für %s kann nicht wiederhergestellt werden. Wird übersprungen.",
+		"Restore canceled.":                                                        "Wiederherstellung abgebrochen.",
+		"Error: invalid SHA2 checksum for share %s. Skipping.":                     "Fehler: ungültige SHA2-Prüfsumme für Anteil %s. Wird übersprungen.",
+		"Error writing restored file %s: %s":                                       "Fehler beim Schreiben der wiederhergestellten Datei %s: %s",
+		"Done. Restored all files!":                                                "Fertig. Alle Dateien wiederhergestellt!",
+		"Passphrase for protected %s:":                                             "Passphrase für geschütztes %s:",
+		"Error: cannot read passphrase: %s":                                        "Fehler: Passphrase kann nicht gelesen werden: %s",
+		"Error: cannot unlock %s: %s. Its files stay locked.":                      "Fehler: %s kann nicht entsperrt werden: %s. Die Dateien bleiben gesperrt.",
+		"Skipped %v protected files in %s. Restore with --unlock to recover them.": "%v geschützte Dateien in %s übersprungen. Mit --unlock wiederherstellen, um sie zurückzuholen.",
+		"Passphrase the bundle is sealed with:":                                    "Passphrase, mit der das Bundle versiegelt ist:",
+		"%s: %v objects imported (%s), %v already stored":                          "%s: %v Objekte importiert (%s), %v bereits gespeichert",
+		", %v failed":              ", %v fehlgeschlagen",
+		"Error: cannot import: %s": "Fehler: Import nicht möglich: %s",
+		"The bundle was exported from a vault of %v stores, this one has %v.": "Das Bundle stammt aus einem Tresor mit %v Speichern, dieser hat %v.",
+		"Imported %s, but %v objects failed.":                                 "%s importiert, aber %v Objekte sind fehlgeschlagen.",
+		"Imported %s. Run chasm restore to recover files from it.":            "%s importiert. Mit chasm restore die Dateien daraus wiederherstellen.",
+		"Error: not enough services. Cannot verify.":                          "Fehler: nicht genug Dienste. Prüfung nicht möglich.",
+		"%s: %v objects, %s downloaded":                                       "%s: %v Objekte, %s heruntergeladen",
+		", %v ranges sampled, %v without checksums":                           ", %v Bereiche stichprobenartig geprüft, %v ohne Prüfsummen",
+		", %v missing, %v corrupt":                                            ", %v fehlend, %v beschädigt",
+		"%v objects failed to verify.":                                        "%v Objekte konnten nicht geprüft werden.",
+	},
+	"es": {
+		"Warning: not enough services. Cannot Restore.":                            "Aviso: no hay suficientes servicios. No se puede restaurar.",
+		"Preparing to restore chasm to %s":                                         "Preparando la restauración de chasm en %s",
+		"Restore failed for %v":                                                    "La restauración falló para %v",
+		"Cannot restore chasm preferences file from cloud services.":               "No se puede restaurar el archivo de preferencias de chasm desde los servicios en la nube.",
+		"Restored the manifest from fragments embedded in shares.":                 "Se restauró el manifiesto a partir de los fragmentos incrustados en las partes.",
+		"Error: cannot restore git bundle for %s. Skipping.":                       "Error: no se puede restaurar el paquete git de %s. Se omite.",
+		"Restore canceled.":                                                        "Restauración cancelada.",
+		"Error: invalid SHA2 checksum for share %s. Skipping.":                     "Error: suma de comprobación SHA2 no válida para la parte %s. Se omite.",
+		"Error writing restored file %s: %s":                                       "Error al escribir el archivo restaurado %s: %s",
+		"Done. Restored all files!":                                                "Listo. ¡Se restauraron todos los archivos!",
+		"Passphrase for protected %s:":                                             "Frase de contraseña de %s protegido:",
+		"Error: cannot read passphrase: %s":                                        "Error: no se puede leer la frase de contraseña: %s",
+		"Error: cannot unlock %s: %s. Its files stay locked.":                      "Error: no se puede desbloquear %s: %s. Sus archivos siguen bloqueados.",
+		"Skipped %v protected files in %s. Restore with --unlock to recover them.": "Se omitieron %v archivos protegidos en %s. Restaure con --unlock para recuperarlos.",
+		"Passphrase the bundle is sealed with:":                                    "Frase de contraseña con la que está sellado el paquete:",
+		"%s: %v objects imported (%s), %v already stored":                          "%s: %v objetos importados (%s), %v ya guardados",
+		", %v failed":              ", %v fallidos",
+		"Error: cannot import: %s": "Error: no se puede importar: %s",
+		"The bundle was exported from a vault of %v stores, this one has %v.": "El paquete se exportó de una bóveda de %v almacenes, esta tiene %v.",
+		"Imported %s, but %v objects failed.":                                 "Se importó %s, pero fallaron %v objetos.",
+		"Imported %s. Run chasm restore to recover files from it.":            "Se importó %s. Ejecute chasm restore para recuperar sus archivos.",
+		"Error: not enough services. Cannot verify.":                          "Error: no hay suficientes servicios. No se puede verificar.",
+		"%s: %v objects, %s downloaded":                                       "%s: %v objetos, %s descargados",
+		", %v ranges sampled, %v without checksums":                           ", %v rangos muestreados, %v sin sumas de comprobación",
+		", %v missing, %v corrupt":                                            ", %v ausentes, %v dañados",
+		"%v objects failed to verify.":                                        "%v objetos no superaron la verificación.",
+	},
+	"fr": {
+		"Warning: not enough services. Cannot Restore.":                            "Attention : pas assez de services. Restauration impossible.",
+		"Preparing to restore chasm to %s":                                         "Préparation de la restauration de chasm dans %s",
+		"Restore failed for %v":                                                    "Échec de la restauration pour %v",
+		"Cannot restore chasm preferences file from cloud services.":               "Impossible de restaurer le fichier de préférences de chasm depuis les services cloud.",
+		"Restored the manifest from fragments embedded in shares.":                 "Manifeste restauré à partir des fragments intégrés aux parts.",
+		"Error: cannot restore git bundle for %s. Skipping.":                       "Erreur : impossible de restaurer le bundle git de %s. Ignoré.",
+		"Restore canceled.":                                                        "Restauration annulée.",
+		"Error: invalid SHA2 checksum for share %s. Skipping.":                     "Erreur : somme de contrôle SHA2 invalide pour la part %s. Ignorée.",
+		"Error writing restored file %s: %s":                                       "Erreur d'écriture du fichier restauré %s : %s",
+		"Done. Restored all files!":                                                "Terminé. Tous les fichiers ont été restaurés !",
+		"Passphrase for protected %s:":                                             "Phrase secrète de %s protégé :",
+		"Error: cannot read passphrase: %s":                                        "Erreur : impossible de lire la phrase secrète : %s",
+		"Error: cannot unlock %s: %s. Its files stay locked.":                      "Erreur : impossible de déverrouiller %s : %s. Ses fichiers restent verrouillés.",
+		"Skipped %v protected files in %s. Restore with --unlock to recover them.": "%v fichiers protégés ignorés dans %s. Restaurez avec --unlock pour les récupérer.",
+		"Passphrase the bundle is sealed with:":                                    "Phrase secrète qui scelle le bundle :",
+		"%s: %v objects imported (%s), %v already stored":                          "%s : %v objets importés (%s), %v déjà stockés",
+		", %v failed":              ", %v en échec",
+		"Error: cannot import: %s": "Erreur : importation impossible : %s",
+		"The bundle was exported from a vault of %v stores, this one has %v.": "Le bundle a été exporté d'un coffre de %v stockages, celui-ci en a %v.",
+		"Imported %s, but %v objects failed.":                                 "%s importé, mais %v objets ont échoué.",
+		"Imported %s. Run chasm restore to recover files from it.":            "%s importé. Lancez chasm restore pour en récupérer les fichiers.",
+		"Error: not enough services. Cannot verify.":                          "Erreur : pas assez de services. Vérification impossible.",
+		"%s: %v objects, %s downloaded":                                       "%s : %v objets, %s téléchargés",
+		", %v ranges sampled, %v without checksums":                           ", %v plages échantillonnées, %v sans somme de contrôle",
+		", %v missing, %v corrupt":                                            ", %v manquants, %v corrompus",
+		"%v objects failed to verify.":                                        "%v objets n'ont pas pu être vérifiés.",
+	},
+}
+
+// catalog of the language in use, nil for English
+var catalog map[string]string
+
+// SetLanguage translates messages into the language of locale, such as de
+// or de_DE.UTF-8, or that of the environment if empty
+func SetLanguage(locale string) {
+	if locale == "" {
+		locale = environmentLocale()
+	}
+	lang := strings.ToLower(locale)
+	if i := strings.IndexAny(lang, "_-.@"); i >= 0 {
+		lang = lang[:i]
+	}
+	catalog = catalogs[lang]
+}
+
+// environmentLocale is the locale of messages set in the environment
+func environmentLocale() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if locale := os.Getenv(name); locale != "" {
+			return locale
+		}
+	}
+	return ""
+}
+
+// T translates a message or format string
+func T(message string) string {
+	if translated, ok := catalog[message]; ok {
+		return translated
+	}
+	return message
+}
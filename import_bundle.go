@@ -0,0 +1,273 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+	"github.com/fatih/color"
+)
+
+// `chasm import` is the counterpart of export: the objects of an export
+// bundle are uploaded again to the configured stores, each store's objects
+// to the store with the same number, which is the one whose shares they
+// are. It recovers stores from the offline copy after a disaster, or seeds a
+// store that replaced a lost one without sharing the files again. Every
+// segment of the bundle is authenticated as it is read, and every share is
+// checked against the manifest before it is uploaded. Objects a store
+// already holds are left alone.
+
+// ImportResult counts what an import did for one store
+type ImportResult struct {
+	Number int
+	Store  string
+
+	Imported int
+	Bytes    int64
+
+	// objects the store already held
+	Present int
+
+	// objects that failed the checks, or could not be uploaded
+	Failed int
+}
+
+// bundleReader opens the segments of a bundle as it is read
+type bundleReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	sealed  []byte
+	segment []byte
+	release func()
+	plain   []byte
+	i       uint64
+	final   bool
+}
+
+func newBundleReader(src io.Reader, passphrase []byte) (*bundleReader, error) {
+	header := make([]byte, len(bundleMagic)+1+16+4)
+	if _, err := io.ReadFull(src, header); err != nil || string(header[:len(bundleMagic)]) != bundleMagic {
+		return nil, errors.New("not an export bundle")
+	}
+	if header[len(bundleMagic)] != bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle format %d", header[len(bundleMagic)])
+	}
+	salt := header[len(bundleMagic)+1 : len(bundleMagic)+17]
+	iterations := binary.BigEndian.Uint32(header[len(bundleMagic)+17:])
+	aead, err := passphraseAEAD(passphrase, nil, salt, int(iterations))
+	if err != nil {
+		return nil, err
+	}
+
+	segment, release := lockedBuffer(bundleSegment)
+	return &bundleReader{src: src, aead: aead, sealed: make([]byte, bundleSegment+aead.Overhead()), segment: segment, release: release}, nil
+}
+
+func (r *bundleReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.final {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *bundleReader) open() error {
+	n, err := io.ReadFull(r.src, r.sealed)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	final := n < len(r.sealed)
+	plain, err := r.aead.Open(r.segment[:0], segmentNonce(r.i, final), r.sealed[:n], bundleContext)
+	if err != nil {
+		if r.i == 0 {
+			return errors.New("wrong passphrase, or the bundle is corrupt")
+		}
+		return errors.New("the bundle is corrupt or truncated")
+	}
+	r.plain = plain
+	r.final = final
+	r.i++
+	return nil
+}
+
+// Close wipes the last opened segment
+func (r *bundleReader) Close() error {
+	r.release()
+	return nil
+}
+
+// ImportBundle uploads the objects in the bundle at bundlePath, opened with
+// passphrase, to the stores numbered in stores, every store if empty
+func ImportBundle(bundlePath string, stores []int, passphrase []byte) ([]ImportResult, BundleInfo, error) {
+	var info BundleInfo
+	file, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, info, err
+	}
+	defer file.Close()
+	opener, err := newBundleReader(file, passphrase)
+	if err != nil {
+		return nil, info, err
+	}
+	defer opener.Close()
+
+	cloudStores := preferences.AllCloudStores()
+	results := make([]ImportResult, len(cloudStores))
+	selected := make([]bool, len(cloudStores))
+	for i, cs := range cloudStores {
+		results[i] = ImportResult{Number: i + 1, Store: cs.ShortDescription()}
+		selected[i] = len(stores) == 0
+	}
+	for _, number := range stores {
+		selected[number-1] = true
+	}
+
+	_, files := verifiedObjects()
+	names := make([]map[string][]string, len(cloudStores))
+	imported := make([][]string, len(cloudStores))
+	archive := tar.NewReader(opener)
+	for {
+		if taskCanceled() {
+			return results, info, errors.New("import canceled")
+		}
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return results, info, err
+		}
+		if header.Name == "bundle.json" {
+			data, err := ioutil.ReadAll(archive)
+			if err != nil {
+				return results, info, err
+			}
+			if err := json.Unmarshal(data, &info); err != nil {
+				return results, info, fmt.Errorf("bad bundle.json: %s", err)
+			}
+			continue
+		}
+
+		number, object, ok := bundleObjectName(header.Name)
+		if !ok {
+			continue
+		}
+		if number > len(cloudStores) {
+			color.Yellow("Skipping %s: there is no store %v", header.Name, number)
+			continue
+		}
+		index := number - 1
+		if !selected[index] {
+			continue
+		}
+		result := &results[index]
+
+		if names[index] == nil {
+			names[index] = storedNames(cloudStores[index].List())
+		}
+		if parts, stored := names[index][object]; stored && !missingPart(parts) {
+			result.Present++
+			continue
+		}
+
+		data, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return results, info, err
+		}
+		if err := checkImported(files, object, number, data); err != nil {
+			color.Red("%s: not importing %s: %s", result.Store, object, err)
+			wipe(data)
+			result.Failed++
+			countError()
+			continue
+		}
+
+		sid, version, tombstone := ParseObjectName(object)
+		cloudStores[index].Upload(Share{SID: sid, Version: version, Tombstone: tombstone, Data: data})
+		imported[index] = append(imported[index], object)
+		result.Bytes += int64(len(data))
+		countFile(int64(len(data)), false)
+		wipe(data)
+	}
+
+	// a bundle ends with its description, so a missing one means it was cut
+	if info.Created.IsZero() {
+		return results, info, errors.New("the bundle is truncated")
+	}
+
+	// uploads report no errors, so the stores are listed again
+	for i, objects := range imported {
+		if len(objects) == 0 {
+			continue
+		}
+		stored := storedNames(cloudStores[i].List())
+		for _, object := range objects {
+			if missingPart(stored[object]) {
+				results[i].Failed++
+			} else {
+				results[i].Imported++
+			}
+		}
+	}
+	return results, info, nil
+}
+
+// bundleObjectName parses stores/<store number>/<object>
+func bundleObjectName(name string) (int, string, bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 3 || parts[0] != "stores" || parts[2] == "" {
+		return 0, "", false
+	}
+	number, err := strconv.Atoi(parts[1])
+	if err != nil || number < 1 {
+		return 0, "", false
+	}
+	return number, parts[2], true
+}
+
+func missingPart(parts []string) bool {
+	for _, part := range parts {
+		if part == "" {
+			return true
+		}
+	}
+	return len(parts) == 0
+}
+
+// checkImported checks the object of store number in a bundle, against the
+// manifest if it knows the object
+func checkImported(files map[string]FileShare, object string, number int, data []byte) error {
+	if !bytes.HasPrefix(data, []byte(recovery.Magic)) {
+		if fileShare, ok := files[object]; ok {
+			return checkShare(fileShare, data)
+		}
+		return nil
+	}
+
+	if _, err := recovery.Decode(data); err != nil {
+		return err
+	}
+	if x := shareX(data); x != number {
+		return fmt.Errorf("it is share %v, not the share of store %v", x, number)
+	}
+	if fileShare, ok := files[object]; ok {
+		return checkStored(fileShare, data)
+	}
+	return nil
+}
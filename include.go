@@ -0,0 +1,75 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// includeRulesFor returns the include patterns of the nearest ancestor
+// directory of filePath that has any, and whether one was found
+func includeRulesFor(filePath string) ([]string, bool) {
+	for dir := path.Dir(path.Clean(filePath)); ; dir = path.Dir(dir) {
+		if patterns, ok := preferences.IncludeRules[dir]; ok {
+			return patterns, true
+		}
+		if dir == "/" || dir == "." {
+			return nil, false
+		}
+	}
+}
+
+// IsIncluded checks if a regular file matches the include rules of the
+// directory it was added under. Files outside such directories are included
+func IsIncluded(filePath string) bool {
+	patterns, ok := includeRulesFor(filePath)
+	if !ok {
+		return true
+	}
+
+	base := filepath.Base(filePath)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SetIncludeRules persists the include patterns for dirPath, replacing any
+// previous ones. No patterns removes the rules
+func SetIncludeRules(dirPath string, patterns []string) {
+	if preferences.IncludeRules == nil {
+		preferences.IncludeRules = make(map[string][]string)
+	}
+
+	dirPath = path.Clean(dirPath)
+	if len(patterns) == 0 {
+		delete(preferences.IncludeRules, dirPath)
+		return
+	}
+
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			color.Red("Warning: invalid include pattern %q: %s", pattern, err)
+		}
+	}
+
+	preferences.IncludeRules[dirPath] = patterns
+	color.Green("Only tracking %s in %s", strings.Join(patterns, ", "), dirPath)
+}
+
+// includeRootsOutside lists directories with include rules that are not
+// inside root, so sync can rescan them
+func includeRootsOutside(root string) []string {
+	var dirs []string
+	for dir := range preferences.IncludeRules {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
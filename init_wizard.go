@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/fatih/color"
+)
+
+// `chasm init` walks a new user through setting up a vault, one question at
+// a time: the root, two or more stores, a protected directory, exclusion
+// sets and retention. Each step runs the command a user would run by hand,
+// so the wizard stays in step with them. It ends with a drill, syncing a
+// test file and reading its shares back from every store, and a recovery
+// kit of the stores.
+
+// drillFile is the file synced and read back by the restore drill
+const drillFile = "chasm-drill.txt"
+
+// wizard asks questions on stdin
+type wizard struct {
+	app *cli.App
+	in  *bufio.Reader
+}
+
+// ask prints question and returns the answer, or def if it is empty
+func (w wizard) ask(question, def string) string {
+	if def != "" {
+		question += " [" + def + "]"
+	}
+	color.Cyan(question)
+	answer, _ := w.in.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return def
+	}
+	return answer
+}
+
+// yes asks a yes or no question
+func (w wizard) yes(question string, def bool) bool {
+	answer := "n"
+	if def {
+		answer = "y"
+	}
+	return strings.HasPrefix(strings.ToLower(w.ask(question+" (y/n)", answer)), "y")
+}
+
+// run runs a chasm command on the wizard's root
+func (w wizard) run(args ...string) error {
+	global := []string{w.app.Name, "--root", chasmRoot}
+	if allowNestedVaults {
+		global = append(global, "--allow-nested")
+	}
+	return w.app.Run(append(global, args...))
+}
+
+// splitArgs splits a command line at spaces, keeping quoted parts together
+func splitArgs(line string) []string {
+	var args []string
+	var arg strings.Builder
+	quote, inArg := rune(0), false
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote, inArg = r, true
+		case quote == 0 && (r == ' ' || r == '\t'):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args
+}
+
+// storeKinds lists the store types of the add command
+func storeKinds(app *cli.App) []string {
+	var kinds []string
+	for _, command := range app.Commands {
+		if command.Name != "add" {
+			continue
+		}
+		for _, sub := range command.Subcommands {
+			kinds = append(kinds, sub.Name)
+		}
+	}
+	return kinds
+}
+
+// RestoreDrill reads the shares of filePath back from every store and
+// combines them, returning the stores that failed
+func RestoreDrill(filePath string) (int, error) {
+	fileShare, ok := preferences.FileMap[filePath]
+	if !ok {
+		return 0, fmt.Errorf("%s was not synced", filePath)
+	}
+	object := fileShare.ObjectName()
+
+	failed := 0
+	var shares []Share
+	for i, cs := range preferences.cloudStores() {
+		data, err := readStored(storeRef(i+1), storedNames(cs.List()), object)
+		if err == nil {
+			err = checkStored(fileShare, data)
+		}
+		if err != nil {
+			color.Red(statusLine(true, fmt.Sprintf("%s: %s", cs.ShortDescription(), err)))
+			failed++
+			continue
+		}
+		color.Green(statusLine(false, cs.ShortDescription()+": share read back"))
+		shares = append(shares, Share{SID: fileShare.SID, Version: fileShare.Version, Data: data})
+	}
+	defer func() {
+		for _, share := range shares {
+			wipe(share.Data)
+		}
+	}()
+
+	contents := CombineShares(shares)
+	defer wipe(contents)
+	if len(contents) == 0 || !checkSHA2(fileShare.Hash, contents) {
+		return failed, errors.New("the shares read back do not combine to the file")
+	}
+	return failed, nil
+}
+
+func initChasm(c *cli.Context) error {
+	w := wizard{app: c.App, in: bufio.NewReader(os.Stdin)}
+	color.Green("Welcome to chasm. A few questions set up a vault; press enter to take the default in brackets.")
+
+	// (1) the root
+	root, err := filepath.Abs(w.ask("Folder to keep safe in chasm:", chasmRoot))
+	if err != nil {
+		return cli.NewExitError(color.RedString("Error: %s", err), 1)
+	}
+	if outer := enclosingVault(root); outer != "" && !allowNestedVaults {
+		color.Yellow("%s is inside the vault at %s, which would back it up a second time.", root, outer)
+		if !w.yes("Set up a vault inside it anyway?", false) {
+			return nil
+		}
+		allowNestedVaults = true
+	}
+	chasmRoot = root
+	loadChasm(c)
+	if fleetManaged() {
+		color.Yellow("This vault is managed by a fleet config, its stores and settings come from there.")
+	}
+
+	// (2) at least two stores, each holding a share that alone reveals nothing
+	if !fleetManaged() {
+		color.Green("\nEach store keeps one share of every file. Any single store learns nothing, and files come back as long as enough stores do.")
+		fmt.Println("Store types:", strings.Join(storeKinds(c.App), ", "))
+		for {
+			loadChasm(c)
+			count := preferences.RegisteredServices()
+			question := fmt.Sprintf("Store %v to add, as you would write after chasm add, e.g. folder /media/usb/chasm or discover:", count+1)
+			if count >= 2 {
+				question = fmt.Sprintf("You have %v stores. Another one to add, or enter to go on:", count)
+			}
+			line := w.ask(question, "")
+			if line == "" {
+				if count >= 2 {
+					break
+				}
+				color.Red("chasm needs at least two stores.")
+				continue
+			}
+			if err := w.run(append([]string{"add"}, splitArgs(line)...)...); err != nil {
+				color.Red("Error: %s", err)
+			}
+		}
+	}
+
+	// (3) a passphrase for the most private files
+	if w.yes("\nKeep a directory under an extra passphrase, needed to restore its files?", false) {
+		dir := w.ask("Directory to protect:", path.Join(root, "Private"))
+		os.MkdirAll(dir, 0770)
+		if err := w.run("protect", dir); err != nil {
+			color.Red("Error: %s", err)
+		}
+	}
+
+	// (4) default policies
+	loadChasm(c)
+	if !fleetManaged() {
+		fmt.Println()
+		w.run("exclude", "list")
+		for _, name := range splitArgs(strings.Replace(w.ask("Exclusion sets to enable, separated by spaces:", ""), ",", " ", -1)) {
+			w.run("exclude", "enable", name)
+		}
+
+		loadChasm(c)
+		days := w.ask("Days to keep superseded and deleted shares:", strconv.Itoa(preferences.RetentionDays))
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			preferences.RetentionDays = n
+			preferences.Save()
+		}
+	}
+
+	// (5) a first backup and restore drill
+	drillPath := path.Join(root, drillFile)
+	if w.yes("\nSync now, with a test file to check every store can give its share back?", true) {
+		secret := make([]byte, 24)
+		rand.Read(secret)
+		contents := fmt.Sprintf("chasm restore drill %s\n", base64.URLEncoding.EncodeToString(secret))
+		if err := ioutil.WriteFile(drillPath, []byte(contents), 0660); err != nil {
+			color.Red("Error: cannot write %s: %s", drillPath, err)
+		} else {
+			w.run("sync")
+			loadChasm(c)
+			failed, err := RestoreDrill(drillPath)
+			if err != nil || failed > 0 {
+				color.Red("Restore drill failed: %v stores could not give their share back. %v", failed, err)
+			} else {
+				color.Green("Restore drill passed: every store gave its share back.")
+			}
+			os.Remove(drillPath)
+		}
+	}
+
+	// (6) the recovery kit
+	if w.yes("\nWrite a paper recovery kit of the stores, split into pages?", true) {
+		pages := w.ask("Pages:", "3")
+		threshold := w.ask("Pages needed to recover:", "2")
+		out := w.ask("Directory to write the pages to:", "chasm-recovery-kit")
+		w.run("recovery-kit", "qr", "--pages", pages, "--threshold", threshold, "--out", out)
+	}
+
+	color.Green("\nAll set. chasm start keeps %s synced from now on.", root)
+	return nil
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// IPFSStore adds shares to an IPFS node through its RPC API, pinned so the
+// node keeps them, and remembers the CID of every object to fetch it back
+// by. With a pinning service the CIDs are also pinned there, by object
+// name, so shares outlive the node and a new machine finds them by listing
+// the service's pins
+type IPFSStore struct {
+	// RPC API of the node, e.g. http://127.0.0.1:5001
+	API string `json:"api"`
+
+	// Pinning Service API endpoint and access token, if any
+	PinService string `json:"pin_service,omitempty"`
+	PinToken   string `json:"-"`
+
+	// CID of every object, by object name
+	CIDs map[string]string `json:"cids"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (s *IPFSStore) credentials() map[string]*string {
+	return map[string]*string{"pin_token": &s.PinToken}
+}
+
+const defaultIPFSAPI = "http://127.0.0.1:5001"
+
+// pins listed per pinning service request, the most the API allows
+const ipfsPinPageSize = 1000
+
+// guards the CIDs of every IPFS store
+var ipfsLock sync.Mutex
+
+type ipfsError struct {
+	Status  string
+	Message string `json:"Message"`
+}
+
+func (e ipfsError) Error() string {
+	if e.Message == "" {
+		return e.Status
+	}
+	return fmt.Sprintf("%s: %s", e.Status, e.Message)
+}
+
+// ipfsPin is a pin of the Pinning Service API
+type ipfsPin struct {
+	RequestID string `json:"requestid"`
+	Created   string `json:"created"`
+	Pin       struct {
+		CID  string `json:"cid"`
+		Name string `json:"name"`
+	} `json:"pin"`
+}
+
+// Setup checks the node and the pinning service are reachable
+func (s IPFSStore) Setup() bool {
+	for _, is := range preferences.IPFSStores {
+		if is.API == s.API && is.PinService == s.PinService {
+			color.Red("IPFS store at %s already exists.", s.API)
+			return false
+		}
+	}
+
+	if _, err := s.rpc("version", nil, nil, ""); err != nil {
+		color.Red("Error: cannot reach the IPFS node at %s: %s", s.API, err)
+		return false
+	}
+	if s.PinService != "" {
+		if _, err := s.pins(url.Values{"limit": {"1"}}); err != nil {
+			color.Red("Error: cannot reach the pinning service %s: %s", s.PinService, err)
+			return false
+		}
+	}
+	return true
+}
+
+// rpc calls a command of the node's RPC API, which only takes POST
+func (s IPFSStore) rpc(command string, query url.Values, body []byte, contentType string) ([]byte, error) {
+	req, err := http.NewRequest("POST", strings.TrimSuffix(s.API, "/")+"/api/v0/"+command+"?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return s.send(req)
+}
+
+// pinService sends a request to the pinning service
+func (s IPFSStore) pinService(method, target string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(s.PinService, "/")+target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.PinToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return s.send(req)
+}
+
+func (s IPFSStore) send(req *http.Request) ([]byte, error) {
+	resp, err := storeHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		ipfsErr := ipfsError{Status: resp.Status}
+		json.Unmarshal(data, &ipfsErr)
+		if ipfsErr.Message == "" {
+			// the pinning service nests its error
+			var nested struct {
+				Error struct {
+					Reason  string `json:"reason"`
+					Details string `json:"details"`
+				} `json:"error"`
+			}
+			json.Unmarshal(data, &nested)
+			ipfsErr.Message = strings.TrimSpace(nested.Error.Reason + " " + nested.Error.Details)
+		}
+		return nil, ipfsErr
+	}
+	return data, nil
+}
+
+// cid is the CID of object, from the store's record or else the pinning
+// service
+func (s IPFSStore) cid(object string) (string, error) {
+	ipfsLock.Lock()
+	cid, ok := s.CIDs[object]
+	ipfsLock.Unlock()
+	if ok {
+		return cid, nil
+	}
+
+	if s.PinService != "" {
+		pins, err := s.pins(url.Values{"name": {object}, "match": {"exact"}})
+		if err != nil {
+			return "", err
+		}
+		if len(pins) > 0 {
+			return pins[0].Pin.CID, nil
+		}
+	}
+	return "", errors.New("object not found")
+}
+
+// pins lists the pinned pins of the pinning service matching query, a page
+// at a time
+func (s IPFSStore) pins(query url.Values) ([]ipfsPin, error) {
+	query.Set("status", "pinned")
+	if query.Get("limit") == "" {
+		query.Set("limit", fmt.Sprint(ipfsPinPageSize))
+	}
+
+	var all []ipfsPin
+	for {
+		data, err := s.pinService("GET", "/pins?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Count   int       `json:"count"`
+			Results []ipfsPin `json:"results"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return nil, err
+		}
+		all = append(all, page.Results...)
+		if len(page.Results) == 0 || len(all) >= page.Count || query.Get("limit") != fmt.Sprint(ipfsPinPageSize) {
+			return all, nil
+		}
+		query.Set("before", page.Results[len(page.Results)-1].Created)
+	}
+}
+
+// add adds data to the node, pinned, returning its CID
+func (s IPFSStore) add(object string, data []byte) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", object)
+	if err != nil {
+		return "", err
+	}
+	part.Write(data)
+	form.Close()
+
+	resp, err := s.rpc("add", url.Values{"pin": {"true"}, "cid-version": {"1"}}, body.Bytes(), form.FormDataContentType())
+	if err != nil {
+		return "", err
+	}
+	var added struct {
+		Hash string `json:"Hash"`
+	}
+	if err := json.Unmarshal(resp, &added); err != nil {
+		return "", err
+	}
+	if added.Hash == "" {
+		return "", errors.New("node returned no CID")
+	}
+	return added.Hash, nil
+}
+
+// Upload adds the share to the node and pins it, refusing to replace an
+// existing object
+func (s IPFSStore) Upload(share Share) {
+	object := share.ObjectName()
+	fmt.Print(color.MagentaString("Uploading IPFS/%s...", object))
+
+	_, err := s.cid(object)
+	if err == nil {
+		err = errors.New("object exists")
+	} else if s.CIDs == nil {
+		err = errors.New("store has no CID record, add it again")
+	} else {
+		var cid string
+		cid, err = s.add(object, share.Data)
+		if err == nil && s.PinService != "" {
+			pin, _ := json.Marshal(map[string]string{"cid": cid, "name": object})
+			_, err = s.pinService("POST", "/pins", pin)
+		}
+		if err == nil {
+			ipfsLock.Lock()
+			s.CIDs[object] = cid
+			ipfsLock.Unlock()
+		}
+	}
+	if err != nil {
+		color.Red("IPFS/%s upload failed: %v", object, err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// Remove unpins a single object, from the pinning service too. The node
+// drops its blocks on its next garbage collection
+func (s IPFSStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting IPFS/%s...", object))
+	cid, err := s.cid(object)
+	if err == nil {
+		_, err = s.rpc("pin/rm", url.Values{"arg": {cid}}, nil, "")
+		if e, ok := err.(ipfsError); ok && strings.Contains(e.Message, "not pinned") {
+			err = nil
+		}
+	}
+	if err == nil && s.PinService != "" {
+		var pins []ipfsPin
+		pins, err = s.pins(url.Values{"name": {object}, "match": {"exact"}})
+		for _, pin := range pins {
+			if err == nil {
+				_, err = s.pinService("DELETE", "/pins/"+pin.RequestID, nil)
+			}
+		}
+	}
+	if err != nil {
+		color.Red("Error: could not delete %s from IPFS: %s", object, err)
+		return
+	}
+	ipfsLock.Lock()
+	delete(s.CIDs, object)
+	ipfsLock.Unlock()
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all objects, recorded or pinned by name on the
+// pinning service
+func (s IPFSStore) list() ([]string, error) {
+	names := make(map[string]bool)
+	ipfsLock.Lock()
+	for object := range s.CIDs {
+		names[object] = true
+	}
+	ipfsLock.Unlock()
+
+	if s.PinService != "" {
+		pins, err := s.pins(url.Values{})
+		if err != nil {
+			return nil, err
+		}
+		for _, pin := range pins {
+			if pin.Pin.Name != "" {
+				names[pin.Pin.Name] = true
+			}
+		}
+	}
+
+	objects := make([]string, 0, len(names))
+	for object := range names {
+		objects = append(objects, object)
+	}
+	sort.Strings(objects)
+	return objects, nil
+}
+
+// List returns the names of all objects
+func (s IPFSStore) List() []string {
+	objects, err := s.list()
+	if err != nil {
+		color.Red("Error listing IPFS objects: %s", err)
+		return nil
+	}
+	return objects
+}
+
+// Read fetches a single object by its CID
+func (s IPFSStore) Read(object string) ([]byte, error) {
+	cid, err := s.cid(object)
+	if err != nil {
+		return nil, err
+	}
+	return s.rpc("cat", url.Values{"arg": {cid}}, nil, "")
+}
+
+// ReadRange fetches length bytes of an object from offset
+func (s IPFSStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	cid, err := s.cid(object)
+	if err != nil {
+		return nil, err
+	}
+	return s.rpc("cat", url.Values{"arg": {cid}, "offset": {fmt.Sprint(offset)}, "length": {fmt.Sprint(length)}}, nil, "")
+}
+
+// Restore fetches every object by CID into a local temp dir
+func (s IPFSStore) Restore() string {
+	objects, err := s.list()
+	if err != nil {
+		color.Red("Error listing IPFS objects: %s", err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_ipfs_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Fetching shares from IPFS...")
+	for _, object := range objects {
+		data, err := s.Read(object)
+		if err != nil {
+			color.Yellow("Error fetching share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects with their CIDs
+func (s IPFSStore) Description() string {
+	if _, err := s.rpc("version", nil, nil, ""); err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", s.ShortDescription(), err)
+	}
+
+	label := s.ShortDescription()
+	ipfsLock.Lock()
+	defer ipfsLock.Unlock()
+	objects := make([]string, 0, len(s.CIDs))
+	for object := range s.CIDs {
+		objects = append(objects, object)
+	}
+	sort.Strings(objects)
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s %s", color.YellowString("-"), object, s.CIDs[object])
+	}
+	return label
+}
+
+func (s IPFSStore) ShortDescription() string {
+	if s.PinService != "" {
+		return "IPFS Store: " + s.API + " pinned at " + s.PinService
+	}
+	return "IPFS Store: " + s.API
+}
+
+// Clean unpins all shares
+func (s IPFSStore) Clean() {
+	for _, object := range s.List() {
+		color.Yellow("Removing IPFS Store: %v", object)
+		s.Remove(object)
+	}
+}
+
+// keepIPFSCIDs carries the recorded CIDs of the vault's IPFS stores over
+// to stores set by a fleet config, which does not know them
+func keepIPFSCIDs(managed []IPFSStore) []IPFSStore {
+	for i := range managed {
+		for _, is := range preferences.IPFSStores {
+			if is.API == managed[i].API && is.PinService == managed[i].PinService && managed[i].CIDs == nil {
+				managed[i].CIDs = is.CIDs
+			}
+		}
+		if managed[i].CIDs == nil {
+			managed[i].CIDs = make(map[string]string)
+		}
+	}
+	return managed
+}
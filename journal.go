@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// JournalCursor is the position in the filesystem change journal (the NTFS
+// USN journal or FSEvents history) taken at the start of the last sync
+type JournalCursor struct {
+	Root string `json:"root"`
+
+	// identifies the journal instance, a new one invalidates Position
+	Journal string `json:"journal"`
+
+	Position uint64 `json:"position"`
+}
+
+// syncChanges returns the paths under root changed since the last sync,
+// deduplicated and without ignored paths, and the cursor to save once this
+// sync completes. ok is false when the tree has to be walked instead
+func syncChanges(root string) (changed []string, next *JournalCursor, ok bool) {
+	since := state.Journal
+	if since != nil && since.Root != root {
+		since = nil
+	}
+
+	paths, next, ok := journalChanges(root, since)
+	if !ok || since == nil {
+		return nil, next, false
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		p = filepath.Clean(p)
+		if seen[p] || !journalPathValid(root, p) {
+			continue
+		}
+		seen[p] = true
+		changed = append(changed, p)
+	}
+
+	// parents before children, so new directories are added first
+	sort.Strings(changed)
+	return changed, next, true
+}
+
+// journalPathValid checks that p is inside root, and neither it nor any of
+// its parents below root would be skipped by a walk of the tree
+func journalPathValid(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+
+	if rel == chasmPrefFile || rel == chasmStateFile {
+		return false
+	}
+
+	for dir := p; dir != root; dir = filepath.Dir(dir) {
+		if !IsValidPath(dir) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyJournalChanges adds changed paths that exist and deletes tracked
+// ones that are gone. Adds go first, so renames are detected
+func applyJournalChanges(changed []string) {
+	var gone []string
+	bundles := make(map[string]bool)
+	for _, p := range changed {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			gone = append(gone, p)
+			continue
+		}
+
+		if dir, ok := gitBundleDir(p); ok {
+			bundles[dir] = true
+			continue
+		}
+
+		// known directories only change by their entries, which are listed too
+		if isDir(p) && preferences.DirMap[p] {
+			continue
+		}
+		AddFile(p)
+	}
+
+	// each changed repository is bundled once
+	for dir := range bundles {
+		addGitBundle(dir)
+	}
+
+	// renamed paths were moved by now and are no longer tracked
+	for _, p := range gone {
+		_, tracked := preferences.FileMap[p]
+		if tracked || preferences.DirMap[p] {
+			DeleteFile(p)
+		}
+	}
+}
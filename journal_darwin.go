@@ -0,0 +1,148 @@
+//go:build darwin && cgo
+
+package main
+
+/*
+#cgo LDFLAGS: -framework CoreServices
+#include <CoreServices/CoreServices.h>
+#include <dispatch/dispatch.h>
+#include <stdlib.h>
+#include <sys/stat.h>
+
+extern void chasmJournalEvents(uintptr_t handle, size_t count, char **paths, FSEventStreamEventFlags *flags);
+
+static void chasmJournalCallback(ConstFSEventStreamRef stream, void *info, size_t count, void *paths,
+		const FSEventStreamEventFlags flags[], const FSEventStreamEventId ids[]) {
+	chasmJournalEvents((uintptr_t)info, count, (char **)paths, (FSEventStreamEventFlags *)flags);
+}
+
+// chasmJournalStart replays the history of root since an event id on a
+// private queue, NULL if the stream cannot be started
+static FSEventStreamRef chasmJournalStart(uintptr_t handle, const char *root, FSEventStreamEventId since) {
+	FSEventStreamContext context = {0, (void *)handle, NULL, NULL, NULL};
+	CFStringRef path = CFStringCreateWithCString(NULL, root, kCFStringEncodingUTF8);
+	CFArrayRef paths = CFArrayCreate(NULL, (const void **)&path, 1, &kCFTypeArrayCallBacks);
+	FSEventStreamRef stream = FSEventStreamCreate(NULL, chasmJournalCallback, &context, paths, since, 0,
+		kFSEventStreamCreateFlagFileEvents | kFSEventStreamCreateFlagNoDefer);
+	CFRelease(paths);
+	CFRelease(path);
+	if (stream == NULL) {
+		return NULL;
+	}
+
+	FSEventStreamSetDispatchQueue(stream, dispatch_queue_create("chasm.journal", DISPATCH_QUEUE_SERIAL));
+	if (!FSEventStreamStart(stream)) {
+		FSEventStreamInvalidate(stream);
+		FSEventStreamRelease(stream);
+		return NULL;
+	}
+	return stream;
+}
+
+static void chasmJournalStop(FSEventStreamRef stream) {
+	FSEventStreamStop(stream);
+	FSEventStreamInvalidate(stream);
+	FSEventStreamRelease(stream);
+}
+
+// chasmJournalUUID writes the FSEvents UUID of the device holding root.
+// Event ids are only comparable while it stays the same
+static int chasmJournalUUID(const char *root, char *out, size_t size) {
+	struct stat st;
+	if (stat(root, &st) != 0) {
+		return 0;
+	}
+	CFUUIDRef uuid = FSEventsCopyUUIDForDevice(st.st_dev);
+	if (uuid == NULL) {
+		return 0;
+	}
+	CFStringRef s = CFUUIDCreateString(NULL, uuid);
+	Boolean ok = CFStringGetCString(s, out, size, kCFStringEncodingUTF8);
+	CFRelease(s);
+	CFRelease(uuid);
+	return ok;
+}
+*/
+import "C"
+
+import (
+	"runtime/cgo"
+	"time"
+	"unsafe"
+)
+
+// give up on the history and walk the tree if replaying takes this long
+const journalReplayTimeout = time.Minute
+
+// events that mean the history is incomplete for the watched tree
+const journalLostFlags = C.kFSEventStreamEventFlagMustScanSubDirs | C.kFSEventStreamEventFlagUserDropped |
+	C.kFSEventStreamEventFlagKernelDropped | C.kFSEventStreamEventFlagRootChanged | C.kFSEventStreamEventFlagEventIdsWrapped
+
+type fseventsHistory struct {
+	paths []string
+	lost  bool
+	done  chan bool
+}
+
+//export chasmJournalEvents
+func chasmJournalEvents(handle C.uintptr_t, count C.size_t, paths **C.char, flags *C.FSEventStreamEventFlags) {
+	history := cgo.Handle(handle).Value().(*fseventsHistory)
+	pathSlice := unsafe.Slice(paths, int(count))
+	flagSlice := unsafe.Slice(flags, int(count))
+
+	for i := range pathSlice {
+		select {
+		case <-history.done:
+			// live events after the history are picked up by the next sync
+			return
+		default:
+		}
+
+		if flagSlice[i]&C.kFSEventStreamEventFlagHistoryDone != 0 {
+			close(history.done)
+			return
+		}
+		if flagSlice[i]&journalLostFlags != 0 {
+			history.lost = true
+		}
+		history.paths = append(history.paths, C.GoString(pathSlice[i]))
+	}
+}
+
+// journalChanges replays the FSEvents history of root since the cursor
+func journalChanges(root string, since *JournalCursor) ([]string, *JournalCursor, bool) {
+	cRoot := C.CString(root)
+	defer C.free(unsafe.Pointer(cRoot))
+
+	var uuid [64]C.char
+	if C.chasmJournalUUID(cRoot, &uuid[0], C.size_t(len(uuid))) == 0 {
+		return nil, nil, false
+	}
+
+	next := &JournalCursor{Root: root, Journal: "fsevents-" + C.GoString(&uuid[0]), Position: uint64(C.FSEventsGetCurrentEventId())}
+	if since == nil || since.Journal != next.Journal || since.Position > next.Position {
+		return nil, next, false
+	}
+
+	history := &fseventsHistory{done: make(chan bool)}
+	handle := cgo.NewHandle(history)
+	defer handle.Delete()
+
+	stream := C.chasmJournalStart(C.uintptr_t(handle), cRoot, C.FSEventStreamEventId(since.Position))
+	if stream == nil {
+		return nil, next, false
+	}
+
+	complete := true
+	select {
+	case <-history.done:
+	case <-time.After(journalReplayTimeout):
+		complete = false
+	}
+	C.chasmJournalStop(stream)
+
+	if !complete || history.lost {
+		return nil, next, false
+	}
+	return history.paths, next, true
+}
@@ -0,0 +1,8 @@
+//go:build !windows && !(darwin && cgo)
+
+package main
+
+// journalChanges is unsupported on this platform, sync always walks the tree
+func journalChanges(root string, since *JournalCursor) ([]string, *JournalCursor, bool) {
+	return nil, nil, false
+}
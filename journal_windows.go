@@ -0,0 +1,147 @@
+//go:build windows
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	fsctlQueryUsnJournal = 0x000900f4
+	fsctlReadUsnJournal  = 0x000900bb
+)
+
+// USN_JOURNAL_DATA_V0
+type usnJournalData struct {
+	UsnJournalID    uint64
+	FirstUsn        int64
+	NextUsn         int64
+	LowestValidUsn  int64
+	MaxUsn          int64
+	MaximumSize     uint64
+	AllocationDelta uint64
+}
+
+// READ_USN_JOURNAL_DATA_V0
+type readUsnJournalData struct {
+	StartUsn          int64
+	ReasonMask        uint32
+	ReturnOnlyOnClose uint32
+	Timeout           uint64
+	BytesToWaitFor    uint64
+	UsnJournalID      uint64
+}
+
+// journalChanges reads the NTFS USN journal of root's volume. Records only
+// carry a name and the parent directory's file reference, so the directories
+// under root are mapped to their references first, which is far cheaper than
+// stat-ing every file. Opening the volume needs administrator rights
+func journalChanges(root string, since *JournalCursor) ([]string, *JournalCursor, bool) {
+	volumePath, err := syscall.UTF16PtrFromString(`\\.\` + filepath.VolumeName(root))
+	if err != nil {
+		return nil, nil, false
+	}
+	volume, err := syscall.CreateFile(volumePath, syscall.GENERIC_READ,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil, syscall.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return nil, nil, false
+	}
+	defer syscall.CloseHandle(volume)
+
+	var journal usnJournalData
+	var n uint32
+	err = syscall.DeviceIoControl(volume, fsctlQueryUsnJournal, nil, 0,
+		(*byte)(unsafe.Pointer(&journal)), uint32(unsafe.Sizeof(journal)), &n, nil)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	next := &JournalCursor{Root: root, Journal: fmt.Sprintf("usn-%016x", journal.UsnJournalID), Position: uint64(journal.NextUsn)}
+	if since == nil || since.Journal != next.Journal || int64(since.Position) < journal.LowestValidUsn {
+		// no cursor, a recreated journal, or records we needed were purged
+		return nil, next, false
+	}
+
+	dirs := directoryReferences(root)
+
+	var paths []string
+	buf := make([]byte, 64*1024)
+	read := readUsnJournalData{StartUsn: int64(since.Position), ReasonMask: 0xffffffff, UsnJournalID: journal.UsnJournalID}
+	for read.StartUsn < journal.NextUsn {
+		err := syscall.DeviceIoControl(volume, fsctlReadUsnJournal,
+			(*byte)(unsafe.Pointer(&read)), uint32(unsafe.Sizeof(read)), &buf[0], uint32(len(buf)), &n, nil)
+		if err != nil {
+			return nil, next, false
+		}
+		if n <= 8 {
+			break
+		}
+
+		// the output starts with the USN to continue from, then USN_RECORD_V2s
+		for off := uint32(8); off+60 <= n; {
+			record := buf[off:n]
+			length := binary.LittleEndian.Uint32(record)
+			if length < 60 || length > uint32(len(record)) {
+				break
+			}
+
+			if binary.LittleEndian.Uint16(record[4:]) == 2 {
+				parent := binary.LittleEndian.Uint64(record[16:])
+				nameLength := uint32(binary.LittleEndian.Uint16(record[56:]))
+				nameOffset := uint32(binary.LittleEndian.Uint16(record[58:]))
+				if dir, ok := dirs[parent]; ok && nameOffset+nameLength <= length {
+					paths = append(paths, filepath.Join(dir, utf16Name(record[nameOffset:nameOffset+nameLength])))
+				}
+			}
+			off += length
+		}
+		read.StartUsn = int64(binary.LittleEndian.Uint64(buf))
+	}
+
+	return paths, next, true
+}
+
+// directoryReferences maps the NTFS file reference of every directory a
+// walk of root would visit to its path
+func directoryReferences(root string) map[uint64]string {
+	dirs := make(map[uint64]string)
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if p != root && !IsValidPath(p) {
+			return filepath.SkipDir
+		}
+
+		name, err := syscall.UTF16PtrFromString(p)
+		if err != nil {
+			return nil
+		}
+		handle, err := syscall.CreateFile(name, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+			nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+		if err != nil {
+			return nil
+		}
+		defer syscall.CloseHandle(handle)
+
+		var info syscall.ByHandleFileInformation
+		if syscall.GetFileInformationByHandle(handle, &info) == nil {
+			dirs[uint64(info.FileIndexHigh)<<32|uint64(info.FileIndexLow)] = p
+		}
+		return nil
+	})
+	return dirs
+}
+
+func utf16Name(b []byte) string {
+	chars := make([]uint16, len(b)/2)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return syscall.UTF16ToString(chars)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// KBFSStore keeps shares in a directory of a Keybase user's private folder,
+// through the KBFS mount of the Keybase app. KBFS encrypts and signs files
+// on the client and keeps their history, and the app is already signed in,
+// so the store needs no settings of its own. The mount point differs by
+// system and is found each time, so the store works on every machine the
+// user is signed in on. While KBFS is not mounted shares are queued like
+// for a folder store on an unmounted volume
+type KBFSStore struct {
+	User string `json:"user"`
+
+	// directory in the private folder
+	Folder string `json:"folder"`
+}
+
+const defaultKBFSFolder = "chasm"
+
+// where the Keybase app mounts KBFS, by system
+var kbfsMountPoints = map[string][]string{
+	"linux":   {"/keybase"},
+	"darwin":  {"/keybase", "/Volumes/Keybase"},
+	"windows": {`K:\`},
+}
+
+// kbfsMount finds the KBFS mount point, the usual one if none exists
+func kbfsMount() string {
+	candidates := kbfsMountPoints[runtime.GOOS]
+	if len(candidates) == 0 {
+		candidates = []string{"/keybase"}
+	}
+	for _, mount := range candidates {
+		if _, err := os.Stat(filepath.Join(mount, "private")); err == nil {
+			return mount
+		}
+	}
+	return candidates[0]
+}
+
+// keybaseUser asks the Keybase app who is signed in
+func keybaseUser() (string, error) {
+	out, err := exec.Command("keybase", "whoami").Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot ask keybase who is signed in: %s", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// folder is the folder store the KBFS store writes through
+func (k KBFSStore) folder() FolderStore {
+	mount := kbfsMount()
+	return FolderStore{Path: filepath.Join(mount, "private", k.User, k.Folder), Mount: mount}
+}
+
+// Setup checks that KBFS is mounted and creates the directory
+func (k KBFSStore) Setup() bool {
+	for _, ks := range preferences.KBFSStores {
+		if ks.User == k.User && ks.Folder == k.Folder {
+			color.Red("KBFS store at %s already exists.", k.folder().Path)
+			return false
+		}
+	}
+
+	f := k.folder()
+	if !f.present() {
+		color.Red("Error: KBFS is not mounted at %s, start the Keybase app first.", f.Mount)
+		return false
+	}
+	if err := os.MkdirAll(f.Path, 0700); err != nil {
+		color.Red("Error: cannot set up %s: %s", f.Path, err)
+		return false
+	}
+	return true
+}
+
+// Upload writes the share into the private folder, queueing it while KBFS
+// is not mounted
+func (k KBFSStore) Upload(share Share) {
+	k.folder().Upload(share)
+}
+
+// Remove permanently deletes a single object. KBFS still keeps it in the
+// folder's history for a while
+func (k KBFSStore) Remove(object string) {
+	k.folder().Remove(object)
+}
+
+// List returns the names of all objects in the directory
+func (k KBFSStore) List() []string {
+	return k.folder().List()
+}
+
+// Read downloads a single object
+func (k KBFSStore) Read(object string) ([]byte, error) {
+	return k.folder().Read(object)
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (k KBFSStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	return k.folder().ReadRange(object, offset, length)
+}
+
+// Restore returns the directory, which KBFS fetches from as it is read
+func (k KBFSStore) Restore() string {
+	return k.folder().Restore()
+}
+
+// Description lists the objects in the directory
+func (k KBFSStore) Description() string {
+	f := k.folder()
+	if !f.present() {
+		return fmt.Sprintf("%s (unreachable: KBFS is not mounted at %s)", k.ShortDescription(), f.Mount)
+	}
+
+	label := k.ShortDescription()
+	for _, object := range f.List() {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (k KBFSStore) ShortDescription() string {
+	return "KBFS Store: /keybase/private/" + k.User + "/" + k.Folder
+}
+
+// Clean deletes all shares from the directory
+func (k KBFSStore) Clean() {
+	k.folder().Clean()
+}
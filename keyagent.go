@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/TheLisztomaniac/chasmOriginal/keywrap"
+	"github.com/fatih/color"
+)
+
+// A key agent keeps unlocked keywrap keys in memory, like ssh-agent, so that
+// scheduled runs do not ask for their passphrases every run. It runs with
+// `chasm agent keys --ttl DURATION`, is handed keys by name once their
+// passphrases are given, and `chasm agent lock` makes it forget them. Keys
+// are also forgotten when their TTL runs out and when the machine wakes from
+// suspend, seen as the wall clock jumping ahead of the monotonic one, which
+// stops during sleep on Linux and macOS. The agent listens on a socket in a
+// directory only its user can open, one per vault, and never writes the keys
+// to disk. Restore asks the agent for the keys of protected directories, held
+// under the directory, before it asks for their passphrases, and `chasm agent
+// unlock` hands it those keys.
+
+// default time a key agent keeps keys
+const defaultKeyAgentTTL = time.Hour
+
+// how often the key agent checks for expired keys and suspend
+const keyAgentTick = 10 * time.Second
+
+// wall clock time beyond the monotonic time that counts as a suspend
+const keyAgentSuspendGap = 30 * time.Second
+
+// KeyAgent holds unlocked keys by name
+type KeyAgent struct {
+	ttl time.Duration
+
+	mu   sync.Mutex
+	keys map[string]heldKey
+}
+
+// heldKey is a private key held by the agent, in memory locked into RAM
+type heldKey struct {
+	key     []byte
+	release func()
+	expires time.Time
+}
+
+// KeyAgentKey is a named private key handed to the agent
+type KeyAgentKey struct {
+	Name string
+	Key  string
+}
+
+func newKeyAgent(ttl time.Duration) *KeyAgent {
+	return &KeyAgent{ttl: ttl, keys: make(map[string]heldKey)}
+}
+
+// Add keeps a key for the agent's TTL
+func (a *KeyAgent) Add(args KeyAgentKey, reply *time.Time) error {
+	if _, err := keywrap.ParsePrivateKey(args.Key); err != nil {
+		return err
+	}
+	key, release := lockedBuffer(len(args.Key))
+	copy(key, args.Key)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if held, ok := a.keys[args.Name]; ok {
+		held.release()
+	}
+	a.keys[args.Name] = heldKey{key: key, release: release, expires: time.Now().Add(a.ttl)}
+	*reply = a.keys[args.Name].expires
+	return nil
+}
+
+// Get gives the key held under name, empty if none
+func (a *KeyAgent) Get(name string, reply *string) error {
+	a.expire(time.Now())
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if held, ok := a.keys[name]; ok {
+		*reply = string(held.key)
+	}
+	return nil
+}
+
+// Lock forgets every key, replying how many were held
+func (a *KeyAgent) Lock(_ struct{}, reply *int) error {
+	*reply = a.forget()
+	return nil
+}
+
+// forget wipes every key held
+func (a *KeyAgent) forget() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := len(a.keys)
+	for name, held := range a.keys {
+		held.release()
+		delete(a.keys, name)
+	}
+	return n
+}
+
+// expire wipes the keys whose TTL ran out by now
+func (a *KeyAgent) expire(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for name, held := range a.keys {
+		if !now.Before(held.expires) {
+			held.release()
+			delete(a.keys, name)
+			color.Yellow("Locked %s: its key expired.", name)
+		}
+	}
+}
+
+// watch expires keys, and forgets all of them when the machine was suspended
+func (a *KeyAgent) watch() {
+	last := time.Now()
+	for range time.Tick(keyAgentTick) {
+		now := time.Now()
+		if suspended(now.Round(0).Sub(last.Round(0)), now.Sub(last)) {
+			if n := a.forget(); n > 0 {
+				color.Yellow("Locked %v keys after a suspend.", n)
+			}
+		}
+		a.expire(now)
+		last = now
+	}
+}
+
+// suspended checks if the wall clock ran ahead of the monotonic clock over
+// the same interval
+func suspended(wall, monotonic time.Duration) bool {
+	return wall-monotonic > keyAgentSuspendGap
+}
+
+// keyAgentSocket is the socket of the key agent of the vault at root, in a
+// directory of the user's only
+func keyAgentSocket(root string) (string, error) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("chasm-%d", os.Getuid()))
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", err
+		}
+		if fi, err := os.Stat(dir); err != nil {
+			return "", err
+		} else if fi.Mode().Perm() != 0700 {
+			return "", fmt.Errorf("%s can be opened by other users", dir)
+		}
+	}
+	sum := sha256.Sum256([]byte(root))
+	return filepath.Join(dir, fmt.Sprintf("chasm-keys-%x.sock", sum[:6])), nil
+}
+
+// ServeKeyAgent holds keys for ttl on socket until interrupted
+func ServeKeyAgent(socket string, ttl time.Duration) error {
+	agent := newKeyAgent(ttl)
+	server := rpc.NewServer()
+	if err := server.Register(agent); err != nil {
+		return err
+	}
+
+	// a socket left by an agent that stopped
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		return fmt.Errorf("a key agent is running on %s", socket)
+	}
+	os.Remove(socket)
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(socket, 0600); err != nil {
+		return err
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		agent.forget()
+		listener.Close()
+	}()
+	go agent.watch()
+
+	color.Green("Holding keys for %s on %s", ttl, socket)
+	server.Accept(listener)
+	return nil
+}
+
+// callKeyAgent calls method of the key agent of this vault
+func callKeyAgent(method string, args, reply interface{}) error {
+	socket, err := keyAgentSocket(state.root)
+	if err != nil {
+		return err
+	}
+	client, err := rpc.Dial("unix", socket)
+	if err != nil {
+		return errors.New("no key agent is running, start it with chasm agent keys")
+	}
+	defer client.Close()
+	return client.Call("KeyAgent."+method, args, reply)
+}
+
+// agentKeys takes the keys of protected directories the key agent holds, if
+// one runs, ignoring keys that do not match the directory's
+func agentKeys(protected map[string]ProtectedPath) {
+	for dir, p := range protected {
+		if _, ok := unlockedPaths[dir]; ok {
+			continue
+		}
+		var secret string
+		if err := callKeyAgent("Get", dir, &secret); err != nil {
+			return
+		}
+		if secret == "" {
+			continue
+		}
+		key, err := keywrap.ParsePrivateKey(secret)
+		if err != nil || key.Public().String() != p.PublicKey {
+			continue
+		}
+		unlockedPaths[dir] = key
+	}
+}
+
+// AgentUnlock asks for the passphrases of the protected directories and
+// hands their keys to the key agent
+func AgentUnlock() error {
+	var secret string
+	if err := callKeyAgent("Get", "", &secret); err != nil {
+		return err
+	}
+	unlockProtected(preferences.Protected)
+	for dir, key := range unlockedPaths {
+		var expires time.Time
+		if err := callKeyAgent("Add", KeyAgentKey{Name: dir, Key: key.String()}, &expires); err != nil {
+			return err
+		}
+		color.Green("Unlocked %s until %s", dir, expires.Format("15:04"))
+	}
+	return nil
+}
+
+// AgentLock makes the key agent forget every key
+func AgentLock() (int, error) {
+	var n int
+	err := callKeyAgent("Lock", struct{}{}, &n)
+	return n, err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheLisztomaniac/chasmOriginal/keywrap"
+)
+
+func TestKeyAgent(t *testing.T) {
+	private, err := keywrap.GenerateKey(keywrap.Modes()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := newKeyAgent(time.Hour)
+
+	var expires time.Time
+	if err := agent.Add(KeyAgentKey{Name: "/secret", Key: private.String()}, &expires); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.Add(KeyAgentKey{Name: "/other", Key: "not a key"}, &expires); err == nil {
+		t.Error("added an invalid key")
+	}
+
+	var secret string
+	agent.Get("/secret", &secret)
+	if secret != private.String() {
+		t.Error("key not held")
+	}
+
+	agent.expire(expires.Add(-time.Minute))
+	if len(agent.keys) != 1 {
+		t.Error("key expired early")
+	}
+	agent.expire(expires)
+	if len(agent.keys) != 0 {
+		t.Error("key outlived its TTL")
+	}
+
+	agent.Add(KeyAgentKey{Name: "/secret", Key: private.String()}, &expires)
+	var locked int
+	agent.Lock(struct{}{}, &locked)
+	secret = ""
+	agent.Get("/secret", &secret)
+	if locked != 1 || secret != "" {
+		t.Error("key held after lock")
+	}
+}
+
+func TestSuspended(t *testing.T) {
+	if suspended(keyAgentTick, keyAgentTick) {
+		t.Error("suspend without a clock jump")
+	}
+	if !suspended(time.Hour, keyAgentTick) {
+		t.Error("no suspend when the wall clock jumped")
+	}
+}
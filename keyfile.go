@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// A keyfile is a second factor kept apart from the machine, such as on a USB
+// stick. A key that needs one is the HMAC of the keyfile keyed by the key
+// derived from the passphrase, so neither the passphrase nor the keyfile
+// gives it alone.
+
+// bytes of a new keyfile, and the fewest a keyfile may have
+const (
+	keyfileSize    = 32
+	keyfileMinSize = 16
+)
+
+// keyfileKey combines key, derived from a passphrase, with keyfile, wiping
+// key
+func keyfileKey(key, keyfile []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(keyfile)
+	wipe(key)
+	return mac.Sum(nil)
+}
+
+// readKeyfile reads the keyfile at keyfilePath
+func readKeyfile(keyfilePath string) ([]byte, error) {
+	keyfile, err := ioutil.ReadFile(keyfilePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyfile) < keyfileMinSize {
+		wipe(keyfile)
+		return nil, fmt.Errorf("keyfile %s is shorter than %v bytes", keyfilePath, keyfileMinSize)
+	}
+	return keyfile, nil
+}
+
+// makeKeyfile reads the keyfile at keyfilePath, writing a new random one
+// there first if there is none. It reports if it wrote one
+func makeKeyfile(keyfilePath string) ([]byte, bool, error) {
+	file, err := os.OpenFile(keyfilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if os.IsExist(err) {
+		keyfile, err := readKeyfile(keyfilePath)
+		return keyfile, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	keyfile := make([]byte, keyfileSize)
+	if _, err := rand.Read(keyfile); err != nil {
+		return nil, false, err
+	}
+	if _, err := file.Write(keyfile); err != nil {
+		wipe(keyfile)
+		os.Remove(keyfilePath)
+		return nil, false, err
+	}
+	return keyfile, true, file.Sync()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyfile(t *testing.T) {
+	keyfilePath := filepath.Join(t.TempDir(), "chasm.key")
+	keyfile, written, err := makeKeyfile(keyfilePath)
+	if err != nil || !written || len(keyfile) != keyfileSize {
+		t.Fatal("keyfile not written:", err)
+	}
+	again, written, err := makeKeyfile(keyfilePath)
+	if err != nil || written || !bytes.Equal(again, keyfile) {
+		t.Fatal("existing keyfile not read:", err)
+	}
+
+	short := filepath.Join(t.TempDir(), "short.key")
+	if err := ioutil.WriteFile(short, []byte("too short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readKeyfile(short); err == nil {
+		t.Error("read a keyfile shorter than the minimum")
+	}
+
+	key := func() []byte { return bytes.Repeat([]byte{1}, 32) }
+	combined := keyfileKey(key(), keyfile)
+	if bytes.Equal(combined, key()) || bytes.Equal(combined, keyfileKey(key(), again[:keyfileMinSize])) {
+		t.Error("combined key does not depend on the keyfile")
+	}
+	if !bytes.Equal(combined, keyfileKey(key(), keyfile)) {
+		t.Error("combined key is not deterministic")
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Package keywrap seals symmetric keys to a recipient's public key with HPKE
+(RFC 9180), for keys that have to be stored next to the data they protect.
+
+Key pairs use one of two KEMs:
+
+	x25519  DHKEM(X25519), compact and widely supported
+	hybrid  X25519 + ML-KEM-768, confidential as long as either holds
+
+Backups live for years, so anything wrapped today has to resist an attacker
+who records it now and gets a quantum computer later. The hybrid mode does,
+and keeps the classical guarantee should ML-KEM turn out to be weak.
+
+Wrapped keys are
+
+	offset  size  field
+	0       4     magic "CHWK"
+	4       1     format version (1)
+	5       2     HPKE KEM id, big endian
+	7       2     encapsulated key length e, big endian
+	9       e     encapsulated key
+	9+e     rest  sealed key: AES-256-GCM under HKDF-SHA256
+
+The HPKE info string binds the format version and a caller chosen context,
+such as "vault key", so a wrapped key cannot be unwrapped as something else.
+*/
+package keywrap
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hpke"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Magic starts every wrapped key
+const Magic = "CHWK"
+
+// FormatVersion is the wrapped key format written by Wrap
+const FormatVersion = 1
+
+const headerSize = 9
+
+// KEMs by mode name
+var kems = map[string]hpke.KEM{
+	"x25519": hpke.DHKEM(ecdh.X25519()),
+	"hybrid": hpke.MLKEM768X25519(),
+}
+
+// Modes lists the supported key pair modes
+func Modes() []string {
+	modes := make([]string, 0, len(kems))
+	for mode := range kems {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	return modes
+}
+
+// PrivateKey unwraps keys wrapped to its public key
+type PrivateKey struct {
+	mode string
+	key  hpke.PrivateKey
+}
+
+// PublicKey wraps keys
+type PublicKey struct {
+	mode string
+	key  hpke.PublicKey
+}
+
+// GenerateKey creates a key pair in mode
+func GenerateKey(mode string) (*PrivateKey, error) {
+	kem, ok := kems[mode]
+	if !ok {
+		return nil, fmt.Errorf("unknown key mode %q, use one of %s", mode, strings.Join(Modes(), ", "))
+	}
+	key, err := kem.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	return &PrivateKey{mode: mode, key: key}, nil
+}
+
+// Mode is the key pair's mode
+func (k *PrivateKey) Mode() string { return k.mode }
+
+// Public returns the key that wraps to k
+func (k *PrivateKey) Public() *PublicKey {
+	return &PublicKey{mode: k.mode, key: k.key.PublicKey()}
+}
+
+// Mode is the key pair's mode
+func (p *PublicKey) Mode() string { return p.mode }
+
+// PostQuantum reports whether keys wrapped to p resist quantum attacks
+func (p *PublicKey) PostQuantum() bool { return p.mode == "hybrid" }
+
+// String encodes the private key as "chasm-secret-<mode>:<base64url>"
+func (k *PrivateKey) String() string {
+	b, err := k.key.Bytes()
+	if err != nil {
+		panic(err)
+	}
+	return "chasm-secret-" + k.mode + ":" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// String encodes the public key as "chasm-<mode>:<base64url>"
+func (p *PublicKey) String() string {
+	return "chasm-" + p.mode + ":" + base64.RawURLEncoding.EncodeToString(p.key.Bytes())
+}
+
+// ParsePrivateKey decodes a private key encoded by String
+func ParsePrivateKey(s string) (*PrivateKey, error) {
+	mode, b, err := parseKey(s, "chasm-secret-")
+	if err != nil {
+		return nil, err
+	}
+	key, err := kems[mode].NewPrivateKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return &PrivateKey{mode: mode, key: key}, nil
+}
+
+// ParsePublicKey decodes a public key encoded by String
+func ParsePublicKey(s string) (*PublicKey, error) {
+	mode, b, err := parseKey(s, "chasm-")
+	if err != nil {
+		return nil, err
+	}
+	key, err := kems[mode].NewPublicKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return &PublicKey{mode: mode, key: key}, nil
+}
+
+func parseKey(s, prefix string) (string, []byte, error) {
+	sep := strings.Index(s, ":")
+	if !strings.HasPrefix(s, prefix) || sep < 0 {
+		return "", nil, errors.New("not a chasm key")
+	}
+	mode := s[len(prefix):sep]
+	if _, ok := kems[mode]; !ok {
+		return "", nil, fmt.Errorf("unknown key mode %q", mode)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(s[sep+1:]))
+	return mode, b, err
+}
+
+func info(context []byte) []byte {
+	return append([]byte(fmt.Sprintf("chasm keywrap v%d ", FormatVersion)), context...)
+}
+
+// Wrap seals key to the recipient for context
+func Wrap(to *PublicKey, key, context []byte) ([]byte, error) {
+	enc, sender, err := hpke.NewSender(to.key, hpke.HKDFSHA256(), hpke.AES256GCM(), info(context))
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := make([]byte, headerSize, headerSize+len(enc)+len(key)+16)
+	copy(wrapped, Magic)
+	wrapped[4] = FormatVersion
+	binary.BigEndian.PutUint16(wrapped[5:], to.key.KEM().ID())
+	binary.BigEndian.PutUint16(wrapped[7:], uint16(len(enc)))
+	wrapped = append(wrapped, enc...)
+
+	// the header is authenticated along with the key
+	sealed, err := sender.Seal(wrapped, key)
+	if err != nil {
+		return nil, err
+	}
+	return append(wrapped, sealed...), nil
+}
+
+// Unwrap opens a key wrapped to k for context
+func Unwrap(k *PrivateKey, wrapped, context []byte) ([]byte, error) {
+	if len(wrapped) < headerSize || !bytes.HasPrefix(wrapped, []byte(Magic)) {
+		return nil, errors.New("not a wrapped key")
+	}
+	if wrapped[4] != FormatVersion {
+		return nil, fmt.Errorf("unsupported wrapped key version %d", wrapped[4])
+	}
+	if id := binary.BigEndian.Uint16(wrapped[5:]); id != k.key.KEM().ID() {
+		return nil, fmt.Errorf("key was wrapped with KEM %#04x, not to this %s key", id, k.mode)
+	}
+
+	encEnd := headerSize + int(binary.BigEndian.Uint16(wrapped[7:]))
+	if encEnd > len(wrapped) {
+		return nil, errors.New("wrapped key is truncated")
+	}
+
+	recipient, err := hpke.NewRecipient(wrapped[headerSize:encEnd], k.key, hpke.HKDFSHA256(), hpke.AES256GCM(), info(context))
+	if err != nil {
+		return nil, err
+	}
+	return recipient.Open(wrapped[:encEnd], wrapped[encEnd:])
+}
@@ -0,0 +1,43 @@
+package keywrap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+// TestWrapRoundTrip wraps a random key to a fresh key pair of every mode and
+// checks it only unwraps intact and in the same context
+func TestWrapRoundTrip(t *testing.T) {
+	for _, mode := range Modes() {
+		priv, err := GenerateKey(mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if priv, err = ParsePrivateKey(priv.String()); err != nil {
+			t.Fatalf("%s private key did not parse: %v", mode, err)
+		}
+		pub, err := ParsePublicKey(priv.Public().String())
+		if err != nil {
+			t.Fatalf("%s public key did not parse: %v", mode, err)
+		}
+
+		key := make([]byte, 32)
+		rand.Read(key)
+		wrapped, err := Wrap(pub, key, []byte("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unwrapped, err := Unwrap(priv, wrapped, []byte("test")); err != nil || !bytes.Equal(unwrapped, key) {
+			t.Errorf("%s wrapped key did not round trip", mode)
+		}
+		if _, err := Unwrap(priv, wrapped, []byte("other")); err == nil {
+			t.Errorf("%s wrapped key unwrapped in the wrong context", mode)
+		}
+		corrupt := append([]byte(nil), wrapped...)
+		corrupt[len(corrupt)-1] ^= 1
+		if _, err := Unwrap(priv, corrupt, []byte("test")); err == nil {
+			t.Errorf("%s wrapped key unwrapped after corruption", mode)
+		}
+	}
+}
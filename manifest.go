@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+
+	"github.com/fatih/color"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Uploading the full .chasm manifest after every change is wasteful and
+// leaks activity timing, so changes are uploaded as small deltas against the
+// last full manifest and consolidated at the end of a batch.
+
+const chasmDeltaSID = ".chasm-delta"
+
+// upload a delta once this many changes are pending
+const manifestDeltaEvery = 25
+
+// ManifestDelta records the manifest changes made since the full manifest
+// at version Base. A nil file or deleted entry, or false dir entry means it
+// was removed
+type ManifestDelta struct {
+	Base    string                  `json:"base"`
+	Files   map[string]*FileShare   `json:"files"`
+	Dirs    map[string]bool         `json:"dirs"`
+	Deleted map[string]*DeletedFile `json:"deleted,omitempty"`
+}
+
+var pendingDelta = newManifestDelta()
+
+func newManifestDelta() ManifestDelta {
+	return ManifestDelta{
+		Files: make(map[string]*FileShare),
+		Dirs:  make(map[string]bool),
+	}
+}
+
+// Len counts the changes in the delta
+func (d ManifestDelta) Len() int {
+	return len(d.Files) + len(d.Dirs) + len(d.Deleted)
+}
+
+// Apply replays the delta onto the preferences
+func (d ManifestDelta) Apply(p *ChasmPref) {
+	if p.FileMap == nil {
+		p.FileMap = make(map[string]FileShare)
+	}
+	if p.DirMap == nil {
+		p.DirMap = make(map[string]bool)
+	}
+
+	for filePath, fs := range d.Files {
+		if fs == nil {
+			delete(p.FileMap, filePath)
+		} else {
+			p.FileMap[filePath] = *fs
+			observeGeneration(p, *fs)
+		}
+	}
+
+	for dirPath, tracked := range d.Dirs {
+		if tracked {
+			p.DirMap[dirPath] = true
+		} else {
+			delete(p.DirMap, dirPath)
+		}
+	}
+
+	for filePath, deleted := range d.Deleted {
+		if deleted == nil {
+			delete(p.Deleted, filePath)
+			continue
+		}
+		if p.Deleted == nil {
+			p.Deleted = make(map[string]*DeletedFile)
+		}
+		p.Deleted[filePath] = deleted
+	}
+}
+
+func recordFileChange(filePath string, fs *FileShare) {
+	pendingDelta.Files[filePath] = fs
+	flushDeltaIfFull()
+}
+
+func recordDirChange(dirPath string, tracked bool) {
+	pendingDelta.Dirs[dirPath] = tracked
+	flushDeltaIfFull()
+}
+
+func flushDeltaIfFull() {
+	if pendingDelta.Len() >= manifestDeltaEvery {
+		UploadManifestDelta()
+	}
+}
+
+// manifestVersion is the version of the last full manifest upload
+func manifestVersion() string {
+	return preferences.FileMap[path.Join(preferences.root, chasmPrefFile)].Version
+}
+
+// UploadManifestDelta uploads the pending manifest changes, if any
+func UploadManifestDelta() {
+	if pendingDelta.Len() == 0 {
+		return
+	}
+
+	pendingDelta.Base = manifestVersion()
+	deltaBytes, err := json.Marshal(pendingDelta)
+	check(err)
+
+	color.Magenta("Uploading manifest delta (%v changes)", pendingDelta.Len())
+	defer startSpan("manifest delta", attribute.Int("chasm.changes", pendingDelta.Len()))()
+	version := NewShareVersion()
+	uploadShares(ShareID(chasmDeltaSID), version, deltaBytes)
+	trace(TraceEvent{Op: "delta", Object: ObjectName(ShareID(chasmDeltaSID), version, false), Size: pendingDelta.Len()})
+	pendingDelta = newManifestDelta()
+}
+
+// UploadManifest uploads the consolidated manifest, superseding all deltas
+func UploadManifest() {
+	preferences.Save()
+	AddFile(path.Join(preferences.root, chasmPrefFile))
+	preferences.Save()
+	pendingDelta = newManifestDelta()
+	trace(TraceEvent{Op: "manifest", Object: ObjectName(ShareID(chasmPrefFile), manifestVersion(), false)})
+}
+
+// restoreManifestDeltas restores the deltas uploaded against the full
+// manifest at base, in the order they were uploaded
+func restoreManifestDeltas(base string, sharePaths []string) []ManifestDelta {
+	var versions []string
+	for _, version := range restorableVersions(ShareID(chasmDeltaSID), sharePaths) {
+		if version > base {
+			versions = append(versions, version)
+		}
+	}
+
+	deltas := make([]ManifestDelta, 0, len(versions))
+	for _, version := range versions {
+		deltaBytes := restoreObject(ObjectName(ShareID(chasmDeltaSID), version, false), sharePaths)
+
+		var delta ManifestDelta
+		if err := json.Unmarshal(deltaBytes, &delta); err != nil {
+			color.Red("Skipping unreadable manifest delta %s: %s", version, err)
+			continue
+		}
+		if delta.Base != base {
+			continue
+		}
+		deltas = append(deltas, delta)
+	}
+
+	return deltas
+}
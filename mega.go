@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/fatih/color"
+	"github.com/t3rm1n4l/go-mega"
+)
+
+// MegaStore keeps shares in a folder of a Mega account. Mega encrypts files
+// on the client with keys derived from the account's password, so shares are
+// encrypted once more before they leave the machine
+type MegaStore struct {
+	Email    string `json:"email"`
+	Password string `json:"-"`
+	Folder   string `json:"folder"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (m *MegaStore) credentials() map[string]*string {
+	return map[string]*string{"password": &m.Password}
+}
+
+// logged in accounts by email, as a login fetches the whole file tree
+var (
+	megaSessionsLock sync.Mutex
+	megaSessions     = make(map[string]*mega.Mega)
+)
+
+// Setup logs in and finds the folder, creating it if missing
+func (m MegaStore) Setup() bool {
+	for _, ms := range preferences.MegaStores {
+		if ms.Email == m.Email && ms.Folder == m.Folder {
+			color.Red("Mega folder %s already exists.", m.location())
+			return false
+		}
+	}
+
+	if _, err := m.folder(true); err != nil {
+		color.Red("Error: cannot set up %s: %s", m.location(), err)
+		return false
+	}
+	return true
+}
+
+func (m MegaStore) location() string {
+	return m.Email + "/" + m.Folder
+}
+
+// session logs in to the account, once per run
+func (m MegaStore) session() (*mega.Mega, error) {
+	megaSessionsLock.Lock()
+	defer megaSessionsLock.Unlock()
+	if session, ok := megaSessions[m.Email]; ok {
+		return session, nil
+	}
+
+	session := mega.New()
+	session.SetClient(storeHTTPClient())
+	if err := session.Login(m.Email, m.Password); err != nil {
+		return nil, err
+	}
+	megaSessions[m.Email] = session
+	return session, nil
+}
+
+// folder finds the folder at the root of the account, creating it if
+// create is set
+func (m MegaStore) folder(create bool) (*mega.Node, error) {
+	session, err := m.session()
+	if err != nil {
+		return nil, err
+	}
+	children, err := session.FS.GetChildren(session.FS.GetRoot())
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range children {
+		if node.GetType() == mega.FOLDER && node.GetName() == m.Folder {
+			return node, nil
+		}
+	}
+	if !create {
+		return nil, fmt.Errorf("no folder %s", m.Folder)
+	}
+	color.Yellow("Creating Mega folder %s", m.location())
+	return session.CreateDir(m.Folder, session.FS.GetRoot())
+}
+
+// files returns the files in the folder by name
+func (m MegaStore) files() (map[string]*mega.Node, error) {
+	folder, err := m.folder(false)
+	if err != nil {
+		return nil, err
+	}
+	session, _ := m.session()
+	children, err := session.FS.GetChildren(folder)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]*mega.Node)
+	for _, node := range children {
+		if node.GetType() == mega.FILE {
+			files[node.GetName()] = node
+		}
+	}
+	return files, nil
+}
+
+// file finds an object in the folder
+func (m MegaStore) file(object string) (*mega.Node, error) {
+	files, err := m.files()
+	if err != nil {
+		return nil, err
+	}
+	node, ok := files[object]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return node, nil
+}
+
+func (m MegaStore) upload(object string, data []byte) error {
+	files, err := m.files()
+	if err != nil {
+		return err
+	}
+	// Mega keeps files of the same name side by side
+	if _, ok := files[object]; ok {
+		return errors.New("object exists")
+	}
+
+	folder, err := m.folder(false)
+	if err != nil {
+		return err
+	}
+	session, _ := m.session()
+	upload, err := session.NewUpload(folder, object, int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for id := 0; id < upload.Chunks(); id++ {
+		position, size, err := upload.ChunkLocation(id)
+		if err != nil {
+			return err
+		}
+		if err := upload.UploadChunk(id, data[position:position+int64(size)]); err != nil {
+			return err
+		}
+	}
+	_, err = upload.Finish()
+	return err
+}
+
+// Upload adds the share as a new file, refusing to add a second one of the
+// same name
+func (m MegaStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading Mega/%s/%s...", m.location(), share.ObjectName()))
+	if err := m.upload(share.ObjectName(), share.Data); err != nil {
+		color.Red("Mega/%s/%s upload failed: %v", m.location(), share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// Remove deletes a single object, into the Mega rubbish bin
+func (m MegaStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting Mega/%s/%s...", m.location(), object))
+	node, err := m.file(object)
+	if err == nil {
+		session, _ := m.session()
+		err = session.Delete(node, false)
+	}
+	if err != nil {
+		color.Red("Error: could not delete %s from Mega: %s", object, err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all files in the folder
+func (m MegaStore) list() ([]string, error) {
+	files, err := m.files()
+	if err != nil {
+		return nil, err
+	}
+	var objects []string
+	for name := range files {
+		objects = append(objects, name)
+	}
+	return objects, nil
+}
+
+// List returns the names of all objects in the folder
+func (m MegaStore) List() []string {
+	objects, err := m.list()
+	if err != nil {
+		color.Red("Error listing Mega: %s", err)
+		return nil
+	}
+	return objects
+}
+
+// download fetches the chunks of an object overlapping length bytes from
+// offset, and checks the object's MAC when that is all of them
+func (m MegaStore) download(object string, offset, length int64) ([]byte, error) {
+	node, err := m.file(object)
+	if err != nil {
+		return nil, err
+	}
+	session, _ := m.session()
+	download, err := session.NewDownload(node)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, length)
+	whole := true
+	for id := 0; id < download.Chunks(); id++ {
+		position, size, err := download.ChunkLocation(id)
+		if err != nil {
+			return nil, err
+		}
+		end := position + int64(size)
+		if end <= offset || position >= offset+length {
+			whole = false
+			continue
+		}
+		chunk, err := download.DownloadChunk(id)
+		if err != nil {
+			return nil, err
+		}
+		from, to := int64(0), int64(len(chunk))
+		if offset > position {
+			from = offset - position
+		}
+		if offset+length < end {
+			to = offset + length - position
+		}
+		data = append(data, chunk[from:to]...)
+	}
+	if whole {
+		if err := download.Finish(); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// Read downloads a single object
+func (m MegaStore) Read(object string) ([]byte, error) {
+	node, err := m.file(object)
+	if err != nil {
+		return nil, err
+	}
+	return m.download(object, 0, node.GetSize())
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (m MegaStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	return m.download(object, offset, length)
+}
+
+// Restore downloads shares to local restore path
+func (m MegaStore) Restore() string {
+	objects, err := m.list()
+	if err != nil {
+		color.Red("Error listing Mega: %s", err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_mega_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from Mega...")
+	for _, object := range objects {
+		data, err := m.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects in the folder
+func (m MegaStore) Description() string {
+	objects, err := m.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", m.ShortDescription(), err)
+	}
+
+	label := m.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (m MegaStore) ShortDescription() string {
+	return "Mega Store: " + m.location()
+}
+
+// Clean deletes all shares from the folder
+func (m MegaStore) Clean() {
+	files, err := m.files()
+	if err != nil {
+		color.Red("Error listing Mega: %s", err)
+		return
+	}
+	session, _ := m.session()
+	for name, node := range files {
+		color.Yellow("Removing Mega: %v", name)
+		session.Delete(node, false)
+	}
+}
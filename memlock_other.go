@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+
+package main
+
+// lockMemory is unsupported on this platform, buffers are only wiped
+func lockMemory(b []byte) bool {
+	return false
+}
+
+func unlockMemory(b []byte) {}
@@ -0,0 +1,13 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import "golang.org/x/sys/unix"
+
+func lockMemory(b []byte) bool {
+	return unix.Mlock(b) == nil
+}
+
+func unlockMemory(b []byte) {
+	unix.Munlock(b)
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+	"github.com/fatih/color"
+)
+
+// A memory budget bounds how much of a file is held at once. Files are
+// normally read whole and shared in memory, taking the file plus a share per
+// store. Files whose shares would not fit are shared a chunk at a time
+// instead: the chunk shares are spooled to temp files, uploaded in parts that
+// fit the budget, and combined chunk by chunk again on restore. Shamir sharing
+// works byte by byte, so chunked shares are identical in format.
+
+// memory budget in MiB from --memory-mb, overriding the preference
+var memoryBudgetMB int64
+
+// smallest chunk worth sharing separately
+const minMemoryChunk = 64 << 10
+
+// MemoryBudget is the memory ceiling in bytes, 0 for none
+func (p ChasmPref) MemoryBudget() int64 {
+	if memoryBudgetMB > 0 {
+		return memoryBudgetMB << 20
+	}
+	return p.MaxMemory
+}
+
+// fitsMemory checks if a file of size can be shared across n stores in memory
+func fitsMemory(size int64, n int) bool {
+	budget := preferences.MemoryBudget()
+	return budget <= 0 || size*int64(n+1) <= budget
+}
+
+// memoryChunkSize is how much of a file is shared at once, so that the chunk
+// and its n shares take a quarter of the budget
+func memoryChunkSize(n int) int {
+	chunk := preferences.MemoryBudget() / int64(4*(n+1))
+	if chunk < minMemoryChunk {
+		chunk = minMemoryChunk
+	}
+	return int(chunk)
+}
+
+// memoryPartSize is the largest share part uploaded at once, 0 for no budget
+func memoryPartSize() int64 {
+	budget := preferences.MemoryBudget()
+	if budget <= 0 {
+		return 0
+	}
+	if budget/4 < minMemoryChunk {
+		return minMemoryChunk
+	}
+	return budget / 4
+}
+
+// hashFile is SHA256Base64URL of the file contents, without reading them
+// into memory
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// uploadSharesStreamed is uploadSharesWith for files over the memory budget
+func uploadSharesStreamed(scheme SharingScheme, sid ShareID, version string, filePath string) uploadedShares {
+	allCloudStores := preferences.AllCloudStores()
+	cloudStores := preferences.cloudStores()
+
+	spoolDir, err := ioutil.TempDir("", "chasm_spool")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		countError()
+		return uploadedShares{}
+	}
+	defer os.RemoveAll(spoolDir)
+
+	endShare := startSpan("share")
+	spooled, err := spoolShares(scheme, filePath, len(allCloudStores), spoolDir)
+	endShare()
+	if err != nil {
+		color.Red("Error sharing %s: %v", filePath, err)
+		countError()
+		return uploadedShares{}
+	}
+
+	// spooled shares are at x = 1..n in order
+	uploaded := uploadedShares{Hashes: make([]string, len(spooled)), Sizes: make([]int64, len(spooled))}
+	if fi, err := os.Stat(filePath); err == nil {
+		uploaded.Shared = fi.Size()
+	}
+	for i, cs := range allCloudStores {
+		share := Share{SID: sid, Version: version}
+		if uploaded.Hashes[i], err = shareHashFile(share.ObjectName(), spooled[i]); err != nil {
+			uploaded.Hashes[i] = ""
+		}
+		if size, err := stagedSize(spooled[i]); err == nil {
+			uploaded.Sizes[i] = size
+		}
+		if err := uploadSpooled(cs, objectPartSize(cloudStores[i]), share, spooled[i]); err != nil {
+			color.Red("Error uploading share of %s to %s: %v", filePath, cs.ShortDescription(), err)
+			countError()
+		}
+	}
+	return uploaded
+}
+
+// spoolShares shares filePath a chunk at a time into one file per share,
+// returning their paths
+func spoolShares(scheme SharingScheme, filePath string, n int, spoolDir string) ([]string, error) {
+	if n > 255 {
+		panic("n > 255 not supported")
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	threshold := scheme.Threshold(n)
+	length := uint64(scheme.ShareSize(fi.Size(), threshold))
+
+	// the spools together are the file, so they are sealed like the shares
+	// staged by restore, see staging.go
+	spools := make([]*stagedWriter, n)
+	defer func() {
+		for _, spool := range spools {
+			if spool != nil {
+				spool.Close()
+			}
+		}
+	}()
+	checksums := make([]hash.Hash32, n)
+	paths := make([]string, n)
+	for i := range spools {
+		paths[i] = filepath.Join(spoolDir, fmt.Sprint(i+1))
+		if spools[i], err = createStaged(paths[i]); err != nil {
+			return nil, err
+		}
+
+		checksums[i] = crc32.NewIEEE()
+		header := recovery.EncodeHeader(recovery.Share{Scheme: scheme.ID(), X: byte(i + 1), Threshold: byte(threshold)}, length)
+		checksums[i].Write(header)
+		if _, err := spools[i].Write(header); err != nil {
+			return nil, err
+		}
+	}
+
+	// chunks are whole stripes, the final one may be empty to add padding
+	stripe := scheme.Stripe(threshold)
+	chunk, release := lockedBuffer(memoryChunkSize(n) / stripe * stripe)
+	defer release()
+	// only the size in the headers is read, a file still being written
+	// that shrinks fails rather than leaving the loop waiting for bytes
+	contents := io.LimitReader(file, fi.Size())
+	var offset int64
+	for final := false; !final; {
+		read, err := io.ReadFull(contents, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		offset += int64(read)
+		if err != nil && offset < fi.Size() {
+			return nil, fmt.Errorf("%s changed while being shared, only %v of %v bytes read", filePath, offset, fi.Size())
+		}
+		final = offset == fi.Size() && (read < len(chunk) || stripe == 1)
+
+		sharesBytes, err := scheme.Split(chunk[:read], n, final)
+		if err != nil {
+			return nil, err
+		}
+		for i, y := range sharesBytes {
+			checksums[i].Write(y)
+			if _, err := spools[i].Write(y); err != nil {
+				return nil, err
+			}
+		}
+		wipeAll(sharesBytes)
+	}
+
+	for i, spool := range spools {
+		if _, err := spool.Write(binary.BigEndian.AppendUint32(nil, checksums[i].Sum32())); err != nil {
+			return nil, err
+		}
+		if _, err := spool.Write(manifestTrailer(i+1, n)); err != nil {
+			return nil, err
+		}
+		spools[i] = nil
+		if err := spool.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// uploadSpooled uploads the spooled share in parts of at most max bytes
+func uploadSpooled(cs CloudStore, max int64, share Share, spoolPath string) error {
+	spool, err := openStaged(spoolPath)
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+
+	parts := int((spool.Size() + max - 1) / max)
+	for i := 1; i <= parts; i++ {
+		offset := int64(i-1) * max
+		size := max
+		if rest := spool.Size() - offset; rest < size {
+			size = rest
+		}
+
+		part := share
+		part.Data = make([]byte, size)
+		if _, err := spool.ReadAt(part.Data, offset); err != nil && err != io.EOF {
+			wipe(part.Data)
+			return err
+		}
+		if parts > 1 {
+			part.Part, part.Parts = i, parts
+		}
+		cs.Upload(part)
+		wipe(part.Data)
+	}
+	return nil
+}
+
+// spooledShare is a share read from disk a chunk at a time
+type spooledShare struct {
+	file     *stagedFile
+	share    recovery.Share
+	offset   int64 // of the payload
+	length   int64
+	checksum hash.Hash32 // nil for legacy shares
+}
+
+// openShare reads the header of a share in the current or legacy format
+func openShare(sharePath string) (*spooledShare, error) {
+	file, err := openStaged(sharePath)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, recovery.HeaderSize)
+	n, _ := file.ReadAt(header, 0)
+	if bytes.HasPrefix(header[:n], []byte(recovery.Magic)) {
+		share, length, err := recovery.ParseHeader(header)
+		if err == nil && int64(length) > file.Size()-recovery.HeaderSize-recovery.ChecksumSize {
+			err = fmt.Errorf("share length does not match header")
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		checksum := crc32.NewIEEE()
+		checksum.Write(header)
+		return &spooledShare{file: file, share: share, offset: recovery.HeaderSize, length: int64(length), checksum: checksum}, nil
+	}
+
+	// legacy shares are the payload followed by the x coordinate
+	if file.Size() == 0 {
+		file.Close()
+		return nil, fmt.Errorf("share is empty")
+	}
+	x := make([]byte, 1)
+	if _, err := file.ReadAt(x, file.Size()-1); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &spooledShare{file: file, share: recovery.Share{Scheme: recovery.SchemeShamir, X: x[0]}, length: file.Size() - 1}, nil
+}
+
+// verify checks the checksum after the whole payload was read
+func (s *spooledShare) verify() error {
+	if s.checksum == nil {
+		return nil
+	}
+	stored := make([]byte, recovery.ChecksumSize)
+	if _, err := s.file.ReadAt(stored, s.offset+s.length); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(stored) != s.checksum.Sum32() {
+		return fmt.Errorf("share checksum mismatch")
+	}
+	return nil
+}
+
+// restoreFileStreamed combines the shares of fileShare chunk by chunk into
+// filePath, replacing it only if the result matches the recorded hash
+func restoreFileStreamed(filePath string, fileShare FileShare, sharePaths []string) {
+	object := fileShare.ObjectName()
+	var shares []*spooledShare
+	defer func() {
+		for _, share := range shares {
+			share.file.Close()
+		}
+	}()
+
+	for _, sp := range sharePaths {
+		if err := checkShareFile(fileShare, path.Join(sp, object)); err != nil {
+			color.Red("(Skipping share) %s in %s: %s", object, sp, err)
+			continue
+		}
+		share, err := openShare(path.Join(sp, object))
+		if err != nil {
+			color.Red("(Skipping share) Cannot read %s in %s: %s", object, sp, err)
+			continue
+		}
+		if len(shares) > 0 && (share.share.Scheme != shares[0].share.Scheme || share.length != shares[0].length) {
+			share.file.Close()
+			color.Red("(Skipping share) %s in %s does not match the other shares", object, sp)
+			continue
+		}
+		shares = append(shares, share)
+	}
+
+	fail := func(format string, args ...interface{}) {
+		color.Red(format, args...)
+		countError()
+	}
+	if len(shares) == 0 {
+		fail("Couldn't retrieve enough shares to restore %s", fileShare.SID)
+		return
+	}
+	scheme, err := sharingSchemeByID(shares[0].share.Scheme)
+	if err != nil {
+		fail("Cannot restore %s: %s", fileShare.SID, err)
+		return
+	}
+	threshold := int(shares[0].share.Threshold)
+	if threshold == 0 {
+		threshold = preferences.RegisteredServices()
+	}
+	if len(shares) < threshold {
+		fail("Couldn't retrieve enough shares to restore %s", fileShare.SID)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filePath), ".chasm-restore")
+	if err != nil {
+		fail("Error writing restored file %s: %s", filePath, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	xs := make([]byte, len(shares))
+	for i, share := range shares {
+		xs[i] = share.share.X
+	}
+
+	h := sha256.New()
+	var size int64
+	length := shares[0].length
+	chunk := int64(memoryChunkSize(len(shares)))
+	for off := int64(0); off < length || off == 0; off += chunk {
+		if off+chunk > length {
+			chunk = length - off
+		}
+
+		ys := make([][]byte, len(shares))
+		for i, share := range shares {
+			ys[i] = make([]byte, chunk)
+			if _, err := share.file.ReadAt(ys[i], share.offset+off); err != nil && chunk > 0 {
+				fail("Error reading share of %s: %s", fileShare.SID, err)
+				return
+			}
+			if share.checksum != nil {
+				share.checksum.Write(ys[i])
+			}
+		}
+
+		secret, err := scheme.Combine(xs, ys, threshold, off+chunk == length)
+		if err != nil {
+			fail("Cannot combine shares of %s: %s", fileShare.SID, err)
+			return
+		}
+		h.Write(secret)
+		size += int64(len(secret))
+		_, err = tmp.Write(secret)
+		wipe(secret)
+		wipeAll(ys)
+		if err != nil {
+			fail("Error writing restored file %s: %s", filePath, err)
+			return
+		}
+		if length == 0 {
+			break
+		}
+	}
+	for _, share := range shares {
+		if err := share.verify(); err != nil {
+			fail("Error: share of %s: %s", fileShare.SID, err)
+			return
+		}
+	}
+	tmp.Close()
+
+	// protected contents are opened into a second temp file
+	restored := tmp.Name()
+	if fileShare.Protection != "" {
+		if restored, size, err = openProtectedFile(unlockedPaths[fileShare.Protection], tmp.Name(), h); err != nil {
+			fail("Error: cannot open protected %s: %s", filePath, err)
+			return
+		}
+		defer os.Remove(restored)
+	}
+
+	if base64.URLEncoding.EncodeToString(h.Sum(nil)) != fileShare.Hash {
+		fail("Error: invalid SHA2 checksum for share %s. Skipping.", fileShare.SID)
+		return
+	}
+	os.Chmod(restored, 0770)
+	if err := os.Rename(restored, filePath); err != nil {
+		fail("Error writing restored file %s: %s", filePath, err)
+		return
+	}
+	countFile(size, false)
+}
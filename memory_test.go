@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// TestStreamedRoundTrip shares files over a small memory budget a chunk at
+// a time to folder stores and restores them, for sizes around the chunk
+// boundaries and past the part size, leaving nothing behind in the temp dir
+func TestStreamedRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	LoadState(root)
+	stores := []FolderStore{{Path: t.TempDir()}, {Path: t.TempDir()}, {Path: t.TempDir()}}
+	n := len(stores)
+	preferences = ChasmPref{root: root, FolderStores: stores, MaxMemory: int64(4*(n+1)) * minMemoryChunk}
+	defer func() { preferences = ChasmPref{} }()
+
+	temp := t.TempDir()
+	t.Setenv("TMPDIR", temp)
+	restoreDir := t.TempDir()
+
+	rng := rand.New(rand.NewSource(1))
+	chunk := memoryChunkSize(n)
+	for _, name := range SharingSchemeNames() {
+		scheme := sharingSchemes[name]
+		stripe := scheme.Stripe(scheme.Threshold(n))
+		spooled := chunk / stripe * stripe
+
+		for _, size := range []int{0, 1, stripe, spooled - 1, spooled, spooled + 1, 2 * spooled, 2*spooled + 1, int(memoryPartSize())*stripe + 1} {
+			data := make([]byte, size)
+			rng.Read(data)
+			filePath := filepath.Join(root, "file")
+			if err := ioutil.WriteFile(filePath, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			fileShare := FileShare{SID: RandomShareID(), Version: NewShareVersion(), Hash: SHA256Base64URL(data)}
+			uploaded := uploadSharesStreamed(scheme, fileShare.SID, fileShare.Version, filePath)
+			fileShare.Shares = uploaded.Hashes
+			fileShare.Threshold = scheme.Threshold(n)
+			if len(fileShare.Shares) != n {
+				t.Fatalf("%s: %v bytes shared into %v shares", name, size, len(fileShare.Shares))
+			}
+
+			var sharePaths []string
+			for _, cs := range preferences.AllCloudStores() {
+				sharePaths = append(sharePaths, cs.Restore())
+			}
+			restored := filepath.Join(restoreDir, "file")
+			restoreFileStreamed(restored, fileShare, sharePaths)
+			removeStaging(sharePaths)
+
+			got, err := ioutil.ReadFile(restored)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s: %v bytes did not round trip: %v", name, size, err)
+			}
+			if left, _ := ioutil.ReadDir(restoreDir); len(left) != 1 {
+				t.Fatalf("%s: %v files in the restore directory after restoring %v bytes", name, len(left), size)
+			}
+			if left, _ := ioutil.ReadDir(temp); len(left) != 0 {
+				t.Fatalf("%s: %s left in the temp dir after %v bytes", name, left[0].Name(), size)
+			}
+		}
+	}
+}
+
+// TestSpoolsSealed checks the shares spooled for upload are not written to
+// the temp dir in the clear
+func TestSpoolsSealed(t *testing.T) {
+	root := t.TempDir()
+	data := bytes.Repeat([]byte("secret "), 1000)
+	filePath := filepath.Join(root, "file")
+	if err := ioutil.WriteFile(filePath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	spooled, err := spoolShares(sharingSchemes["replicate"], filePath, 3, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, spool := range spooled {
+		raw, err := ioutil.ReadFile(spool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(raw, []byte(stagedMagic)) || bytes.Contains(raw, []byte("secret")) {
+			t.Fatalf("spool %s is not sealed", spool)
+		}
+	}
+}
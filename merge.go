@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Several processes can change the same vault, e.g. `chasm serve` and a
+// `chasm add` from the shell. Instead of the last .chasm written winning,
+// Save merges its changes with whatever was written since it last read the
+// file, three-way, entry by entry.
+
+// the .chasm contents last read or written by this process, the common
+// base for merging
+var savedManifest []byte
+
+const chasmLockFile = ".chasm.lock"
+
+// a lock older than this was left behind by a crashed process
+const manifestLockStale = 30 * time.Second
+
+// how long to wait for another process to release the lock
+var manifestLockWait = manifestLockStale
+
+var errManifestLocked = errors.New("manifest still locked by another process")
+
+// lockManifest takes the manifest lock of root, waiting for other processes.
+// Returns the function releasing it, or errManifestLocked if the lock was
+// not released in time
+func lockManifest(root string) (func(), error) {
+	lockPath := path.Join(root, chasmLockFile)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			lock.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+
+		if fi, err := os.Stat(lockPath); err == nil && time.Since(fi.ModTime()) > manifestLockStale {
+			color.Yellow("Removing stale manifest lock %s", lockPath)
+			os.Remove(lockPath)
+		} else if time.Since(start) > manifestLockWait {
+			return nil, errManifestLocked
+		}
+	}
+}
+
+// mergeManifestJSON merges the changes of ours and theirs since base. Maps
+// such as files and dirs are merged per entry, other fields as a whole. An
+// entry changed on one side only takes that side. If both changed it, an
+// entry still present wins over a removal and otherwise the newer file
+// version wins, so concurrent adds are never lost
+func mergeManifestJSON(base, ours, theirs []byte) ([]byte, error) {
+	var b, o, t map[string]json.RawMessage
+	for _, m := range []struct {
+		data []byte
+		out  *map[string]json.RawMessage
+	}{{base, &b}, {ours, &o}, {theirs, &t}} {
+		if err := json.Unmarshal(m.data, m.out); err != nil {
+			return nil, err
+		}
+	}
+
+	merged := make(map[string]json.RawMessage)
+	for _, key := range unionKeys(b, o, t) {
+		bm, bok := decodeObject(b[key])
+		om, ook := decodeObject(o[key])
+		tm, tok := decodeObject(t[key])
+		if !bok || !ook || !tok || (bm == nil && om == nil && tm == nil) {
+			if value, ok := mergeEntry(key, b[key], o[key], t[key]); ok {
+				merged[key] = value
+			}
+			continue
+		}
+
+		entries := make(map[string]json.RawMessage)
+		for _, entry := range unionKeys(bm, om, tm) {
+			if value, ok := mergeEntry(key, bm[entry], om[entry], tm[entry]); ok {
+				entries[entry] = value
+			}
+		}
+		value, err := json.Marshal(entries)
+		if err != nil {
+			return nil, err
+		}
+		merged[key] = value
+	}
+
+	return json.MarshalIndent(merged, "", "    ")
+}
+
+// mergeEntry three-way merges one value, nil meaning absent. Returns false
+// if the merged value is absent
+func mergeEntry(field string, base, ours, theirs json.RawMessage) (json.RawMessage, bool) {
+	switch {
+	case sameJSON(ours, base):
+		return theirs, theirs != nil
+	case sameJSON(theirs, base), sameJSON(ours, theirs):
+		return ours, ours != nil
+	case ours == nil:
+		return theirs, true
+	case theirs == nil:
+		return ours, true
+	}
+
+	// changed on both sides: the newer file version and the higher
+	// generation win, otherwise ours
+	switch field {
+	case "files":
+		var of, tf FileShare
+		if json.Unmarshal(ours, &of) == nil && json.Unmarshal(theirs, &tf) == nil && newerShare(tf, of) {
+			return theirs, true
+		}
+	case "generation":
+		var og, tg uint64
+		if json.Unmarshal(ours, &og) == nil && json.Unmarshal(theirs, &tg) == nil && tg > og {
+			return theirs, true
+		}
+	}
+	return ours, true
+}
+
+// decodeObject decodes a JSON object, treating absent and null as empty
+func decodeObject(raw json.RawMessage) (map[string]json.RawMessage, bool) {
+	var m map[string]json.RawMessage
+	if raw == nil {
+		return nil, true
+	}
+	err := json.Unmarshal(raw, &m)
+	return m, err == nil
+}
+
+func sameJSON(a, b json.RawMessage) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+func unionKeys(maps ...map[string]json.RawMessage) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, m := range maps {
+		for key := range m {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
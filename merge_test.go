@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// mergeFiles merges manifests holding only files, by path
+func mergeFiles(t *testing.T, base, ours, theirs map[string]FileShare) map[string]FileShare {
+	t.Helper()
+	encode := func(files map[string]FileShare) []byte {
+		data, err := json.Marshal(map[string]interface{}{"files": files})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	merged, err := mergeManifestJSON(encode(base), encode(ours), encode(theirs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m struct {
+		Files map[string]FileShare `json:"files"`
+	}
+	if err := json.Unmarshal(merged, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m.Files
+}
+
+func TestMergeManifest(t *testing.T) {
+	old := FileShare{SID: "a", Hash: "old", Version: "20240101T000000.000000000Z", Generation: 1}
+	edited := FileShare{SID: "a", Hash: "edited", Version: "20240102T000000.000000000Z", Generation: 2}
+	newer := FileShare{SID: "a", Hash: "newer", Version: "20240103T000000.000000000Z", Generation: 3}
+	other := FileShare{SID: "b", Hash: "other", Version: "20240101T000000.000000000Z", Generation: 1}
+
+	for _, tt := range []struct {
+		name               string
+		base, ours, theirs map[string]FileShare
+		want               map[string]FileShare
+	}{
+		{
+			name:   "unchanged",
+			base:   map[string]FileShare{"a": old},
+			ours:   map[string]FileShare{"a": old},
+			theirs: map[string]FileShare{"a": old},
+			want:   map[string]FileShare{"a": old},
+		},
+		{
+			name:   "changed on one side each",
+			base:   map[string]FileShare{"a": old},
+			ours:   map[string]FileShare{"a": edited},
+			theirs: map[string]FileShare{"a": old, "b": other},
+			want:   map[string]FileShare{"a": edited, "b": other},
+		},
+		{
+			name:   "deleted on one side",
+			base:   map[string]FileShare{"a": old, "b": other},
+			ours:   map[string]FileShare{"b": other},
+			theirs: map[string]FileShare{"a": old, "b": other},
+			want:   map[string]FileShare{"b": other},
+		},
+		{
+			name:   "we delete, they modify",
+			base:   map[string]FileShare{"a": old},
+			ours:   map[string]FileShare{},
+			theirs: map[string]FileShare{"a": edited},
+			want:   map[string]FileShare{"a": edited},
+		},
+		{
+			name:   "we modify, they delete",
+			base:   map[string]FileShare{"a": old},
+			ours:   map[string]FileShare{"a": edited},
+			theirs: map[string]FileShare{},
+			want:   map[string]FileShare{"a": edited},
+		},
+		{
+			name:   "both delete",
+			base:   map[string]FileShare{"a": old},
+			ours:   map[string]FileShare{},
+			theirs: map[string]FileShare{},
+			want:   map[string]FileShare{},
+		},
+		{
+			name:   "concurrent adds, theirs newer",
+			base:   map[string]FileShare{},
+			ours:   map[string]FileShare{"a": edited},
+			theirs: map[string]FileShare{"a": newer},
+			want:   map[string]FileShare{"a": newer},
+		},
+		{
+			name:   "concurrent adds, ours newer",
+			base:   map[string]FileShare{},
+			ours:   map[string]FileShare{"a": newer},
+			theirs: map[string]FileShare{"a": edited},
+			want:   map[string]FileShare{"a": newer},
+		},
+		{
+			name:   "higher generation wins over a newer version",
+			base:   map[string]FileShare{"a": old},
+			ours:   map[string]FileShare{"a": {SID: "a", Hash: "ours", Version: "20240105T000000.000000000Z", Generation: 2}},
+			theirs: map[string]FileShare{"a": {SID: "a", Hash: "theirs", Version: "20240104T000000.000000000Z", Generation: 3}},
+			want:   map[string]FileShare{"a": {SID: "a", Hash: "theirs", Version: "20240104T000000.000000000Z", Generation: 3}},
+		},
+		{
+			name:   "generation tie, newer version wins",
+			base:   map[string]FileShare{"a": old},
+			ours:   map[string]FileShare{"a": {SID: "a", Hash: "ours", Version: "20240104T000000.000000000Z", Generation: 2}},
+			theirs: map[string]FileShare{"a": {SID: "a", Hash: "theirs", Version: "20240105T000000.000000000Z", Generation: 2}},
+			want:   map[string]FileShare{"a": {SID: "a", Hash: "theirs", Version: "20240105T000000.000000000Z", Generation: 2}},
+		},
+		{
+			name:   "complete tie keeps ours",
+			base:   map[string]FileShare{"a": old},
+			ours:   map[string]FileShare{"a": {SID: "a", Hash: "ours", Version: "20240104T000000.000000000Z", Generation: 2}},
+			theirs: map[string]FileShare{"a": {SID: "a", Hash: "theirs", Version: "20240104T000000.000000000Z", Generation: 2}},
+			want:   map[string]FileShare{"a": {SID: "a", Hash: "ours", Version: "20240104T000000.000000000Z", Generation: 2}},
+		},
+	} {
+		got := mergeFiles(t, tt.base, tt.ours, tt.theirs)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: merged %+v, want %+v", tt.name, got, tt.want)
+			continue
+		}
+		for filePath, want := range tt.want {
+			if got[filePath].Hash != want.Hash || got[filePath].Version != want.Version || got[filePath].Generation != want.Generation {
+				t.Errorf("%s: merged %s into %+v, want %+v", tt.name, filePath, got[filePath], want)
+			}
+		}
+	}
+}
+
+func TestMergeGeneration(t *testing.T) {
+	for _, tt := range []struct {
+		base, ours, theirs, want string
+	}{
+		{`{"generation": 5}`, `{"generation": 7}`, `{"generation": 6}`, `7`},
+		{`{"generation": 5}`, `{"generation": 6}`, `{"generation": 7}`, `7`},
+		{`{"generation": 5}`, `{"generation": 6}`, `{"generation": 6}`, `6`},
+		{`{"generation": 5}`, `{"generation": 5}`, `{"generation": 8}`, `8`},
+	} {
+		merged, err := mergeManifestJSON([]byte(tt.base), []byte(tt.ours), []byte(tt.theirs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(merged, &m); err != nil {
+			t.Fatal(err)
+		}
+		if string(m["generation"]) != tt.want {
+			t.Errorf("merged generations %s, %s and %s into %s, want %s", tt.base, tt.ours, tt.theirs, m["generation"], tt.want)
+		}
+	}
+}
+
+func TestManifestLock(t *testing.T) {
+	root := t.TempDir()
+	lockPath := path.Join(root, chasmLockFile)
+
+	unlock, err := lockManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(lockPath); err != nil {
+		t.Fatalf("no lock file while locked: %v", err)
+	}
+
+	// a live lock is waited for, then given up on rather than overwritten
+	saved := manifestLockWait
+	manifestLockWait = 50 * time.Millisecond
+	defer func() { manifestLockWait = saved }()
+	if _, err := lockManifest(root); err != errManifestLocked {
+		t.Fatalf("took a held lock: %v", err)
+	}
+
+	unlock()
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Fatalf("lock file left after unlocking: %v", err)
+	}
+
+	// a lock left behind by a crashed process is taken over
+	if err := os.WriteFile(lockPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	stale := time.Now().Add(-2 * manifestLockStale)
+	if err := os.Chtimes(lockPath, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err = lockManifest(root)
+	if err != nil {
+		t.Fatalf("stale lock not taken over: %v", err)
+	}
+	unlock()
+}
+
+func TestSaveWhileLocked(t *testing.T) {
+	root := t.TempDir()
+	LoadState(root)
+	preferences = ChasmPref{root: root, FileMap: map[string]FileShare{}}
+	defer func() { preferences = ChasmPref{} }()
+
+	chasmFilePath := path.Join(root, chasmPrefFile)
+	if err := os.WriteFile(chasmFilePath, []byte(`{"files": {}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	saved := manifestLockWait
+	manifestLockWait = 50 * time.Millisecond
+	defer func() { manifestLockWait = saved }()
+	preferences.FileMap["a"] = FileShare{SID: "a", Hash: "ours"}
+	preferences.Save()
+
+	if data, _ := os.ReadFile(chasmFilePath); string(data) != `{"files": {}}` {
+		t.Fatalf("saved over a locked manifest: %s", data)
+	}
+}
@@ -0,0 +1,153 @@
+// Package mobile exposes vault status, single-file restore and adding files
+// to gomobile, for iOS/Android companion apps:
+//
+//	gomobile bind -target=android ./mobile
+//	gomobile bind -target=ios ./mobile
+//
+// The app is responsible for syncing each store's share objects into a local
+// directory (for example with the provider's own SDK), and registers one
+// directory per store with AddShareDir.
+package mobile
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+)
+
+// Vault is a chasm vault read from local copies of its stores
+type Vault struct {
+	dirs []string
+}
+
+// Status summarizes a vault
+type Status struct {
+	Stores          int
+	Files           int
+	Dirs            int
+	ManifestVersion string
+}
+
+// NewVault creates a vault without any stores
+func NewVault() *Vault {
+	return &Vault{}
+}
+
+// AddShareDir registers the local copy of a store's share objects
+func (v *Vault) AddShareDir(dir string) {
+	v.dirs = append(v.dirs, dir)
+}
+
+// Status reads the manifest and summarizes the vault
+func (v *Vault) Status() (*Status, error) {
+	manifest, err := recovery.ReadManifest(v.dirs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Status{
+		Stores:          len(v.dirs),
+		Files:           len(manifest.Files),
+		Dirs:            len(manifest.Dirs),
+		ManifestVersion: manifest.Version,
+	}, nil
+}
+
+// Files lists the tracked paths, one per line, sorted
+func (v *Vault) Files() (string, error) {
+	manifest, err := recovery.ReadManifest(v.dirs)
+	if err != nil {
+		return "", err
+	}
+
+	paths := make([]string, 0, len(manifest.Files))
+	for path, entry := range manifest.Files {
+		if entry.SID != recovery.ManifestSID {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return strings.Join(paths, "\n"), nil
+}
+
+// RestoreFile reconstructs and verifies a single tracked file
+func (v *Vault) RestoreFile(path string) ([]byte, error) {
+	manifest, err := recovery.ReadManifest(v.dirs)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, ok := manifest.Files[path]
+	if !ok {
+		return nil, fmt.Errorf("%s is not tracked", path)
+	}
+	return recovery.ReadFile(v.dirs, entry)
+}
+
+// AddFile shares data (e.g. from the share sheet) into every store and
+// records it at path in a manifest delta. The desktop picks the file up on
+// its next restore; a full manifest upload from the desktop supersedes it
+func (v *Vault) AddFile(path string, data []byte) error {
+	if len(v.dirs) < 2 {
+		return errors.New("a vault needs at least 2 stores")
+	}
+
+	manifest, err := recovery.ReadManifest(v.dirs)
+	if err != nil {
+		return err
+	}
+
+	sidBytes := make([]byte, 16)
+	if _, err := rand.Read(sidBytes); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	entry := recovery.FileEntry{
+		SID:     base64.URLEncoding.EncodeToString(sidBytes),
+		Hash:    base64.URLEncoding.EncodeToString(sum[:]),
+		Version: newVersion(),
+	}
+	if err := v.writeObject(entry.ObjectName(), data); err != nil {
+		return err
+	}
+
+	delta := recovery.Delta{
+		Base:  manifest.Version,
+		Files: map[string]*recovery.FileEntry{path: &entry},
+	}
+	deltaBytes, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	return v.writeObject(recovery.ObjectName(recovery.DeltaSID, newVersion(), false), deltaBytes)
+}
+
+// writeObject writes one share of data to every store
+func (v *Vault) writeObject(object string, data []byte) error {
+	shares, err := recovery.Split(data, len(v.dirs), len(v.dirs))
+	if err != nil {
+		return err
+	}
+
+	for i, dir := range v.dirs {
+		if err := ioutil.WriteFile(filepath.Join(dir, object), recovery.Encode(shares[i]), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newVersion() string {
+	return fmt.Sprintf("%016x", time.Now().UnixNano())
+}
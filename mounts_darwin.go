@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// mountedVolumes lists the volumes under /Volumes, except the boot volume
+func mountedVolumes() []StoreCandidate {
+	volumes, _ := ioutil.ReadDir("/Volumes")
+
+	var candidates []StoreCandidate
+	for _, v := range volumes {
+		volumePath := filepath.Join("/Volumes", v.Name())
+		if target, err := os.Readlink(volumePath); err == nil && target == "/" {
+			continue
+		}
+		candidates = append(candidates, StoreCandidate{Kind: "mounted", Name: v.Name(), Path: volumePath})
+	}
+	return candidates
+}
+
+// listVolumes lists the volumes under /Volumes, labelled by their names,
+// with the UUIDs diskutil reports
+func listVolumes() []VolumeInfo {
+	var volumes []VolumeInfo
+	for _, candidate := range mountedVolumes() {
+		v := VolumeInfo{Mount: candidate.Path, Label: candidate.Name}
+		if out, err := exec.Command("diskutil", "info", candidate.Path).Output(); err == nil {
+			scanner := bufio.NewScanner(bytes.NewReader(out))
+			for scanner.Scan() {
+				field := strings.TrimSpace(scanner.Text())
+				if strings.HasPrefix(field, "Volume UUID:") {
+					v.UUID = strings.TrimSpace(strings.TrimPrefix(field, "Volume UUID:"))
+				}
+			}
+		}
+		volumes = append(volumes, v)
+	}
+	return volumes
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// file systems of network shares
+var networkFileSystems = map[string]string{
+	"cifs": "smb", "smb3": "smb", "smbfs": "smb",
+	"nfs": "nfs", "nfs4": "nfs",
+	"fuse.sshfs": "sshfs", "afpfs": "afp",
+}
+
+// mountedVolumes lists mounted network shares and removable volumes
+func mountedVolumes() []StoreCandidate {
+	mounts, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil
+	}
+	defer mounts.Close()
+
+	var candidates []StoreCandidate
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		device, mountPoint, fsType := fields[0], unescapeMount(fields[1]), fields[2]
+
+		kind, network := networkFileSystems[fsType]
+		removable := strings.HasPrefix(mountPoint, "/media/") || strings.HasPrefix(mountPoint, "/run/media/") || strings.HasPrefix(mountPoint, "/mnt/")
+		if !network && !removable {
+			continue
+		}
+		if !network {
+			kind = "mounted"
+		}
+		candidate := StoreCandidate{Kind: kind, Name: device, Path: mountPoint}
+		if fsType == "vfat" || fsType == "msdos" {
+			candidate.MaxFileSize = fat32MaxFileSize
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates
+}
+
+// unescapeMount decodes the octal escapes of /proc/self/mounts
+func unescapeMount(field string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(field)
+}
+
+// listVolumes lists the mounted block devices with their UUIDs and labels
+// from /dev/disk
+func listVolumes() []VolumeInfo {
+	mounts, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil
+	}
+	defer mounts.Close()
+
+	byDevice := make(map[string]*VolumeInfo)
+	var volumes []*VolumeInfo
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		device, err := filepath.EvalSymlinks(fields[0])
+		if err != nil || byDevice[device] != nil {
+			continue
+		}
+		v := &VolumeInfo{Mount: unescapeMount(fields[1])}
+		byDevice[device] = v
+		volumes = append(volumes, v)
+	}
+
+	for _, kind := range []string{"by-uuid", "by-label"} {
+		dir := filepath.Join("/dev/disk", kind)
+		links, _ := ioutil.ReadDir(dir)
+		for _, link := range links {
+			device, err := filepath.EvalSymlinks(filepath.Join(dir, link.Name()))
+			if err != nil || byDevice[device] == nil {
+				continue
+			}
+			if kind == "by-uuid" {
+				byDevice[device].UUID = link.Name()
+			} else {
+				byDevice[device].Label = unescapeLabel(link.Name())
+			}
+		}
+	}
+
+	list := make([]VolumeInfo, len(volumes))
+	for i, v := range volumes {
+		list[i] = *v
+	}
+	return list
+}
+
+// unescapeLabel decodes the \xNN escapes udev writes in label links
+func unescapeLabel(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		var c byte
+		if name[i] == '\\' && i+3 < len(name) && name[i+1] == 'x' {
+			if _, err := fmt.Sscanf(name[i+2:i+4], "%02x", &c); err == nil {
+				b.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+// mountedVolumes is unsupported on this platform
+func mountedVolumes() []StoreCandidate {
+	return nil
+}
+
+// listVolumes is unsupported on this platform
+func listVolumes() []VolumeInfo {
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	driveRemovable = 2
+	driveRemote    = 4
+)
+
+var (
+	kernel32                         = syscall.NewLazyDLL("kernel32.dll")
+	getDriveType                     = kernel32.NewProc("GetDriveTypeW")
+	getVolumeInformation             = kernel32.NewProc("GetVolumeInformationW")
+	getVolumeNameForVolumeMountPoint = kernel32.NewProc("GetVolumeNameForVolumeMountPointW")
+)
+
+// mountedVolumes lists mapped network drives and removable drives
+func mountedVolumes() []StoreCandidate {
+	var candidates []StoreCandidate
+	for letter := 'A'; letter <= 'Z'; letter++ {
+		root := string(letter) + `:\`
+		name, err := syscall.UTF16PtrFromString(root)
+		if err != nil {
+			continue
+		}
+
+		kind := ""
+		switch driveType, _, _ := getDriveType.Call(uintptr(unsafe.Pointer(name))); driveType {
+		case driveRemote:
+			kind = "smb"
+		case driveRemovable:
+			kind = "mounted"
+		default:
+			continue
+		}
+		candidates = append(candidates, StoreCandidate{Kind: kind, Name: root, Path: root})
+	}
+	return candidates
+}
+
+// listVolumes lists the drives by letter, with their volume GUIDs and labels
+func listVolumes() []VolumeInfo {
+	var volumes []VolumeInfo
+	for letter := 'A'; letter <= 'Z'; letter++ {
+		root := string(letter) + `:\`
+		name, err := syscall.UTF16PtrFromString(root)
+		if err != nil {
+			continue
+		}
+
+		guid := make([]uint16, 50)
+		if ok, _, _ := getVolumeNameForVolumeMountPoint.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&guid[0])), uintptr(len(guid))); ok == 0 {
+			continue
+		}
+		v := VolumeInfo{Mount: root}
+
+		// \\?\Volume{GUID}\
+		volumeName := syscall.UTF16ToString(guid)
+		if start, end := strings.Index(volumeName, "{"), strings.Index(volumeName, "}"); start >= 0 && end > start {
+			v.UUID = volumeName[start+1 : end]
+		}
+
+		label := make([]uint16, syscall.MAX_PATH+1)
+		if ok, _, _ := getVolumeInformation.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&label[0])), uintptr(len(label)), 0, 0, 0, 0, 0); ok != 0 {
+			v.Label = syscall.UTF16ToString(label)
+		}
+		volumes = append(volumes, v)
+	}
+	return volumes
+}
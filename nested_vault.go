@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// A vault inside another is backed up twice, by itself and as files of the
+// outer one, which then also holds the inner manifest and whatever the
+// inner vault keeps in folder stores of its own. With both running every
+// change is shared twice, and a restore of either writes into the other.
+// Neither direction is allowed unless --allow-nested is given: a vault
+// inside another refuses to load, and a vault skips the roots of vaults
+// inside it.
+
+// set by --allow-nested to let vaults hold or be held by other vaults
+var allowNestedVaults bool
+
+// isVaultRoot checks if dirPath holds a vault's manifest
+func isVaultRoot(dirPath string) bool {
+	fi, err := os.Stat(filepath.Join(dirPath, chasmPrefFile))
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// enclosingVault finds the root of a vault holding root, "" if none
+func enclosingVault(root string) string {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return ""
+	}
+	for dir := filepath.Dir(abs); dir != abs; abs, dir = dir, filepath.Dir(dir) {
+		if isVaultRoot(dir) {
+			return dir
+		}
+	}
+	return ""
+}
+
+// nestingProblem is why the vault at root cannot be loaded, if it cannot
+func nestingProblem(root string) error {
+	if allowNestedVaults {
+		return nil
+	}
+	if outer := enclosingVault(root); outer != "" {
+		return fmt.Errorf("%s is inside the vault at %s, which would back it up a second time. Use --allow-nested to load it anyway", root, outer)
+	}
+	return nil
+}
+
+// innerVault checks if dirPath is the root of a vault inside the loaded
+// one, which is not tracked
+func innerVault(dirPath string) bool {
+	return !allowNestedVaults && absSlash(dirPath) != absSlash(preferences.root) && isVaultRoot(dirPath)
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// OneDriveStore keeps shares in the app folder of a OneDrive, through the
+// Microsoft Graph API. The app is registered by the user as a public client,
+// and signed in with the device code flow, so no browser needs to run where
+// chasm does
+type OneDriveStore struct {
+	// the tokens are left out of the JSON, see MarshalJSON
+	Config     oauth2.Config `json:"oauth_config"`
+	OAuthToken oauth2.Token  `json:"oauth_token"`
+	UserID     string        `json:"user_id"`
+	Name       string        `json:"name"`
+}
+
+// credentials are kept in the local state, see credentials.go. A public
+// client has no secret, and without the access token every run refreshes
+// it once
+func (o *OneDriveStore) credentials() map[string]*string {
+	return map[string]*string{"refresh_token": &o.OAuthToken.RefreshToken}
+}
+
+// MarshalJSON leaves the tokens out of the preferences
+func (o OneDriveStore) MarshalJSON() ([]byte, error) {
+	type oneDriveStore OneDriveStore
+	plain := oneDriveStore(o)
+	plain.OAuthToken.AccessToken = ""
+	plain.OAuthToken.RefreshToken = ""
+	return json.Marshal(plain)
+}
+
+const (
+	graphMe = "https://graph.microsoft.com/v1.0/me"
+
+	// uploads larger than this go through an upload session
+	onedriveSimpleUpload = 4 << 20
+
+	// upload session chunks must be multiples of 320 KiB
+	onedriveChunk = 32 * 320 << 10
+
+	// largest file OneDrive takes
+	onedriveMaxObjectSize = 250 << 30
+)
+
+// personal and work or school accounts both sign in through common
+const onedriveLogin = "https://login.microsoftonline.com/common/oauth2/v2.0/"
+
+var onedriveEndpoint = oauth2.Endpoint{
+	AuthURL:  onedriveLogin + "authorize",
+	TokenURL: onedriveLogin + "token",
+}
+
+var onedriveScopes = []string{"Files.ReadWrite.AppFolder", "User.Read", "offline_access"}
+
+type onedriveDeviceCode struct {
+	DeviceCode string `json:"device_code"`
+	Message    string `json:"message"`
+	Interval   int    `json:"interval"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+type onedriveItem struct {
+	Name        string    `json:"name"`
+	File        *struct{} `json:"file"`
+	DownloadURL string    `json:"@microsoft.graph.downloadUrl"`
+}
+
+type onedriveListing struct {
+	Value    []onedriveItem `json:"value"`
+	NextLink string         `json:"@odata.nextLink"`
+}
+
+// Setup OneDrive with the client id of the user's app registration
+func (o *OneDriveStore) Setup(clientID string) bool {
+	o.Config = oauth2.Config{ClientID: clientID, Endpoint: onedriveEndpoint, Scopes: onedriveScopes}
+
+	tok, err := o.deviceToken()
+	if err != nil {
+		color.Red("Unable to sign in to OneDrive %v", err)
+		return false
+	}
+	o.OAuthToken = *tok
+
+	var me struct {
+		ID          string `json:"id"`
+		DisplayName string `json:"displayName"`
+		Principal   string `json:"userPrincipalName"`
+	}
+	if err := o.call("GET", graphMe, nil, &me); err != nil {
+		color.Red("Unable to retrieve OneDrive account %v", err)
+		return false
+	}
+	for _, ods := range preferences.OneDriveStores {
+		if ods.UserID == me.ID {
+			color.Red("OneDrive account %v (%v) already exists.", me.DisplayName, me.Principal)
+			return false
+		}
+	}
+
+	o.UserID = me.ID
+	o.Name = me.Principal
+	return true
+}
+
+// deviceToken signs in with the device code flow: the user enters a code
+// shown here on any device, while chasm polls for the token
+func (o OneDriveStore) deviceToken() (*oauth2.Token, error) {
+	form := url.Values{"client_id": {o.Config.ClientID}, "scope": {strings.Join(o.Config.Scopes, " ")}}
+	var code onedriveDeviceCode
+	if err := onedrivePostForm(onedriveLogin+"devicecode", form, &code); err != nil {
+		return nil, err
+	}
+	color.Yellow(code.Message)
+
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	form = url.Values{
+		"client_id":   {o.Config.ClientID},
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {code.DeviceCode},
+	}
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		var tok struct {
+			AccessToken  string `json:"access_token"`
+			RefreshToken string `json:"refresh_token"`
+			TokenType    string `json:"token_type"`
+			ExpiresIn    int    `json:"expires_in"`
+			Error        string `json:"error"`
+		}
+		err := onedrivePostForm(o.Config.Endpoint.TokenURL, form, &tok)
+		switch {
+		case tok.AccessToken != "":
+			return &oauth2.Token{AccessToken: tok.AccessToken, RefreshToken: tok.RefreshToken, TokenType: tok.TokenType, Expiry: time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)}, nil
+		case tok.Error == "authorization_pending":
+		case tok.Error == "slow_down":
+			interval += 5 * time.Second
+		case tok.Error != "":
+			return nil, errors.New(tok.Error)
+		case err != nil:
+			return nil, err
+		}
+	}
+	return nil, errors.New("the device code expired")
+}
+
+// onedrivePostForm posts a form and decodes the JSON answer into out,
+// which also holds the OAuth error of a failed request
+func onedrivePostForm(endpoint string, form url.Values, out interface{}) error {
+	resp, err := storeHTTPClient().PostForm(endpoint, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+func (o OneDriveStore) client() *http.Client {
+	ctx := storeContext(context.Background())
+	return oauth2.NewClient(ctx, o.Config.TokenSource(ctx, &o.OAuthToken))
+}
+
+// onedriveItemURL is the Graph URL of an object in the app folder,
+// followed by suffix
+func onedriveItemURL(object, suffix string) string {
+	return graphMe + "/drive/special/approot:/" + url.PathEscape(object) + ":" + suffix
+}
+
+// call sends a Graph request with a JSON body, decoding the result into out
+// unless it is nil
+func (o OneDriveStore) call(method, endpoint string, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	data, err := onedriveDo(o.client(), req)
+	if err != nil || out == nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// onedriveDo sends req with client, returning the body of a successful
+// response
+func onedriveDo(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// Upload adds the share as a new file, never replacing one
+func (o OneDriveStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading OneDrive/%s...", share.ObjectName()))
+	if err := o.upload(share.ObjectName(), share.Data); err != nil {
+		color.Red("OneDrive/%s upload failed: %v", share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+func (o OneDriveStore) upload(object string, data []byte) error {
+	if len(data) <= onedriveSimpleUpload {
+		req, err := http.NewRequest("PUT", onedriveItemURL(object, "/content?@microsoft.graph.conflictBehavior=fail"), bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		_, err = onedriveDo(o.client(), req)
+		return err
+	}
+
+	var session struct {
+		UploadURL string `json:"uploadUrl"`
+	}
+	item := map[string]interface{}{"item": map[string]string{"@microsoft.graph.conflictBehavior": "fail"}}
+	if err := o.call("POST", onedriveItemURL(object, "/createUploadSession"), item, &session); err != nil {
+		return err
+	}
+
+	// the upload URL is authorized on its own, and must not get the token
+	for offset := 0; offset < len(data); offset += onedriveChunk {
+		end := offset + onedriveChunk
+		if end > len(data) {
+			end = len(data)
+		}
+		req, err := http.NewRequest("PUT", session.UploadURL, bytes.NewReader(data[offset:end]))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, len(data)))
+		if _, err := onedriveDo(storeHTTPClient(), req); err != nil {
+			cancel, _ := http.NewRequest("DELETE", session.UploadURL, nil)
+			onedriveDo(storeHTTPClient(), cancel)
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove deletes a single object, into the OneDrive recycle bin
+func (o OneDriveStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting OneDrive/%s...", object))
+	if err := o.call("DELETE", onedriveItemURL(object, ""), nil, nil); err != nil {
+		color.Red("Error: could not delete %s from OneDrive: %s", object, err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all files in the app folder
+func (o OneDriveStore) list() ([]string, error) {
+	var objects []string
+	next := graphMe + "/drive/special/approot/children?$select=name,file&$top=1000"
+	for next != "" {
+		var listing onedriveListing
+		if err := o.call("GET", next, nil, &listing); err != nil {
+			return nil, err
+		}
+		for _, item := range listing.Value {
+			if item.File != nil {
+				objects = append(objects, item.Name)
+			}
+		}
+		next = listing.NextLink
+	}
+	return objects, nil
+}
+
+// List returns the names of all objects in the app folder
+func (o OneDriveStore) List() []string {
+	objects, err := o.list()
+	if err != nil {
+		color.Red("Error listing OneDrive: %s", err)
+		return nil
+	}
+	return objects
+}
+
+// download fetches an object from its pre-authorized download URL, which
+// must not get the token either
+func (o OneDriveStore) download(object string, header http.Header) ([]byte, error) {
+	var item onedriveItem
+	if err := o.call("GET", onedriveItemURL(object, "?$select=name,@microsoft.graph.downloadUrl"), nil, &item); err != nil {
+		return nil, err
+	}
+	if item.DownloadURL == "" {
+		return nil, errors.New("no download URL")
+	}
+	req, err := http.NewRequest("GET", item.DownloadURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return onedriveDo(storeHTTPClient(), req)
+}
+
+// Read downloads a single object
+func (o OneDriveStore) Read(object string) ([]byte, error) {
+	return o.download(object, nil)
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (o OneDriveStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	data, err := o.download(object, http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}})
+	if err == nil && int64(len(data)) > length {
+		// the whole object, when the range was ignored
+		if end := offset + length; end <= int64(len(data)) {
+			data = data[offset:end]
+		}
+	}
+	return data, err
+}
+
+// Restore downloads shares to local restore path
+func (o OneDriveStore) Restore() string {
+	objects, err := o.list()
+	if err != nil {
+		color.Red("Error listing OneDrive: %s", err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_onedrive_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from OneDrive...")
+	for _, object := range objects {
+		data, err := o.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects in the app folder
+func (o OneDriveStore) Description() string {
+	objects, err := o.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", o.ShortDescription(), err)
+	}
+
+	label := o.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (o OneDriveStore) ShortDescription() string {
+	return "OneDrive Store: " + o.Name
+}
+
+// Clean deletes all shares from the app folder
+func (o OneDriveStore) Clean() {
+	for _, object := range o.List() {
+		color.Yellow("Removing OneDrive: %v", object)
+		o.call("DELETE", onedriveItemURL(object, ""), nil, nil)
+	}
+}
+
+// MaxObjectSize of a single OneDrive file
+func (o OneDriveStore) MaxObjectSize() int64 {
+	return onedriveMaxObjectSize
+}
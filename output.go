@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Plain output is meant for screen readers and braille displays: no colors,
+// words instead of symbols, and results whose color told whether they
+// failed start with OK or FAILED. Long runs print a progress line every
+// plainProgressInterval instead of leaving the reader waiting. It is turned
+// on with --plain or CHASM_PLAIN=1 for a run, or with `chasm output plain`
+// for every run on this machine
+
+// time between progress lines of plain output
+const plainProgressInterval = 10 * time.Second
+
+var (
+	// set by --plain and the local state
+	plainOutput bool
+
+	// when the last progress line was printed
+	lastPlainProgress time.Time
+)
+
+// SetPlainOutput turns plain output on or off
+func SetPlainOutput(plain bool) {
+	plainOutput = plain
+	if plain {
+		color.NoColor = true
+	}
+}
+
+// doneMark ends a line such as "Uploading ..." once it is done
+func doneMark() string {
+	if plainOutput {
+		return " done\n"
+	}
+	return "\u2713\n"
+}
+
+// statusLine states whether a result line colored by its outcome failed,
+// as colors don't in plain output
+func statusLine(failed bool, line string) string {
+	if !plainOutput {
+		return line
+	}
+	if failed {
+		return "FAILED: " + line
+	}
+	return "OK: " + line
+}
+
+// plainProgress prints the progress of the run, at most once per
+// plainProgressInterval
+func plainProgress() {
+	if !plainOutput || currentRun == nil || time.Since(lastPlainProgress) < plainProgressInterval {
+		return
+	}
+	lastPlainProgress = time.Now()
+	fmt.Printf("Progress: %s, %v files, %s, %v errors so far.\n", currentRun.Command, currentRun.Files, formatBytes(currentRun.Bytes), currentRun.Errors)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The vault must never track what chasm itself writes: shares in a folder
+// store inside the vault would be shared again on every sync, each round
+// adding shares of the last, and so would the temp dirs restore downloads
+// shares to and the cache queued shares wait in, were the vault to hold
+// them. These are recognized by where they are rather than left to
+// .chasmignore, which users edit and which only matches names. A vault
+// that is itself inside one of these places is still tracked.
+
+// names chasm gives the temp files and dirs it creates in the system's
+// temp dir
+var stagingPrefixes = []string{"chasm_", "chasm-"}
+
+// names of the temp files written next to files being restored or exported
+var sideFilePrefixes = []string{".chasm-restore", ".chasm-export"}
+
+// ownPath describes the place of chasm's own that filePath is in, "" if
+// none
+func ownPath(filePath string) string {
+	abs := absSlash(filePath)
+	if abs == "" {
+		return ""
+	}
+	if hasPrefixIn(path.Base(abs), sideFilePrefixes) {
+		return "a temp file of a restore or export"
+	}
+	if abs == absSlash(preferences.RunLog) {
+		return "the run log"
+	}
+
+	root := absSlash(preferences.root)
+	own := func(dir string) bool {
+		return dir != "" && within(abs, dir) && !within(root, dir)
+	}
+
+	for _, dir := range folderStorePaths() {
+		if own(dir) {
+			return "in the folder store at " + filepath.FromSlash(dir)
+		}
+	}
+	if cache := absSlash(chasmCacheDir()); own(cache) {
+		return "in the cache at " + filepath.FromSlash(cache)
+	}
+	if temp := absSlash(os.TempDir()); temp != "" && abs != temp && within(abs, temp) {
+		first := strings.SplitN(strings.TrimPrefix(strings.TrimPrefix(abs, temp), "/"), "/", 2)[0]
+		if staging := path.Join(temp, first); hasPrefixIn(first, stagingPrefixes) && own(staging) {
+			return "in the staging area at " + filepath.FromSlash(staging)
+		}
+	}
+	return ""
+}
+
+// folderStorePaths are the absolute slash paths of the vault's folder
+// stores, including those on KBFS and the standby
+func folderStorePaths() []string {
+	var paths []string
+	for _, fs := range preferences.FolderStores {
+		paths = append(paths, absSlash(fs.Path))
+	}
+	for _, ks := range preferences.KBFSStores {
+		paths = append(paths, absSlash(ks.folder().Path))
+	}
+	if preferences.Standby != nil && preferences.Standby.Folder != nil {
+		paths = append(paths, absSlash(preferences.Standby.Folder.Path))
+	}
+	return paths
+}
+
+// absSlash is the absolute path of p with forward slashes, "" if p is
+// empty or has none
+func absSlash(p string) string {
+	if p == "" {
+		return ""
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return ""
+	}
+	return filepath.ToSlash(abs)
+}
+
+func hasPrefixIn(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// PCloudStore keeps shares in a folder of a pCloud account, through its
+// HTTP JSON API. Accounts live in either the US or the EU data region, each
+// with an API host of its own
+type PCloudStore struct {
+	Region   string `json:"region"`
+	Email    string `json:"email"`
+	Password string `json:"-"`
+	Folder   string `json:"folder"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (p *PCloudStore) credentials() map[string]*string {
+	return map[string]*string{"password": &p.Password}
+}
+
+// API hosts by data region
+var pcloudHosts = map[string]string{
+	"us": "https://api.pcloud.com",
+	"eu": "https://eapi.pcloud.com",
+}
+
+const (
+	// result of calls for a file or folder that does not exist
+	pcloudNotFound = 2009
+
+	// results of calls made with an expired or invalid auth token
+	pcloudLoginRequired = 1000
+	pcloudLoginFailed   = 2000
+)
+
+// auth tokens by account, signed in for once per run
+var (
+	pcloudAuthsLock sync.Mutex
+	pcloudAuths     = make(map[string]string)
+)
+
+// pcloudError is the result of a failed call
+type pcloudError struct {
+	Result  int    `json:"result"`
+	Message string `json:"error"`
+}
+
+func (e pcloudError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Result)
+}
+
+// pcloudMetadata describes a file or folder
+type pcloudMetadata struct {
+	Name     string           `json:"name"`
+	IsFolder bool             `json:"isfolder"`
+	Contents []pcloudMetadata `json:"contents"`
+}
+
+// Setup signs in and creates the folder if missing
+func (p PCloudStore) Setup() bool {
+	for _, ps := range preferences.PCloudStores {
+		if ps.Region == p.Region && ps.Email == p.Email && ps.Folder == p.Folder {
+			color.Red("pCloud folder %s already exists.", p.location())
+			return false
+		}
+	}
+	if _, ok := pcloudHosts[p.Region]; !ok {
+		color.Red("Error: unknown pCloud region %s, use us or eu", p.Region)
+		return false
+	}
+
+	if err := p.call("createfolderifnotexists", url.Values{"path": {p.folderPath()}}, new(pcloudError)); err != nil {
+		color.Red("Error: cannot set up %s: %s", p.location(), err)
+		return false
+	}
+	return true
+}
+
+func (p PCloudStore) location() string {
+	return p.Email + "/" + p.Folder
+}
+
+func (p PCloudStore) folderPath() string {
+	return "/" + p.Folder
+}
+
+func (p PCloudStore) objectPath(object string) string {
+	return path.Join(p.folderPath(), object)
+}
+
+// auth signs in to the account, once per run
+func (p PCloudStore) auth(renew bool) (string, error) {
+	pcloudAuthsLock.Lock()
+	defer pcloudAuthsLock.Unlock()
+	key := p.Region + "/" + p.Email
+	if auth, ok := pcloudAuths[key]; ok && !renew {
+		return auth, nil
+	}
+
+	var login struct {
+		Auth string `json:"auth"`
+	}
+	query := url.Values{"getauth": {"1"}, "username": {p.Email}, "password": {p.Password}}
+	if err := p.request("POST", "userinfo", query, nil, &login); err != nil {
+		return "", err
+	}
+	pcloudAuths[key] = login.Auth
+	return login.Auth, nil
+}
+
+// request calls method with the query, sent as a form unless body is set,
+// and decodes the JSON result into result
+func (p PCloudStore) request(httpMethod, method string, query url.Values, body []byte, result interface{}) error {
+	target := pcloudHosts[p.Region] + "/" + method
+	var req *http.Request
+	var err error
+	if body == nil {
+		req, err = http.NewRequest(httpMethod, target, bytes.NewBufferString(query.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest(httpMethod, target+"?"+query.Encode(), bytes.NewReader(body))
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := storeHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", method, resp.Status)
+	}
+
+	var status pcloudError
+	if err := json.Unmarshal(data, &status); err != nil {
+		return err
+	}
+	if status.Result != 0 {
+		return status
+	}
+	return json.Unmarshal(data, result)
+}
+
+// call calls method as the account, signing in again if the auth token is
+// no longer valid
+func (p PCloudStore) call(method string, query url.Values, result interface{}) error {
+	return p.callWithBody("POST", method, query, nil, result)
+}
+
+func (p PCloudStore) callWithBody(httpMethod, method string, query url.Values, body []byte, result interface{}) error {
+	for renew := false; ; renew = true {
+		auth, err := p.auth(renew)
+		if err != nil {
+			return err
+		}
+		authed := url.Values{"auth": {auth}}
+		for name, values := range query {
+			authed[name] = values
+		}
+		err = p.request(httpMethod, method, authed, body, result)
+		if e, ok := err.(pcloudError); ok && !renew && (e.Result == pcloudLoginRequired || e.Result == pcloudLoginFailed) {
+			continue
+		}
+		return err
+	}
+}
+
+// exists tells if the folder has an object
+func (p PCloudStore) exists(object string) (bool, error) {
+	err := p.call("stat", url.Values{"path": {p.objectPath(object)}}, new(pcloudError))
+	if e, ok := err.(pcloudError); ok && e.Result == pcloudNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (p PCloudStore) upload(object string, data []byte) error {
+	// an upload of an existing name would replace the file
+	exists, err := p.exists(object)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.New("object exists")
+	}
+
+	query := url.Values{"path": {p.folderPath()}, "filename": {object}, "nopartial": {"1"}}
+	return p.callWithBody("PUT", "uploadfile", query, data, new(pcloudError))
+}
+
+// Upload adds the share as a new file, refusing to replace one
+func (p PCloudStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading pCloud/%s/%s...", p.location(), share.ObjectName()))
+	if err := p.upload(share.ObjectName(), share.Data); err != nil {
+		color.Red("pCloud/%s/%s upload failed: %v", p.location(), share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// Remove permanently deletes a single object
+func (p PCloudStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting pCloud/%s/%s...", p.location(), object))
+	if err := p.call("deletefile", url.Values{"path": {p.objectPath(object)}}, new(pcloudError)); err != nil {
+		color.Red("Error: could not delete %s from pCloud: %s", object, err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all files in the folder
+func (p PCloudStore) list() ([]string, error) {
+	var listing struct {
+		Metadata pcloudMetadata `json:"metadata"`
+	}
+	if err := p.call("listfolder", url.Values{"path": {p.folderPath()}}, &listing); err != nil {
+		return nil, err
+	}
+	var objects []string
+	for _, entry := range listing.Metadata.Contents {
+		if !entry.IsFolder {
+			objects = append(objects, entry.Name)
+		}
+	}
+	return objects, nil
+}
+
+// List returns the names of all objects in the folder
+func (p PCloudStore) List() []string {
+	objects, err := p.list()
+	if err != nil {
+		color.Red("Error listing pCloud: %s", err)
+		return nil
+	}
+	return objects
+}
+
+// download fetches an object from the content server pCloud links it to,
+// with the Range header if set
+func (p PCloudStore) download(object, byteRange string) ([]byte, error) {
+	var link struct {
+		Path  string   `json:"path"`
+		Hosts []string `json:"hosts"`
+	}
+	if err := p.call("getfilelink", url.Values{"path": {p.objectPath(object)}}, &link); err != nil {
+		return nil, err
+	}
+	if len(link.Hosts) == 0 {
+		return nil, errors.New("no download host")
+	}
+
+	req, err := http.NewRequest("GET", "https://"+link.Hosts[0]+link.Path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	resp, err := storeHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("download failed: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Read downloads a single object
+func (p PCloudStore) Read(object string) ([]byte, error) {
+	return p.download(object, "")
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (p PCloudStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	return p.download(object, "bytes="+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(offset+length-1, 10))
+}
+
+// Restore downloads shares to local restore path
+func (p PCloudStore) Restore() string {
+	objects, err := p.list()
+	if err != nil {
+		color.Red("Error listing pCloud: %s", err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_pcloud_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from pCloud...")
+	for _, object := range objects {
+		data, err := p.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects in the folder
+func (p PCloudStore) Description() string {
+	objects, err := p.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", p.ShortDescription(), err)
+	}
+
+	label := p.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (p PCloudStore) ShortDescription() string {
+	return "pCloud Store (" + p.Region + "): " + p.location()
+}
+
+// Clean deletes all shares from the folder
+func (p PCloudStore) Clean() {
+	for _, object := range p.List() {
+		color.Yellow("Removing pCloud Store: %v", object)
+		p.call("deletefile", url.Values{"path": {p.objectPath(object)}}, new(pcloudError))
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+/// Hosting peers ///
+
+// HostedPeer is a friend whose shares this daemon keeps, up to a quota
+type HostedPeer struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Dir   string `json:"dir"`
+
+	// bytes the peer may store, 0 for no limit
+	Quota int64 `json:"quota"`
+}
+
+// PeerUsage is returned by GET /api/peer/objects/
+type PeerUsage struct {
+	Quota   int64    `json:"quota"`
+	Used    int64    `json:"used"`
+	Objects []string `json:"objects"`
+}
+
+// HostPeer starts hosting a peer and returns the token to give them
+func HostPeer(name, dir string, quota int64) (HostedPeer, bool) {
+	if name == "" || name != filepath.Base(name) {
+		color.Red("Error: invalid peer name %q.", name)
+		return HostedPeer{}, false
+	}
+	for _, peer := range state.Peers {
+		if peer.Name == name {
+			color.Red("Error: already hosting a peer named %s.", name)
+			return HostedPeer{}, false
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		color.Red("Error: cannot create %s: %s", dir, err)
+		return HostedPeer{}, false
+	}
+
+	peer := HostedPeer{Name: name, Token: string(RandomShareID()), Dir: dir, Quota: quota}
+	state.Peers = append(state.Peers, peer)
+	state.Save()
+	return peer, true
+}
+
+// UnhostPeer stops hosting a peer. Their shares are left in place
+func UnhostPeer(name string) bool {
+	for i, peer := range state.Peers {
+		if peer.Name == name {
+			state.Peers = append(state.Peers[:i], state.Peers[i+1:]...)
+			state.Save()
+			return true
+		}
+	}
+	return false
+}
+
+func (h HostedPeer) usage() PeerUsage {
+	usage := PeerUsage{Quota: h.Quota, Objects: []string{}}
+	files, _ := ioutil.ReadDir(h.Dir)
+	for _, f := range files {
+		// the access log is ours, not one of their objects
+		if hostLogFile(f.Name()) {
+			continue
+		}
+		usage.Used += f.Size()
+		usage.Objects = append(usage.Objects, f.Name())
+	}
+	return usage
+}
+
+// requestPeer finds the hosted peer whose token authorizes r, or answers
+// with an error
+func requestPeer(w http.ResponseWriter, r *http.Request) *HostedPeer {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	var peer *HostedPeer
+	for i := range state.Peers {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(state.Peers[i].Token)) == 1 {
+			peer = &state.Peers[i]
+		}
+	}
+	if peer == nil {
+		http.Error(w, "invalid peer token", http.StatusUnauthorized)
+	}
+	return peer
+}
+
+// apiPeerObjects serves /api/peer/objects/<object> to hosted peers, each
+// confined to their own directory
+func apiPeerObjects(w http.ResponseWriter, r *http.Request) {
+	peer := requestPeer(w, r)
+	if peer == nil {
+		return
+	}
+
+	object := strings.TrimPrefix(r.URL.Path, "/api/peer/objects/")
+	if object == "" && r.Method == "GET" {
+		writeJSON(w, peer.usage())
+		return
+	}
+	// manifests start with a dot, only the host's own log is off limits
+	if object == "" || object != filepath.Base(object) || object == "." || object == ".." || hostLogFile(object) {
+		http.Error(w, "invalid object name", http.StatusBadRequest)
+		return
+	}
+	objectPath := filepath.Join(peer.Dir, object)
+	peer.logAccess(r, object)
+
+	switch r.Method {
+	case "GET":
+		http.ServeFile(w, r, objectPath)
+	case "PUT":
+		// the quota is checked before the body is read, which is then
+		// streamed to the file
+		if r.ContentLength < 0 {
+			http.Error(w, "missing content length", http.StatusLengthRequired)
+			return
+		}
+		if usage := peer.usage(); peer.Quota > 0 && usage.Used+r.ContentLength > peer.Quota {
+			http.Error(w, fmt.Sprintf("quota of %s exceeded", formatQuota(peer.Quota)), http.StatusInsufficientStorage)
+			return
+		}
+
+		file, err := os.OpenFile(objectPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			http.Error(w, "object exists", http.StatusConflict)
+			return
+		}
+		written, err := io.Copy(file, io.LimitReader(r.Body, r.ContentLength))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil && written != r.ContentLength {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			os.Remove(objectPath)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	case "DELETE":
+		if err := os.Remove(objectPath); err != nil {
+			http.Error(w, "no such object", http.StatusNotFound)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// formatQuota prints a quota, 0 meaning unlimited
+func formatQuota(n int64) string {
+	if n <= 0 {
+		return "unlimited"
+	}
+	return formatBytes(n)
+}
+
+func formatBytes(n int64) string {
+	if n < 1<<20 {
+		return fmt.Sprintf("%v bytes", n)
+	}
+	return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// PeerStore keeps shares on a friend's chasm daemon, which hosts us with
+// `chasm peer host`. The daemon is reached over https, pinned to its
+// certificate fingerprint, or over plain http inside a WireGuard tunnel
+type PeerStore struct {
+	URL   string `json:"url"`
+	Token string `json:"-"`
+
+	// hex SHA-256 of the peer's TLS certificate, for self-signed daemons
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (p *PeerStore) credentials() map[string]*string {
+	return map[string]*string{"token": &p.Token}
+}
+
+// Setup checks that the peer accepts our token
+func (p PeerStore) Setup() bool {
+	for _, ps := range preferences.PeerStores {
+		if ps.URL == p.URL {
+			color.Red("Peer store at %v already exists.", p.URL)
+			return false
+		}
+	}
+
+	usage, err := p.usage()
+	if err != nil {
+		color.Red("Error: cannot reach peer %s: %s", p.URL, err)
+		return false
+	}
+
+	color.Green("Peer %s grants %s, %s used.", p.URL, formatQuota(usage.Quota), formatBytes(usage.Used))
+	return true
+}
+
+func (p PeerStore) client() *http.Client {
+	if p.Fingerprint == "" {
+		return storeHTTPClient()
+	}
+
+	// the certificate is trusted by its pinned fingerprint, not by a CA
+	pinned := strings.ToLower(strings.Replace(p.Fingerprint, ":", "", -1))
+	transport := &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) > 0 {
+				sum := sha256.Sum256(rawCerts[0])
+				if hex.EncodeToString(sum[:]) == pinned {
+					return nil
+				}
+			}
+			return errors.New("peer certificate does not match the pinned fingerprint")
+		},
+	}}
+
+	if debugHTTPLog != nil {
+		return &http.Client{Transport: debugTransport{base: transport}}
+	}
+	return &http.Client{Transport: transport}
+}
+
+func (p PeerStore) do(method, object string, body []byte) ([]byte, error) {
+	return p.doWith(method, object, body, nil)
+}
+
+// doWith is do with extra request headers
+func (p PeerStore) doWith(method, object string, body []byte, header http.Header) ([]byte, error) {
+	endpoint := strings.TrimSuffix(p.URL, "/") + "/api/peer/objects/" + url.PathEscape(object)
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+func (p PeerStore) usage() (PeerUsage, error) {
+	var usage PeerUsage
+	data, err := p.do("GET", "", nil)
+	if err == nil {
+		err = json.Unmarshal(data, &usage)
+	}
+	return usage, err
+}
+
+// Upload sends a share to the peer, which refuses to overwrite objects and
+// to go over our quota
+func (p PeerStore) Upload(share Share) {
+	if _, err := p.do("PUT", share.ObjectName(), share.Data); err != nil {
+		color.Red("Error uploading share %s to peer %s: %s", share.ObjectName(), p.URL, err)
+		return
+	}
+	if !share.Tombstone {
+		recordChallenges(p.URL, share.ObjectName(), share.Data)
+	}
+	color.Magenta("Share %s saved to peer %s!", share.ObjectName(), p.URL)
+}
+
+// Remove permanently deletes a single object
+func (p PeerStore) Remove(object string) {
+	if _, err := p.do("DELETE", object, nil); err != nil {
+		color.Red("Error: could not delete %s from peer %s: %s", object, p.URL, err)
+		return
+	}
+	delete(state.PeerChallenges[p.URL], object)
+	color.Yellow("Share %s deleted from peer!", object)
+}
+
+// List returns the names of all our objects on the peer
+func (p PeerStore) List() []string {
+	usage, err := p.usage()
+	if err != nil {
+		color.Red("Error listing peer %s: %s", p.URL, err)
+		return nil
+	}
+	return usage.Objects
+}
+
+// Restore downloads all our shares from the peer
+func (p PeerStore) Restore() string {
+	usage, err := p.usage()
+	if err != nil {
+		color.Red("Error listing peer %s: %s", p.URL, err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_peer_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from peer %s...", p.URL)
+	for _, object := range usage.Objects {
+		data, err := p.do("GET", object, nil)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects held by the peer
+func (p PeerStore) Description() string {
+	usage, err := p.usage()
+	if err != nil {
+		return fmt.Sprintf("Peer store at %s (unreachable: %s)", p.URL, err)
+	}
+
+	label := fmt.Sprintf("Peer store at %s, %s of %s used", p.URL, formatBytes(usage.Used), formatQuota(usage.Quota))
+	for _, object := range usage.Objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (p PeerStore) ShortDescription() string {
+	return "Peer store: " + p.URL
+}
+
+// Clean deletes all our shares from the peer
+func (p PeerStore) Clean() {
+	for _, object := range p.List() {
+		color.Yellow("Removing Peer Store: %v", object)
+		p.do("DELETE", object, nil)
+	}
+	delete(state.PeerChallenges, p.URL)
+}
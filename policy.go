@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A policy file in the root, .chasmpolicy.yaml, sets how paths are handled
+// in one place instead of with a flag per command. It holds a list of rules,
+// each for a path pattern:
+//
+//	rules:
+//	  - path: "*.iso"
+//	    ignore: true
+//	  - path: Documents/Taxes/**
+//	    retention_days: 3650
+//	    deleted_retention_days: 365
+//	    encryption: /home/me/chasm/Private
+//	    min_redundancy: 1
+//	  - path: Photos
+//	    schedule: 6h
+//	  - path: "*.mkv"
+//	    scheme: reed-solomon
+//
+// A pattern without a slash matches any name in the path, like the lines of
+// .chasmignore. Otherwise it matches the path relative to the root, or the
+// absolute path if it starts with a slash, and ** stands for any number of
+// directories. A rule for a directory applies to everything in it. When
+// several rules set the same thing, the last one wins.
+//
+// ignore leaves paths untracked. retention_days and deleted_retention_days
+// replace the vault's retention of superseded shares and of deleted files.
+// encryption seals files to the key of a protected directory, as if they
+// were in it. schedule is on-change, uploading changes as the watcher sees
+// them, sync, leaving them to chasm sync, or a duration to upload them at
+// most that often. Every file is shared across all stores, so placement
+// can only be all. min_redundancy is how many shares beyond those restore
+// needs every file must keep, see redundancy.go. scheme shares new uploads
+// with another sharing scheme than the vault's, see sharing.go.
+//
+// add, sync, compact and the watcher apply the policy, and refuse to run
+// with a policy that has errors. `chasm policy lint` lists them. A vault
+// enrolled in a fleet uses the fleet config's policy instead of its file.
+
+const chasmPolicyFile = ".chasmpolicy.yaml"
+
+// schedules accepted besides durations
+const (
+	scheduleOnChange = "on-change"
+	scheduleSync     = "sync"
+)
+
+// shortest schedule period, the watcher checks for due uploads this often
+const minSchedule = time.Minute
+
+// Policy is the parsed policy file
+type Policy struct {
+	Rules []PolicyRule `yaml:"rules"`
+}
+
+// PolicyRule sets how paths matching Path are handled. Unset fields leave
+// the setting to earlier rules or the vault's defaults
+type PolicyRule struct {
+	Path string `yaml:"path"`
+
+	Ignore *bool `yaml:"ignore,omitempty"`
+
+	// only all, every file is shared across all stores
+	Placement string `yaml:"placement,omitempty"`
+
+	RetentionDays        *int `yaml:"retention_days,omitempty"`
+	DeletedRetentionDays *int `yaml:"deleted_retention_days,omitempty"`
+
+	// protected directory the files are sealed to
+	Encryption string `yaml:"encryption,omitempty"`
+
+	// on-change, sync or a duration
+	Schedule string `yaml:"schedule,omitempty"`
+
+	// shares kept beyond the threshold, stores that can be lost
+	MinRedundancy *int `yaml:"min_redundancy,omitempty"`
+
+	// sharing scheme of new uploads instead of the vault's
+	Scheme string `yaml:"scheme,omitempty"`
+}
+
+// PolicyProblem is something lint found in a rule, numbered from 1, or in
+// the whole file if Rule is 0
+type PolicyProblem struct {
+	Rule    int
+	Warning bool
+	Message string
+}
+
+func (p PolicyProblem) String() string {
+	if p.Rule == 0 {
+		return p.Message
+	}
+	return fmt.Sprintf("rule %d: %s", p.Rule, p.Message)
+}
+
+// policy of the loaded vault, empty without a policy file
+var policy Policy
+
+// policyErr is why the policy file could not be applied
+var policyErr error
+
+// policyPath is the policy file of the vault at root
+func policyPath(root string) string {
+	return path.Join(root, chasmPolicyFile)
+}
+
+// loadPolicy reads and checks the policy of the fleet config, or else the
+// policy file of the vault at root
+func loadPolicy(root string) {
+	policy, policyErr = Policy{}, nil
+	var loaded Policy
+	var problems []PolicyProblem
+	var err error
+	if state.Fleet != nil {
+		loaded, problems, err = ParsePolicy([]byte(state.Fleet.Policy))
+	} else {
+		loaded, problems, err = ReadPolicy(policyPath(root))
+	}
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		policyErr = err
+		return
+	}
+	for _, problem := range problems {
+		if !problem.Warning {
+			policyErr = fmt.Errorf("%s", problem)
+			return
+		}
+	}
+	policy = loaded
+}
+
+// ReadPolicy parses the policy file at policyFile and lints it
+func ReadPolicy(policyFile string) (Policy, []PolicyProblem, error) {
+	data, err := ioutil.ReadFile(policyFile)
+	if err != nil {
+		return Policy{}, nil, err
+	}
+	return ParsePolicy(data)
+}
+
+// ParsePolicy parses a policy and lints it
+func ParsePolicy(data []byte) (Policy, []PolicyProblem, error) {
+	var parsed Policy
+	if err := yaml.UnmarshalStrict(data, &parsed); err != nil {
+		return Policy{}, nil, err
+	}
+	return parsed, parsed.Lint(), nil
+}
+
+// Lint checks every rule, with the vault's protected directories loaded
+func (p Policy) Lint() []PolicyProblem {
+	var problems []PolicyProblem
+	if len(p.Rules) == 0 {
+		problems = append(problems, PolicyProblem{Warning: true, Message: "no rules"})
+	}
+
+	for i, rule := range p.Rules {
+		problem := func(warning bool, format string, args ...interface{}) {
+			problems = append(problems, PolicyProblem{Rule: i + 1, Warning: warning, Message: fmt.Sprintf(format, args...)})
+		}
+
+		if rule.Path == "" {
+			problem(false, "missing path")
+		} else if err := checkPolicyPattern(rule.Path); err != nil {
+			problem(false, "bad path %q: %s", rule.Path, err)
+		}
+
+		if rule.Placement != "" && rule.Placement != "all" {
+			problem(false, "placement %q: every file is shared across all stores, placement can only be all", rule.Placement)
+		}
+		if rule.RetentionDays != nil && *rule.RetentionDays < 0 {
+			problem(false, "retention_days cannot be negative")
+		}
+		if rule.DeletedRetentionDays != nil && *rule.DeletedRetentionDays < 0 {
+			problem(false, "deleted_retention_days cannot be negative")
+		}
+		if rule.MinRedundancy != nil && *rule.MinRedundancy < 0 {
+			problem(false, "min_redundancy cannot be negative")
+		}
+		if rule.Encryption != "" {
+			if _, ok := preferences.Protected[path.Clean(rule.Encryption)]; !ok {
+				problem(false, "encryption %q is not a protected directory, see chasm protect", rule.Encryption)
+			}
+		}
+		if rule.Scheme != "" {
+			if _, ok := sharingSchemes[rule.Scheme]; !ok {
+				problem(false, "scheme %q is not one of %s", rule.Scheme, strings.Join(SharingSchemeNames(), ", "))
+			}
+		}
+		switch rule.Schedule {
+		case "", scheduleOnChange, scheduleSync:
+		default:
+			period, err := time.ParseDuration(rule.Schedule)
+			if err != nil {
+				problem(false, "schedule %q is not on-change, sync or a duration", rule.Schedule)
+			} else if period < minSchedule {
+				problem(false, "schedule %q is shorter than %v", rule.Schedule, minSchedule)
+			}
+		}
+
+		ignored := rule.Ignore != nil && *rule.Ignore
+		sets := rule.Placement != "" || rule.RetentionDays != nil || rule.DeletedRetentionDays != nil || rule.Encryption != "" || rule.Schedule != "" || rule.MinRedundancy != nil || rule.Scheme != ""
+		if ignored && sets {
+			problem(true, "ignored paths are not tracked, the other settings do nothing")
+		} else if rule.Ignore == nil && !sets {
+			problem(true, "sets nothing")
+		}
+		if ignored && rule.Path != "" && (matchPolicyPattern(rule.Path, chasmPrefFile) || matchPolicyPattern(rule.Path, chasmPolicyFile)) {
+			problem(true, "%q matches %s or %s, which are never ignored", rule.Path, chasmPrefFile, chasmPolicyFile)
+		}
+	}
+	return problems
+}
+
+// checkPolicyPattern checks the syntax of every part of pattern
+func checkPolicyPattern(pattern string) error {
+	for _, part := range strings.Split(strings.Trim(pattern, "/"), "/") {
+		if part == "" {
+			return fmt.Errorf("empty directory name")
+		}
+		if _, err := path.Match(part, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchPolicyPattern checks if pattern matches the path name, given relative
+// to the root or absolute, or one of the directories it is in
+func matchPolicyPattern(pattern string, name string) bool {
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+
+	// a bare name matches any part of the path
+	if !strings.Contains(strings.Trim(pattern, "/"), "/") && !strings.HasPrefix(pattern, "/") {
+		for _, part := range parts {
+			if ok, _ := path.Match(pattern, part); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	// absolute patterns only match absolute paths, relative ones relative
+	if strings.HasPrefix(pattern, "/") != strings.HasPrefix(name, "/") {
+		return false
+	}
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	for n := len(parts); n > 0; n-- {
+		if matchParts(patternParts, parts[:n]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchParts matches path parts against pattern parts, where ** matches any
+// number of parts
+func matchParts(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		for skip := 0; skip <= len(parts); skip++ {
+			if matchParts(pattern[1:], parts[skip:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+		return false
+	}
+	return matchParts(pattern[1:], parts[1:])
+}
+
+// policyName is filePath as rule patterns see it, relative to the root if it
+// is inside it
+func policyName(filePath string) string {
+	filePath = path.Clean(filePath)
+	if preferences.root != "" {
+		if rel, err := filepath.Rel(preferences.root, filePath); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.ToSlash(filePath)
+}
+
+// policyFor merges the rules matching filePath, later ones taking precedence
+func policyFor(filePath string) PolicyRule {
+	var merged PolicyRule
+	if len(policy.Rules) == 0 {
+		return merged
+	}
+	name := policyName(filePath)
+	for _, rule := range policy.Rules {
+		if !matchPolicyPattern(rule.Path, name) {
+			continue
+		}
+		if rule.Ignore != nil {
+			merged.Ignore = rule.Ignore
+		}
+		if rule.RetentionDays != nil {
+			merged.RetentionDays = rule.RetentionDays
+		}
+		if rule.DeletedRetentionDays != nil {
+			merged.DeletedRetentionDays = rule.DeletedRetentionDays
+		}
+		if rule.Encryption != "" {
+			merged.Encryption = path.Clean(rule.Encryption)
+		}
+		if rule.Schedule != "" {
+			merged.Schedule = rule.Schedule
+		}
+		if rule.MinRedundancy != nil {
+			merged.MinRedundancy = rule.MinRedundancy
+		}
+		if rule.Scheme != "" {
+			merged.Scheme = rule.Scheme
+		}
+	}
+	return merged
+}
+
+// policyIgnores checks if the policy leaves filePath untracked. The
+// manifest and the policy itself are always tracked
+func policyIgnores(filePath string) bool {
+	base := path.Base(filePath)
+	if base == chasmPrefFile || base == chasmPolicyFile {
+		return false
+	}
+	ignore := policyFor(filePath).Ignore
+	return ignore != nil && *ignore
+}
+
+// retentionFor is how long superseded shares of filePath are kept
+func retentionFor(filePath string) int {
+	if days := policyFor(filePath).RetentionDays; days != nil {
+		return *days
+	}
+	return preferences.RetentionDays
+}
+
+// deletedRetentionFor is how long filePath stays restorable once deleted
+func deletedRetentionFor(filePath string) int {
+	if days := policyFor(filePath).DeletedRetentionDays; days != nil {
+		return *days
+	}
+	return preferences.DeletedRetentionDays
+}
+
+// scheduleFor is when the watcher uploads changes to filePath: at once for
+// a zero period, never if manual, otherwise at most once per period
+func scheduleFor(filePath string) (period time.Duration, manual bool) {
+	switch schedule := policyFor(filePath).Schedule; schedule {
+	case "", scheduleOnChange:
+		return 0, false
+	case scheduleSync:
+		return 0, true
+	default:
+		period, _ := time.ParseDuration(schedule)
+		return period, false
+	}
+}
+
+// minRedundancyFor is how many spare shares filePath must keep
+func minRedundancyFor(filePath string) int {
+	if min := policyFor(filePath).MinRedundancy; min != nil {
+		return *min
+	}
+	return 0
+}
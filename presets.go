@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	"github.com/fatih/color"
+)
+
+// Preset is a curated group of commonly valuable paths, relative to the
+// home directory, per platform. Missing paths are skipped
+type Preset struct {
+	Description string
+	Paths       map[string][]string // GOOS -> paths, "" applies to all
+}
+
+var presets = map[string]Preset{
+	"ssh-keys": {
+		Description: "SSH and GnuPG keys and configuration",
+		Paths: map[string][]string{
+			"":        {".ssh", ".gnupg"},
+			"windows": {"AppData/Roaming/gnupg"},
+		},
+	},
+	"browser-profiles": {
+		Description: "Firefox, Chrome and Chromium profiles, without caches",
+		Paths: map[string][]string{
+			"linux":   {".mozilla/firefox", ".config/google-chrome", ".config/chromium"},
+			"darwin":  {"Library/Application Support/Firefox/Profiles", "Library/Application Support/Google/Chrome", "Library/Application Support/Chromium"},
+			"windows": {"AppData/Roaming/Mozilla/Firefox/Profiles", "AppData/Local/Google/Chrome/User Data", "AppData/Local/Chromium/User Data"},
+		},
+	},
+	"dotfiles": {
+		Description: "Shell, editor and git configuration",
+		Paths: map[string][]string{
+			"": {".bashrc", ".bash_profile", ".profile", ".zshrc", ".zprofile", ".inputrc",
+				".gitconfig", ".vimrc", ".tmux.conf", ".config/nvim", ".config/fish", ".config/git"},
+			"windows": {"Documents/WindowsPowerShell/Microsoft.PowerShell_profile.ps1", "Documents/PowerShell/Microsoft.PowerShell_profile.ps1"},
+		},
+	},
+}
+
+// PresetNames lists the available presets, sorted
+func PresetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PresetPaths returns the absolute paths of a preset that exist on this machine
+func PresetPaths(name string) ([]string, bool) {
+	preset, ok := presets[name]
+	if !ok {
+		return nil, false
+	}
+
+	usr, err := user.Current()
+	if err != nil {
+		color.Red("Error: cannot find home directory: %s", err)
+		return nil, true
+	}
+
+	var paths []string
+	for _, rel := range append(preset.Paths[""], preset.Paths[runtime.GOOS]...) {
+		filePath := filepath.Join(usr.HomeDir, filepath.FromSlash(rel))
+		if _, err := os.Stat(filePath); err == nil {
+			paths = append(paths, filePath)
+		}
+	}
+	return paths, true
+}
+
+// AddPreset tracks every existing path of a preset and remembers it, so
+// sync picks up paths that appear later
+func AddPreset(name string) bool {
+	paths, ok := PresetPaths(name)
+	if !ok {
+		color.Red("Error: unknown preset %s. Available presets:", name)
+		for _, name := range PresetNames() {
+			color.Cyan("  %-18s %s", name, presets[name].Description)
+		}
+		return false
+	}
+
+	if preferences.Presets == nil {
+		preferences.Presets = make(map[string]bool)
+	}
+	preferences.Presets[name] = true
+
+	if len(paths) == 0 {
+		color.Yellow("Preset %s: nothing found on this machine yet.", name)
+		return true
+	}
+
+	color.Green("Preset %s: tracking %d paths", name, len(paths))
+	for _, filePath := range paths {
+		AddFile(filePath)
+	}
+	return true
+}
+
+// presetPathsToSync lists the existing paths of all remembered presets
+func presetPathsToSync() []string {
+	var all []string
+	for name := range preferences.Presets {
+		paths, _ := PresetPaths(name)
+		all = append(all, paths...)
+	}
+	return all
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// A friend hosting our shares could drop them and we would only find out
+// when restoring. Downloading them all to check costs their size every
+// time, so each share uploaded to a peer comes with a few challenges made
+// while its contents are at hand: a random nonce and range of the share,
+// and the SHA-256 of the nonce followed by the range. The peer is later
+// sent the nonce and range and must answer with the hash, which it can only
+// compute from the share itself. Each challenge is used once, as the peer
+// learns its answer. `chasm peer challenge --refill` downloads the shares
+// whose challenges are used up, or that were uploaded before challenges
+// were made, and makes new ones
+
+const (
+	// challenges made for each share uploaded to a peer
+	peerChallengesPerObject = 8
+
+	// largest range of a share a challenge hashes
+	peerChallengeRange = 64 << 10
+
+	// shares challenged in each round, and how often the watcher runs one
+	defaultPeerChallenges = 16
+	peerChallengeInterval = 24 * time.Hour
+)
+
+// StorageChallenge asks a peer to prove it holds a share
+type StorageChallenge struct {
+	Nonce  []byte `json:"nonce"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+
+	// expected answer, never sent
+	Proof []byte `json:"proof,omitempty"`
+}
+
+// ChallengeResult counts the answers of one peer
+type ChallengeResult struct {
+	Peer   string
+	Proven int
+	Failed int
+
+	// error ending the round early, such as the peer being unreachable
+	Err error
+
+	// challenges left for later rounds, and shares without any
+	Left      int
+	Exhausted int
+}
+
+// proofOf is the answer to a challenge over data
+func proofOf(nonce, data []byte) []byte {
+	sum := sha256.Sum256(append(append([]byte{}, nonce...), data...))
+	return sum[:]
+}
+
+// randomInt64 is a uniform random number in [0, n)
+func randomInt64(n int64) int64 {
+	if n <= 0 {
+		return 0
+	}
+	r, err := rand.Int(rand.Reader, big.NewInt(n))
+	check(err)
+	return r.Int64()
+}
+
+// makeChallenges makes the challenges of a share
+func makeChallenges(data []byte) []StorageChallenge {
+	challenges := make([]StorageChallenge, peerChallengesPerObject)
+	for i := range challenges {
+		length := int64(len(data))
+		if length > peerChallengeRange {
+			length = peerChallengeRange
+		}
+		offset := randomInt64(int64(len(data)) - length + 1)
+		nonce := make([]byte, 16)
+		_, err := rand.Read(nonce)
+		check(err)
+		challenges[i] = StorageChallenge{Nonce: nonce, Offset: offset, Length: length, Proof: proofOf(nonce, data[offset:offset+length])}
+	}
+	return challenges
+}
+
+// recordChallenges keeps the challenges of a share uploaded to peer
+func recordChallenges(peer, object string, data []byte) {
+	if state.PeerChallenges == nil {
+		state.PeerChallenges = make(map[string]map[string][]StorageChallenge)
+	}
+	if state.PeerChallenges[peer] == nil {
+		state.PeerChallenges[peer] = make(map[string][]StorageChallenge)
+	}
+	state.PeerChallenges[peer][object] = makeChallenges(data)
+}
+
+// prove sends a challenge for object to the peer and returns its answer
+func (p PeerStore) prove(object string, challenge StorageChallenge) ([]byte, error) {
+	challenge.Proof = nil
+	body, err := json.Marshal(challenge)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := strings.TrimSuffix(p.URL, "/") + "/api/peer/prove/" + url.PathEscape(object)
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var answer struct {
+		Proof []byte `json:"proof"`
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = json.NewDecoder(resp.Body).Decode(&answer)
+		return answer.Proof, err
+	case http.StatusNotFound:
+		// a definite answer: the share is gone
+		return nil, nil
+	}
+	return nil, fmt.Errorf("peer answered %s", resp.Status)
+}
+
+// ChallengePeer sends up to count challenges, each for a different share
+// picked at random, to the peer, using them up
+func ChallengePeer(p PeerStore, count int) ChallengeResult {
+	result := ChallengeResult{Peer: p.URL}
+	challenges := state.PeerChallenges[p.URL]
+
+	var objects []string
+	for object, left := range challenges {
+		if len(left) > 0 {
+			objects = append(objects, object)
+		}
+	}
+	for i := len(objects) - 1; i > 0; i-- {
+		j := randomInt64(int64(i + 1))
+		objects[i], objects[j] = objects[j], objects[i]
+	}
+	if len(objects) > count {
+		objects = objects[:count]
+	}
+
+	for _, object := range objects {
+		left := challenges[object]
+		challenge := left[len(left)-1]
+		answer, err := p.prove(object, challenge)
+		if err != nil {
+			result.Err = err
+			break
+		}
+		challenges[object] = left[:len(left)-1]
+		if subtle.ConstantTimeCompare(answer, challenge.Proof) == 1 {
+			result.Proven++
+		} else {
+			color.Red("Peer %s failed to prove it holds %s", p.URL, object)
+			result.Failed++
+		}
+	}
+
+	for _, left := range challenges {
+		result.Left += len(left)
+		if len(left) == 0 {
+			result.Exhausted++
+		}
+	}
+	state.Save()
+	return result
+}
+
+// RefillChallenges downloads the peer's shares without challenges left and
+// makes new ones. Returns the number of shares refilled
+func RefillChallenges(p PeerStore) (int, error) {
+	usage, err := p.usage()
+	if err != nil {
+		return 0, err
+	}
+	refilled := 0
+	for _, object := range usage.Objects {
+		if len(state.PeerChallenges[p.URL][object]) > 0 {
+			continue
+		}
+		data, err := p.do("GET", object, nil)
+		if err != nil {
+			color.Red("Error downloading %s from peer %s: %s", object, p.URL, err)
+			continue
+		}
+		recordChallenges(p.URL, object, data)
+		refilled++
+	}
+	state.Save()
+	return refilled, nil
+}
+
+// ChallengePeers runs a round of challenges against every peer store
+func ChallengePeers(count int) []ChallengeResult {
+	var results []ChallengeResult
+	for _, p := range preferences.PeerStores {
+		results = append(results, ChallengePeer(p, count))
+	}
+	return results
+}
+
+// apiPeerProve serves POST /api/peer/prove/<object>, answering a challenge
+// for one of the hosted peer's shares
+func apiPeerProve(w http.ResponseWriter, r *http.Request) {
+	peer := requestPeer(w, r)
+	if peer == nil {
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	object := strings.TrimPrefix(r.URL.Path, "/api/peer/prove/")
+	if object == "" || object != filepath.Base(object) || strings.HasPrefix(object, ".") {
+		http.Error(w, "invalid object name", http.StatusBadRequest)
+		return
+	}
+	var challenge StorageChallenge
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&challenge); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if challenge.Offset < 0 || challenge.Length < 0 || challenge.Length > peerChallengeRange {
+		http.Error(w, "invalid range", http.StatusBadRequest)
+		return
+	}
+
+	data, err := readPeerRange(filepath.Join(peer.Dir, object), challenge.Offset, challenge.Length)
+	if os.IsNotExist(err) {
+		http.Error(w, "no such object", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string][]byte{"proof": proofOf(challenge.Nonce, data)})
+}
+
+// readPeerRange reads exactly length bytes of a hosted share from offset
+func readPeerRange(objectPath string, offset, length int64) ([]byte, error) {
+	file, err := os.Open(objectPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, offset); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("range past the end of the object")
+		}
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/TheLisztomaniac/chasmOriginal/keywrap"
+	"github.com/fatih/color"
+)
+
+// Protected directories add a second secret on top of secret sharing, for
+// folders that should not come back with a routine restore. Each has a
+// keywrap key pair: sync seals files to the public key, so it never needs the
+// passphrase, while the private key is kept sealed under the passphrase and
+// only opened by restore --unlock.
+//
+// A directory can also require a keyfile, such as one kept on a USB stick.
+// The key its private key is sealed under is then keyfileKey of the keyfile
+// and the passphrase's PBKDF2 key, so neither the passphrase nor the keyfile
+// opens it alone. protect --rekey seals the same private key under a new
+// passphrase or keyfile, leaving the uploaded files as they are.
+//
+// A protected file is shared as
+//
+//	"CHPF" | version | wrapped key length (2) | wrapped key | segments
+//
+// where the wrapped key is a fresh AES-256 key per upload, and the contents
+// are sealed with it in AES-GCM segments of protectSegment bytes. Segment
+// nonces count up and flag the final segment, which is always shorter than
+// the others, so reordered or truncated contents fail to open.
+
+const protectMagic = "CHPF"
+
+const protectVersion = 1
+
+// plaintext bytes per sealed segment
+const protectSegment = 64 << 10
+
+// PBKDF2-SHA256 rounds for new passphrases
+const protectIterations = 600000
+
+// keywrap and AES-GCM contexts
+var (
+	protectFileContext = []byte("chasm protected file")
+	protectKeyContext  = []byte("chasm protected path key")
+)
+
+// ProtectedPath is a directory whose files need a passphrase to restore
+type ProtectedPath struct {
+	// keywrap public key new uploads are sealed to
+	PublicKey string `json:"public_key"`
+
+	// base64 salt, nonce and AES-GCM sealed private key, under a key derived
+	// from the passphrase
+	SealedKey string `json:"sealed_key"`
+
+	// PBKDF2 rounds the passphrase key was derived with
+	Iterations int `json:"iterations"`
+
+	// unlocking also needs the keyfile the key was sealed with
+	Keyfile bool `json:"keyfile,omitempty"`
+}
+
+// restore asks for the passphrases of protected directories, from --unlock
+var unlockRestore bool
+
+// keyfiles to unlock protected directories with, from --keyfile
+var keyfilePaths []string
+
+// keys of the protected directories unlocked for this restore
+var unlockedPaths = make(map[string]*keywrap.PrivateKey)
+
+// protected files skipped by restore, by directory
+var lockedSkipped = make(map[string]int)
+
+// protectionFor is the protected directory whose key filePath is sealed to,
+// if any: the one the policy names, else the one containing it
+func protectionFor(filePath string) string {
+	if encryption := policyFor(filePath).Encryption; encryption != "" {
+		return encryption
+	}
+
+	filePath = path.Clean(filePath)
+	protection := ""
+	for dir := range preferences.Protected {
+		if strings.HasPrefix(filePath, dir+"/") && len(dir) > len(protection) {
+			protection = dir
+		}
+	}
+	return protection
+}
+
+// ProtectPath protects dirPath with a new key pair of mode sealed under
+// passphrase, and keyfile if not nil
+func ProtectPath(dirPath string, mode string, passphrase, keyfile []byte) error {
+	private, err := keywrap.GenerateKey(mode)
+	if err != nil {
+		return err
+	}
+	return sealPathKey(dirPath, private, passphrase, keyfile)
+}
+
+// RekeyPath seals the key of protected dirPath under a new passphrase, and
+// keyfile if not nil
+func RekeyPath(dirPath string, key *keywrap.PrivateKey, passphrase, keyfile []byte) error {
+	if key.Public().String() != preferences.Protected[dirPath].PublicKey {
+		return fmt.Errorf("the key is not that of %s", dirPath)
+	}
+	return sealPathKey(dirPath, key, passphrase, keyfile)
+}
+
+// sealPathKey keeps private as the key of protected dirPath, sealed under
+// passphrase and keyfile
+func sealPathKey(dirPath string, private *keywrap.PrivateKey, passphrase, keyfile []byte) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := passphraseAEAD(passphrase, keyfile, salt, protectIterations)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	secret := []byte(private.String())
+	defer wipe(secret)
+	sealed := append(append(salt, nonce...), aead.Seal(nil, nonce, secret, protectKeyContext)...)
+
+	if preferences.Protected == nil {
+		preferences.Protected = make(map[string]ProtectedPath)
+	}
+	preferences.Protected[dirPath] = ProtectedPath{
+		PublicKey:  private.Public().String(),
+		SealedKey:  base64.StdEncoding.EncodeToString(sealed),
+		Iterations: protectIterations,
+		Keyfile:    keyfile != nil,
+	}
+	return nil
+}
+
+// Unlock opens the private key of a protected directory with passphrase,
+// and keyfile if it needs one
+func (p ProtectedPath) Unlock(passphrase, keyfile []byte) (*keywrap.PrivateKey, error) {
+	if !p.Keyfile {
+		keyfile = nil
+	} else if keyfile == nil {
+		return nil, errors.New("needs its keyfile")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(p.SealedKey)
+	if err != nil || len(sealed) < 16 {
+		return nil, errors.New("invalid sealed key")
+	}
+	aead, err := passphraseAEAD(passphrase, keyfile, sealed[:16], p.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < 16+aead.NonceSize() {
+		return nil, errors.New("invalid sealed key")
+	}
+
+	nonce := sealed[16 : 16+aead.NonceSize()]
+	secret, err := aead.Open(nil, nonce, sealed[16+aead.NonceSize():], protectKeyContext)
+	if err != nil {
+		if p.Keyfile {
+			return nil, errors.New("wrong passphrase or keyfile")
+		}
+		return nil, errors.New("wrong passphrase")
+	}
+	defer wipe(secret)
+	return keywrap.ParsePrivateKey(string(secret))
+}
+
+// unlockPath opens the private key of p with passphrase and, if it needs
+// one, the first of keyfilePaths that fits
+func unlockPath(p ProtectedPath, passphrase []byte) (*keywrap.PrivateKey, error) {
+	if !p.Keyfile {
+		return p.Unlock(passphrase, nil)
+	}
+
+	err := errors.New("needs its keyfile, give it with --keyfile")
+	for _, keyfilePath := range keyfilePaths {
+		keyfile, readErr := readKeyfile(keyfilePath)
+		if readErr != nil {
+			err = readErr
+			continue
+		}
+		key, unlockErr := p.Unlock(passphrase, keyfile)
+		wipe(keyfile)
+		if unlockErr == nil {
+			return key, nil
+		}
+		err = unlockErr
+	}
+	return nil, err
+}
+
+// passphraseAEAD is AES-256-GCM under a PBKDF2 key of passphrase, or its
+// keyfileKey with keyfile if not nil
+func passphraseAEAD(passphrase, keyfile, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	if keyfile != nil {
+		key = keyfileKey(key, keyfile)
+	}
+	defer wipe(key)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce numbers segment i, flagging the final one
+func segmentNonce(i uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, i)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// sealProtected seals src to the key of protected directory dir
+func sealProtected(dir string, dst io.Writer, src io.Reader) error {
+	public, err := keywrap.ParsePublicKey(preferences.Protected[dir].PublicKey)
+	if err != nil {
+		return fmt.Errorf("protected %s: %s", dir, err)
+	}
+
+	key := make([]byte, 32)
+	defer wipe(key)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	wrapped, err := keywrap.Wrap(public, key, protectFileContext)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	header := append([]byte(protectMagic), protectVersion)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	if _, err := dst.Write(append(header, wrapped...)); err != nil {
+		return err
+	}
+
+	segment, release := lockedBuffer(protectSegment)
+	defer release()
+	sealed := make([]byte, 0, protectSegment+aead.Overhead())
+	for i := uint64(0); ; i++ {
+		n, err := io.ReadFull(src, segment)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		final := n < len(segment)
+		sealed = aead.Seal(sealed[:0], segmentNonce(i, final), segment[:n], nil)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// openProtected opens contents sealed by sealProtected with key into dst
+func openProtected(key *keywrap.PrivateKey, dst io.Writer, src io.Reader) error {
+	header := make([]byte, len(protectMagic)+3)
+	if _, err := io.ReadFull(src, header); err != nil || string(header[:len(protectMagic)]) != protectMagic {
+		return errors.New("not protected contents")
+	}
+	if header[len(protectMagic)] != protectVersion {
+		return fmt.Errorf("unsupported protected format %d", header[len(protectMagic)])
+	}
+	wrapped := make([]byte, binary.BigEndian.Uint16(header[len(protectMagic)+1:]))
+	if _, err := io.ReadFull(src, wrapped); err != nil {
+		return errors.New("protected contents are truncated")
+	}
+
+	fileKey, err := keywrap.Unwrap(key, wrapped, protectFileContext)
+	if err != nil {
+		return err
+	}
+	defer wipe(fileKey)
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	sealed := make([]byte, protectSegment+aead.Overhead())
+	segment, release := lockedBuffer(protectSegment)
+	defer release()
+	for i := uint64(0); ; i++ {
+		n, err := io.ReadFull(src, sealed)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		final := n < len(sealed)
+		plain, err := aead.Open(segment[:0], segmentNonce(i, final), sealed[:n], nil)
+		if err != nil {
+			return errors.New("protected contents are corrupt or truncated")
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// sealProtectedFile seals filePath into a temp file for sharing
+func sealProtectedFile(dir string, filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	sealed, err := ioutil.TempFile("", "chasm_sealed")
+	if err != nil {
+		return "", err
+	}
+	defer sealed.Close()
+	if err := sealProtected(dir, sealed, file); err != nil {
+		os.Remove(sealed.Name())
+		return "", err
+	}
+	return sealed.Name(), nil
+}
+
+// openProtectedFile opens the sealed file at sealedPath into a temp file
+// next to it, hashing the contents into h. It returns the temp file and the
+// size of the contents
+func openProtectedFile(key *keywrap.PrivateKey, sealedPath string, h hash.Hash) (string, int64, error) {
+	sealed, err := os.Open(sealedPath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer sealed.Close()
+
+	plain, err := ioutil.TempFile(path.Dir(sealedPath), ".chasm-restore")
+	if err != nil {
+		return "", 0, err
+	}
+	defer plain.Close()
+
+	h.Reset()
+	if err := openProtected(key, io.MultiWriter(plain, h), sealed); err != nil {
+		os.Remove(plain.Name())
+		return "", 0, err
+	}
+	fi, err := plain.Stat()
+	if err != nil {
+		os.Remove(plain.Name())
+		return "", 0, err
+	}
+	return plain.Name(), fi.Size(), nil
+}
+
+// skipLocked checks if fileShare is sealed to a directory that was not
+// unlocked, counting it for reportLocked
+func skipLocked(fileShare FileShare) bool {
+	if fileShare.Protection == "" {
+		return false
+	}
+	if _, ok := unlockedPaths[fileShare.Protection]; ok {
+		return false
+	}
+	lockedSkipped[fileShare.Protection]++
+	countDecision("skipped")
+	return true
+}
+
+// unprotect opens the restored contents of a protected file. Locked files
+// must have been skipped with skipLocked
+func unprotect(filePath string, fileShare FileShare, contents []byte) ([]byte, bool) {
+	if fileShare.Protection == "" || len(contents) == 0 {
+		return contents, true
+	}
+
+	var plain bytes.Buffer
+	err := openProtected(unlockedPaths[fileShare.Protection], &plain, bytes.NewReader(contents))
+	if err != nil {
+		color.Red("Error: cannot open protected %s: %s", filePath, err)
+		countError()
+		return nil, false
+	}
+	return plain.Bytes(), true
+}
+
+// unlockProtected asks for the passphrase of every protected directory of
+// the restored preferences not unlocked yet
+func unlockProtected(protected map[string]ProtectedPath) {
+	dirs := make([]string, 0, len(protected))
+	for dir := range protected {
+		if _, ok := unlockedPaths[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		if protected[dir].Keyfile && len(keyfilePaths) == 0 {
+			color.Red(T("Error: %s also needs its keyfile, give it with --keyfile. Its files stay locked."), dir)
+			continue
+		}
+		passphrase, err := readPassphrase(fmt.Sprintf(T("Passphrase for protected %s:"), dir))
+		if err != nil {
+			color.Red(T("Error: cannot read passphrase: %s"), err)
+			continue
+		}
+		key, err := unlockPath(protected[dir], passphrase)
+		wipe(passphrase)
+		if err != nil {
+			color.Red(T("Error: cannot unlock %s: %s. Its files stay locked."), dir, err)
+			continue
+		}
+		unlockedPaths[dir] = key
+	}
+}
+
+// reportLocked lists the protected files restore skipped
+func reportLocked() {
+	for dir, skipped := range lockedSkipped {
+		color.Yellow(T("Skipped %v protected files in %s. Restore with --unlock to recover them."), skipped, dir)
+	}
+}
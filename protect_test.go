@@ -0,0 +1,49 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyfileUnlock(t *testing.T) {
+	saved := preferences.Protected
+	defer func() { preferences.Protected = saved }()
+	preferences.Protected = nil
+
+	keyfile, _, err := makeKeyfile(filepath.Join(t.TempDir(), "chasm.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passphrase := []byte("correct horse")
+	if err := ProtectPath("/secret", "x25519", passphrase, keyfile); err != nil {
+		t.Fatal(err)
+	}
+	protected := preferences.Protected["/secret"]
+	if !protected.Keyfile {
+		t.Fatal("keyfile not required")
+	}
+
+	if _, err := protected.Unlock(passphrase, nil); err == nil {
+		t.Error("unlocked without the keyfile")
+	}
+	if _, err := protected.Unlock([]byte("wrong"), keyfile); err == nil {
+		t.Error("unlocked with the keyfile alone")
+	}
+	key, err := protected.Unlock(passphrase, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rekeyed without the keyfile, the passphrase alone opens the same key
+	if err := RekeyPath("/secret", key, []byte("new passphrase"), nil); err != nil {
+		t.Fatal(err)
+	}
+	rekeyed := preferences.Protected["/secret"]
+	if rekeyed.Keyfile || rekeyed.PublicKey != protected.PublicKey {
+		t.Fatal("rekey changed the key or kept the keyfile")
+	}
+	if _, err := rekeyed.Unlock([]byte("new passphrase"), nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/fatih/color"
+)
+
+// A provider preset adds a store at a known provider from an account's
+// credentials alone. The preset knows which of the protocols chasm speaks
+// the provider offers, and its servers, ports and paths, and adds the same
+// store `chasm add webdav` or `chasm add sftp` would with those filled in.
+
+// ProviderPreset is a provider's settings for the protocols it offers
+type ProviderPreset struct {
+	Description string
+
+	// what the provider calls the user to sign in as
+	UserHint string
+
+	// protocols offered, the first is the default
+	Protocols []string
+
+	// store adds the store of an account for a protocol. Protocols signing
+	// in with rclone's own configuration take no password
+	store func(protocol, user, password string)
+}
+
+// folder shares are kept in at every provider
+const presetFolder = "chasm"
+
+var providerPresets = map[string]ProviderPreset{
+	"hetzner": {
+		Description: "Hetzner Storage Box, over SFTP on port 23 or WebDAV",
+		UserHint:    "Storage Box user, like u123456 or u123456-sub1",
+		Protocols:   []string{"sftp", "webdav"},
+		store: func(protocol, user, password string) {
+			host := user + ".your-storagebox.de"
+			if protocol == "webdav" {
+				addWebDAVStore(WebDAVStore{URL: "https://" + host, Username: user, Password: password, Folder: presetFolder})
+				return
+			}
+			// the box is the user's home, /home to SFTP
+			addSFTPStore(SFTPStore{Host: net.JoinHostPort(host, "23"), User: user, Path: "/home/" + presetFolder, Password: password})
+		},
+	},
+	"koofr": {
+		Description: "Koofr, over WebDAV with an app password",
+		UserHint:    "email address of the account",
+		Protocols:   []string{"webdav"},
+		store: func(protocol, user, password string) {
+			addWebDAVStore(WebDAVStore{URL: "https://app.koofr.net/dav/Koofr", Username: user, Password: password, Folder: presetFolder})
+		},
+	},
+	"jottacloud": {
+		// Jottacloud has no WebDAV or SFTP, and signs in with a login token
+		// only rclone config knows how to trade
+		Description: "Jottacloud, through a remote set up with rclone config",
+		UserHint:    "name of the rclone remote",
+		Protocols:   []string{"rclone"},
+		store: func(protocol, user, password string) {
+			addRcloneStore(RcloneStore{Remote: strings.TrimSuffix(user, ":") + ":" + presetFolder})
+		},
+	},
+}
+
+// ProviderPresetNames lists the provider presets, sorted
+func ProviderPresetNames() []string {
+	names := make([]string, 0, len(providerPresets))
+	for name := range providerPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// addProviderPreset adds a store at the provider the command is named
+// after, asking for the user and the password if not given
+func addProviderPreset(c *cli.Context) error {
+	loadChasm(c)
+	if fleetManaged() {
+		return nil
+	}
+
+	preset := providerPresets[c.Command.Name]
+	protocol := c.String("protocol")
+	if protocol == "" {
+		protocol = preset.Protocols[0]
+	}
+	offered := false
+	for _, p := range preset.Protocols {
+		offered = offered || p == protocol
+	}
+	if !offered {
+		color.Red("Error: %s offers %s, not %s", c.Command.Name, strings.Join(preset.Protocols, " or "), protocol)
+		return nil
+	}
+
+	user := c.String("user")
+	if user == "" {
+		color.Cyan("User (%s):", preset.UserHint)
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		user = strings.TrimSpace(line)
+	}
+	if user == "" {
+		color.Red("Error: missing --user")
+		return nil
+	}
+
+	password := c.String("password")
+	if password == "" && protocol != "rclone" {
+		entered, err := readPassphrase(fmt.Sprintf("Password of %s at %s:", user, c.Command.Name))
+		if err != nil {
+			color.Red("Error: cannot read password: %s", err)
+			return nil
+		}
+		password = string(entered)
+		wipe(entered)
+	}
+
+	preset.store(protocol, user, password)
+	return nil
+}
+
+// providerPresetCommands are the add subcommands of the provider presets
+func providerPresetCommands() []cli.Command {
+	var commands []cli.Command
+	for _, name := range ProviderPresetNames() {
+		preset := providerPresets[name]
+		commands = append(commands, cli.Command{
+			Name:   name,
+			Usage:  "add a store at " + preset.Description,
+			Action: addProviderPreset,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "user",
+					Usage: "User to sign in as, the " + preset.UserHint + ". Asked for if empty.",
+				},
+				cli.StringFlag{
+					Name:   "password",
+					Usage:  "Password to sign in with, asked for if empty.",
+					EnvVar: "CHASM_PRESET_PASSWORD",
+				},
+				cli.StringFlag{
+					Name:  "protocol",
+					Usage: "Protocol to use, " + strings.Join(preset.Protocols, " (default) or ") + ".",
+				},
+			},
+		})
+	}
+	return commands
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// RcloneStore keeps shares in a directory of an rclone remote, running the
+// rclone command for every operation. Any of rclone's backends can hold
+// shares this way, configured and signed in to with rclone itself
+type RcloneStore struct {
+	// remote:path of the directory, as rclone names it
+	Remote string `json:"remote"`
+
+	// rclone config file, empty for rclone's default
+	Config string `json:"config,omitempty"`
+
+	// rclone command, empty to find rclone on the PATH
+	Binary string `json:"binary,omitempty"`
+}
+
+// uploads are written under a temporary name, then moved into place
+const rcloneUploadSuffix = ".uploading"
+
+// Setup checks that rclone can reach the remote and creates the directory
+func (r RcloneStore) Setup() bool {
+	for _, rs := range preferences.RcloneStores {
+		if rs.Remote == r.Remote {
+			color.Red("Rclone store at %s already exists.", r.Remote)
+			return false
+		}
+	}
+
+	if _, err := r.run(nil, "mkdir", r.Remote); err != nil {
+		color.Red("Error: cannot set up %s: %s", r.Remote, err)
+		return false
+	}
+	return true
+}
+
+func (r RcloneStore) objectPath(object string) string {
+	if strings.HasSuffix(r.Remote, ":") {
+		return r.Remote + object
+	}
+	return r.Remote + "/" + object
+}
+
+// run runs rclone with args, returning its output. Errors carry what rclone
+// printed to stderr
+func (r RcloneStore) run(stdin io.Reader, args ...string) ([]byte, error) {
+	binary := r.Binary
+	if binary == "" {
+		binary = "rclone"
+	}
+	if r.Config != "" {
+		args = append([]string{"--config", r.Config}, args...)
+	}
+
+	cmd := exec.Command(binary, args...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			lines := strings.Split(msg, "\n")
+			return nil, errors.New(lines[len(lines)-1])
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// exists checks if the remote holds object, listing only that name
+func (r RcloneStore) exists(object string) (bool, error) {
+	out, err := r.run(nil, "lsf", "--files-only", "--include", object, r.Remote)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(out)) == object, nil
+}
+
+// Upload writes the share under a temporary name and moves it into place,
+// refusing to replace an existing object
+func (r RcloneStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading %s...", r.objectPath(share.ObjectName())))
+
+	exists, err := r.exists(share.ObjectName())
+	if err == nil && exists {
+		err = errors.New("object exists")
+	}
+	if err == nil {
+		tmp := r.objectPath(share.ObjectName() + rcloneUploadSuffix)
+		if _, err = r.run(bytes.NewReader(share.Data), "rcat", tmp); err == nil {
+			_, err = r.run(nil, "moveto", tmp, r.objectPath(share.ObjectName()))
+		}
+		if err != nil {
+			r.run(nil, "deletefile", tmp)
+		}
+	}
+	if err != nil {
+		color.Red("%s upload failed: %v", r.objectPath(share.ObjectName()), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// Remove permanently deletes a single object
+func (r RcloneStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting %s...", r.objectPath(object)))
+	if _, err := r.run(nil, "deletefile", r.objectPath(object)); err != nil {
+		color.Red("Error: could not delete %s from %s: %s", object, r.Remote, err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all objects in the remote directory
+func (r RcloneStore) list() ([]string, error) {
+	out, err := r.run(nil, "lsf", "--files-only", r.Remote)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []string
+	for _, name := range strings.Split(string(out), "\n") {
+		// uploads interrupted before their move
+		if name != "" && !strings.HasSuffix(name, rcloneUploadSuffix) {
+			objects = append(objects, name)
+		}
+	}
+	return objects, nil
+}
+
+// List returns the names of all objects in the remote directory
+func (r RcloneStore) List() []string {
+	objects, err := r.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", r.Remote, err)
+		return nil
+	}
+	return objects
+}
+
+// Read downloads a single object
+func (r RcloneStore) Read(object string) ([]byte, error) {
+	return r.run(nil, "cat", r.objectPath(object))
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (r RcloneStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	return r.run(nil, "cat", "--offset", strconv.FormatInt(offset, 10), "--count", strconv.FormatInt(length, 10), r.objectPath(object))
+}
+
+// Restore downloads shares to local restore path
+func (r RcloneStore) Restore() string {
+	objects, err := r.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", r.Remote, err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_rclone_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from %s...", r.Remote)
+	for _, object := range objects {
+		data, err := r.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+	return restoreDir
+}
+
+// Description lists the objects in the remote directory
+func (r RcloneStore) Description() string {
+	objects, err := r.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", r.ShortDescription(), err)
+	}
+
+	label := r.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (r RcloneStore) ShortDescription() string {
+	return "Rclone Store: " + r.Remote
+}
+
+// Clean deletes all shares from the remote directory
+func (r RcloneStore) Clean() {
+	for _, object := range r.List() {
+		color.Yellow("Removing Rclone Store: %v", object)
+		r.run(nil, "deletefile", r.objectPath(object))
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Package recovery documents the chasm share and manifest formats and
+reconstructs files from raw share objects without the rest of chasm. It only
+depends on the secret sharing library, so files stay recoverable even if the
+main project disappears.
+
+# Objects
+
+Every cloud store holds one object per share, named
+
+	<sid>                     unversioned share (original layout)
+	<sid>~<version>           share of the file at version
+	<sid>~<version>~tomb      tombstone: sid was deleted at version
+
+Stores that cap object sizes hold larger objects as parts, which are
+concatenated in order to get the object back:
+
+	<object>~part-<i>-of-<n>  part i, counting from 1, of n
+
+A sid is a random base64URL string, or ".chasm" for the manifest and
+".chasm-delta" for manifest deltas. Versions are 16 lowercase hex digits of
+the upload time in unix nanoseconds, so they sort lexically by age.
+
+Share format (version 1)
+
+	offset  size  field
+	0       4     magic "CHSM"
+	4       1     format version (1)
+	5       1     sharing scheme, see below
+	6       1     x coordinate of the share
+	7       1     threshold: shares needed to reconstruct
+	8       8     payload length n, big endian
+	16      n     payload: y values, one byte per secret byte
+	16+n    4     CRC-32 (IEEE) of bytes [0, 16+n), big endian
+
+A share may be followed by a fragment of the manifest, see Manifest
+fragments. The payload length in the header tells where it starts.
+
+Shares without the magic use the legacy framing: the payload followed by a
+single x coordinate byte, with every share required to reconstruct.
+
+# Sharing schemes
+
+Share x of n is taken at x = 1..n. The payload of each scheme is
+
+	1  Shamir over GF(2^8) (AES field): the secret polynomial at x, one
+	   byte per secret byte
+	2  XOR: random pads for x < n, and the secret XOR all pads for x = n
+	3  Reed-Solomon: the secret is padded with 0x80 then zeros to a multiple
+	   of k = threshold and striped, byte j of share x <= k being byte
+	   j*k+x-1. Shares x > k are parity, the sum over data shares c of
+	   y_c / (x XOR c)
+	4  replicate: the secret itself
+
+A vault can hold objects of different schemes, shares of one object always
+share theirs. Reed-Solomon and replicate shares contain plaintext, they are
+meant for contents that are already encrypted.
+
+# Manifest
+
+The ".chasm" object is the JSON encoded manifest. Only these fields are
+needed for recovery, others are ignored:
+
+	{
+	    "files": {"<path>": {"sid": "<sid>", "hash": "<sha256>", "version": "<version>"}},
+	    "dirs":  {"<path>": true}
+	}
+
+hash is the base64URL encoded SHA-256 of the file contents. Entries may
+also have "shares", a list holding for each x coordinate the base64URL
+encoded SHA-256 of the object name followed by the whole share object, which
+identifies a corrupt share without combining it. Changes made
+after the newest manifest are uploaded as ".chasm-delta" objects:
+
+	{"base": "<manifest version>", "files": {"<path>": entry or null}, "dirs": {"<path>": bool}}
+
+Deltas whose base is the newest manifest version are applied in version
+order; a null file or false dir removes the entry.
+
+# Manifest fragments
+
+So the manifest survives losing its own objects, ordinary shares carry a
+share of the manifest after their checksum:
+
+	offset  size  field
+	0       16    manifest version, zero padded
+	16      8     set: random, the same for all fragments of one split
+	24      m     the manifest share x, framed as a share (version 1)
+	24+m    4     m + 24, big endian
+	28+m    4     magic "CHMF"
+
+Fragments combine like shares, but only within one version and set. The
+newest version with enough fragments is the manifest, and deltas against
+it apply as above. Manifests over 256 KiB are not embedded.
+*/
+package recovery
@@ -0,0 +1,191 @@
+package recovery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sort"
+)
+
+// FragmentMagic ends a share that carries a manifest fragment
+const FragmentMagic = "CHMF"
+
+// FragmentFooterSize is the length and magic after a fragment
+const FragmentFooterSize = 8
+
+const fragmentVersionSize = 16
+const fragmentSetSize = 8
+
+// Fragment is one share of the manifest embedded after an ordinary share,
+// so the manifest can be reassembled if its own objects are lost
+type Fragment struct {
+	// Version of the manifest the fragment belongs to
+	Version string
+
+	// Set tells apart splits of the same manifest, only fragments of one
+	// set combine
+	Set [fragmentSetSize]byte
+
+	Share Share
+}
+
+// EncodeFragment is the trailer carrying f, appended after the checksum of
+// a share
+func EncodeFragment(f Fragment) []byte {
+	version := make([]byte, fragmentVersionSize)
+	copy(version, f.Version)
+
+	trailer := append(version, f.Set[:]...)
+	trailer = append(trailer, Encode(f.Share)...)
+	trailer = binary.BigEndian.AppendUint32(trailer, uint32(len(trailer)))
+	return append(trailer, FragmentMagic...)
+}
+
+// isFragment checks the footer of a trailer, without decoding the fragment
+func isFragment(trailer []byte) bool {
+	if len(trailer) < fragmentVersionSize+fragmentSetSize+FragmentFooterSize || !bytes.HasSuffix(trailer, []byte(FragmentMagic)) {
+		return false
+	}
+	body := len(trailer) - FragmentFooterSize
+	return binary.BigEndian.Uint32(trailer[body:]) == uint32(body)
+}
+
+// DecodeFragment parses a trailer written by EncodeFragment
+func DecodeFragment(trailer []byte) (Fragment, error) {
+	if !isFragment(trailer) {
+		return Fragment{}, errors.New("not a manifest fragment")
+	}
+	body := trailer[:len(trailer)-FragmentFooterSize]
+
+	var f Fragment
+	f.Version = string(bytes.TrimRight(body[:fragmentVersionSize], "\x00"))
+	copy(f.Set[:], body[fragmentVersionSize:])
+	share, err := Decode(body[fragmentVersionSize+fragmentSetSize:])
+	if err != nil {
+		return Fragment{}, err
+	}
+	f.Share = share
+	return f, nil
+}
+
+// splitTrailer splits a share in the current format into the share itself
+// and the trailer after its checksum, which the header length locates
+func splitTrailer(b []byte) (share, trailer []byte, err error) {
+	if len(b) < HeaderSize+ChecksumSize {
+		return nil, nil, errors.New("share is truncated")
+	}
+	length := binary.BigEndian.Uint64(b[8:HeaderSize])
+	if length > uint64(len(b)-HeaderSize-ChecksumSize) {
+		return nil, nil, errors.New("share length does not match header")
+	}
+	end := HeaderSize + int(length) + ChecksumSize
+	return b[:end], b[end:], nil
+}
+
+// ReadFragment reads the manifest fragment embedded in a share object
+func ReadFragment(b []byte) (Fragment, error) {
+	if !bytes.HasPrefix(b, []byte(Magic)) {
+		return Fragment{}, errors.New("legacy shares carry no manifest fragment")
+	}
+	_, trailer, err := splitTrailer(b)
+	if err != nil {
+		return Fragment{}, err
+	}
+	return DecodeFragment(trailer)
+}
+
+// CombineFragments reassembles the newest manifest that enough fragments
+// are found for, returning it with its version
+func CombineFragments(fragments []Fragment) ([]byte, string, error) {
+	type setKey struct {
+		version string
+		set     [fragmentSetSize]byte
+	}
+	sets := make(map[setKey]map[byte]Share)
+	for _, f := range fragments {
+		key := setKey{f.Version, f.Set}
+		if sets[key] == nil {
+			sets[key] = make(map[byte]Share)
+		}
+		sets[key][f.Share.X] = f.Share
+	}
+
+	keys := make([]setKey, 0, len(sets))
+	for key := range sets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].version > keys[j].version })
+
+	for _, key := range keys {
+		shares := make([]Share, 0, len(sets[key]))
+		for _, share := range sets[key] {
+			shares = append(shares, share)
+		}
+		if shares[0].Threshold == 0 || len(shares) < int(shares[0].Threshold) {
+			continue
+		}
+		if manifest, err := Combine(shares); err == nil {
+			return manifest, key.version, nil
+		}
+	}
+	return nil, "", errors.New("not enough manifest fragments found")
+}
+
+// ReadEmbeddedManifest reassembles the manifest from the fragments embedded
+// in the share objects of the store directories
+func ReadEmbeddedManifest(dirs []string) ([]byte, string, error) {
+	return ReadEmbeddedManifestFrom(dirs, ReadStoredObject)
+}
+
+// ReadEmbeddedManifestFrom is ReadEmbeddedManifest with the objects read by
+// read, for directories that do not hold them as plain files
+func ReadEmbeddedManifestFrom(dirs []string, read func(dir, object string) ([]byte, error)) ([]byte, string, error) {
+	var fragments []Fragment
+	for _, dir := range dirs {
+		files, _ := ioutil.ReadDir(dir)
+		seen := make(map[string]bool)
+		for _, f := range files {
+			object := f.Name()
+			if whole, _, _, ok := ParsePartName(object); ok {
+				object = whole
+			}
+			if seen[object] {
+				continue
+			}
+			seen[object] = true
+
+			data, err := read(dir, object)
+			if err != nil {
+				continue
+			}
+			if fragment, err := ReadFragment(data); err == nil {
+				fragments = append(fragments, fragment)
+			}
+		}
+	}
+	return CombineFragments(fragments)
+}
+
+// readEmbeddedManifest is ReadManifest's fallback when no manifest object
+// can be read
+func readEmbeddedManifest(dirs []string) (Manifest, error) {
+	manifestBytes, version, err := ReadEmbeddedManifest(dirs)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return Manifest{}, err
+	}
+	manifest.Version = version
+	if manifest.Files == nil {
+		manifest.Files = make(map[string]FileEntry)
+	}
+	if manifest.Dirs == nil {
+		manifest.Dirs = make(map[string]bool)
+	}
+	return manifest, manifest.applyDeltas(dirs)
+}
@@ -0,0 +1,212 @@
+package recovery
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// ManifestSID is the share id of the manifest
+const ManifestSID = ".chasm"
+
+// DeltaSID is the share id of manifest deltas
+const DeltaSID = ".chasm-delta"
+
+const objectNameSep = "~"
+const tombstoneSuffix = "tomb"
+
+// FileEntry locates the shares of a single file
+type FileEntry struct {
+	SID     string `json:"sid"`
+	Hash    string `json:"hash"`
+	Version string `json:"version,omitempty"`
+}
+
+// ObjectName is the object holding the file's shares
+func (e FileEntry) ObjectName() string {
+	return ObjectName(e.SID, e.Version, false)
+}
+
+// Manifest is the part of the .chasm manifest needed for recovery
+type Manifest struct {
+	Files map[string]FileEntry `json:"files"`
+	Dirs  map[string]bool      `json:"dirs"`
+
+	// Version of the manifest object the deltas were applied to
+	Version string `json:"-"`
+}
+
+// Delta is a manifest delta against the manifest at version Base
+type Delta struct {
+	Base  string                `json:"base"`
+	Files map[string]*FileEntry `json:"files"`
+	Dirs  map[string]bool       `json:"dirs"`
+}
+
+// ObjectName builds the object name for sid at version
+func ObjectName(sid, version string, tombstone bool) string {
+	if version == "" {
+		return sid
+	}
+
+	name := sid + objectNameSep + version
+	if tombstone {
+		name += objectNameSep + tombstoneSuffix
+	}
+	return name
+}
+
+// ParseObjectName splits an object name into its parts
+func ParseObjectName(name string) (sid, version string, tombstone bool) {
+	parts := strings.Split(name, objectNameSep)
+	sid = parts[0]
+	if len(parts) > 1 {
+		version = parts[1]
+	}
+	if len(parts) > 2 {
+		tombstone = parts[2] == tombstoneSuffix
+	}
+	return
+}
+
+// ReadObject reconstructs an object from the share directories, one per
+// store. Directories missing the object are skipped
+func ReadObject(dirs []string, object string) ([]byte, error) {
+	shares := make([]Share, 0, len(dirs))
+	for _, dir := range dirs {
+		shareBytes, err := ReadStoredObject(dir, object)
+		if err != nil {
+			continue
+		}
+
+		share, err := Decode(shareBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s in %s: %v", object, dir, err)
+		}
+		shares = append(shares, share)
+	}
+
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("no shares of %s found", object)
+	}
+
+	// legacy shares carry no threshold, they need every store
+	if shares[0].Threshold == 0 && len(shares) < len(dirs) {
+		return nil, fmt.Errorf("need %d shares of %s, have %d", len(dirs), object, len(shares))
+	}
+
+	return Combine(shares)
+}
+
+// versions lists the non-tombstone versions of sid found in any directory
+func versions(dirs []string, sid string) []string {
+	found := make(map[string]bool)
+	for _, dir := range dirs {
+		files, _ := ioutil.ReadDir(dir)
+		for _, f := range files {
+			objSID, version, tombstone := ParseObjectName(f.Name())
+			if objSID == sid && !tombstone {
+				found[version] = true
+			}
+		}
+	}
+
+	sorted := make([]string, 0, len(found))
+	for version := range found {
+		sorted = append(sorted, version)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// ReadManifest reconstructs the newest readable manifest and applies its deltas
+func ReadManifest(dirs []string) (Manifest, error) {
+	manifestVersions := versions(dirs, ManifestSID)
+
+	for i := len(manifestVersions) - 1; i >= 0; i-- {
+		base := manifestVersions[i]
+		manifestBytes, err := ReadObject(dirs, ObjectName(ManifestSID, base, false))
+		if err != nil {
+			continue
+		}
+
+		var manifest Manifest
+		if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+			continue
+		}
+		manifest.Version = base
+		if manifest.Files == nil {
+			manifest.Files = make(map[string]FileEntry)
+		}
+		if manifest.Dirs == nil {
+			manifest.Dirs = make(map[string]bool)
+		}
+
+		return manifest, manifest.applyDeltas(dirs)
+	}
+
+	// shares carry fragments of the manifest in case its objects are lost
+	if manifest, err := readEmbeddedManifest(dirs); err == nil {
+		return manifest, nil
+	}
+	return Manifest{}, errors.New("no readable manifest found")
+}
+
+// applyDeltas applies the deltas uploaded against the manifest's version
+func (m Manifest) applyDeltas(dirs []string) error {
+	for _, version := range versions(dirs, DeltaSID) {
+		if version <= m.Version {
+			continue
+		}
+
+		deltaBytes, err := ReadObject(dirs, ObjectName(DeltaSID, version, false))
+		if err != nil {
+			return err
+		}
+
+		var delta Delta
+		if err := json.Unmarshal(deltaBytes, &delta); err != nil {
+			return err
+		}
+		if delta.Base == m.Version {
+			m.apply(delta)
+		}
+	}
+	return nil
+}
+
+func (m Manifest) apply(d Delta) {
+	for path, entry := range d.Files {
+		if entry == nil {
+			delete(m.Files, path)
+		} else {
+			m.Files[path] = *entry
+		}
+	}
+	for path, tracked := range d.Dirs {
+		if tracked {
+			m.Dirs[path] = true
+		} else {
+			delete(m.Dirs, path)
+		}
+	}
+}
+
+// ReadFile reconstructs a file and verifies its hash
+func ReadFile(dirs []string, entry FileEntry) ([]byte, error) {
+	fileBytes, err := ReadObject(dirs, entry.ObjectName())
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(fileBytes)
+	if base64.URLEncoding.EncodeToString(sum[:]) != entry.Hash {
+		return nil, fmt.Errorf("%s: SHA-256 mismatch", entry.ObjectName())
+	}
+	return fileBytes, nil
+}
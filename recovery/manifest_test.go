@@ -0,0 +1,43 @@
+package recovery
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// FuzzManifest feeds arbitrary bytes to the manifest and delta parsers and
+// applies the result. Object names of the entries must parse back
+func FuzzManifest(f *testing.F) {
+	f.Add([]byte(`{"files":{"a/b.txt":{"sid":"4f1c","hash":"00","version":"17"}},"dirs":{"a":true}}`))
+	f.Add([]byte(`{"base":"17","files":{"a/b.txt":null,"c":{"sid":"9e","hash":"01"}},"dirs":{"a":false}}`))
+	f.Add([]byte(`{"files":null}`))
+	f.Add([]byte(`[]`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		manifest := Manifest{Files: make(map[string]FileEntry), Dirs: make(map[string]bool)}
+		json.Unmarshal(data, &manifest)
+
+		var delta Delta
+		if json.Unmarshal(data, &delta) == nil {
+			if manifest.Files == nil {
+				manifest.Files = make(map[string]FileEntry)
+			}
+			if manifest.Dirs == nil {
+				manifest.Dirs = make(map[string]bool)
+			}
+			manifest.apply(delta)
+		}
+
+		// object names of real share ids never contain the separator
+		for _, entry := range manifest.Files {
+			if strings.Contains(entry.SID+entry.Version, objectNameSep) {
+				continue
+			}
+			sid, version, _ := ParseObjectName(entry.ObjectName())
+			if sid != entry.SID || version != entry.Version {
+				t.Fatalf("object name of %+v does not parse back", entry)
+			}
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package recovery
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const partPrefix = "part-"
+
+// PartName names part i, counting from 1, of an object split into n parts
+// for a store that caps object sizes
+func PartName(object string, i, n int) string {
+	return fmt.Sprintf("%s%s%s%d-of-%d", object, objectNameSep, partPrefix, i, n)
+}
+
+// ParsePartName splits a part name into its object, part number and count
+func ParsePartName(name string) (object string, i, n int, ok bool) {
+	sep := strings.LastIndex(name, objectNameSep+partPrefix)
+	if sep < 0 {
+		return "", 0, 0, false
+	}
+
+	if _, err := fmt.Sscanf(name[sep+len(objectNameSep+partPrefix):], "%d-of-%d", &i, &n); err != nil || i < 1 || i > n {
+		return "", 0, 0, false
+	}
+	return name[:sep], i, n, PartName(name[:sep], i, n) == name
+}
+
+// ReadStoredObject reads an object from a store directory, joining its
+// parts if the store split it
+func ReadStoredObject(dir, object string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, object))
+	if !os.IsNotExist(err) {
+		return data, err
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, escapeGlob(object)+objectNameSep+partPrefix+"*"))
+	for _, match := range matches {
+		if _, _, n, ok := ParsePartName(filepath.Base(match)); ok {
+			var joined []byte
+			for i := 1; i <= n; i++ {
+				part, err := ioutil.ReadFile(filepath.Join(dir, PartName(object, i, n)))
+				if err != nil {
+					return nil, err
+				}
+				joined = append(joined, part...)
+			}
+			return joined, nil
+		}
+	}
+	return nil, err
+}
+
+func escapeGlob(s string) string {
+	return strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`, `\`, `\\`).Replace(s)
+}
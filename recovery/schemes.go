@@ -0,0 +1,211 @@
+package recovery
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Sharing schemes besides Shamir. Share x of n is always at x = 1..n.
+const (
+	// SchemeXOR: shares 1..n-1 are random pads, share n is the secret XOR
+	// all pads. Every share is needed
+	SchemeXOR = 2
+
+	// SchemeReedSolomon: the padded secret is striped over threshold data
+	// shares, byte j of share x being secret[j*threshold+x-1], and shares
+	// past the threshold are Cauchy parity. Any threshold shares rebuild the
+	// secret, but data shares hold plaintext
+	SchemeReedSolomon = 3
+
+	// SchemeReplicate: every share is the secret. Any share is enough
+	SchemeReplicate = 4
+)
+
+// SchemeName names the sharing scheme with id
+func SchemeName(id byte) string {
+	switch id {
+	case SchemeShamir:
+		return "shamir"
+	case SchemeXOR:
+		return "xor"
+	case SchemeReedSolomon:
+		return "reed-solomon"
+	case SchemeReplicate:
+		return "replicate"
+	}
+	return fmt.Sprintf("scheme %d", id)
+}
+
+// Pad ends data with 0x80 and then zeros up to a multiple of stripe,
+// always adding at least one byte
+func Pad(data []byte, stripe int) []byte {
+	padded := make([]byte, len(data), len(data)+stripe)
+	copy(padded, data)
+	padded = append(padded, 0x80)
+	for len(padded)%stripe != 0 {
+		padded = append(padded, 0)
+	}
+	return padded
+}
+
+// Unpad removes the padding added by Pad
+func Unpad(padded []byte) ([]byte, error) {
+	end := bytes.LastIndexByte(padded, 0x80)
+	if end < 0 || len(bytes.Trim(padded[end+1:], "\x00")) != 0 {
+		return nil, errors.New("invalid padding")
+	}
+	return padded[:end], nil
+}
+
+func combineXOR(shares []Share) ([]byte, error) {
+	if len(shares) < int(shares[0].Threshold) {
+		return nil, fmt.Errorf("need %d shares, have %d", shares[0].Threshold, len(shares))
+	}
+
+	secret := make([]byte, len(shares[0].Data))
+	for _, s := range shares {
+		if len(s.Data) != len(secret) {
+			return nil, errors.New("shares differ in length")
+		}
+		for i, b := range s.Data {
+			secret[i] ^= b
+		}
+	}
+	return secret, nil
+}
+
+// combineReedSolomon solves for the data shares from any threshold shares,
+// then interleaves them back into the secret
+func combineReedSolomon(shares []Share) ([]byte, error) {
+	k := int(shares[0].Threshold)
+	if k == 0 || len(shares) < k {
+		return nil, fmt.Errorf("need %d shares, have %d", k, len(shares))
+	}
+	shares = shares[:k]
+
+	xs := make([]byte, k)
+	for i, s := range shares {
+		if len(s.Data) != len(shares[0].Data) {
+			return nil, errors.New("shares differ in length")
+		}
+		xs[i] = s.X
+	}
+	inverse, err := DecodeMatrix(xs, k)
+	if err != nil {
+		return nil, err
+	}
+
+	size := len(shares[0].Data)
+	padded := make([]byte, size*k)
+	for c := 0; c < k; c++ {
+		for i, s := range shares {
+			coefficient := inverse[c][i]
+			for j, y := range s.Data {
+				padded[j*k+c] ^= gfMul(coefficient, y)
+			}
+		}
+	}
+	return Unpad(padded)
+}
+
+// DecodeMatrix inverts the encoding rows of the k shares at xs. Data share
+// c is the sum over i of row c, column i times share i
+func DecodeMatrix(xs []byte, k int) ([][]byte, error) {
+	if len(xs) != k {
+		return nil, fmt.Errorf("need %d shares, have %d", k, len(xs))
+	}
+
+	matrix := make([][]byte, k)
+	for i, x := range xs {
+		if x == 0 {
+			return nil, errors.New("share x must not be 0")
+		}
+		matrix[i] = make([]byte, k)
+		for c := 0; c < k; c++ {
+			matrix[i][c] = ParityCoefficient(int(x), c+1, k)
+		}
+	}
+	return invert(matrix)
+}
+
+// ParityCoefficient is the encoding matrix entry of share x for data share
+// c: identity rows for data shares, Cauchy rows 1/(x^c) for parity
+func ParityCoefficient(x, c, k int) byte {
+	if x <= k {
+		if x == c {
+			return 1
+		}
+		return 0
+	}
+	return gfInverse(byte(x ^ c))
+}
+
+// invert inverts a square matrix over GF(2^8) by Gauss-Jordan elimination
+func invert(matrix [][]byte) ([][]byte, error) {
+	k := len(matrix)
+	work := make([][]byte, k)
+	for i := range work {
+		work[i] = make([]byte, 2*k)
+		copy(work[i], matrix[i])
+		work[i][k+i] = 1
+	}
+
+	for col := 0; col < k; col++ {
+		pivot := col
+		for pivot < k && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == k {
+			return nil, errors.New("shares do not determine the secret, duplicate x?")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := gfInverse(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMul(work[col][j], scale)
+		}
+		for row := 0; row < k; row++ {
+			if row == col || work[row][col] == 0 {
+				continue
+			}
+			factor := work[row][col]
+			for j := range work[row] {
+				work[row][j] ^= gfMul(factor, work[col][j])
+			}
+		}
+	}
+
+	inverse := make([][]byte, k)
+	for i := range work {
+		inverse[i] = work[i][k:]
+	}
+	return inverse, nil
+}
+
+// GF(2^8) arithmetic in the AES field, kept here so recovery does not depend
+// on the rest of chasm
+
+var gfExp, gfLog = func() (exp [510]byte, log [256]byte) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = byte(x), byte(x)
+		log[x] = byte(i)
+		x ^= x << 1
+		if x&0x100 != 0 {
+			x ^= 0x11b
+		}
+	}
+	return
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInverse(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
@@ -0,0 +1,156 @@
+package recovery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/agrinman/sss"
+)
+
+// Magic starts every share in the versioned format
+const Magic = "CHSM"
+
+// FormatVersion is the share format version written by Encode
+const FormatVersion = 1
+
+// SchemeShamir is Shamir secret sharing over GF(2^8)
+const SchemeShamir = 1
+
+// HeaderSize and ChecksumSize are the bytes before and after the payload
+// of a share in the current format
+const HeaderSize = 16
+const ChecksumSize = 4
+
+// Share is a single decoded share
+type Share struct {
+	Scheme    byte
+	X         byte
+	Threshold byte
+	Data      []byte
+}
+
+// Encode frames the share in the current share format
+func Encode(s Share) []byte {
+	framed := make([]byte, 0, HeaderSize+len(s.Data)+ChecksumSize)
+	framed = append(framed, EncodeHeader(s, uint64(len(s.Data)))...)
+	framed = append(framed, s.Data...)
+	return binary.BigEndian.AppendUint32(framed, crc32.ChecksumIEEE(framed))
+}
+
+// EncodeHeader is the header of a share with a payload of length bytes, for
+// writers that stream the payload. The checksum covers header and payload
+func EncodeHeader(s Share, length uint64) []byte {
+	header := make([]byte, HeaderSize)
+	copy(header, Magic)
+	header[4] = FormatVersion
+	header[5] = s.Scheme
+	header[6] = s.X
+	header[7] = s.Threshold
+	binary.BigEndian.PutUint64(header[8:], length)
+	return header
+}
+
+// Decode parses a share in the current or the legacy format, skipping an
+// embedded manifest fragment
+func Decode(b []byte) (Share, error) {
+	if !bytes.HasPrefix(b, []byte(Magic)) {
+		return decodeLegacy(b)
+	}
+
+	b, trailer, err := splitTrailer(b)
+	if err != nil {
+		return Share{}, err
+	}
+	if len(trailer) > 0 && !isFragment(trailer) {
+		return Share{}, errors.New("share length does not match header")
+	}
+	share, length, err := ParseHeader(b[:HeaderSize])
+	if err != nil {
+		return Share{}, err
+	}
+
+	end := HeaderSize + int(length)
+	if crc32.ChecksumIEEE(b[:end]) != binary.BigEndian.Uint32(b[end:]) {
+		return Share{}, errors.New("share checksum mismatch")
+	}
+
+	share.Data = b[HeaderSize:end]
+	return share, nil
+}
+
+// ParseHeader parses the header of a share in the current format, returning
+// the share without its data and the payload length
+func ParseHeader(header []byte) (Share, uint64, error) {
+	if len(header) < HeaderSize || !bytes.HasPrefix(header, []byte(Magic)) {
+		return Share{}, 0, errors.New("not a share header")
+	}
+	if header[4] != FormatVersion {
+		return Share{}, 0, fmt.Errorf("unsupported share format version %d", header[4])
+	}
+	share := Share{Scheme: header[5], X: header[6], Threshold: header[7]}
+	return share, binary.BigEndian.Uint64(header[8:HeaderSize]), nil
+}
+
+// legacy shares are the payload followed by the x coordinate
+func decodeLegacy(b []byte) (Share, error) {
+	if len(b) == 0 {
+		return Share{}, errors.New("share is empty")
+	}
+	return Share{Scheme: SchemeShamir, X: b[len(b)-1], Data: b[:len(b)-1]}, nil
+}
+
+// Split creates n shares of secret, any threshold of which reconstruct it
+func Split(secret []byte, n, threshold int) ([]Share, error) {
+	if n > 255 || threshold > n {
+		return nil, fmt.Errorf("cannot split into %d shares with threshold %d", n, threshold)
+	}
+
+	sharesBytes, err := sss.Split(byte(n), byte(threshold), secret)
+	if err != nil {
+		return nil, err
+	}
+
+	shares := make([]Share, 0, n)
+	for x, y := range sharesBytes {
+		shares = append(shares, Share{Scheme: SchemeShamir, X: x, Threshold: byte(threshold), Data: y})
+	}
+	return shares, nil
+}
+
+// Combine reconstructs the secret from decoded shares of one scheme
+func Combine(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares")
+	}
+	for _, s := range shares {
+		if s.Scheme != shares[0].Scheme || s.Threshold != shares[0].Threshold {
+			return nil, errors.New("shares of different schemes")
+		}
+	}
+
+	switch shares[0].Scheme {
+	case SchemeXOR:
+		return combineXOR(shares)
+	case SchemeReedSolomon:
+		return combineReedSolomon(shares)
+	case SchemeReplicate:
+		return shares[0].Data, nil
+	}
+
+	sharesBytes := make(map[byte][]byte)
+	for _, s := range shares {
+		if s.Scheme != SchemeShamir {
+			return nil, fmt.Errorf("unsupported sharing scheme %d", s.Scheme)
+		}
+		sharesBytes[s.X] = s.Data
+	}
+
+	if len(shares) > 0 && len(sharesBytes) < int(shares[0].Threshold) {
+		return nil, fmt.Errorf("need %d shares, have %d", shares[0].Threshold, len(sharesBytes))
+	}
+
+	return sss.Combine(sharesBytes), nil
+}
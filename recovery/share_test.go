@@ -0,0 +1,66 @@
+package recovery
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// TestSplitCombine checks that any threshold-sized subset of framed shares
+// combines back to the secret
+func TestSplitCombine(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		secret := make([]byte, rng.Intn(4096))
+		rng.Read(secret)
+		n := 2 + rng.Intn(7)
+		threshold := 2 + rng.Intn(n-1)
+
+		shares, err := Split(secret, n, threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded := make([]Share, 0, threshold)
+		for _, j := range rng.Perm(n)[:threshold] {
+			share, err := Decode(Encode(shares[j]))
+			if err != nil {
+				t.Fatalf("decoding share %d: %v", j, err)
+			}
+			decoded = append(decoded, share)
+		}
+
+		combined, err := Combine(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(combined, secret) {
+			t.Fatalf("%d bytes with %d/%d shares did not round trip", len(secret), threshold, n)
+		}
+	}
+}
+
+// FuzzDecode feeds arbitrary bytes to Decode. Any share it accepts in the
+// current format must encode back to the same bytes
+func FuzzDecode(f *testing.F) {
+	shares, err := Split([]byte("a secret of some length"), 3, 2)
+	if err != nil {
+		f.Fatal(err)
+	}
+	framed := Encode(shares[0])
+	f.Add(framed)
+	f.Add(framed[:HeaderSize])
+	f.Add(framed[:len(framed)-1])
+	f.Add([]byte(Magic))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		share, err := Decode(data)
+		if err != nil || !bytes.HasPrefix(data, []byte(Magic)) {
+			return
+		}
+		if !bytes.Equal(Encode(share), data) {
+			t.Fatalf("Decode accepted %x but it does not re-encode", data)
+		}
+	})
+}
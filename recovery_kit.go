@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Restoring a vault on a new machine only needs the stores: everything else
+// is in the manifest they hold. A recovery kit keeps the store settings,
+// credentials included, on paper. They are secret shared into pages, any
+// threshold of which recover them while fewer reveal nothing, so the pages
+// can be given to different relatives. Each page is an HTML file of QR
+// codes, each code holding one line
+//
+//	CHASMKIT1 <set> <page>/<pages> <part>/<parts> <base64url data>
+//
+// where set tells kits apart and the parts of a page join to its share, in
+// the share format of the recovery package. The share is of the settings
+// as fleetKeys JSON, with the store credentials of the local state under
+// store_credentials, deflated. Passphrases of protected directories are not
+// in the kit.
+
+const kitPrefix = "CHASMKIT1"
+
+// key of the store credentials in the settings of a kit
+const kitCredentialsKey = "store_credentials"
+
+// base64 characters per QR code, small enough to scan off a printed page
+const kitPartSize = 900
+
+// kitSettings is the secret of a recovery kit: the settings of fleetKeys
+// and the store credentials, deflated
+func kitSettings() ([]byte, error) {
+	data, err := json.Marshal(preferences)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	for key := range all {
+		if !fleetKeys[key] {
+			delete(all, key)
+		}
+	}
+	if all[kitCredentialsKey], err = json.Marshal(storeCredentialValues()); err != nil {
+		return nil, err
+	}
+	defer wipe(all[kitCredentialsKey])
+	settings, err := json.Marshal(all)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(settings)
+
+	var deflated bytes.Buffer
+	w, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	w.Write(settings)
+	w.Close()
+	return deflated.Bytes(), nil
+}
+
+// KitPages splits the vault's store settings into pages of QR code lines,
+// threshold of which recover them
+func KitPages(pages, threshold int) ([][]string, error) {
+	if threshold < 2 || threshold > pages || pages > 255 {
+		return nil, fmt.Errorf("cannot split into %d pages needing %d", pages, threshold)
+	}
+	secret, err := kitSettings()
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(secret)
+
+	shares, err := recovery.Split(secret, pages, threshold)
+	if err != nil {
+		return nil, err
+	}
+	set := make([]byte, 4)
+	if _, err := rand.Read(set); err != nil {
+		return nil, err
+	}
+
+	lines := make([][]string, pages)
+	for _, share := range shares {
+		encoded := base64.RawURLEncoding.EncodeToString(recovery.Encode(share))
+		wipe(share.Data)
+		parts := (len(encoded) + kitPartSize - 1) / kitPartSize
+		page := int(share.X)
+		for i := 0; i < parts; i++ {
+			end := (i + 1) * kitPartSize
+			if end > len(encoded) {
+				end = len(encoded)
+			}
+			line := fmt.Sprintf("%s %s %d/%d %d/%d %s", kitPrefix, hex.EncodeToString(set), page, pages, i+1, parts, encoded[i*kitPartSize:end])
+			lines[page-1] = append(lines[page-1], line)
+		}
+	}
+	return lines, nil
+}
+
+// WriteKitPages writes one printable HTML file per page into dir
+func WriteKitPages(dir string, lines [][]string, threshold int) ([]string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for i, page := range lines {
+		var out bytes.Buffer
+		fmt.Fprintf(&out, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>chasm recovery kit, page %d of %d</title>\n", i+1, len(lines))
+		out.WriteString("<style>body{font-family:sans-serif}figure{break-inside:avoid;margin:1em 0}pre{white-space:pre-wrap;word-break:break-all;font-size:7pt}</style></head><body>\n")
+		fmt.Fprintf(&out, "<h1>chasm recovery kit, page %d of %d</h1>\n", i+1, len(lines))
+		fmt.Fprintf(&out, "<p>Any %d pages of this kit recover the stores of a chasm vault. Fewer reveal nothing about them. Keep the pages in different places.</p>\n", threshold)
+		out.WriteString("<p>To recover, scan every code of enough pages into a text file, one per line, and run <code>chasm recovery-kit combine FILE</code> in a new vault, then <code>chasm restore</code>.</p>\n")
+		for _, line := range page {
+			png, err := qrcode.Encode(line, qrcode.Medium, 512)
+			if err != nil {
+				return paths, err
+			}
+			fmt.Fprintf(&out, "<figure><img width=\"320\" src=\"data:image/png;base64,%s\"><pre>%s</pre></figure>\n", base64.StdEncoding.EncodeToString(png), html.EscapeString(line))
+		}
+		out.WriteString("</body></html>\n")
+
+		path := filepath.Join(dir, fmt.Sprintf("page-%d-of-%d.html", i+1, len(lines)))
+		if err := ioutil.WriteFile(path, out.Bytes(), 0600); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// kitPart is one scanned QR code line
+type kitPart struct {
+	set         string
+	page, pages int
+	part, parts int
+	data        string
+}
+
+func parseKitLine(line string) (kitPart, bool) {
+	var p kitPart
+	fields := strings.Fields(line)
+	if len(fields) != 5 || fields[0] != kitPrefix {
+		return p, false
+	}
+	p.set, p.data = fields[1], fields[4]
+	if _, err := fmt.Sscanf(fields[2], "%d/%d", &p.page, &p.pages); err != nil {
+		return p, false
+	}
+	if _, err := fmt.Sscanf(fields[3], "%d/%d", &p.part, &p.parts); err != nil {
+		return p, false
+	}
+	return p, p.part >= 1 && p.part <= p.parts
+}
+
+// CombineKit recovers the store settings and credentials from scanned QR
+// code lines, other lines are skipped
+func CombineKit(r io.Reader) (ChasmPref, map[string]map[string]string, error) {
+	var settings ChasmPref
+	pageParts := make(map[int]map[int]kitPart)
+	set := ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 64<<10)
+	for scanner.Scan() {
+		p, ok := parseKitLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		if set != "" && p.set != set {
+			return settings, nil, errors.New("lines of different recovery kits")
+		}
+		set = p.set
+		if pageParts[p.page] == nil {
+			pageParts[p.page] = make(map[int]kitPart)
+		}
+		pageParts[p.page][p.part] = p
+	}
+	if err := scanner.Err(); err != nil {
+		return settings, nil, err
+	}
+
+	var shares []recovery.Share
+	var incomplete []string
+	for page, parts := range pageParts {
+		var total int
+		for _, p := range parts {
+			total = p.parts
+		}
+		if len(parts) < total {
+			incomplete = append(incomplete, fmt.Sprintf("page %d has %d of %d codes", page, len(parts), total))
+			continue
+		}
+		var encoded strings.Builder
+		for i := 1; i <= total; i++ {
+			encoded.WriteString(parts[i].data)
+		}
+		shareBytes, err := base64.RawURLEncoding.DecodeString(encoded.String())
+		if err != nil {
+			return settings, nil, fmt.Errorf("page %d: %s", page, err)
+		}
+		share, err := recovery.Decode(shareBytes)
+		if err != nil {
+			return settings, nil, fmt.Errorf("page %d: %s", page, err)
+		}
+		shares = append(shares, share)
+	}
+	sort.Strings(incomplete)
+
+	if len(shares) == 0 || len(shares) < int(shares[0].Threshold) {
+		needed := "more pages"
+		if len(shares) > 0 {
+			needed = fmt.Sprintf("%d pages, have %d", shares[0].Threshold, len(shares))
+		}
+		if len(incomplete) > 0 {
+			needed += " (" + strings.Join(incomplete, ", ") + ")"
+		}
+		return settings, nil, fmt.Errorf("need %s", needed)
+	}
+
+	deflated, err := recovery.Combine(shares)
+	if err != nil {
+		return settings, nil, err
+	}
+	settingsBytes, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	if err != nil {
+		return settings, nil, fmt.Errorf("kit does not combine: %s", err)
+	}
+	defer wipe(settingsBytes)
+	if err := json.Unmarshal(settingsBytes, &settings); err != nil {
+		return settings, nil, err
+	}
+	var credentials struct {
+		Stores map[string]map[string]string `json:"store_credentials"`
+	}
+	err = json.Unmarshal(settingsBytes, &credentials)
+	return settings, credentials.Stores, err
+}
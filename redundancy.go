@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/fatih/color"
+)
+
+// A sharing scheme needs a threshold of a file's shares to rebuild it: all
+// of them for Shamir, fewer for Reed-Solomon or replication. The shares
+// beyond the threshold are the file's redundancy, how many stores can be
+// lost without losing it, and min_redundancy in the policy sets how much of
+// it files must keep.
+//
+// A vault is set up once it has two stores and its scheme gives every file
+// the redundancy the policy asks for. Commands that upload refuse to run
+// before, restore and the other commands reading shares back only need the
+// stores. Commands that destroy shares check the files they affect first:
+//
+//   - remove: the sync after it shares files on disk anew over the other
+//     stores, but files kept only on the stores, deleted ones kept for
+//     undelete and tracked ones missing on disk, lose their share on the
+//     removed store for good
+//   - compact: superseded versions of a file are only removed once enough
+//     stores list its current version
+//   - scheme: the new scheme must give every file its redundancy
+//
+// Manifest entries from before thresholds were recorded are taken to need
+// every share, as Shamir shares do.
+
+// fewest stores a vault shares files across
+const minStores = 2
+
+// files listed when an operation would leave files short of shares
+const maxShortfallLines = 10
+
+var errNotEnoughStores = errors.New("not enough services")
+
+// SetupProblem is why the vault cannot upload yet, if it cannot: too few
+// stores, or a policy rule asking for more redundancy than the scheme gives
+func (p ChasmPref) SetupProblem() error {
+	return setupProblem(p.RegisteredServices(), p.Scheme())
+}
+
+// HasStores checks if there are enough stores to read files back from,
+// whatever the policy asks of uploads
+func (p ChasmPref) HasStores() bool {
+	return p.RegisteredServices() >= minStores
+}
+
+// setupProblem checks n stores sharing with scheme against the policy
+func setupProblem(n int, scheme SharingScheme) error {
+	if n < minStores {
+		return errNotEnoughStores
+	}
+	for i, rule := range policy.Rules {
+		// a rule naming a scheme checks its own, rules only setting the
+		// redundancy of files another rule gives a scheme check the vault's
+		ruleScheme := scheme
+		if s, ok := sharingSchemes[rule.Scheme]; ok {
+			ruleScheme = s
+		}
+		spare := n - ruleScheme.Threshold(n)
+		if rule.MinRedundancy != nil && *rule.MinRedundancy > spare {
+			return fmt.Errorf("policy rule %d asks for %v spare shares, but %s across %v stores leaves %v", i+1, *rule.MinRedundancy, schemeName(ruleScheme), n, spare)
+		}
+	}
+	return nil
+}
+
+// schemeName is the name of scheme in the preferences
+func schemeName(scheme SharingScheme) string {
+	for name, s := range sharingSchemes {
+		if s == scheme {
+			return name
+		}
+	}
+	return "the sharing scheme"
+}
+
+// uploadThreshold is the threshold of filePath shared into n shares now
+func uploadThreshold(filePath string, n int) int {
+	if n == 0 {
+		return 0
+	}
+	return schemeFor(filePath).Threshold(n)
+}
+
+// shareCounts is how many shares of fs were uploaded and how many of them
+// restore needs. Entries without share hashes had one share per store
+func shareCounts(fs FileShare, stores int) (shares, threshold int) {
+	shares = len(fs.Shares)
+	if shares == 0 {
+		shares = stores
+	}
+	threshold = fs.Threshold
+	if threshold == 0 {
+		threshold = shares
+	}
+	return shares, threshold
+}
+
+// RedundancyShortfall is a file an operation would leave with fewer shares
+// than its threshold and the spare shares the policy asks for
+type RedundancyShortfall struct {
+	Path   string
+	Shares int
+	Needed int
+}
+
+// storedOnly returns the files only the stores hold: deleted files kept for
+// undelete and tracked files missing on disk
+func storedOnly() map[string]FileShare {
+	files := make(map[string]FileShare)
+	for filePath, fs := range preferences.FileMap {
+		if fs.SID == ShareID(chasmPrefFile) {
+			continue
+		}
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			files[filePath] = fs
+		}
+	}
+	for filePath, deleted := range preferences.Deleted {
+		files[filePath] = deleted.FileShare
+	}
+	return files
+}
+
+// StoreRemovalShortfalls lists the files kept only on the stores that
+// removing store k, numbered from 1, would leave short of shares
+func StoreRemovalShortfalls(k int) []RedundancyShortfall {
+	n := preferences.RegisteredServices()
+	var short []RedundancyShortfall
+	for filePath, fs := range storedOnly() {
+		shares, threshold := shareCounts(fs, n)
+		if k <= shares {
+			shares--
+		}
+		if needed := threshold + minRedundancyFor(filePath); shares < needed {
+			short = append(short, RedundancyShortfall{Path: filePath, Shares: shares, Needed: needed})
+		}
+	}
+	sort.Slice(short, func(i, j int) bool { return short[i].Path < short[j].Path })
+	return short
+}
+
+// storeRemovalProblem is why store k cannot be removed, if it cannot
+func storeRemovalProblem(k int) error {
+	if err := setupProblem(preferences.RegisteredServices()-1, preferences.Scheme()); err != nil {
+		return fmt.Errorf("the other stores would not be enough, %s", err)
+	}
+	if short := StoreRemovalShortfalls(k); len(short) > 0 {
+		printShortfalls(short)
+		return fmt.Errorf("%v files kept only on the stores would be left without enough shares", len(short))
+	}
+	return nil
+}
+
+// compactionShortfalls finds the files whose current version too few of
+// the stores list, by share id. listings are the objects of each store
+func compactionShortfalls(listings [][]string) map[ShareID]RedundancyShortfall {
+	held := make(map[string]int)
+	for _, objects := range listings {
+		for _, object := range objects {
+			held[object]++
+		}
+	}
+
+	short := make(map[ShareID]RedundancyShortfall)
+	check := func(filePath string, fs FileShare) {
+		// entries not uploaded yet, or from the unversioned layout, have
+		// no superseded versions
+		if fs.SID == ShareID(chasmPrefFile) || fs.Version == "" {
+			return
+		}
+		_, threshold := shareCounts(fs, len(listings))
+		shares := held[fs.ObjectName()]
+		if needed := threshold + minRedundancyFor(filePath); shares < needed {
+			short[fs.SID] = RedundancyShortfall{Path: filePath, Shares: shares, Needed: needed}
+		}
+	}
+	for filePath, fs := range preferences.FileMap {
+		check(filePath, fs)
+	}
+	for filePath, deleted := range preferences.Deleted {
+		check(filePath, deleted.FileShare)
+	}
+	return short
+}
+
+// printShortfalls lists files left short of shares, the first few of them
+func printShortfalls(short []RedundancyShortfall) {
+	for i, s := range short {
+		if i == maxShortfallLines {
+			fmt.Printf("... and %v more\n", len(short)-i)
+			break
+		}
+		color.Red(statusLine(true, fmt.Sprintf("%s: %v shares, %v needed", s.Path, s.Shares, s.Needed)))
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// A USB drive is mounted wherever the system puts it: another /media path
+// or drive letter each time, and other drives turn up at its old mount
+// point. A removable folder store knows its drive by volume UUID or label
+// and its path on the drive, finds where the drive is mounted when the vault
+// loads, and only writes to it while that very drive is mounted there. In
+// between shares are queued like for any unmounted folder store.
+
+// VolumeInfo is a mounted volume and what identifies it
+type VolumeInfo struct {
+	Mount string
+	UUID  string
+	Label string
+}
+
+// matches checks if the volume is the one id names, by UUID or label
+func (v VolumeInfo) matches(id string) bool {
+	return id != "" && (strings.EqualFold(v.UUID, id) || v.Label == id)
+}
+
+// findVolume finds where the volume named id is mounted
+func findVolume(id string) (VolumeInfo, bool) {
+	for _, v := range listVolumes() {
+		if v.matches(id) {
+			return v, true
+		}
+	}
+	return VolumeInfo{}, false
+}
+
+// volumeOf finds the volume holding dirPath, the one mounted closest to it
+func volumeOf(dirPath string) (VolumeInfo, bool) {
+	abs, err := filepath.Abs(dirPath)
+	if err != nil {
+		return VolumeInfo{}, false
+	}
+
+	var best VolumeInfo
+	for _, v := range listVolumes() {
+		rel, err := filepath.Rel(v.Mount, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if len(v.Mount) > len(best.Mount) {
+			best = v
+		}
+	}
+	return best, best.Mount != ""
+}
+
+// MakeRemovable ties the folder store to the volume its path is on
+func (f *FolderStore) MakeRemovable() error {
+	v, ok := volumeOf(f.Path)
+	if !ok {
+		return fmt.Errorf("%s is not on a mounted volume", f.Path)
+	}
+
+	f.Volume = v.UUID
+	if f.Volume == "" {
+		f.Volume = v.Label
+	}
+	if f.Volume == "" {
+		return fmt.Errorf("the volume at %s has neither UUID nor label", v.Mount)
+	}
+
+	abs, _ := filepath.Abs(f.Path)
+	rel, err := filepath.Rel(v.Mount, abs)
+	if err != nil {
+		return err
+	}
+	f.Mount = v.Mount
+	f.VolumePath = filepath.ToSlash(rel)
+	return nil
+}
+
+// relocate points a removable folder store at its drive's current mount
+// point, returning true if it moved
+func (f *FolderStore) relocate() bool {
+	if f.Volume == "" {
+		return false
+	}
+	v, ok := findVolume(f.Volume)
+	if !ok || v.Mount == f.Mount {
+		return false
+	}
+	f.Mount = v.Mount
+	f.Path = filepath.Join(v.Mount, filepath.FromSlash(f.VolumePath))
+	return true
+}
+
+// relocateRemovableStores finds the drives of removable folder stores
+func relocateRemovableStores() {
+	stores := make([]*FolderStore, 0, len(preferences.FolderStores)+1)
+	for i := range preferences.FolderStores {
+		stores = append(stores, &preferences.FolderStores[i])
+	}
+	if preferences.Standby != nil && preferences.Standby.Folder != nil {
+		stores = append(stores, preferences.Standby.Folder)
+	}
+
+	for _, f := range stores {
+		if f.relocate() {
+			color.Yellow("Drive %s is now mounted at %s.", f.Volume, f.Mount)
+		}
+	}
+}
+
+// volumeName names the volume of the store in messages
+func (f FolderStore) volumeName() string {
+	if f.Volume != "" {
+		return "Drive " + f.Volume
+	}
+	return f.Mount
+}
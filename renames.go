@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+)
+
+// FileID identifies a file on this machine across renames: device and
+// inode on unix, volume serial and file index on Windows
+type FileID struct {
+	Device uint64 `json:"dev"`
+	Inode  uint64 `json:"ino"`
+}
+
+// rememberFileID records the identity of a tracked file in the local state
+func rememberFileID(filePath string, fi os.FileInfo) {
+	id, ok := fileIdentity(filePath, fi)
+	if !ok {
+		return
+	}
+	if state.FileIDs == nil {
+		state.FileIDs = make(map[string]FileID)
+	}
+	state.FileIDs[filePath] = id
+}
+
+// findRenameSource finds the tracked path that the untracked filePath was
+// renamed from: a tracked path that no longer exists and had the same
+// identity or, failing that, the same contents
+func findRenameSource(filePath string, fi os.FileInfo, hash string) (string, bool) {
+	gone := func(p string) bool {
+		_, err := os.Lstat(p)
+		return os.IsNotExist(err)
+	}
+
+	if id, ok := fileIdentity(filePath, fi); ok {
+		for oldPath, oldID := range state.FileIDs {
+			if _, tracked := preferences.FileMap[oldPath]; oldID == id && tracked && gone(oldPath) {
+				return oldPath, true
+			}
+		}
+	}
+
+	for oldPath, fileShare := range preferences.FileMap {
+		if fileShare.Hash == hash && gone(oldPath) {
+			return oldPath, true
+		}
+	}
+	return "", false
+}
+
+// moveFileShare moves the manifest entry of oldPath to newPath, keeping its
+// share id and therefore its version history
+func moveFileShare(oldPath, newPath string) {
+	fileShare := preferences.FileMap[oldPath]
+	delete(preferences.FileMap, oldPath)
+	preferences.FileMap[newPath] = fileShare
+	delete(state.FileIDs, oldPath)
+
+	recordFileChange(oldPath, nil)
+	recordFileChange(newPath, &fileShare)
+	preferences.Save()
+	trace(TraceEvent{Op: "delete", Path: tracePath(oldPath), Detail: "renamed"})
+}
@@ -0,0 +1,30 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func fileIdentity(filePath string, fi os.FileInfo) (FileID, bool) {
+	name, err := syscall.UTF16PtrFromString(filePath)
+	if err != nil {
+		return FileID{}, false
+	}
+	handle, err := syscall.CreateFile(name, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return FileID{}, false
+	}
+	defer syscall.CloseHandle(handle)
+
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(handle, &info); err != nil {
+		return FileID{}, false
+	}
+	return FileID{
+		Device: uint64(info.VolumeSerialNumber),
+		Inode:  uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow),
+	}, true
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+	"github.com/fatih/color"
+)
+
+// When a provider loses data, `chasm repair --store` brings that one store
+// back in line without touching the others. Each file's share on the store
+// is downloaded and checked; a missing or corrupt one is copied back from
+// the standby store if it stood in for the store, or regenerated from the
+// healthy shares of the other stores when the threshold allows and the scheme
+// splits deterministically, so it fits the shares already stored. Otherwise
+// the file is shared again as a new version, from the contents the healthy
+// shares still combine to or else from the local copy.
+
+// RepairResult counts what a repair of one store did
+type RepairResult struct {
+	Store   string
+	Healthy int
+
+	// shares regenerated or copied back from the standby store in place,
+	// and files shared again as a new version
+	Regenerated int
+	Reshared    int
+
+	Failed int
+}
+
+// findStore finds a store by its number in chasm status, its description or
+// the path or URL in it, returning its index from 0
+func findStore(name string) (int, error) {
+	cloudStores := preferences.primaryStores()
+	if index, err := strconv.Atoi(name); err == nil {
+		if index < 1 || index > len(cloudStores) {
+			return 0, fmt.Errorf("no store numbered %v", index)
+		}
+		return index - 1, nil
+	}
+
+	found := -1
+	for i, cs := range cloudStores {
+		description := cs.ShortDescription()
+		if description != name && !strings.HasSuffix(description, ": "+name) {
+			continue
+		}
+		if found >= 0 {
+			return 0, fmt.Errorf("%s names more than one store, use its number", name)
+		}
+		found = i
+	}
+	if found < 0 {
+		return 0, fmt.Errorf("no store named %s, see chasm status", name)
+	}
+	return found, nil
+}
+
+// readStored downloads an object from a store, joining its parts
+func readStored(store interface{}, names map[string][]string, object string) ([]byte, error) {
+	reader, ok := store.(objectReader)
+	if !ok {
+		return nil, errors.New("store cannot download single objects")
+	}
+	parts := names[object]
+	if len(parts) == 0 {
+		return nil, errors.New("missing")
+	}
+
+	var data []byte
+	for _, name := range parts {
+		if name == "" {
+			wipe(data)
+			return nil, errors.New("missing parts")
+		}
+		part, err := reader.Read(name)
+		if err != nil {
+			wipe(data)
+			return nil, err
+		}
+		data = append(data, part...)
+		wipe(part)
+	}
+	return data, nil
+}
+
+// checkStored checks a downloaded share of fileShare
+func checkStored(fileShare FileShare, data []byte) error {
+	if err := checkShare(fileShare, data); err != nil {
+		return err
+	}
+	if bytes.HasPrefix(data, []byte(recovery.Magic)) {
+		_, err := recovery.Decode(data)
+		return err
+	}
+	return nil
+}
+
+// Repair regenerates the missing and corrupt shares of the store at index
+// for every tracked and retained deleted file, then uploads the manifest to
+// every store again
+func Repair(index int) RepairResult {
+	cloudStores := preferences.cloudStores()
+	result := RepairResult{Store: cloudStores[index].ShortDescription()}
+	taskTotal(len(preferences.FileMap) + len(preferences.Deleted))
+
+	names := make([]map[string][]string, len(cloudStores))
+	for i, cs := range cloudStores {
+		names[i] = storedNames(cs.List())
+	}
+	// the standby may hold shares of the store from a past failover, even
+	// while it stands in for another one. Only shares at the store's x
+	// are copied back
+	var standby CloudStore
+	var standbyNames map[string][]string
+	if preferences.Standby != nil {
+		standby = preferences.Standby.store()
+		standbyNames = storedNames(standby.List())
+	}
+
+	repair := func(filePath string, fileShare FileShare, deleted bool) {
+		if taskCanceled() || fileShare.Version == "" || fileShare.SID == ShareID(chasmPrefFile) {
+			return
+		}
+		object := fileShare.ObjectName()
+
+		data, err := readStored(storeRef(index+1), names[index], object)
+		if err == nil {
+			err = checkStored(fileShare, data)
+		}
+		wipe(data)
+		if err == nil {
+			result.Healthy++
+			countFile(fileShare.Size, true)
+			return
+		}
+		color.Yellow("%s: %s of %s is %s", result.Store, object, filePath, err)
+
+		// shares written to the standby store in its place are copied back
+		if standby != nil {
+			data, err := readStored(standby, standbyNames, object)
+			if err == nil && shareX(data) == index+1 && checkStored(fileShare, data) == nil {
+				preferences.AllCloudStores()[index].Upload(Share{SID: fileShare.SID, Version: fileShare.Version, Data: data})
+				wipe(data)
+				color.Green("Copied the share of %s from the standby store", filePath)
+				result.Regenerated++
+				countFile(fileShare.Size, false)
+				return
+			}
+			wipe(data)
+		}
+
+		if err := repairShare(index, names, filePath, fileShare, deleted, &result); err != nil {
+			color.Red("Cannot repair %s: %s", filePath, err)
+			result.Failed++
+			countError()
+		}
+	}
+
+	paths := make([]string, 0, len(preferences.FileMap))
+	for filePath := range preferences.FileMap {
+		paths = append(paths, filePath)
+	}
+	sort.Strings(paths)
+	for _, filePath := range paths {
+		repair(filePath, preferences.FileMap[filePath], false)
+	}
+	for _, filePath := range DeletedPaths() {
+		repair(filePath, preferences.Deleted[filePath].FileShare, true)
+	}
+
+	if !taskCanceled() {
+		UploadManifest()
+	}
+	state.Save()
+	return result
+}
+
+// repairShare replaces the share of fileShare on the store at index
+func repairShare(index int, names []map[string][]string, filePath string, fileShare FileShare, deleted bool, result *RepairResult) error {
+	object := fileShare.ObjectName()
+	sid, version, _ := ParseObjectName(object)
+
+	// healthy shares of the other stores
+	var shares []Share
+	defer func() {
+		for _, share := range shares {
+			wipe(share.Data)
+		}
+	}()
+	threshold := len(names)
+	for i := range names {
+		if i == index {
+			continue
+		}
+		data, err := readStored(storeRef(i+1), names[i], object)
+		if err == nil {
+			err = checkStored(fileShare, data)
+		}
+		if err != nil {
+			wipe(data)
+			continue
+		}
+		if decoded, err := recovery.Decode(data); err == nil && decoded.Threshold > 0 {
+			threshold = int(decoded.Threshold)
+		}
+		shares = append(shares, Share{SID: sid, Data: data, Version: version})
+	}
+
+	var secret []byte
+	defer func() { wipe(secret) }()
+	if len(shares) >= threshold {
+		secret = CombineShares(shares)
+		// protected contents can only be checked by opening them
+		if len(secret) == 0 || fileShare.Protection == "" && !checkSHA2(fileShare.Hash, secret) {
+			wipe(secret)
+			secret = nil
+		}
+	}
+
+	if secret != nil {
+		if share, ok := regenerateShare(shares, secret, index); ok {
+			share.SID, share.Version = sid, version
+			if expected := expectedShareHash(fileShare, index+1); expected == "" || shareHash(object, share.Data) == expected {
+				preferences.AllCloudStores()[index].Upload(share)
+				wipe(share.Data)
+				countFile(fileShare.Size, false)
+				color.Green("Regenerated the share of %s", filePath)
+				result.Regenerated++
+				return nil
+			}
+			wipe(share.Data)
+		}
+	}
+
+	// deleted files are not tracked, so cannot take a new version
+	if deleted {
+		return errors.New("its share cannot be regenerated")
+	}
+	if secret != nil && protectionFor(filePath) == fileShare.Protection {
+		shareFile(filePath, fileShare.Hash, fileShare.Size, func(sid ShareID, version string) uploadedShares {
+			return uploadSharesWith(schemeFor(filePath), sid, version, secret)
+		})
+		color.Green("Shared %s again from the healthy shares", filePath)
+		result.Reshared++
+		return nil
+	}
+	if err := reshareLocal(filePath, fileShare); err != nil {
+		return err
+	}
+	color.Green("Shared %s again from the local copy", filePath)
+	result.Reshared++
+	return nil
+}
+
+// regenerateShare splits secret again with the scheme of shares and returns
+// the share at index, if the split reproduces the shares already stored
+func regenerateShare(shares []Share, secret []byte, index int) (Share, bool) {
+	decoded, err := recovery.Decode(shares[0].Data)
+	if err != nil {
+		return Share{}, false
+	}
+	scheme, err := sharingSchemeByID(decoded.Scheme)
+	if err != nil {
+		return Share{}, false
+	}
+
+	regenerated := CreateSharesWith(scheme, secret, shares[0].SID, len(preferences.cloudStores()))
+	ok := true
+	for _, share := range shares {
+		x := shareX(share.Data)
+		ok = ok && x >= 1 && x <= len(regenerated) && bytes.Equal(regenerated[x-1].Data, share.Data)
+	}
+	for i := range regenerated {
+		if !ok || i != index {
+			wipe(regenerated[i].Data)
+		}
+	}
+	if !ok {
+		return Share{}, false
+	}
+	return regenerated[index], true
+}
+
+// reshareLocal shares the local copy of a file as a new version, if it still
+// has the contents recorded in the manifest
+func reshareLocal(filePath string, fileShare FileShare) error {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return errors.New("not enough healthy shares and no local copy")
+	}
+	hash, err := hashFile(filePath)
+	if err != nil {
+		return err
+	}
+	if hash != fileShare.Hash {
+		return errors.New("not enough healthy shares and the local copy has changed")
+	}
+
+	if fitsMemory(fi.Size(), len(preferences.cloudStores())) {
+		fileBytes, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		defer wipe(fileBytes)
+		shareFileBytes(filePath, fileBytes)
+		return nil
+	}
+
+	sharePath := filePath
+	if protection := protectionFor(filePath); protection != "" {
+		if sharePath, err = sealProtectedFile(protection, filePath); err != nil {
+			return err
+		}
+		defer os.Remove(sharePath)
+	}
+	shareFile(filePath, hash, fi.Size(), func(sid ShareID, version string) uploadedShares {
+		return uploadSharesStreamed(schemeFor(filePath), sid, version, sharePath)
+	})
+	return nil
+}
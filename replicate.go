@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Replication keeps two chasm installations, e.g. a home server and an
+// office machine, holding the same files under their roots. Each side
+// shares them into its own stores, so either can recover on its own. Files
+// keep their share id and version on both sides, and the versions agreed on
+// by the last replication tell a deletion from a file the other side lacks.
+
+// Replica is the other vault of `chasm replicate`. Paths are relative to
+// its root
+type Replica interface {
+	Manifest() (ReplicaManifest, error)
+	ReadFile(rel string) ([]byte, error)
+	WriteFile(rel string, fileShare FileShare, data []byte) error
+	DeleteFile(rel string) error
+}
+
+// ReplicaManifest lists the replicated files of a vault by relative path
+type ReplicaManifest struct {
+	Files map[string]FileShare `json:"files"`
+}
+
+// OpenReplica connects to ssh://[user@]host[:port]/path/to/root or to the
+// daemon API at http(s)://host:port
+func OpenReplica(remote, token string) (Replica, error) {
+	u, err := url.Parse(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "ssh":
+		if u.Path == "" {
+			return nil, errors.New("missing remote chasm root in " + remote)
+		}
+		return sshReplica{url: u}, nil
+	case "http", "https":
+		if token == "" {
+			return nil, errors.New("missing API token of the remote vault")
+		}
+		return apiReplica{base: strings.TrimSuffix(remote, "/"), token: token}, nil
+	}
+	return nil, fmt.Errorf("unsupported remote %s, use ssh://, http:// or https://", remote)
+}
+
+// Replicate synchronizes the files of this vault and the remote one in both
+// directions. Returns the number of errors
+func Replicate(remote string, replica Replica) int {
+	theirs, err := replica.Manifest()
+	if err != nil {
+		color.Red("Error: cannot read remote manifest: %s", err)
+		return 1
+	}
+	ours := localReplicaManifest()
+	warnClockSkew(remote, theirs.Files)
+
+	base := state.ReplicaBase[remote]
+	agreed := make(map[string]string)
+	errs := 0
+
+	for _, rel := range replicaPaths(ours, theirs) {
+		local, lok := ours.Files[rel]
+		other, rok := theirs.Files[rel]
+		baseVersion, bok := base[rel]
+
+		var err error
+		switch {
+		case lok && rok && local.Version == other.Version:
+			agreed[rel] = local.Version
+			continue
+		case lok && rok && newerShare(local, other), lok && !rok && !(bok && baseVersion == local.Version):
+			color.Magenta("Push %s", rel)
+			err = pushReplicaFile(replica, rel, local)
+			agreed[rel] = local.Version
+		case lok && rok, rok && !lok && !(bok && baseVersion == other.Version):
+			color.Magenta("Pull %s", rel)
+			err = pullReplicaFile(replica, rel, other)
+			agreed[rel] = other.Version
+		case lok:
+			// unchanged here since the last replication, deleted there
+			color.Yellow("Delete %s", rel)
+			err = removeReplicaFile(rel)
+		default:
+			color.Yellow("Delete remote %s", rel)
+			err = replica.DeleteFile(rel)
+		}
+
+		if err != nil {
+			color.Red("Error replicating %s: %s", rel, err)
+			countError()
+			delete(agreed, rel)
+			if v, ok := base[rel]; ok {
+				// retry against the old base next time
+				agreed[rel] = v
+			}
+			errs++
+		}
+	}
+
+	if state.ReplicaBase == nil {
+		state.ReplicaBase = make(map[string]map[string]string)
+	}
+	state.ReplicaBase[remote] = agreed
+	state.Save()
+	return errs
+}
+
+func pushReplicaFile(replica Replica, rel string, fileShare FileShare) error {
+	data, err := readReplicaFile(rel)
+	if err != nil {
+		return err
+	}
+	countFile(int64(len(data)), false)
+	return replica.WriteFile(rel, fileShare, data)
+}
+
+func pullReplicaFile(replica Replica, rel string, fileShare FileShare) error {
+	data, err := replica.ReadFile(rel)
+	if err != nil {
+		return err
+	}
+	countFile(int64(len(data)), false)
+	return importReplicaFile(rel, fileShare, data)
+}
+
+func replicaPaths(manifests ...ReplicaManifest) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, m := range manifests {
+		for rel := range m.Files {
+			if !seen[rel] {
+				seen[rel] = true
+				paths = append(paths, rel)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+/// Local side, also serving the remote end ///
+
+// localReplicaManifest lists the tracked files inside the root. The
+// manifest itself, git bundles and files outside the root are not replicated
+func localReplicaManifest() ReplicaManifest {
+	m := ReplicaManifest{Files: make(map[string]FileShare)}
+	for filePath, fileShare := range preferences.FileMap {
+		rel, err := filepath.Rel(preferences.root, filePath)
+		if err != nil || strings.HasPrefix(rel, "..") || rel == chasmPrefFile || path.Base(filePath) == gitBundleName {
+			continue
+		}
+		m.Files[filepath.ToSlash(rel)] = fileShare
+	}
+	return m
+}
+
+// replicaPath resolves a relative replica path inside the root
+func replicaPath(rel string) (string, error) {
+	clean := path.Clean("/" + rel)[1:]
+	if clean == "" || clean != rel || clean == chasmPrefFile {
+		return "", fmt.Errorf("invalid replica path %q", rel)
+	}
+	return filepath.Join(preferences.root, filepath.FromSlash(clean)), nil
+}
+
+// readReplicaFile reads a tracked file, which must still match the manifest
+func readReplicaFile(rel string) ([]byte, error) {
+	filePath, err := replicaPath(rel)
+	if err != nil {
+		return nil, err
+	}
+	fileShare, ok := preferences.FileMap[filePath]
+	if !ok {
+		return nil, fmt.Errorf("%s is not tracked", rel)
+	}
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if !checkSHA2(fileShare.Hash, data) {
+		return nil, fmt.Errorf("%s changed since it was shared, sync first", rel)
+	}
+	return data, nil
+}
+
+// importReplicaFile writes a replicated file and shares it with the same
+// share id and version as on the other side
+func importReplicaFile(rel string, fileShare FileShare, data []byte) error {
+	filePath, err := replicaPath(rel)
+	if err != nil {
+		return err
+	}
+	if !checkSHA2(fileShare.Hash, data) {
+		return fmt.Errorf("invalid SHA2 checksum for %s", rel)
+	}
+
+	for dir := filepath.Dir(filePath); dir != preferences.root && !preferences.DirMap[dir]; dir = filepath.Dir(dir) {
+		preferences.DirMap[dir] = true
+		recordDirChange(dir, true)
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0770); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filePath, data, 0660); err != nil {
+		return err
+	}
+
+	observeGeneration(&preferences, fileShare)
+	fileShare.Size = int64(len(data))
+	fileShare.Shares = uploadSharesWith(schemeFor(filePath), fileShare.SID, fileShare.Version, data).Hashes
+	fileShare.Threshold = uploadThreshold(filePath, len(fileShare.Shares))
+	preferences.FileMap[filePath] = fileShare
+	recordFileChange(filePath, &fileShare)
+	preferences.Save()
+	trace(TraceEvent{Op: "add", Path: tracePath(filePath), Object: fileShare.ObjectName(), Size: len(data), Detail: "replicated"})
+
+	if fi, err := os.Stat(filePath); err == nil {
+		rememberFileID(filePath, fi)
+	}
+	return nil
+}
+
+// removeReplicaFile deletes a file the other side deleted
+func removeReplicaFile(rel string) error {
+	filePath, err := replicaPath(rel)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	DeleteFile(filePath)
+	return nil
+}
+
+/// Daemon API transport ///
+
+type apiReplica struct {
+	base  string
+	token string
+}
+
+func (a apiReplica) do(method, rel string, query url.Values, body []byte) ([]byte, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if rel != "" {
+		query.Set("path", rel)
+	}
+
+	endpoint := a.base + "/api/replica/manifest"
+	if rel != "" {
+		endpoint = a.base + "/api/replica/file"
+	}
+	req, err := http.NewRequest(method, endpoint+"?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+func (a apiReplica) Manifest() (ReplicaManifest, error) {
+	var m ReplicaManifest
+	data, err := a.do("GET", "", nil, nil)
+	if err == nil {
+		err = json.Unmarshal(data, &m)
+	}
+	return m, err
+}
+
+func (a apiReplica) ReadFile(rel string) ([]byte, error) {
+	return a.do("GET", rel, nil, nil)
+}
+
+func (a apiReplica) WriteFile(rel string, fileShare FileShare, data []byte) error {
+	query := url.Values{"sid": {string(fileShare.SID)}, "hash": {fileShare.Hash}, "version": {fileShare.Version}, "generation": {fmt.Sprint(fileShare.Generation)}}
+	_, err := a.do("PUT", rel, query, data)
+	return err
+}
+
+func (a apiReplica) DeleteFile(rel string) error {
+	_, err := a.do("DELETE", rel, nil, nil)
+	return err
+}
+
+// apiReplicaManifest serves GET /api/replica/manifest
+func apiReplicaManifest(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, localReplicaManifest())
+}
+
+// apiReplicaFile serves GET, PUT and DELETE /api/replica/file?path=
+func apiReplicaFile(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	rel := query.Get("path")
+
+	var err error
+	switch r.Method {
+	case "GET":
+		var data []byte
+		if data, err = readReplicaFile(rel); err == nil {
+			w.Write(data)
+			return
+		}
+	case "PUT":
+		var data []byte
+		if data, err = ioutil.ReadAll(r.Body); err == nil {
+			generation, _ := strconv.ParseUint(query.Get("generation"), 10, 64)
+			fileShare := FileShare{SID: ShareID(query.Get("sid")), Hash: query.Get("hash"), Version: query.Get("version"), Generation: generation}
+			err = importReplicaFile(rel, fileShare, data)
+		}
+	case "DELETE":
+		err = removeReplicaFile(rel)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	UploadManifestDelta()
+}
+
+/// SSH transport ///
+
+// sshReplica runs the hidden `chasm replica` commands on the remote host
+type sshReplica struct {
+	url *url.URL
+}
+
+func (s sshReplica) run(stdin []byte, args ...string) ([]byte, error) {
+	var sshArgs []string
+	if port := s.url.Port(); port != "" {
+		sshArgs = append(sshArgs, "-p", port)
+	}
+	host := s.url.Hostname()
+	if s.url.User != nil {
+		host = s.url.User.Username() + "@" + host
+	}
+	sshArgs = append(sshArgs, host)
+
+	remote := []string{"chasm", "--root", s.url.Path, "replica"}
+	for _, arg := range append(remote, args...) {
+		// the remote shell splits the command again
+		sshArgs = append(sshArgs, "'"+strings.Replace(arg, "'", `'\''`, -1)+"'")
+	}
+
+	cmd := exec.Command("ssh", sshArgs...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (s sshReplica) Manifest() (ReplicaManifest, error) {
+	var m ReplicaManifest
+	out, err := s.run(nil, "manifest")
+	if err == nil {
+		err = json.Unmarshal(out, &m)
+	}
+	return m, err
+}
+
+func (s sshReplica) ReadFile(rel string) ([]byte, error) {
+	return s.run(nil, "cat", rel)
+}
+
+func (s sshReplica) WriteFile(rel string, fileShare FileShare, data []byte) error {
+	_, err := s.run(data, "put", "--sid", string(fileShare.SID), "--hash", fileShare.Hash, "--version", fileShare.Version, "--generation", fmt.Sprint(fileShare.Generation), rel)
+	return err
+}
+
+func (s sshReplica) DeleteFile(rel string) error {
+	_, err := s.run(nil, "rm", rel)
+	return err
+}
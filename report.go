@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// A compliance report lists every tracked file with its hash, the stores
+// holding its shares and when they were last all listed, as JSON or CSV.
+// Listings only show a store names the object: chasm verify checks the
+// shares themselves. The report is signed with an Ed25519 key kept in the
+// local state, the signature going to a .sig file next to the report, so an
+// auditor holding the vault's public key can check that it was not edited.
+// Verifying a report checks it was signed with that key, the vault's own if
+// not given, then checks every entry against the live vault.
+
+// ComplianceReport is the JSON form of a report
+type ComplianceReport struct {
+	Generated time.Time     `json:"generated"`
+	Root      string        `json:"root"`
+	Stores    []string      `json:"stores"`
+	Files     []ReportEntry `json:"files"`
+}
+
+// ReportEntry is one tracked file in a report
+type ReportEntry struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"` // hex
+	Object string `json:"object"`
+
+	// stores holding the object, and those missing it
+	PresentOn   []string `json:"present_on"`
+	MissingFrom []string `json:"missing_from,omitempty"`
+
+	// last time every store listed the object, zero if never seen
+	LastListed time.Time `json:"last_listed,omitempty"`
+}
+
+var reportCSVHeader = []string{"path", "sha256", "object", "present_on", "missing_from", "last_listed"}
+
+// BuildReport lists the stores' objects and checks every tracked file's
+// shares are listed on all of them, recording the time in the local state
+func BuildReport() ComplianceReport {
+	report := ComplianceReport{Generated: time.Now().UTC(), Root: preferences.root}
+
+	var listings []map[string]bool
+	for _, cs := range preferences.AllCloudStores() {
+		report.Stores = append(report.Stores, cs.ShortDescription())
+		listing := make(map[string]bool)
+		for _, object := range cs.List() {
+			listing[object] = true
+		}
+		listings = append(listings, listing)
+	}
+
+	if state.Listed == nil {
+		state.Listed = make(map[string]time.Time)
+	}
+
+	// the manifest's entry names a superseded version
+	paths := make([]string, 0, len(preferences.FileMap))
+	for filePath, fileShare := range preferences.FileMap {
+		if fileShare.SID != ShareID(chasmPrefFile) {
+			paths = append(paths, filePath)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, filePath := range paths {
+		fileShare := preferences.FileMap[filePath]
+		entry := ReportEntry{Path: filePath, SHA256: hexHash(fileShare.Hash), Object: fileShare.ObjectName(), PresentOn: []string{}}
+		for i, listing := range listings {
+			if listing[entry.Object] {
+				entry.PresentOn = append(entry.PresentOn, report.Stores[i])
+			} else {
+				entry.MissingFrom = append(entry.MissingFrom, report.Stores[i])
+			}
+		}
+		if len(entry.MissingFrom) == 0 {
+			state.Listed[filePath] = report.Generated
+		}
+		entry.LastListed = state.Listed[filePath]
+		report.Files = append(report.Files, entry)
+	}
+
+	state.Save()
+	return report
+}
+
+// hexHash converts a SHA256Base64URL hash to hex, as auditors expect
+func hexHash(hash string) string {
+	sum, err := base64.URLEncoding.DecodeString(hash)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(sum)
+}
+
+// Encode writes the report as JSON, or CSV if csv is set
+func (r ComplianceReport) Encode(asCSV bool) ([]byte, error) {
+	if !asCSV {
+		return json.MarshalIndent(r, "", "  ")
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(reportCSVHeader)
+	for _, e := range r.Files {
+		listed := ""
+		if !e.LastListed.IsZero() {
+			listed = e.LastListed.Format(time.RFC3339)
+		}
+		w.Write([]string{e.Path, e.SHA256, e.Object, strings.Join(e.PresentOn, ";"), strings.Join(e.MissingFrom, ";"), listed})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// parseReport reads the entries of a JSON or CSV report
+func parseReport(data []byte) ([]ReportEntry, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var report ComplianceReport
+		err := json.Unmarshal(data, &report)
+		return report.Files, err
+	}
+
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 || strings.Join(rows[0], ",") != strings.Join(reportCSVHeader, ",") {
+		return nil, errors.New("not a chasm report")
+	}
+
+	entries := make([]ReportEntry, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		entry := ReportEntry{Path: row[0], SHA256: row[1], Object: row[2], PresentOn: splitList(row[3]), MissingFrom: splitList(row[4])}
+		if row[5] != "" {
+			if entry.LastListed, err = time.Parse(time.RFC3339, row[5]); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ";")
+}
+
+// reportKey is the local report signing key, created on first use
+func reportKey() ed25519.PrivateKey {
+	if seed, err := base64.StdEncoding.DecodeString(state.ReportKey); err == nil && len(seed) == ed25519.SeedSize {
+		return ed25519.NewKeyFromSeed(seed)
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	check(err)
+	state.ReportKey = base64.StdEncoding.EncodeToString(key.Seed())
+	state.Save()
+	return key
+}
+
+// ReportPublicKey is the base64 public key reports of the vault are signed
+// with, for auditors to verify them with
+func ReportPublicKey() string {
+	return base64.StdEncoding.EncodeToString(reportKey().Public().(ed25519.PublicKey))
+}
+
+// SignReport returns the contents of the .sig file for a report
+func SignReport(report []byte) []byte {
+	return signDetached(reportKey(), report)
+}
+
+// checkReportSignature verifies a report against its .sig file, returning
+// the signing public key
+func checkReportSignature(report, sig []byte) (string, error) {
+	return checkDetached(report, sig, "report")
+}
+
+// VerifyReport checks the report at reportPath is signed with publicKey,
+// the vault's own report key if empty, then that every entry still holds for
+// the live vault. It returns the number of entries that no longer do
+func VerifyReport(reportPath, publicKey string) (int, error) {
+	data, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		return 0, err
+	}
+	sig, err := ioutil.ReadFile(reportPath + ".sig")
+	if err != nil {
+		return 0, fmt.Errorf("cannot read signature: %s", err)
+	}
+	if publicKey == "" {
+		if state.ReportKey == "" {
+			return 0, errors.New("this vault has no report key, give the signer's public key with --key")
+		}
+		publicKey = ReportPublicKey()
+	}
+	signer, err := checkReportSignature(data, sig)
+	if err != nil {
+		return 0, err
+	}
+	if signer != publicKey {
+		return 0, fmt.Errorf("signed by %s, not %s", signer, publicKey)
+	}
+	color.Green("Signature valid, signed by %s", signer)
+
+	entries, err := parseReport(data)
+	if err != nil {
+		return 0, err
+	}
+
+	live := make(map[string]bool)
+	for _, cs := range preferences.AllCloudStores() {
+		for _, object := range cs.List() {
+			live[cs.ShortDescription()+"\x00"+object] = true
+		}
+	}
+
+	failed := 0
+	for _, entry := range entries {
+		fileShare, tracked := preferences.FileMap[entry.Path]
+		switch {
+		case !tracked:
+			color.Yellow("%s: no longer tracked", entry.Path)
+		case hexHash(fileShare.Hash) != entry.SHA256:
+			color.Yellow("%s: changed since the report", entry.Path)
+		}
+
+		var gone []string
+		for _, store := range entry.PresentOn {
+			if !live[store+"\x00"+entry.Object] {
+				gone = append(gone, store)
+			}
+		}
+		if len(gone) == 0 {
+			continue
+		}
+		if tracked && fileShare.ObjectName() != entry.Object {
+			// superseded versions are removed by compaction
+			color.Yellow("%s: the reported version was compacted away on %s", entry.Path, strings.Join(gone, ", "))
+			continue
+		}
+		color.Red("%s: %s no longer on %s", entry.Path, entry.Object, strings.Join(gone, ", "))
+		failed++
+	}
+
+	color.Green("Checked %v entries, %v hold.", len(entries), len(entries)-failed)
+	return failed, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// At the end of every run, such as a sync, restore or repair, chasm prints
+// what it did: the files examined and what became of them, the bytes
+// uploaded to each store, how long it took, and the warnings printed along
+// the way, which scroll out of sight in a long run. The run_summary
+// preference, or --summary, picks the form: full by default, line for the
+// line of chasm stats, json for scripts, or off. With run_log set, every
+// summary is also appended to that file as a JSON line. A run that counted
+// errors makes chasm exit with exitRunErrors, so schedulers notice.
+
+const (
+	summaryFull = "full"
+	summaryLine = "line"
+	summaryJSON = "json"
+	summaryOff  = "off"
+)
+
+var summaryModes = []string{summaryFull, summaryLine, summaryJSON, summaryOff}
+
+// exit status once a run counted errors
+const exitRunErrors = 1
+
+// warnings listed in a full summary, the others are only counted
+const maxSummaryWarnings = 10
+
+// form of the summaries from --summary, the run_summary preference if
+// empty
+var summaryFlag string
+
+// set once a run of this process counted errors
+var runErrors bool
+
+// summaryMode is the form summaries are printed in
+func summaryMode() string {
+	mode := preferences.RunSummary
+	if summaryFlag != "" {
+		mode = summaryFlag
+	}
+	for _, m := range summaryModes {
+		if m == mode {
+			return mode
+		}
+	}
+	return summaryFull
+}
+
+// finishRunSummary prints the summary of a finished run, and appends it to
+// the run log
+func finishRunSummary(r RunStats) {
+	if r.Errors > 0 {
+		runErrors = true
+	}
+
+	switch summaryMode() {
+	case summaryOff:
+	case summaryLine:
+		if r.Errors > 0 {
+			color.Red("%s", r.Summary())
+		} else {
+			fmt.Println(r.Summary())
+		}
+	case summaryJSON:
+		data, err := json.Marshal(r)
+		check(err)
+		fmt.Println(string(data))
+	default:
+		for i, line := range runReport(r) {
+			switch {
+			case i > 0:
+				fmt.Println("\t" + line)
+			case r.Errors > 0:
+				color.Red("%s", line)
+			default:
+				color.Green("%s", line)
+			}
+		}
+	}
+
+	if preferences.RunLog != "" {
+		if err := appendRunLog(preferences.RunLog, r); err != nil {
+			color.Red("Error: cannot write to the run log %s: %s", preferences.RunLog, err)
+		}
+	}
+}
+
+// runReport describes a run over several lines
+func runReport(r RunStats) []string {
+	lines := []string{fmt.Sprintf("Finished %s in %v with %v errors.", r.Command, r.Duration.Round(time.Millisecond), r.Errors)}
+
+	if r.Examined > 0 {
+		lines = append(lines, fmt.Sprintf("%v files examined: %v added, %v updated, %v unchanged, %v skipped, %s in all",
+			r.Examined, r.Added, r.Updated, r.Unchanged, r.Skipped, formatBytes(r.Bytes)))
+	} else if r.Files > 0 || r.Skipped > 0 {
+		lines = append(lines, fmt.Sprintf("%v files, %s, %v skipped", r.Files, formatBytes(r.Bytes), r.Skipped))
+	}
+	if r.Partial {
+		lines = append(lines, fmt.Sprintf("Stopped at its deadline, %v files left for the next sync", r.Pending))
+	}
+
+	var shared PipelineStats
+	for _, stages := range r.Pipeline {
+		shared = shared.Add(stages)
+	}
+	stores := preferences.cloudStores()
+	for i, stored := range shared.Stored {
+		store := fmt.Sprintf("store %v", i+1)
+		if i < len(stores) {
+			store += " (" + stores[i].ShortDescription() + ")"
+		}
+		lines = append(lines, fmt.Sprintf("%s uploaded to %s", formatBytes(stored), store))
+	}
+
+	if r.Warnings > 0 {
+		lines = append(lines, fmt.Sprintf("%v warnings:", r.Warnings))
+		for i, warning := range r.warnings {
+			if i == maxSummaryWarnings {
+				lines = append(lines, fmt.Sprintf("- and %v more", r.Warnings-maxSummaryWarnings))
+				break
+			}
+			lines = append(lines, "- "+strings.TrimPrefix(warning, "Warning: "))
+		}
+	}
+	return lines
+}
+
+// appendRunLog appends r to logPath as a JSON line
+func appendRunLog(logPath string, r RunStats) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
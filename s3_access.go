@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 server access logging delivers the requests to a bucket, every few
+// hours, as log objects in another bucket. The bucket's logging
+// configuration names that bucket and the key prefix of its logs, unless
+// the store names them itself. Log objects are named after their delivery
+// time, so those delivered before the time checked from are skipped:
+//
+//	logs/2024-05-01-10-20-31-0123456789ABCDEF
+//	logs/123456789012/eu-west-1/bucket/2024/05/01/2024-05-01-10-20-31-0123456789ABCDEF
+//
+// Each line of a log is one request, with space separated fields, some in
+// brackets or quotes. The ones read are the bucket, time, remote IP,
+// operation and key:
+//
+//	owner bucket [01/May/2024:10:04:12 +0000] 192.0.2.3 requester id REST.GET.OBJECT vault/key "GET /vault/key HTTP/1.1" 200 ...
+
+const (
+	// time at the start of the names of log objects
+	s3LogNameTime = "2006-01-02-15-04-05"
+
+	// time of a request in a log
+	s3LogTime = "02/Jan/2006:15:04:05 -0700"
+)
+
+// s3LoggingStatus is the logging configuration of a bucket
+type s3LoggingStatus struct {
+	LoggingEnabled *struct {
+		TargetBucket string `xml:"TargetBucket"`
+		TargetPrefix string `xml:"TargetPrefix"`
+	} `xml:"LoggingEnabled"`
+}
+
+// accessLogs is the bucket and key prefix the bucket's access logs are
+// delivered to
+func (s S3Store) accessLogs() (string, string, error) {
+	if s.AccessLogs != "" {
+		parts := strings.SplitN(s.AccessLogs, "/", 2)
+		if len(parts) == 1 {
+			return parts[0], "", nil
+		}
+		return parts[0], parts[1], nil
+	}
+
+	data, err := s.do("GET", "", url.Values{"logging": {""}}, nil, nil)
+	if err != nil {
+		return "", "", err
+	}
+	var status s3LoggingStatus
+	if err := xml.Unmarshal(data, &status); err != nil {
+		return "", "", err
+	}
+	if status.LoggingEnabled == nil || status.LoggingEnabled.TargetBucket == "" {
+		return "", "", errors.New("server access logging is off for the bucket")
+	}
+	return status.LoggingEnabled.TargetBucket, status.LoggingEnabled.TargetPrefix, nil
+}
+
+// AccessLog reads the bucket's server access logs for requests to our
+// objects since a time, oldest first
+func (s S3Store) AccessLog(since time.Time) ([]StoreAccess, error) {
+	bucket, prefix, err := s.accessLogs()
+	if err != nil {
+		return nil, err
+	}
+
+	// the logs bucket is reached like the store's own
+	logs := S3Store{Bucket: bucket, Region: s.Region, Endpoint: s.Endpoint, PathStyle: s.PathStyle, Profile: s.Profile}
+	keys, err := logs.listKeys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	accesses := []StoreAccess{}
+	for _, key := range keys {
+		name := path.Base(key)
+		if len(name) < len(s3LogNameTime) {
+			continue
+		}
+		delivered, err := time.Parse(s3LogNameTime, name[:len(s3LogNameTime)])
+		if err != nil || delivered.Before(since) {
+			continue
+		}
+
+		data, err := logs.do("GET", key, nil, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if access, ok := s.parseAccess(line); ok && !access.Time.Before(since) {
+				accesses = append(accesses, access)
+			}
+		}
+	}
+
+	sort.Slice(accesses, func(i, j int) bool { return accesses[i].Time.Before(accesses[j].Time) })
+	return accesses, nil
+}
+
+// parseAccess reads a request to one of our objects from a line of an
+// access log
+func (s S3Store) parseAccess(line string) (StoreAccess, bool) {
+	fields := s3LogFields(line)
+	if len(fields) < 8 || fields[1] != s.Bucket {
+		return StoreAccess{}, false
+	}
+
+	// e.g. REST.GET.OBJECT, requests not for an object have no key
+	operation := strings.Split(fields[6], ".")
+	if len(operation) != 3 || operation[0] != "REST" || operation[2] != "OBJECT" {
+		return StoreAccess{}, false
+	}
+	key, err := url.PathUnescape(fields[7])
+	if err != nil {
+		key = fields[7]
+	}
+	prefix := s.key("")
+	object := strings.TrimPrefix(key, prefix)
+	if !strings.HasPrefix(key, prefix) || object == "" || strings.Contains(object, "/") {
+		return StoreAccess{}, false
+	}
+
+	at, err := time.Parse(s3LogTime, fields[2])
+	if err != nil {
+		return StoreAccess{}, false
+	}
+	return StoreAccess{Time: at.UTC(), Method: operation[1], Object: object, Remote: fields[3]}, true
+}
+
+// s3LogFields splits a line of an access log into its fields, without the
+// brackets and quotes around them
+func s3LogFields(line string) []string {
+	var fields []string
+	for line = strings.TrimLeft(line, " "); line != ""; line = strings.TrimLeft(line, " ") {
+		end := " "
+		switch line[0] {
+		case '[':
+			end, line = "]", line[1:]
+		case '"':
+			end, line = "\"", line[1:]
+		}
+		i := strings.Index(line, end)
+		if i < 0 {
+			fields = append(fields, line)
+			break
+		}
+		fields = append(fields, line[:i])
+		line = line[i+1:]
+	}
+	return fields
+}
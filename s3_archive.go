@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+	"github.com/fatih/color"
+)
+
+// An S3 store can upload shares in a cheaper storage class. STANDARD_IA,
+// GLACIER_IR and the others are read like STANDARD, but objects of the
+// archive classes GLACIER and DEEP_ARCHIVE cannot be read until they are
+// thawed: a restore request makes a temporary copy readable after hours,
+// 3-5 for GLACIER and up to 12 for DEEP_ARCHIVE with the Standard tier.
+// `chasm thaw` asks for that copy of the current objects of every archive
+// store, and run again tells how many are ready. A vault with enough shares
+// on other stores restores without waiting, as archived shares are only
+// missing ones. Manifests are always uploaded in the bucket's default
+// class, so a vault can be found and listed without thawing. Archived
+// objects are billed for 90 or 180 days even if compaction removes them
+// sooner.
+
+var s3StorageClasses = []string{"STANDARD", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER_IR", "GLACIER", "DEEP_ARCHIVE"}
+
+// classes whose objects must be thawed to be read
+var s3ArchiveClasses = map[string]bool{"GLACIER": true, "DEEP_ARCHIVE": true}
+
+// retrieval tiers of a thaw, from the default
+var s3ThawTiers = []string{"Standard", "Bulk", "Expedited"}
+
+// days a thawed copy stays readable by default
+const defaultThawDays = 7
+
+// errArchived is returned for reads of objects not thawed
+var errArchived = errors.New("archived, thaw it first with chasm thaw")
+
+// ThawResult counts the objects of an archive store by what chasm thaw
+// found or did
+type ThawResult struct {
+	Store string
+
+	// thaws asked for now, thaws asked for earlier and not done, and
+	// objects readable
+	Requested int
+	Thawing   int
+	Ready     int
+	Failed    int
+}
+
+// Waiting tells if objects of the store are not readable yet
+func (r ThawResult) Waiting() bool {
+	return r.Requested > 0 || r.Thawing > 0
+}
+
+func validS3StorageClass(class string) bool {
+	for _, c := range s3StorageClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// archived tells if the store's shares must be thawed to be read
+func (s S3Store) archived() bool {
+	return s3ArchiveClasses[s.StorageClass]
+}
+
+// storageClass is the class share is uploaded in, "" for the bucket's
+// default. Manifests stay readable at once
+func (s S3Store) storageClass(share Share) string {
+	if share.SID == ShareID(chasmPrefFile) || share.SID == ShareID(chasmDeltaSID) {
+		return ""
+	}
+	return s.StorageClass
+}
+
+// archivedError is errArchived for an error reading an object not thawed
+func (s S3Store) archivedError(err error) error {
+	if err != nil && strings.Contains(err.Error(), "InvalidObjectState") {
+		return fmt.Errorf("%s in %s: %w", s.StorageClass, s.location(), errArchived)
+	}
+	return err
+}
+
+// thawState finds if the object named name is archived, being thawed or
+// readable
+func (s S3Store) thawState(name string) (archived, thawing bool, err error) {
+	_, header, err := s.request("HEAD", s.key(name), nil, nil, s.readHeader())
+	if err != nil {
+		return false, false, err
+	}
+	if !s3ArchiveClasses[header.Get("X-Amz-Storage-Class")] {
+		return false, false, nil
+	}
+
+	// ongoing-request="false" once the copy is readable, no header if no
+	// thaw was asked for
+	restore := header.Get("X-Amz-Restore")
+	if strings.Contains(restore, `ongoing-request="false"`) {
+		return false, false, nil
+	}
+	return true, restore != "", nil
+}
+
+// thaw asks for a copy of the object named name, readable for days
+func (s S3Store) thaw(name string, days int, tier string) error {
+	body := fmt.Sprintf(`<RestoreRequest xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Days>%d</Days><GlacierJobParameters><Tier>%s</Tier></GlacierJobParameters></RestoreRequest>`, days, tier)
+	header := http.Header{"Content-Type": {"application/xml"}}
+	_, err := s.do("POST", s.key(name), url.Values{"restore": {""}}, []byte(body), header)
+	return err
+}
+
+// Thaw asks every archive store for copies of the current objects of the
+// vault readable for days, or of all its objects if all is set or the
+// vault tracks no files yet, as before a restore
+func Thaw(days int, tier string, all bool) []ThawResult {
+	var wanted map[string]bool
+	if !all && len(preferences.FileMap) > 0 {
+		objects, _ := verifiedObjects()
+		wanted = make(map[string]bool)
+		for _, object := range objects {
+			wanted[object] = true
+		}
+	}
+
+	var results []ThawResult
+	for _, s := range preferences.S3Stores {
+		if !s.archived() {
+			continue
+		}
+		result := ThawResult{Store: s.ShortDescription()}
+		if tier == "Expedited" && s.StorageClass == "DEEP_ARCHIVE" {
+			color.Red("Error: %s cannot be thawed with the Expedited tier.", s.location())
+			result.Failed++
+			results = append(results, result)
+			continue
+		}
+
+		names, err := s.list()
+		if err != nil {
+			color.Red("Error listing %s: %s", s.location(), err)
+			result.Failed++
+			results = append(results, result)
+			continue
+		}
+		for _, name := range names {
+			object := name
+			if whole, _, _, ok := recovery.ParsePartName(name); ok {
+				object = whole
+			}
+			if wanted != nil && !wanted[object] {
+				continue
+			}
+
+			archived, thawing, err := s.thawState(name)
+			switch {
+			case err != nil:
+				color.Red("Error: cannot check %s in %s: %s", name, s.location(), err)
+				result.Failed++
+				countError()
+			case thawing:
+				result.Thawing++
+			case !archived:
+				result.Ready++
+			default:
+				err := s.thaw(name, days, tier)
+				switch {
+				case err != nil && strings.Contains(err.Error(), "RestoreAlreadyInProgress"):
+					result.Thawing++
+				case err != nil:
+					color.Red("Error: cannot thaw %s in %s: %s", name, s.location(), err)
+					result.Failed++
+					countError()
+				default:
+					result.Requested++
+				}
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// S3Store keeps shares as objects in an S3 bucket, under an optional key
+// prefix. Requests are signed with credentials from the standard AWS
+// credential chain, see aws.go. Besides AWS, the bucket can be on any
+// S3-compatible service, such as MinIO, Wasabi or DigitalOcean Spaces,
+// given its endpoint
+type S3Store struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix,omitempty"`
+	Region string `json:"region"`
+
+	// base URL of an S3-compatible service, AWS if empty
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// address the bucket in the path rather than the host name, as MinIO
+	// and most self-hosted services need
+	PathStyle bool `json:"path_style,omitempty"`
+
+	// profile in the shared credentials file, AWS_PROFILE or default if empty
+	Profile string `json:"profile,omitempty"`
+
+	// provider-side encryption of every upload
+	SSE *ServerSideEncryption `json:"sse,omitempty"`
+
+	// storage class of uploaded shares, the bucket's default if empty. See
+	// s3_archive.go for the archive classes
+	StorageClass string `json:"storage_class,omitempty"`
+
+	// bucket/prefix the bucket's server access logs are delivered to, from
+	// its logging configuration if empty. See s3_access.go
+	AccessLogs string `json:"access_logs,omitempty"`
+}
+
+// credentials are kept in the local state, see credentials.go. The AWS
+// credentials themselves come from the credential chain
+func (s *S3Store) credentials() map[string]*string {
+	if s.SSE == nil || s.SSE.Mode != sseCustomer {
+		return map[string]*string{}
+	}
+	return map[string]*string{"sse_customer_key": &s.SSE.CustomerKey}
+}
+
+// largest single PUT S3 takes
+const s3MaxObjectSize = 5 << 30
+
+// Setup checks that the bucket can be listed with the credentials found
+func (s S3Store) Setup() bool {
+	for _, ss := range preferences.S3Stores {
+		if ss.Endpoint == s.Endpoint && ss.Bucket == s.Bucket && ss.Prefix == s.Prefix {
+			color.Red("S3 store at %s already exists.", s.location())
+			return false
+		}
+	}
+
+	if _, err := s.list(); err != nil {
+		color.Red("Error: cannot list %s: %s", s.location(), err)
+		return false
+	}
+	return true
+}
+
+// location is the s3:// URL of the store, or the URL of its bucket on an
+// S3-compatible service
+func (s S3Store) location() string {
+	if s.Endpoint != "" {
+		return s.Endpoint + "/" + path.Join(s.Bucket, s.Prefix)
+	}
+	return "s3://" + path.Join(s.Bucket, s.Prefix)
+}
+
+// endpoint is the bucket's base URL and the path of key in it. Buckets
+// with dots in their names are addressed by path, so TLS names match
+func (s S3Store) endpoint(key string) (string, string) {
+	scheme, host := "https://", "s3."+s.Region+".amazonaws.com"
+	if s.Endpoint != "" {
+		u, err := url.Parse(s.Endpoint)
+		if err == nil && u.Host != "" {
+			scheme, host = u.Scheme+"://", u.Host
+		}
+	}
+	if s.PathStyle || strings.Contains(s.Bucket, ".") {
+		return scheme + host, "/" + s.Bucket + "/" + key
+	}
+	return scheme + s.Bucket + "." + host, "/" + key
+}
+
+func (s S3Store) key(object string) string {
+	if s.Prefix == "" {
+		return object
+	}
+	return strings.TrimSuffix(s.Prefix, "/") + "/" + object
+}
+
+// do sends a signed request for key, returning the response body
+func (s S3Store) do(method, key string, query url.Values, body []byte, header http.Header) ([]byte, error) {
+	data, _, err := s.request(method, key, query, body, header)
+	return data, err
+}
+
+// request sends a signed request for key, returning the response body and
+// header
+func (s S3Store) request(method, key string, query url.Values, body []byte, header http.Header) ([]byte, http.Header, error) {
+	creds, err := loadAWSCredentials(s.Profile)
+	if err != nil {
+		return nil, nil, err
+	}
+	base, keyPath := s.endpoint(key)
+	u, err := awsEscapedURL(base, keyPath, query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signAWS(req, body, creds, s.Region, "s3")
+
+	resp, err := storeHTTPClient().Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, resp.Header, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, resp.Header, nil
+}
+
+// Upload writes the share as a new object, refusing to overwrite one
+func (s S3Store) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading %s/%s...", s.location(), share.ObjectName()))
+
+	sum := sha256.Sum256(share.Data)
+	header := http.Header{
+		"If-None-Match":         {"*"},
+		"X-Amz-Checksum-Sha256": {base64.StdEncoding.EncodeToString(sum[:])},
+	}
+	if s.SSE != nil {
+		for name, values := range s.SSE.S3UploadHeaders() {
+			header[name] = values
+		}
+	}
+	if class := s.storageClass(share); class != "" {
+		header.Set("X-Amz-Storage-Class", class)
+	}
+	if _, err := s.do("PUT", s.key(share.ObjectName()), nil, share.Data, header); err != nil {
+		color.Red("%s/%s upload failed: %v", s.location(), share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// Remove permanently deletes a single object
+func (s S3Store) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting %s/%s...", s.location(), object))
+	if _, err := s.do("DELETE", s.key(object), nil, nil, nil); err != nil {
+		color.Red("Error: could not delete %s from %s: %s", object, s.location(), err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list returns the names of all objects under the prefix
+func (s S3Store) list() ([]string, error) {
+	prefix := s.key("")
+	keys, err := s.listKeys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []string
+	for _, key := range keys {
+		// objects in sub-prefixes are not ours
+		if object := strings.TrimPrefix(key, prefix); !strings.Contains(object, "/") {
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
+// listKeys returns the keys of all objects starting with prefix
+func (s S3Store) listKeys(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		data, err := s.do("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return nil, err
+		}
+		for _, content := range result.Contents {
+			keys = append(keys, content.Key)
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// List returns the names of all objects under the prefix
+func (s S3Store) List() []string {
+	objects, err := s.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", s.location(), err)
+		return nil
+	}
+	return objects
+}
+
+func (s S3Store) readHeader() http.Header {
+	if s.SSE == nil {
+		return nil
+	}
+	return s.SSE.S3ReadHeaders()
+}
+
+// Read downloads a single object
+func (s S3Store) Read(object string) ([]byte, error) {
+	data, err := s.do("GET", s.key(object), nil, nil, s.readHeader())
+	return data, s.archivedError(err)
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (s S3Store) ReadRange(object string, offset, length int64) ([]byte, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	for name, values := range s.readHeader() {
+		header[name] = values
+	}
+	data, err := s.do("GET", s.key(object), nil, nil, header)
+	return data, s.archivedError(err)
+}
+
+// Restore downloads shares to local restore path
+func (s S3Store) Restore() string {
+	objects, err := s.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", s.location(), err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_s3_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from %s...", s.location())
+	archived := 0
+	for _, object := range objects {
+		data, err := s.Read(object)
+		if errors.Is(err, errArchived) {
+			archived++
+			continue
+		}
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+	if archived > 0 {
+		color.Yellow("%v shares in %s are archived in %s. Thaw them with chasm thaw, and restore again once they are ready.", archived, s.location(), s.StorageClass)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects under the prefix
+func (s S3Store) Description() string {
+	objects, err := s.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", s.ShortDescription(), err)
+	}
+
+	label := s.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (s S3Store) ShortDescription() string {
+	return "S3 Store: " + s.location()
+}
+
+// Clean deletes all shares under the prefix
+func (s S3Store) Clean() {
+	for _, object := range s.List() {
+		color.Yellow("Removing S3 Store: %v", object)
+		s.do("DELETE", s.key(object), nil, nil, nil)
+	}
+}
+
+// MaxObjectSize of a single PUT
+func (s S3Store) MaxObjectSize() int64 {
+	return s3MaxObjectSize
+}
+
+// ServerSideEncryption is the encryption asked of S3 on upload
+func (s *S3Store) ServerSideEncryption() *ServerSideEncryption {
+	return s.SSE
+}
+
+// SetServerSideEncryption asks S3 to encrypt new uploads with sse
+func (s *S3Store) SetServerSideEncryption(sse *ServerSideEncryption) {
+	s.SSE = sse
+}
+
+// defaultAWSRegion is the region from the environment, us-east-1 if unset
+func defaultAWSRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	if region := os.Getenv("AWS_DEFAULT_REGION"); region != "" {
+		return region
+	}
+	return "us-east-1"
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheLisztomaniac/chasmOriginal/storesim"
+)
+
+// testS3Store is an S3 store in bucket of an emulated object store
+func testS3Store(t *testing.T, prefix string) (S3Store, *storesim.Server) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	sim := storesim.NewServer()
+	server := httptest.NewServer(sim)
+	t.Cleanup(server.Close)
+	return S3Store{Bucket: "bucket", Prefix: prefix, Region: "us-east-1", Endpoint: server.URL, PathStyle: true}, sim
+}
+
+func TestS3StoreObjects(t *testing.T) {
+	s, sim := testS3Store(t, "vault")
+
+	shares := []Share{
+		{SID: RandomShareID(), Version: NewShareVersion(), Data: []byte("first share")},
+		{SID: RandomShareID(), Version: NewShareVersion(), Data: []byte("second share")},
+	}
+	for _, share := range shares {
+		s.Upload(share)
+	}
+
+	// objects under another prefix are not the store's
+	other := s
+	other.Prefix = "other"
+	other.Upload(Share{SID: RandomShareID(), Data: []byte("elsewhere")})
+
+	want := []string{shares[0].ObjectName(), shares[1].ObjectName()}
+	sort.Strings(want)
+	got := s.List()
+	sort.Strings(got)
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("listed %v, want %v", got, want)
+	}
+
+	data, err := s.Read(shares[0].ObjectName())
+	if err != nil || !bytes.Equal(data, shares[0].Data) {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	data, err = s.ReadRange(shares[1].ObjectName(), 7, 5)
+	if err != nil || string(data) != "share" {
+		t.Fatalf("read range %q, %v", data, err)
+	}
+
+	// uploads never overwrite an object
+	s.Upload(Share{SID: shares[0].SID, Version: shares[0].Version, Data: []byte("overwritten")})
+	if object := sim.Objects("bucket")["vault/"+shares[0].ObjectName()]; !bytes.Equal(object.Data, shares[0].Data) {
+		t.Fatalf("upload overwrote %s with %q", shares[0].ObjectName(), object.Data)
+	}
+
+	s.Remove(shares[0].ObjectName())
+	if _, err := s.Read(shares[0].ObjectName()); err == nil {
+		t.Fatal("removed object still readable")
+	}
+	if got := s.List(); len(got) != 1 || got[0] != shares[1].ObjectName() {
+		t.Fatalf("listed %v after remove", got)
+	}
+}
+
+func TestS3StoreRestore(t *testing.T) {
+	s, _ := testS3Store(t, "")
+	share := Share{SID: RandomShareID(), Version: NewShareVersion(), Data: []byte("restored share")}
+	s.Upload(share)
+
+	restoreDir := s.Restore()
+	if restoreDir == "" {
+		t.Fatal("restore failed")
+	}
+	defer os.RemoveAll(restoreDir)
+
+	data, err := readStagedObject(restoreDir, share.ObjectName())
+	if err != nil || !bytes.Equal(data, share.Data) {
+		t.Fatalf("staged %q, %v", data, err)
+	}
+}
+
+func TestS3StoreCustomerKey(t *testing.T) {
+	s, sim := testS3Store(t, "")
+	key := make([]byte, 32)
+	rand.Read(key)
+	s.SSE = &ServerSideEncryption{Mode: sseCustomer, CustomerKey: base64.StdEncoding.EncodeToString(key)}
+
+	share := Share{SID: RandomShareID(), Data: []byte("encrypted share")}
+	s.Upload(share)
+	if object := sim.Objects("bucket")[share.ObjectName()]; object.SSE == nil {
+		t.Fatal("upload did not ask for encryption")
+	}
+
+	if data, err := s.Read(share.ObjectName()); err != nil || !bytes.Equal(data, share.Data) {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	withoutKey := s
+	withoutKey.SSE = nil
+	if _, err := withoutKey.Read(share.ObjectName()); err == nil {
+		t.Fatal("read without the customer key")
+	}
+}
+
+func TestS3StoreAccessLog(t *testing.T) {
+	s, _ := testS3Store(t, "vault")
+	s.AccessLogs = "logs/s3/"
+	logs := S3Store{Bucket: "logs", Region: s.Region, Endpoint: s.Endpoint, PathStyle: true}
+
+	line := func(bucket, at, operation, key string) string {
+		return "owner " + bucket + " [" + at + "] 192.0.2.3 arn:aws:iam::1:user/someone REQID " + operation + " " + key + ` "GET /x HTTP/1.1" 200 - 10 10 5 4 "-" "curl/8.0" - hostid SigV4 ECDHE-RSA-AES128-GCM-SHA256 AuthHeader bucket.s3.amazonaws.com TLSv1.2 - -`
+	}
+	delivered := strings.Join([]string{
+		line("bucket", "01/May/2024:10:04:12 +0000", "REST.GET.OBJECT", "vault/share1"),
+		line("bucket", "01/May/2024:10:05:00 +0000", "REST.PUT.OBJECT", "vault/share%2B2"),
+		line("bucket", "01/May/2024:10:06:00 +0000", "REST.GET.BUCKET", "-"),
+		line("bucket", "01/May/2024:10:07:00 +0000", "REST.GET.OBJECT", "other/share3"),
+		line("another", "01/May/2024:10:08:00 +0000", "REST.GET.OBJECT", "vault/share4"),
+		line("bucket", "30/Apr/2024:23:59:00 +0000", "REST.GET.OBJECT", "vault/share5"),
+		"",
+	}, "\n")
+	if _, err := logs.do("PUT", "s3/2024-05-01-11-00-00-ABCDEF", nil, []byte(delivered), nil); err != nil {
+		t.Fatal(err)
+	}
+	old := line("bucket", "30/Apr/2024:09:00:00 +0000", "REST.GET.OBJECT", "vault/share6")
+	if _, err := logs.do("PUT", "s3/2024-04-30-10-00-00-ABCDEF", nil, []byte(old), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	accesses, err := s.AccessLog(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []StoreAccess{
+		{Time: time.Date(2024, 5, 1, 10, 4, 12, 0, time.UTC), Method: "GET", Object: "share1", Remote: "192.0.2.3"},
+		{Time: time.Date(2024, 5, 1, 10, 5, 0, 0, time.UTC), Method: "PUT", Object: "share+2", Remote: "192.0.2.3"},
+	}
+	if len(accesses) != len(want) {
+		t.Fatalf("read %+v, want %+v", accesses, want)
+	}
+	for i := range want {
+		if !accesses[i].Time.Equal(want[i].Time) || accesses[i].Method != want[i].Method || accesses[i].Object != want[i].Object || accesses[i].Remote != want[i].Remote {
+			t.Errorf("access %d is %+v, want %+v", i, accesses[i], want[i])
+		}
+	}
+}
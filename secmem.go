@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/fatih/color"
+)
+
+// Plaintext and key material are wiped once used, so they do not linger in
+// the heap for a core dump or a later allocation to expose. Buffers that are
+// reused for every chunk of a large file are also locked into RAM where the
+// platform allows, keeping them out of swap. Locking is best effort: it is
+// limited by RLIMIT_MEMLOCK, and whole files read into memory are wiped but
+// not locked.
+
+// wipe zeroes a buffer that held plaintext or key material
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// wipeAll zeroes every buffer
+func wipeAll(bs [][]byte) {
+	for _, b := range bs {
+		wipe(b)
+	}
+}
+
+// lockedBuffer allocates a buffer locked into RAM if possible. release wipes
+// and unlocks it
+func lockedBuffer(size int) (buf []byte, release func()) {
+	buf = make([]byte, size)
+	locked := size > 0 && lockMemory(buf)
+	return buf, func() {
+		wipe(buf)
+		if locked {
+			unlockMemory(buf)
+		}
+	}
+}
+
+// readSecretFile reads a key from path, or from stdin for "-", so that it
+// never appears in the process arguments or environment
+func readSecretFile(path string) ([]byte, error) {
+	var secret []byte
+	var err error
+	if path == "-" {
+		secret, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		secret, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(secret), nil
+}
+
+// passphrase file from --passphrase-file, the terminal is asked if empty
+var passphraseFile string
+
+// readPassphrase reads a passphrase from --passphrase-file, or asks for it
+// on the terminal without echoing it
+func readPassphrase(prompt string) ([]byte, error) {
+	if passphraseFile != "" {
+		passphrase, err := readSecretFile(passphraseFile)
+		if err == nil && len(passphrase) == 0 {
+			err = errors.New("empty passphrase")
+		}
+		return passphrase, err
+	}
+
+	color.Cyan(prompt)
+	if restore, ok := disableEcho(os.Stdin.Fd()); ok {
+		defer fmt.Println()
+		defer restore()
+	}
+
+	// read a byte at a time, so no buffer is left holding the rest
+	var passphrase []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 1 && b[0] != '\n' {
+			grown := append(passphrase, b[0])
+			if cap(grown) != cap(passphrase) {
+				wipe(passphrase[:cap(passphrase)])
+			}
+			passphrase = grown
+			continue
+		}
+		if err != nil && err != io.EOF {
+			wipe(passphrase)
+			return nil, err
+		}
+		if n == 1 || err == io.EOF {
+			break
+		}
+	}
+	wipe(b)
+
+	passphrase = bytes.TrimRight(passphrase, "\r")
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return passphrase, nil
+}
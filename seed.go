@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+	"github.com/fatih/color"
+)
+
+// A large initial backup can travel by disk instead of over the network.
+// `chasm seed --store N --to DIR` makes DIR, typically on a removable drive,
+// take the place of store N on this machine: the shares of every file are
+// written there at once, as are the shares of everything added or synced
+// until the seeding ends. The drive is then bulk-loaded into the provider,
+// or mailed to the friend running the peer store, and
+// `chasm seed --store N --reconcile` compares the store with the drive,
+// uploading whatever did not arrive and replacing whatever arrived damaged,
+// before the store is used again. Objects are named as on the store, split
+// at its object size limit, so they can be copied in as they are.
+
+// SeedResult counts what reconciling a store with its seed directory found
+type SeedResult struct {
+	Store string
+
+	// objects the store held as in the seed directory
+	Verified int
+
+	// objects the store was missing or held damaged, and were uploaded
+	Uploaded int
+	Replaced int
+
+	Failed int
+}
+
+// seedStore is the folder taking the place of a store being seeded, nil if
+// the store is not being seeded
+func seedStore(cs CloudStore) *FolderStore {
+	dir, ok := state.Seeding[cs.ShortDescription()]
+	if !ok {
+		return nil
+	}
+	seed := FolderStore{Path: dir}
+	if limited, ok := cs.(objectSizeLimited); ok {
+		seed.MaxObjectBytes = limited.MaxObjectSize()
+	}
+	return &seed
+}
+
+// StartSeed writes the shares of the store at index to dir from now on, and
+// writes the shares of every file there
+func StartSeed(index int, dir string) (RepairResult, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return RepairResult{}, err
+	}
+	if !fi.IsDir() {
+		return RepairResult{}, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	if state.Seeding == nil {
+		state.Seeding = make(map[string]string)
+	}
+	state.Seeding[preferences.primaryStores()[index].ShortDescription()] = dir
+	state.Save()
+
+	// the seed directory is empty, so every share is written
+	return Repair(index), nil
+}
+
+// ReconcileSeed checks the store at index against its seed directory,
+// uploading the objects it lacks or holds damaged, and ends the seeding once
+// the store holds all of them
+func ReconcileSeed(index int) SeedResult {
+	remote := preferences.primaryStores()[index]
+	result := SeedResult{Store: remote.ShortDescription()}
+	seed := seedStore(remote)
+	if seed == nil {
+		color.Red("%s is not being seeded", result.Store)
+		result.Failed++
+		return result
+	}
+
+	seedNames := seed.List()
+	sort.Strings(seedNames)
+	taskTotal(len(seedNames))
+	stored := make(map[string]bool)
+	for _, name := range remote.List() {
+		stored[name] = true
+	}
+	reader, canRead := storeRef(index + 1).(objectReader)
+
+	var uploaded []string
+	for _, name := range seedNames {
+		if taskCanceled() {
+			result.Failed++
+			return result
+		}
+		data, err := seed.Read(name)
+		if err != nil {
+			color.Red("Cannot read %s from the seed directory: %s", name, err)
+			result.Failed++
+			countError()
+			continue
+		}
+
+		if stored[name] {
+			if !canRead {
+				result.Verified++
+				countFile(int64(len(data)), true)
+				wipe(data)
+				continue
+			}
+			remoteData, err := reader.Read(name)
+			same := err == nil && bytes.Equal(remoteData, data)
+			wipe(remoteData)
+			if same {
+				result.Verified++
+				countFile(int64(len(data)), true)
+				wipe(data)
+				continue
+			}
+			color.Yellow("%s: %s differs from the seed directory, replacing it", result.Store, name)
+			remote.Remove(name)
+			result.Replaced++
+		} else {
+			result.Uploaded++
+		}
+
+		remote.Upload(seedShare(name, data))
+		uploaded = append(uploaded, name)
+		countFile(int64(len(data)), false)
+		wipe(data)
+	}
+
+	// uploads report no errors, so the store is listed again
+	if len(uploaded) > 0 {
+		stored = make(map[string]bool)
+		for _, name := range remote.List() {
+			stored[name] = true
+		}
+		for _, name := range uploaded {
+			if !stored[name] {
+				result.Failed++
+			}
+		}
+	}
+
+	if result.Failed == 0 && !taskCanceled() {
+		delete(state.Seeding, result.Store)
+		state.Save()
+	}
+	return result
+}
+
+// seedShare is the share stored as name, which may be a part
+func seedShare(name string, data []byte) Share {
+	var share Share
+	object := name
+	if whole, i, n, ok := recovery.ParsePartName(name); ok {
+		object, share.Part, share.Parts = whole, i, n
+	}
+	share.SID, share.Version, share.Tombstone = ParseObjectName(object)
+	share.Data = data
+	return share
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/fatih/color"
+)
+
+/// Daemon API ///
+
+// StatusResponse is returned by GET /api/status
+type StatusResponse struct {
+	Root        string   `json:"root"`
+	Stores      []string `json:"stores"`
+	Files       int      `json:"files"`
+	NeedsSetup  bool     `json:"needs_setup"`
+	LastRunTime string   `json:"last_run,omitempty"`
+}
+
+// StartAPI serves the daemon API on addr in the background, over TLS if a
+// certificate and key are given, wanting client certificates signed by the
+// CAs in clientCAFile if given
+func StartAPI(addr, certFile, keyFile, clientCAFile string) {
+	apiToken()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/status", requireScope(scopeStatus, apiStatus))
+	mux.HandleFunc("/api/stats", requireScope(scopeStatus, apiStats))
+	mux.HandleFunc("/api/replica/manifest", requireScope(scopeFull, apiReplicaManifest))
+	mux.HandleFunc("/api/replica/file", requireScope(scopeFull, apiReplicaFile))
+	mux.HandleFunc("/api/peer/objects/", apiPeerObjects)
+	mux.HandleFunc("/api/peer/access", apiPeerAccess)
+	mux.HandleFunc("/api/peer/prove/", apiPeerProve)
+	mux.HandleFunc("/api/tasks", checkScope(scopeStatus, apiTasks))
+	mux.HandleFunc("/api/tasks/", checkScope(scopeStatus, apiTasks))
+	mux.HandleFunc("/api/dashboard", requireScope(scopeStatus, apiDashboard))
+	mux.HandleFunc("/api/files", requireScope(scopeRestore, apiFiles))
+	mux.HandleFunc("/api/files/download", requireScope(scopeRestore, apiFileDownload))
+	mux.HandleFunc("/api/tree", requireScope(scopeRestore, apiTree))
+	mux.HandleFunc("/api/reload", checkScope(scopeFull, apiReload))
+	mux.HandleFunc("/", serveDashboard)
+
+	if clientCAFile != "" && certFile == "" {
+		color.Red("Error: daemon API needs --tls-cert to ask for client certificates")
+		return
+	}
+	tlsConfig, err := apiTLSConfig(clientCAFile)
+	if err != nil {
+		color.Red("Error: cannot read client CAs: %s", err)
+		return
+	}
+
+	listener, err := apiListener(addr)
+	if err != nil {
+		color.Red("Error: daemon API cannot listen on %s: %s", addr, err)
+		return
+	}
+	go func() {
+		var err error
+		if certFile != "" {
+			server := &http.Server{Handler: mux, TLSConfig: tlsConfig}
+			err = server.ServeTLS(listener, certFile, keyFile)
+		} else {
+			err = http.Serve(listener, mux)
+		}
+		if err != nil {
+			color.Red("Error: daemon API stopped: %s", err)
+		}
+	}()
+
+	// the token is never printed, logs of the daemon are kept and shared
+	// more widely than the token should be, the system service's by every
+	// vault
+	color.Green("Daemon API and dashboard listening on %s", listener.Addr())
+	if tenantDaemon {
+		color.Cyan("API token: run chasm token as the vault's owner")
+	} else {
+		color.Cyan("API token: run chasm token")
+	}
+}
+
+// apiToken returns the API token, creating it the first time
+func apiToken() string {
+	if state.APIToken == "" {
+		state.APIToken = string(RandomShareID())
+		state.Save()
+	}
+	return state.APIToken
+}
+
+// apiReload serves POST /api/reload, reloading the configuration once the
+// change in progress is done
+func apiReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	requestReload()
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, map[string]string{"status": "reload queued"})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		color.Red("Error: could not write API response: %s", err)
+	}
+}
+
+func apiStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, currentStatus())
+}
+
+// currentStatus summarizes the chasm setup
+func currentStatus() StatusResponse {
+	status := StatusResponse{
+		Root:       preferences.root,
+		Files:      len(preferences.FileMap),
+		NeedsSetup: preferences.NeedSetup(),
+	}
+	for _, cs := range preferences.AllCloudStores() {
+		status.Stores = append(status.Stores, cs.ShortDescription())
+	}
+	if len(state.Runs) > 0 {
+		status.LastRunTime = state.Runs[len(state.Runs)-1].Start.Format(http.TimeFormat)
+	}
+
+	return status
+}
+
+// apiStats returns the run history, or only the last run unless ?history is set
+func apiStats(w http.ResponseWriter, r *http.Request) {
+	runs := state.Runs
+	if _, ok := r.URL.Query()["history"]; !ok && len(runs) > 0 {
+		runs = runs[len(runs)-1:]
+	}
+
+	writeJSON(w, runs)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPStore keeps shares in a directory of a remote host, such as a NAS or a
+// VPS, over SSH. It signs in with a private key file, the keys of a running
+// ssh-agent, or a password, and only talks to the host key pinned when the
+// store was added
+type SFTPStore struct {
+	// host:port
+	Host string `json:"host"`
+	User string `json:"user"`
+	Path string `json:"path"`
+
+	// private key file on this machine, the ssh-agent's keys if empty
+	KeyFile  string `json:"key_file,omitempty"`
+	Password string `json:"-"`
+
+	// authorized_keys line of the pinned host key
+	HostKey string `json:"host_key"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (s *SFTPStore) credentials() map[string]*string {
+	return map[string]*string{"password": &s.Password}
+}
+
+// uploads are written under a temporary name, then renamed into place
+const sftpUploadSuffix = ".uploading"
+
+// connections by store, kept for the run and dropped on error
+var (
+	sftpClientsLock sync.Mutex
+	sftpClients     = make(map[string]*sftp.Client)
+)
+
+// Setup connects to the host, pinning its host key if the known hosts file
+// does not know it and the user trusts it, and creates the share directory
+func (s *SFTPStore) Setup() bool {
+	for _, ss := range preferences.SFTPStores {
+		if ss.Host == s.Host && ss.Path == s.Path {
+			color.Red("SFTP store at %s already exists.", s.location())
+			return false
+		}
+	}
+
+	hostKey, err := s.scanHostKey()
+	if err != nil {
+		color.Red("Error: cannot reach %s: %s", s.Host, err)
+		return false
+	}
+	s.HostKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey)))
+
+	client, err := s.client()
+	if err != nil {
+		color.Red("Error: cannot connect to %s: %s", s.location(), err)
+		return false
+	}
+	if err := client.MkdirAll(s.Path); err != nil {
+		color.Red("Error: cannot create %s: %s", s.location(), err)
+		return false
+	}
+	return true
+}
+
+// scanHostKey gets the host key, checked against the known hosts file or
+// else confirmed by the user
+func (s SFTPStore) scanHostKey() (ssh.PublicKey, error) {
+	var hostKey ssh.PublicKey
+	var remoteAddr net.Addr
+	config := &ssh.ClientConfig{
+		User:    s.User,
+		Timeout: 30 * time.Second,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey, remoteAddr = key, remote
+			return errors.New("host key scanned")
+		},
+	}
+	if _, err := ssh.Dial("tcp", s.Host, config); hostKey == nil {
+		return nil, err
+	}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		if known, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts")); err == nil {
+			err := known(s.Host, remoteAddr, hostKey)
+			var keyErr *knownhosts.KeyError
+			switch {
+			case err == nil:
+				return hostKey, nil
+			case errors.As(err, &keyErr) && len(keyErr.Want) > 0:
+				return nil, errors.New("the host key does not match the known hosts file")
+			}
+		}
+	}
+
+	color.Cyan("The host key of %s is %s %s", s.Host, hostKey.Type(), ssh.FingerprintSHA256(hostKey))
+	color.Cyan("Trust it? (yes/no)")
+	var answer string
+	fmt.Scan(&answer)
+	if answer != "yes" && answer != "y" {
+		return nil, errors.New("host key not trusted")
+	}
+	return hostKey, nil
+}
+
+func (s SFTPStore) location() string {
+	return "sftp://" + s.User + "@" + s.Host + "/" + strings.TrimPrefix(s.Path, "/")
+}
+
+// auth is how the store signs in
+func (s SFTPStore) auth() ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if s.KeyFile != "" {
+		pem, err := ioutil.ReadFile(s.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			passphrase, perr := readPassphrase("Passphrase of " + s.KeyFile + ":")
+			if perr != nil {
+				return nil, perr
+			}
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, passphrase)
+			wipe(passphrase)
+		}
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	} else if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	if s.Password != "" {
+		methods = append(methods, ssh.Password(s.Password))
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("no key file, ssh-agent or password to sign in with")
+	}
+	return methods, nil
+}
+
+// client is the run's connection to the host, opened if needed
+func (s SFTPStore) client() (*sftp.Client, error) {
+	sftpClientsLock.Lock()
+	defer sftpClientsLock.Unlock()
+	if client, ok := sftpClients[s.location()]; ok {
+		return client, nil
+	}
+
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.HostKey))
+	if err != nil {
+		return nil, fmt.Errorf("bad pinned host key: %s", err)
+	}
+	auth, err := s.auth()
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{User: s.User, Auth: auth, HostKeyCallback: ssh.FixedHostKey(hostKey), Timeout: 30 * time.Second}
+	conn, err := ssh.Dial("tcp", s.Host, config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sftpClients[s.location()] = client
+	return client, nil
+}
+
+// drop closes the run's connection after an error, so the next operation
+// connects again
+func (s SFTPStore) drop() {
+	sftpClientsLock.Lock()
+	defer sftpClientsLock.Unlock()
+	if client, ok := sftpClients[s.location()]; ok {
+		client.Close()
+		delete(sftpClients, s.location())
+	}
+}
+
+// with runs op with the connection, dropping it if op fails
+func (s SFTPStore) with(op func(client *sftp.Client) error) error {
+	client, err := s.client()
+	if err != nil {
+		return err
+	}
+	if err := op(client); err != nil {
+		s.drop()
+		return err
+	}
+	return nil
+}
+
+// Upload writes the share under a temporary name and renames it into place,
+// which fails rather than replace an existing object
+func (s SFTPStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading %s/%s...", s.location(), share.ObjectName()))
+
+	objectPath := path.Join(s.Path, share.ObjectName())
+	err := s.with(func(client *sftp.Client) error {
+		if _, err := client.Stat(objectPath); err == nil {
+			return errors.New("object exists")
+		}
+		tmp := objectPath + sftpUploadSuffix
+		file, err := client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, bytes.NewReader(share.Data))
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = client.Rename(tmp, objectPath)
+		}
+		if err != nil {
+			client.Remove(tmp)
+		}
+		return err
+	})
+	if err != nil {
+		color.Red("%s/%s upload failed: %v", s.location(), share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// Remove permanently deletes a single object
+func (s SFTPStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting %s/%s...", s.location(), object))
+	err := s.with(func(client *sftp.Client) error {
+		return client.Remove(path.Join(s.Path, object))
+	})
+	if err != nil {
+		color.Red("Error: could not delete %s from %s: %s", object, s.location(), err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all objects in the share directory
+func (s SFTPStore) list() ([]string, error) {
+	var objects []string
+	err := s.with(func(client *sftp.Client) error {
+		files, err := client.ReadDir(s.Path)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			// uploads interrupted before their rename
+			if file.Mode().IsRegular() && !strings.HasSuffix(file.Name(), sftpUploadSuffix) {
+				objects = append(objects, file.Name())
+			}
+		}
+		return nil
+	})
+	return objects, err
+}
+
+// List returns the names of all objects in the share directory
+func (s SFTPStore) List() []string {
+	objects, err := s.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", s.location(), err)
+		return nil
+	}
+	return objects
+}
+
+// Read downloads a single object
+func (s SFTPStore) Read(object string) ([]byte, error) {
+	var data []byte
+	err := s.with(func(client *sftp.Client) error {
+		file, err := client.Open(path.Join(s.Path, object))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		data, err = ioutil.ReadAll(file)
+		return err
+	})
+	return data, err
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (s SFTPStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	data := make([]byte, length)
+	err := s.with(func(client *sftp.Client) error {
+		file, err := client.Open(path.Join(s.Path, object))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		n, err := file.ReadAt(data, offset)
+		data = data[:n]
+		if err == io.EOF {
+			err = nil
+		}
+		return err
+	})
+	return data, err
+}
+
+// Restore pulls the share directory to a local temp dir
+func (s SFTPStore) Restore() string {
+	objects, err := s.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", s.location(), err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_sftp_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from %s...", s.location())
+	for _, object := range objects {
+		data, err := s.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects in the share directory
+func (s SFTPStore) Description() string {
+	objects, err := s.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", s.ShortDescription(), err)
+	}
+
+	label := s.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (s SFTPStore) ShortDescription() string {
+	return "SFTP Store: " + s.location()
+}
+
+// Clean deletes all shares from the share directory
+func (s SFTPStore) Clean() {
+	for _, object := range s.List() {
+		color.Yellow("Removing SFTP Store: %v", object)
+		s.with(func(client *sftp.Client) error {
+			return client.Remove(path.Join(s.Path, object))
+		})
+	}
+}
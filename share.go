@@ -3,8 +3,13 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/agrinman/sss"
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+	"github.com/fatih/color"
 )
 
 // ShareID is a uniqiue id to represent uploaded shares
@@ -14,45 +19,144 @@ type ShareID string
 type Share struct {
 	SID  ShareID
 	Data []byte
+
+	// Version makes every upload a distinct remote object
+	Version string
+
+	// Tombstone marks the share id as deleted as of Version
+	Tombstone bool
+
+	// Part of Parts, when split for a store that caps object sizes
+	Part, Parts int
+}
+
+// separates the share id, version and tombstone marker in object names.
+// never appears in a base64URL share id
+const objectNameSep = "~"
+const tombstoneSuffix = "tomb"
+
+// ObjectName is the remote name of the share. Shares without a version use
+// the bare share id (the original layout)
+func (s Share) ObjectName() string {
+	name := ObjectName(s.SID, s.Version, s.Tombstone)
+	if s.Parts > 0 {
+		name = recovery.PartName(name, s.Part, s.Parts)
+	}
+	return name
+}
+
+// ObjectName builds the remote object name for a share id at version
+func ObjectName(sid ShareID, version string, tombstone bool) string {
+	if version == "" {
+		return string(sid)
+	}
+
+	name := string(sid) + objectNameSep + version
+	if tombstone {
+		name += objectNameSep + tombstoneSuffix
+	}
+	return name
+}
+
+// ParseObjectName splits a remote object name into its parts
+func ParseObjectName(name string) (sid ShareID, version string, tombstone bool) {
+	parts := strings.Split(name, objectNameSep)
+	sid = ShareID(parts[0])
+	if len(parts) > 1 {
+		version = parts[1]
+	}
+	if len(parts) > 2 {
+		tombstone = parts[2] == tombstoneSuffix
+	}
+	return
 }
 
-// CreateShares creates n shares from secret
+// CreateShares creates n shares from secret with the vault's scheme
 func CreateShares(secret []byte, sid ShareID, n int) []Share {
+	return CreateSharesWith(preferences.Scheme(), secret, sid, n)
+}
+
+// CreateSharesWith creates n shares from secret, framed with scheme in their
+// headers
+func CreateSharesWith(scheme SharingScheme, secret []byte, sid ShareID, n int) []Share {
 	if n > 255 {
 		panic("n > 255 not supported")
 	}
 
-	sharesBytes, err := sss.Split(byte(n), byte(n), secret)
+	payloads, err := scheme.Split(secret, n, true)
 	check(err)
 
+	threshold := byte(scheme.Threshold(n))
 	shares := make([]Share, n)
-	i := 0
-	for x, y := range sharesBytes {
+	for i, y := range payloads {
 		shares[i].SID = sid
-		shares[i].Data = append(y, x)
-		i++
+		shares[i].Data = recovery.Encode(recovery.Share{Scheme: scheme.ID(), X: byte(i + 1), Threshold: threshold, Data: y})
 	}
 
 	return shares
 }
 
-// CombineShares restores the secret by adding
+// CombineShares restores the secret from shares of one object, with the
+// scheme in their headers. Legacy shares are Shamir shares needing all
 func CombineShares(shares []Share) []byte {
 	if len(shares) > 255 {
 		panic("n > 255 not supported")
 	}
+	if len(shares) == 0 {
+		return []byte{}
+	}
+
+	var first recovery.Share
+	xs := make([]byte, len(shares))
+	ys := make([][]byte, len(shares))
+	for i, v := range shares {
+		decoded, err := recovery.Decode(v.Data)
+		if err == nil && i > 0 && (decoded.Scheme != first.Scheme || decoded.Threshold != first.Threshold) {
+			err = fmt.Errorf("shares of different schemes")
+		}
+		if err != nil {
+			color.Red("Cannot decode share of %s: %s", v.SID, err)
+			return []byte{}
+		}
+		if i == 0 {
+			first = decoded
+		}
+		xs[i], ys[i] = decoded.X, decoded.Data
+	}
 
-	sharesBytes := make(map[byte][]byte)
-	for _, v := range shares {
-		i := v.Data[len(v.Data)-1]
-		sharesBytes[i] = v.Data[:len(v.Data)-1]
+	threshold := int(first.Threshold)
+	if threshold == 0 {
+		threshold = len(shares)
 	}
 
-	return sss.Combine(sharesBytes)
+	scheme, err := sharingSchemeByID(first.Scheme)
+	if err == nil {
+		var secret []byte
+		if secret, err = scheme.Combine(xs, ys, threshold, true); err == nil {
+			return secret
+		}
+	}
+	color.Red("Cannot combine shares of %s: %s", shares[0].SID, err)
+	return []byte{}
 }
 
 /// Helper Functions ///
 
+// NewShareVersion returns a new share version. Versions sort lexically in
+// the order they were created, see clock.go
+func NewShareVersion() string {
+	return fmt.Sprintf("%016x", nextVersionStamp())
+}
+
+// VersionTime returns the creation time of a share version
+func VersionTime(version string) (time.Time, bool) {
+	nanos, err := strconv.ParseInt(version, 16, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
 // RandomShareID randomly generates a 16 byte base64URL encoded string
 func RandomShareID() ShareID {
 	randomBytes := make([]byte, 16)
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+)
+
+// The manifest keeps the hash of every share uploaded for a file, so a
+// share can be checked on its own without combining it with the others, and
+// a restore can tell which store delivered a corrupt one and do without it.
+// Each hash is chained to the object name, tying the share to the share id
+// and version it was uploaded as.
+
+func newShareHash(object string) hash.Hash {
+	h := sha256.New()
+	h.Write([]byte(object))
+	return h
+}
+
+// shareHash is the hash of the share data uploaded as object
+func shareHash(object string, data []byte) string {
+	h := newShareHash(object)
+	h.Write(data)
+	return base64.URLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// shareHashFile is the hash of the share in sharePath uploaded as object
+func shareHashFile(object, sharePath string) (string, error) {
+	file, err := openStaged(sharePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := newShareHash(object)
+	if _, err := io.Copy(h, io.NewSectionReader(file, 0, file.Size())); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// shareX is the x coordinate of a share, 0 if it cannot be read
+func shareX(data []byte) int {
+	if bytes.HasPrefix(data, []byte(recovery.Magic)) {
+		if len(data) < recovery.HeaderSize {
+			return 0
+		}
+		return int(data[6])
+	}
+	if len(data) == 0 {
+		return 0
+	}
+	return int(data[len(data)-1])
+}
+
+// expectedShareHash is the recorded hash of share x of fileShare, empty if
+// none was recorded
+func expectedShareHash(fileShare FileShare, x int) string {
+	if x < 1 || x > len(fileShare.Shares) {
+		return ""
+	}
+	return fileShare.Shares[x-1]
+}
+
+// checkShare checks share data of fileShare against the recorded hash
+func checkShare(fileShare FileShare, data []byte) error {
+	x := shareX(data)
+	expected := expectedShareHash(fileShare, x)
+	if expected == "" || shareHash(fileShare.ObjectName(), data) == expected {
+		return nil
+	}
+	return fmt.Errorf("share %v does not match the hash in the manifest", x)
+}
+
+// checkShareFile checks the share of fileShare in sharePath against the
+// recorded hash
+func checkShareFile(fileShare FileShare, sharePath string) error {
+	if len(fileShare.Shares) == 0 {
+		return nil
+	}
+	spooled, err := openShare(sharePath)
+	if err != nil {
+		return err
+	}
+	x := int(spooled.share.X)
+	spooled.file.Close()
+
+	expected := expectedShareHash(fileShare, x)
+	if expected == "" {
+		return nil
+	}
+	actual, err := shareHashFile(fileShare.ObjectName(), sharePath)
+	if err == nil && actual != expected {
+		err = fmt.Errorf("share %v does not match the hash in the manifest", x)
+	}
+	return err
+}
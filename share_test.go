@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+)
+
+// TestSharesRoundTrip checks every sharing scheme combines a random
+// threshold-sized subset of its shares, with CombineShares and with the
+// independent code of the recovery package
+func TestSharesRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 50; i++ {
+		secret := make([]byte, rng.Intn(4096))
+		rng.Read(secret)
+		n := 2 + rng.Intn(7)
+
+		for _, name := range SharingSchemeNames() {
+			scheme := sharingSchemes[name]
+			shares := CreateSharesWith(scheme, secret, RandomShareID(), n)
+
+			subset := make([]Share, 0, n)
+			decoded := make([]recovery.Share, 0, n)
+			for _, j := range rng.Perm(n)[:scheme.Threshold(n)] {
+				subset = append(subset, shares[j])
+				share, err := recovery.Decode(shares[j].Data)
+				if err != nil {
+					t.Fatalf("%s share did not decode: %v", name, err)
+				}
+				decoded = append(decoded, share)
+			}
+
+			if combined := CombineShares(subset); !bytes.Equal(combined, secret) {
+				t.Errorf("%s shares of %v bytes did not round trip", name, len(secret))
+			}
+			if combined, err := recovery.Combine(decoded); err != nil || !bytes.Equal(combined, secret) {
+				t.Errorf("%s shares of %v bytes did not combine with recovery", name, len(secret))
+			}
+		}
+	}
+}
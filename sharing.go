@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/TheLisztomaniac/chasmOriginal/gf256"
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+)
+
+// SharingScheme turns a secret into one share per store and back. Its id is
+// recorded in every share header, so a vault can switch schemes and still
+// restore objects shared with the old one
+type SharingScheme interface {
+	// ID is the scheme's number in the share format
+	ID() byte
+
+	// Threshold is how many of n shares rebuild the secret
+	Threshold(n int) int
+
+	// Stripe is how many secret bytes make up one byte of each share. Files
+	// over the memory budget are shared in chunks of whole stripes
+	Stripe(threshold int) int
+
+	// ShareSize is the payload size of each share of a size byte secret
+	ShareSize(size int64, threshold int) int64
+
+	// Split returns n share payloads, share i at x = i+1. Every chunk but
+	// the final one of a secret must be whole stripes
+	Split(secret []byte, n int, final bool) ([][]byte, error)
+
+	// Combine rebuilds a chunk of the secret from at least threshold shares
+	Combine(xs []byte, ys [][]byte, threshold int, final bool) ([]byte, error)
+}
+
+// sharing schemes by their name in the preferences
+var sharingSchemes = map[string]SharingScheme{
+	"shamir":       shamirScheme{},
+	"xor":          xorScheme{},
+	"reed-solomon": reedSolomonScheme{},
+	"replicate":    replicateScheme{},
+}
+
+// SharingSchemeNames lists the schemes a vault can use
+func SharingSchemeNames() []string {
+	names := make([]string, 0, len(sharingSchemes))
+	for name := range sharingSchemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sharingSchemeByID finds the scheme shares were made with
+func sharingSchemeByID(id byte) (SharingScheme, error) {
+	for _, scheme := range sharingSchemes {
+		if scheme.ID() == id {
+			return scheme, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported sharing scheme %d", id)
+}
+
+// Scheme is the sharing scheme of new uploads, Shamir unless set
+func (p ChasmPref) Scheme() SharingScheme {
+	if scheme, ok := sharingSchemes[p.SharingScheme]; ok {
+		return scheme
+	}
+	return shamirScheme{}
+}
+
+// schemeFor is the sharing scheme of new uploads of filePath, the one the
+// policy names or else the vault's
+func schemeFor(filePath string) SharingScheme {
+	if scheme, ok := sharingSchemes[policyFor(filePath).Scheme]; ok {
+		return scheme
+	}
+	return preferences.Scheme()
+}
+
+/// Shamir ///
+
+// shamirScheme needs every share, and any fewer reveal nothing
+type shamirScheme struct{}
+
+func (shamirScheme) ID() byte                                  { return recovery.SchemeShamir }
+func (shamirScheme) Threshold(n int) int                       { return n }
+func (shamirScheme) Stripe(threshold int) int                  { return 1 }
+func (shamirScheme) ShareSize(size int64, threshold int) int64 { return size }
+
+func (shamirScheme) Split(secret []byte, n int, final bool) ([][]byte, error) {
+	return gf256.Split(secret, n, n, gf256.NewRandom())
+}
+
+func (shamirScheme) Combine(xs []byte, ys [][]byte, threshold int, final bool) ([]byte, error) {
+	if len(ys) < threshold {
+		return nil, fmt.Errorf("need %d shares, have %d", threshold, len(ys))
+	}
+	return gf256.Combine(xs, ys)
+}
+
+/// XOR ///
+
+// xorScheme also needs every share and reveals nothing with fewer, with
+// cheaper math than Shamir
+type xorScheme struct{}
+
+func (xorScheme) ID() byte                                  { return recovery.SchemeXOR }
+func (xorScheme) Threshold(n int) int                       { return n }
+func (xorScheme) Stripe(threshold int) int                  { return 1 }
+func (xorScheme) ShareSize(size int64, threshold int) int64 { return size }
+
+func (xorScheme) Split(secret []byte, n int, final bool) ([][]byte, error) {
+	random := gf256.NewRandom()
+	shares := make([][]byte, n)
+	last := make([]byte, len(secret))
+	copy(last, secret)
+	for i := 0; i < n-1; i++ {
+		shares[i] = make([]byte, len(secret))
+		random.Read(shares[i])
+		gf256.MulAdd(1, shares[i], last)
+	}
+	shares[n-1] = last
+	return shares, nil
+}
+
+func (xorScheme) Combine(xs []byte, ys [][]byte, threshold int, final bool) ([]byte, error) {
+	if len(ys) < threshold || len(ys) == 0 {
+		return nil, fmt.Errorf("need %d shares, have %d", threshold, len(ys))
+	}
+	secret := make([]byte, len(ys[0]))
+	for _, y := range ys {
+		if len(y) != len(secret) {
+			return nil, fmt.Errorf("shares differ in length")
+		}
+		gf256.MulAdd(1, y, secret)
+	}
+	return secret, nil
+}
+
+/// Reed-Solomon ///
+
+// reedSolomonScheme survives losing one store at 1/(n-1) of the storage of
+// replication, but is not secret sharing: data shares hold plaintext
+type reedSolomonScheme struct{}
+
+func (reedSolomonScheme) ID() byte { return recovery.SchemeReedSolomon }
+
+func (reedSolomonScheme) Threshold(n int) int {
+	if n <= 2 {
+		return 1
+	}
+	return n - 1
+}
+
+func (reedSolomonScheme) Stripe(threshold int) int { return threshold }
+
+func (reedSolomonScheme) ShareSize(size int64, threshold int) int64 {
+	return size/int64(threshold) + 1
+}
+
+func (rs reedSolomonScheme) Split(secret []byte, n int, final bool) ([][]byte, error) {
+	k := rs.Threshold(n)
+	if final {
+		secret = recovery.Pad(secret, k)
+	}
+	if len(secret)%k != 0 {
+		return nil, fmt.Errorf("chunk of %v bytes is not whole stripes of %v", len(secret), k)
+	}
+
+	size := len(secret) / k
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, size)
+	}
+	for c := 0; c < k; c++ {
+		for j := range shares[c] {
+			shares[c][j] = secret[j*k+c]
+		}
+	}
+	for x := k + 1; x <= n; x++ {
+		for c := 1; c <= k; c++ {
+			gf256.MulAdd(recovery.ParityCoefficient(x, c, k), shares[c-1], shares[x-1])
+		}
+	}
+	return shares, nil
+}
+
+func (reedSolomonScheme) Combine(xs []byte, ys [][]byte, threshold int, final bool) ([]byte, error) {
+	if len(ys) < threshold {
+		return nil, fmt.Errorf("need %d shares, have %d", threshold, len(ys))
+	}
+	xs, ys = xs[:threshold], ys[:threshold]
+
+	inverse, err := recovery.DecodeMatrix(xs, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	size := len(ys[0])
+	data := make([]byte, size)
+	secret := make([]byte, size*threshold)
+	for c := 0; c < threshold; c++ {
+		for j := range data {
+			data[j] = 0
+		}
+		for i, y := range ys {
+			if len(y) != size {
+				return nil, fmt.Errorf("shares differ in length")
+			}
+			gf256.MulAdd(inverse[c][i], y, data)
+		}
+		for j, b := range data {
+			secret[j*threshold+c] = b
+		}
+	}
+
+	if final {
+		return recovery.Unpad(secret)
+	}
+	return secret, nil
+}
+
+/// Replicate ///
+
+// replicateScheme stores a full copy everywhere, for contents that are
+// already encrypted
+type replicateScheme struct{}
+
+func (replicateScheme) ID() byte                                  { return recovery.SchemeReplicate }
+func (replicateScheme) Threshold(n int) int                       { return 1 }
+func (replicateScheme) Stripe(threshold int) int                  { return 1 }
+func (replicateScheme) ShareSize(size int64, threshold int) int64 { return size }
+
+func (replicateScheme) Split(secret []byte, n int, final bool) ([][]byte, error) {
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+		copy(shares[i], secret)
+	}
+	return shares, nil
+}
+
+func (replicateScheme) Combine(xs []byte, ys [][]byte, threshold int, final bool) ([]byte, error) {
+	if len(ys) == 0 {
+		return nil, fmt.Errorf("need 1 share, have none")
+	}
+	return ys[0], nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Reports and fleet configs are signed with a detached .sig file holding
+// the Ed25519 public key and the signature, base64 encoded:
+//
+//	ed25519 <public key>
+//	<signature>
+
+// signDetached returns the contents of the .sig file for data
+func signDetached(key ed25519.PrivateKey, data []byte) []byte {
+	public := key.Public().(ed25519.PublicKey)
+	return []byte(fmt.Sprintf("ed25519 %s\n%s\n",
+		base64.StdEncoding.EncodeToString(public),
+		base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))))
+}
+
+// checkDetached verifies data against its .sig file, returning the signing
+// public key. what names data in errors
+func checkDetached(data, sig []byte, what string) (string, error) {
+	lines := strings.Fields(string(sig))
+	if len(lines) != 3 || lines[0] != "ed25519" {
+		return "", fmt.Errorf("not a chasm %s signature", what)
+	}
+	public, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(public) != ed25519.PublicKeySize {
+		return "", errors.New("invalid signing key")
+	}
+	signature, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil || !ed25519.Verify(public, data, signature) {
+		return "", fmt.Errorf("signature does not match the %s", what)
+	}
+	return lines[1], nil
+}
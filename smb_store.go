@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/hirochachacha/go-smb2"
+)
+
+// SMBStore keeps shares in a directory of a Windows or Samba network share,
+// such as that of a NAS, signing in with NTLM. It talks SMB 2 and 3 itself,
+// so the share need not be mounted on this machine
+type SMBStore struct {
+	// host:port
+	Server string `json:"server"`
+	Share  string `json:"share"`
+
+	// directory within the share, / separated
+	Path string `json:"path"`
+
+	User     string `json:"user"`
+	Password string `json:"-"`
+	Domain   string `json:"domain,omitempty"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (s *SMBStore) credentials() map[string]*string {
+	return map[string]*string{"password": &s.Password}
+}
+
+// uploads are written under a temporary name, then renamed into place
+const smbUploadSuffix = ".uploading"
+
+// smbConn is a signed in session with the share mounted
+type smbConn struct {
+	session *smb2.Session
+	share   *smb2.Share
+}
+
+// connections by store, kept for the run and dropped on error
+var (
+	smbConnsLock sync.Mutex
+	smbConns     = make(map[string]smbConn)
+)
+
+// ParseUNC splits \\server\share\path, or //server/share/path, into the
+// server, share and path within it
+func ParseUNC(unc string) (server, share, dir string, err error) {
+	parts := strings.Split(strings.Trim(strings.Replace(unc, `\`, "/", -1), "/"), "/")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", fmt.Errorf("%s is not a UNC path like \\\\server\\share\\dir", unc)
+	}
+	return parts[0], parts[1], strings.Join(parts[2:], "/"), nil
+}
+
+// Setup signs in and creates the share directory
+func (s SMBStore) Setup() bool {
+	for _, ss := range preferences.SMBStores {
+		if ss.Server == s.Server && ss.Share == s.Share && ss.Path == s.Path {
+			color.Red("SMB store at %s already exists.", s.location())
+			return false
+		}
+	}
+
+	err := s.with(func(share *smb2.Share) error {
+		if s.Path == "" {
+			return nil
+		}
+		return share.MkdirAll(s.Path, 0700)
+	})
+	if err != nil {
+		color.Red("Error: cannot set up %s: %s", s.location(), err)
+		return false
+	}
+	return true
+}
+
+func (s SMBStore) location() string {
+	host, _, err := net.SplitHostPort(s.Server)
+	if err != nil {
+		host = s.Server
+	}
+	return `\\` + host + `\` + s.Share + strings.TrimSuffix(`\`+strings.Replace(s.Path, "/", `\`, -1), `\`)
+}
+
+func (s SMBStore) objectPath(object string) string {
+	return path.Join(s.Path, object)
+}
+
+// conn is the run's session to the server, opened if needed. Callers hold
+// smbConnsLock
+func (s SMBStore) conn() (*smb2.Share, error) {
+	if conn, ok := smbConns[s.location()]; ok {
+		return conn.share, nil
+	}
+
+	tcp, err := net.DialTimeout("tcp", s.Server, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &smb2.Dialer{Initiator: &smb2.NTLMInitiator{User: s.User, Password: s.Password, Domain: s.Domain}}
+	session, err := dialer.Dial(tcp)
+	if err != nil {
+		tcp.Close()
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(s.Server)
+	share, err := session.Mount(`\\` + host + `\` + s.Share)
+	if err != nil {
+		session.Logoff()
+		return nil, err
+	}
+	smbConns[s.location()] = smbConn{session: session, share: share}
+	return share, nil
+}
+
+// with runs op with the mounted share, dropping the session if op fails so
+// the next operation connects again
+func (s SMBStore) with(op func(share *smb2.Share) error) error {
+	smbConnsLock.Lock()
+	defer smbConnsLock.Unlock()
+	share, err := s.conn()
+	if err != nil {
+		return err
+	}
+	if err := op(share); err != nil {
+		conn := smbConns[s.location()]
+		conn.share.Umount()
+		conn.session.Logoff()
+		delete(smbConns, s.location())
+		return err
+	}
+	return nil
+}
+
+// Upload writes the share under a temporary name and renames it into place,
+// refusing to replace an existing object
+func (s SMBStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading %s\\%s...", s.location(), share.ObjectName()))
+
+	objectPath := s.objectPath(share.ObjectName())
+	err := s.with(func(fs *smb2.Share) error {
+		if _, err := fs.Stat(objectPath); err == nil {
+			return errors.New("object exists")
+		}
+		tmp := objectPath + smbUploadSuffix
+		file, err := fs.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(share.Data)
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = fs.Rename(tmp, objectPath)
+		}
+		if err != nil {
+			fs.Remove(tmp)
+		}
+		return err
+	})
+	if err != nil {
+		color.Red("%s\\%s upload failed: %v", s.location(), share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// Remove permanently deletes a single object
+func (s SMBStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting %s\\%s...", s.location(), object))
+	err := s.with(func(fs *smb2.Share) error {
+		return fs.Remove(s.objectPath(object))
+	})
+	if err != nil {
+		color.Red("Error: could not delete %s from %s: %s", object, s.location(), err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all objects in the share directory
+func (s SMBStore) list() ([]string, error) {
+	var objects []string
+	err := s.with(func(fs *smb2.Share) error {
+		files, err := fs.ReadDir(s.Path)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			// uploads interrupted before their rename
+			if file.Mode().IsRegular() && !strings.HasSuffix(file.Name(), smbUploadSuffix) {
+				objects = append(objects, file.Name())
+			}
+		}
+		return nil
+	})
+	return objects, err
+}
+
+// List returns the names of all objects in the share directory
+func (s SMBStore) List() []string {
+	objects, err := s.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", s.location(), err)
+		return nil
+	}
+	return objects
+}
+
+// Read downloads a single object
+func (s SMBStore) Read(object string) ([]byte, error) {
+	var data []byte
+	err := s.with(func(fs *smb2.Share) error {
+		var err error
+		data, err = fs.ReadFile(s.objectPath(object))
+		return err
+	})
+	return data, err
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (s SMBStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	data := make([]byte, length)
+	err := s.with(func(fs *smb2.Share) error {
+		file, err := fs.Open(s.objectPath(object))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		n, err := file.ReadAt(data, offset)
+		data = data[:n]
+		if err == io.EOF {
+			err = nil
+		}
+		return err
+	})
+	return data, err
+}
+
+// Restore pulls the share directory to a local temp dir
+func (s SMBStore) Restore() string {
+	objects, err := s.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", s.location(), err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_smb_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from %s...", s.location())
+	for _, object := range objects {
+		data, err := s.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects in the share directory
+func (s SMBStore) Description() string {
+	objects, err := s.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", s.ShortDescription(), err)
+	}
+
+	label := s.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (s SMBStore) ShortDescription() string {
+	return "SMB Store: " + s.location()
+}
+
+// Clean deletes all shares from the share directory
+func (s SMBStore) Clean() {
+	for _, object := range s.List() {
+		color.Yellow("Removing SMB Store: %v", object)
+		s.with(func(fs *smb2.Share) error {
+			return fs.Remove(s.objectPath(object))
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Every full manifest upload is a snapshot of the vault, kept on the stores
+// until compaction removes it after the retention period. Snapshots are
+// named by their version, by a time, picking the last snapshot taken by
+// then, or as latest. local is the manifest on this machine.
+
+// FileChange is a difference between two snapshots
+type FileChange struct {
+	Path   string `json:"path"`
+	Change string `json:"change"` // added, removed, modified or renamed
+	From   string `json:"from,omitempty"`
+
+	// sizes, 0 when the snapshot predates recorded sizes
+	OldSize int64 `json:"old_size,omitempty"`
+	NewSize int64 `json:"new_size,omitempty"`
+}
+
+// SnapshotVersions lists the manifest versions every store holds, oldest
+// first
+func SnapshotVersions(versions map[ShareID]map[string]int) []string {
+	stores := len(preferences.AllCloudStores())
+	var snapshots []string
+	for version, count := range versions[ShareID(chasmPrefFile)] {
+		if count == stores {
+			snapshots = append(snapshots, version)
+		}
+	}
+	sort.Strings(snapshots)
+	return snapshots
+}
+
+// readManifest reads the full manifest at version from the stores
+func readManifest(version string) (ChasmPref, error) {
+	var manifest ChasmPref
+	manifestBytes, err := RestoreSingleFile(FileShare{SID: ShareID(chasmPrefFile), Version: version})
+	if err != nil {
+		return manifest, err
+	}
+	defer wipe(manifestBytes)
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return manifest, fmt.Errorf("cannot read the manifest %s: %s", version, err)
+	}
+	return manifest, nil
+}
+
+// resolveSnapshot finds the snapshot version named by name
+func resolveSnapshot(name string, snapshots []string) (string, error) {
+	if len(snapshots) == 0 {
+		return "", fmt.Errorf("no snapshots on the stores")
+	}
+	if name == "latest" {
+		return snapshots[len(snapshots)-1], nil
+	}
+	for _, version := range snapshots {
+		if version == name {
+			return version, nil
+		}
+	}
+
+	// a day means its end
+	at, err := time.Parse(time.RFC3339, name)
+	if err != nil {
+		day, dayErr := time.ParseInLocation("2006-01-02", name, time.Local)
+		if dayErr != nil {
+			return "", fmt.Errorf("%s is not a snapshot version, date or time", name)
+		}
+		at = day.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	found := ""
+	for _, version := range snapshots {
+		if created, ok := VersionTime(version); ok && !created.After(at) {
+			found = version
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("no snapshot as old as %s", name)
+	}
+	return found, nil
+}
+
+// loadSnapshot reads the tracked files of the snapshot named by name
+func loadSnapshot(name string, snapshots []string) (map[string]FileShare, string, error) {
+	if name == "local" {
+		return browsableFiles(preferences.FileMap), "local", nil
+	}
+	version, err := resolveSnapshot(name, snapshots)
+	if err != nil {
+		return nil, "", err
+	}
+	manifest, err := readManifest(version)
+	if err != nil {
+		return nil, "", err
+	}
+	return browsableFiles(manifest.FileMap), version, nil
+}
+
+// DiffSnapshots lists the files added, removed, modified and renamed from a
+// to b, by path. Renamed files keep their share id
+func DiffSnapshots(a, b map[string]FileShare) []FileChange {
+	var changes []FileChange
+	removed := make(map[ShareID]string)
+	for filePath, old := range a {
+		if _, ok := b[filePath]; !ok {
+			removed[old.SID] = filePath
+		}
+	}
+
+	for filePath, current := range b {
+		old, ok := a[filePath]
+		switch {
+		case !ok && removed[current.SID] != "":
+			from := removed[current.SID]
+			delete(removed, current.SID)
+			changes = append(changes, FileChange{Path: filePath, Change: "renamed", From: from, OldSize: a[from].Size, NewSize: current.Size})
+		case !ok:
+			changes = append(changes, FileChange{Path: filePath, Change: "added", NewSize: current.Size})
+		case old.Hash != current.Hash || old.Hash == "" && old.Version != current.Version:
+			changes = append(changes, FileChange{Path: filePath, Change: "modified", OldSize: old.Size, NewSize: current.Size})
+		}
+	}
+	for _, filePath := range removed {
+		changes = append(changes, FileChange{Path: filePath, Change: "removed", OldSize: a[filePath].Size})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+// sizeDelta describes the change in size of a modified file
+func sizeDelta(change FileChange) string {
+	if change.OldSize == 0 && change.NewSize == 0 {
+		return "size unknown"
+	}
+	return signedBytes(change.NewSize - change.OldSize)
+}
+
+func signedBytes(n int64) string {
+	if n < 0 {
+		return "-" + formatBytes(-n)
+	}
+	return "+" + formatBytes(n)
+}
+
+// PrintChanges prints the changes with a summary line
+func PrintChanges(changes []FileChange) {
+	counts := make(map[string]int)
+	var total int64
+	for _, change := range changes {
+		counts[change.Change]++
+		total += change.NewSize - change.OldSize
+
+		switch change.Change {
+		case "added":
+			color.Green("+ %s (%s)", change.Path, formatBytes(change.NewSize))
+		case "removed":
+			color.Red("- %s (%s)", change.Path, formatBytes(change.OldSize))
+		case "modified":
+			color.Yellow("~ %s (%s)", change.Path, sizeDelta(change))
+		case "renamed":
+			color.Cyan("> %s -> %s", change.From, change.Path)
+		}
+	}
+
+	fmt.Printf("%v added, %v removed, %v modified, %v renamed, %s in total\n",
+		counts["added"], counts["removed"], counts["modified"], counts["renamed"], signedBytes(total))
+}
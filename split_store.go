@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+	"github.com/fatih/color"
+)
+
+// objectSizeLimited is implemented by stores that cap the size of a single
+// object. A limit of 0 means none
+type objectSizeLimited interface {
+	MaxObjectSize() int64
+}
+
+// splitStore uploads shares larger than its store's limit as numbered parts,
+// and hides the parts from everything else: List returns whole objects and
+// Restore reassembles them
+type splitStore struct {
+	CloudStore
+	max int64 // 0 for no limit
+
+	// parts of each object, from the last List
+	parts map[string][]string
+}
+
+func withSplitting(cloudStores []CloudStore) []CloudStore {
+	wrapped := make([]CloudStore, len(cloudStores))
+	for i, cs := range cloudStores {
+		// parts are joined even without a limit, they may have been
+		// uploaded under an earlier limit or memory budget
+		wrapped[i] = &splitStore{CloudStore: cs, max: objectPartSize(cs)}
+	}
+	return wrapped
+}
+
+// objectPartSize is the largest object uploaded to cs in one piece, the
+// smaller of its own limit and the memory budget's part size. 0 means none
+func objectPartSize(cs CloudStore) int64 {
+	max := memoryPartSize()
+	if limited, ok := cs.(objectSizeLimited); ok && limited.MaxObjectSize() > 0 {
+		if max == 0 || limited.MaxObjectSize() < max {
+			max = limited.MaxObjectSize()
+		}
+	}
+	return max
+}
+
+func (s *splitStore) Upload(share Share) {
+	if s.max == 0 || share.Parts > 0 || int64(len(share.Data)) <= s.max {
+		s.CloudStore.Upload(share)
+		return
+	}
+
+	data := share.Data
+	parts := int((int64(len(data)) + s.max - 1) / s.max)
+	color.Cyan("Splitting share %s into %v parts for %s", share.ObjectName(), parts, s.ShortDescription())
+	for i := 1; i <= parts; i++ {
+		end := int64(i) * s.max
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+
+		part := share
+		part.Data = data[int64(i-1)*s.max : end]
+		part.Part, part.Parts = i, parts
+		s.CloudStore.Upload(part)
+	}
+}
+
+func (s *splitStore) List() []string {
+	s.parts = make(map[string][]string)
+	var objects []string
+	for _, name := range s.CloudStore.List() {
+		object, _, _, ok := recovery.ParsePartName(name)
+		if !ok {
+			objects = append(objects, name)
+			continue
+		}
+		if s.parts[object] == nil {
+			objects = append(objects, object)
+		}
+		s.parts[object] = append(s.parts[object], name)
+	}
+	return objects
+}
+
+func (s *splitStore) Remove(object string) {
+	if s.parts == nil {
+		s.List()
+	}
+
+	parts, ok := s.parts[object]
+	if !ok {
+		s.CloudStore.Remove(object)
+		return
+	}
+	for _, part := range parts {
+		s.CloudStore.Remove(part)
+	}
+	delete(s.parts, object)
+}
+
+// Restore joins split objects into a separate directory. The store's own
+// directory is removed if it was staged, and left untouched if it is a
+// folder store
+func (s *splitStore) Restore() string {
+	restorePath := s.CloudStore.Restore()
+	if restorePath == "" {
+		return ""
+	}
+
+	// part names of each object, a single entry for whole objects
+	files, _ := ioutil.ReadDir(restorePath)
+	objects := make(map[string][]string)
+	split := false
+	for _, f := range files {
+		object, i, n, ok := recovery.ParsePartName(f.Name())
+		if !ok {
+			objects[f.Name()] = []string{f.Name()}
+			continue
+		}
+		if objects[object] == nil {
+			objects[object] = make([]string, n)
+		}
+		if i <= len(objects[object]) {
+			objects[object][i-1] = f.Name()
+		}
+		split = true
+	}
+	if !split {
+		return restorePath
+	}
+
+	joinedPath, err := ioutil.TempDir("", "chasm_split_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	names := make([]string, 0, len(objects))
+	for object := range objects {
+		names = append(names, object)
+	}
+	sort.Strings(names)
+
+	for _, object := range names {
+		joined := filepath.Join(joinedPath, object)
+		if err := joinParts(restorePath, objects[object], joined); err != nil {
+			color.Yellow("Error joining parts of %s: %v", object, err)
+			os.Remove(joined)
+		}
+	}
+	removeStaging([]string{restorePath})
+	return joinedPath
+}
+
+// joinParts concatenates parts into dst, staged sealed, streaming so a split object is
+// never held in memory
+func joinParts(dir string, parts []string, dst string) error {
+	out, err := createStaged(dst)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		if part == "" {
+			out.Close()
+			return fmt.Errorf("missing part")
+		}
+		in, err := openStaged(filepath.Join(dir, part))
+		if err != nil {
+			out.Close()
+			return err
+		}
+		_, err = io.Copy(out, io.NewSectionReader(in, 0, in.Size()))
+		in.Close()
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+func (s *splitStore) Clean() {
+	s.CloudStore.Clean()
+	s.parts = nil
+}
+
+// sizes of common volume and provider limits
+const (
+	fat32MaxFileSize    = 1<<32 - 1
+	peerMaxObjectSize   = 1<<32 - 1
+	gdriveMaxObjectSize = 5 << 40
+)
+
+// MaxObjectSize of a folder store, e.g. 4 GB on FAT32 drives
+func (f FolderStore) MaxObjectSize() int64 {
+	return f.MaxObjectBytes
+}
+
+// MaxObjectSize of Google Drive files
+func (g GDriveStore) MaxObjectSize() int64 {
+	return gdriveMaxObjectSize
+}
+
+// MaxObjectSize the peer daemon accepts in one request
+func (p PeerStore) MaxObjectSize() int64 {
+	return peerMaxObjectSize
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// ServerSideEncryption asks a provider to also encrypt stored shares with
+// its own keys. chasm does not need it, but corporate policies often require
+// provider-side KMS on every object
+type ServerSideEncryption struct {
+	// AES256 (provider managed keys), aws:kms, or SSE-C (customer key)
+	Mode string `json:"mode"`
+
+	// key id or ARN for aws:kms, the provider default key if empty
+	KMSKeyID string `json:"kms_key_id,omitempty"`
+
+	// encryption context for aws:kms
+	KMSContext map[string]string `json:"kms_context,omitempty"`
+
+	// use an S3 bucket key for aws:kms, reducing KMS requests
+	BucketKey bool `json:"bucket_key,omitempty"`
+
+	// base64 encoded 256-bit key for SSE-C, kept in the local state with the
+	// store's credentials, see credentials.go
+	CustomerKey string `json:"-"`
+}
+
+const (
+	sseAES256   = "AES256"
+	sseKMS      = "aws:kms"
+	sseCustomer = "SSE-C"
+)
+
+// serverSideEncrypting is implemented by stores whose provider can encrypt
+// objects on its side. The configuration is applied to every upload
+type serverSideEncrypting interface {
+	SetServerSideEncryption(sse *ServerSideEncryption)
+	ServerSideEncryption() *ServerSideEncryption
+}
+
+// Validate checks the configuration is complete for its mode
+func (e ServerSideEncryption) Validate() error {
+	switch e.Mode {
+	case sseAES256:
+	case sseKMS:
+	case sseCustomer:
+		key, err := base64.StdEncoding.DecodeString(e.CustomerKey)
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("SSE-C needs a base64 encoded 256-bit customer key")
+		}
+	default:
+		return fmt.Errorf("unknown server-side encryption mode %q, use %s, %s or %s", e.Mode, sseAES256, sseKMS, sseCustomer)
+	}
+
+	if e.Mode != sseKMS && (e.KMSKeyID != "" || len(e.KMSContext) > 0 || e.BucketKey) {
+		return fmt.Errorf("KMS options only apply to %s", sseKMS)
+	}
+	return nil
+}
+
+// S3UploadHeaders are the headers S3 and S3-compatible providers take on
+// PUT requests
+func (e ServerSideEncryption) S3UploadHeaders() http.Header {
+	header := http.Header{}
+	switch e.Mode {
+	case sseAES256:
+		header.Set("x-amz-server-side-encryption", sseAES256)
+	case sseKMS:
+		header.Set("x-amz-server-side-encryption", sseKMS)
+		if e.KMSKeyID != "" {
+			header.Set("x-amz-server-side-encryption-aws-kms-key-id", e.KMSKeyID)
+		}
+		if len(e.KMSContext) > 0 {
+			context, _ := json.Marshal(e.KMSContext)
+			header.Set("x-amz-server-side-encryption-context", base64.StdEncoding.EncodeToString(context))
+		}
+		if e.BucketKey {
+			header.Set("x-amz-server-side-encryption-bucket-key-enabled", "true")
+		}
+	case sseCustomer:
+		for name, values := range e.S3ReadHeaders() {
+			header[name] = values
+		}
+	}
+	return header
+}
+
+// S3ReadHeaders are needed on GET and HEAD requests too, only for SSE-C
+func (e ServerSideEncryption) S3ReadHeaders() http.Header {
+	header := http.Header{}
+	if e.Mode != sseCustomer {
+		return header
+	}
+
+	key, _ := base64.StdEncoding.DecodeString(e.CustomerKey)
+	sum := md5.Sum(key)
+	header.Set("x-amz-server-side-encryption-customer-algorithm", sseAES256)
+	header.Set("x-amz-server-side-encryption-customer-key", e.CustomerKey)
+	header.Set("x-amz-server-side-encryption-customer-key-md5", base64.StdEncoding.EncodeToString(sum[:]))
+	return header
+}
+
+// B2Settings is the serverSideEncryption field of the B2 native API
+func (e ServerSideEncryption) B2Settings() map[string]interface{} {
+	switch e.Mode {
+	case sseAES256:
+		return map[string]interface{}{"mode": "SSE-B2", "algorithm": sseAES256}
+	case sseCustomer:
+		key, _ := base64.StdEncoding.DecodeString(e.CustomerKey)
+		sum := md5.Sum(key)
+		return map[string]interface{}{
+			"mode":           sseCustomer,
+			"algorithm":      sseAES256,
+			"customerKey":    e.CustomerKey,
+			"customerKeyMd5": base64.StdEncoding.EncodeToString(sum[:]),
+		}
+	}
+	return nil
+}
+
+// storeRef points at the configuration of the store numbered index, from 1,
+// in the order AllCloudStores lists them
+func storeRef(index int) interface{} {
+	index--
+	if index < 0 {
+		return nil
+	}
+	if index < len(preferences.FolderStores) {
+		return &preferences.FolderStores[index]
+	}
+	index -= len(preferences.FolderStores)
+	if index < len(preferences.GDriveStores) {
+		return &preferences.GDriveStores[index]
+	}
+	index -= len(preferences.GDriveStores)
+	if index < len(preferences.PeerStores) {
+		return &preferences.PeerStores[index]
+	}
+	index -= len(preferences.PeerStores)
+	if index < len(preferences.DropboxStores) {
+		return &preferences.DropboxStores[index]
+	}
+	index -= len(preferences.DropboxStores)
+	if index < len(preferences.S3Stores) {
+		return &preferences.S3Stores[index]
+	}
+	index -= len(preferences.S3Stores)
+	if index < len(preferences.OneDriveStores) {
+		return &preferences.OneDriveStores[index]
+	}
+	index -= len(preferences.OneDriveStores)
+	if index < len(preferences.B2Stores) {
+		return &preferences.B2Stores[index]
+	}
+	index -= len(preferences.B2Stores)
+	if index < len(preferences.SFTPStores) {
+		return &preferences.SFTPStores[index]
+	}
+	index -= len(preferences.SFTPStores)
+	if index < len(preferences.WebDAVStores) {
+		return &preferences.WebDAVStores[index]
+	}
+	index -= len(preferences.WebDAVStores)
+	if index < len(preferences.AzureBlobStores) {
+		return &preferences.AzureBlobStores[index]
+	}
+	index -= len(preferences.AzureBlobStores)
+	if index < len(preferences.GCSStores) {
+		return &preferences.GCSStores[index]
+	}
+	index -= len(preferences.GCSStores)
+	if index < len(preferences.AgentStores) {
+		return &preferences.AgentStores[index]
+	}
+	index -= len(preferences.AgentStores)
+	if index < len(preferences.BoxStores) {
+		return &preferences.BoxStores[index]
+	}
+	index -= len(preferences.BoxStores)
+	if index < len(preferences.MegaStores) {
+		return &preferences.MegaStores[index]
+	}
+	index -= len(preferences.MegaStores)
+	if index < len(preferences.PCloudStores) {
+		return &preferences.PCloudStores[index]
+	}
+	index -= len(preferences.PCloudStores)
+	if index < len(preferences.YandexDiskStores) {
+		return &preferences.YandexDiskStores[index]
+	}
+	index -= len(preferences.YandexDiskStores)
+	if index < len(preferences.FTPStores) {
+		return &preferences.FTPStores[index]
+	}
+	index -= len(preferences.FTPStores)
+	if index < len(preferences.SMBStores) {
+		return &preferences.SMBStores[index]
+	}
+	index -= len(preferences.SMBStores)
+	if index < len(preferences.RcloneStores) {
+		return &preferences.RcloneStores[index]
+	}
+	index -= len(preferences.RcloneStores)
+	if index < len(preferences.IPFSStores) {
+		return &preferences.IPFSStores[index]
+	}
+	index -= len(preferences.IPFSStores)
+	if index < len(preferences.StorjStores) {
+		return &preferences.StorjStores[index]
+	}
+	index -= len(preferences.StorjStores)
+	if index < len(preferences.KBFSStores) {
+		return &preferences.KBFSStores[index]
+	}
+	index -= len(preferences.KBFSStores)
+	if index < len(preferences.EmailStores) {
+		return &preferences.EmailStores[index]
+	}
+	index -= len(preferences.EmailStores)
+	if index < len(preferences.TelegramStores) {
+		return &preferences.TelegramStores[index]
+	}
+	index -= len(preferences.TelegramStores)
+	if index < len(preferences.GitStores) {
+		return &preferences.GitStores[index]
+	}
+	index -= len(preferences.GitStores)
+	if index < len(preferences.SwiftStores) {
+		return &preferences.SwiftStores[index]
+	}
+	index -= len(preferences.SwiftStores)
+	if index < len(preferences.DBStores) {
+		return &preferences.DBStores[index]
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// Restore downloads the shares of every store to temp dirs before
+// combining them, and the shares of all stores together are the vault. So
+// they are staged sealed, with a key made for the run that is only ever
+// held in memory: a restore that crashes or is killed leaves nothing in the
+// temp dir that can be combined, and the staging dirs are removed when it
+// ends. Uploads of files over the memory budget spool their shares the
+// same way. Folder stores are read in place and their objects are not
+// sealed, so readers take both.
+//
+// A staged file is the magic, a random nonce prefix, and the share in
+// chunks sealed with AES-GCM, each nonce the prefix and the chunk's index.
+// The last chunk is sealed with different additional data so a file cut at
+// a chunk boundary does not open. Chunks let large shares be combined a
+// chunk at a time without reading the whole file.
+
+const (
+	stagedMagic = "CHSMSTG1"
+
+	// plaintext bytes per sealed chunk
+	stagedChunkSize = 64 << 10
+
+	stagedPrefixSize = 8
+	stagedHeaderSize = len(stagedMagic) + stagedPrefixSize
+	stagedTagSize    = 16
+)
+
+var (
+	stagingKeyOnce sync.Once
+	stagingAEAD    cipher.AEAD
+	stagingKeyErr  error
+)
+
+// stagingCipher is the run's cipher for staged shares, its key made on
+// first use and locked into RAM where possible
+func stagingCipher() (cipher.AEAD, error) {
+	stagingKeyOnce.Do(func() {
+		key, _ := lockedBuffer(32)
+		if _, stagingKeyErr = io.ReadFull(rand.Reader, key); stagingKeyErr != nil {
+			return
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			stagingKeyErr = err
+			return
+		}
+		stagingAEAD, stagingKeyErr = cipher.NewGCM(block)
+	})
+	return stagingAEAD, stagingKeyErr
+}
+
+func stagedNonce(prefix []byte, index int64) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[stagedPrefixSize:], uint32(index))
+	return nonce
+}
+
+func stagedAdditionalData(last bool) []byte {
+	if last {
+		return []byte("last")
+	}
+	return nil
+}
+
+// stagedWriter seals what is written to it into a staged file
+type stagedWriter struct {
+	file   *os.File
+	aead   cipher.AEAD
+	prefix []byte
+	chunk  []byte
+	index  int64
+
+	release func()
+}
+
+// createStaged creates a staged file at filePath
+func createStaged(filePath string) (*stagedWriter, error) {
+	aead, err := stagingCipher()
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, stagedPrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(append([]byte(stagedMagic), prefix...)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	chunk, release := lockedBuffer(stagedChunkSize)
+	return &stagedWriter{file: file, aead: aead, prefix: prefix, chunk: chunk[:0], release: release}, nil
+}
+
+// seal writes the buffered chunk
+func (w *stagedWriter) seal(last bool) error {
+	sealed := w.aead.Seal(nil, stagedNonce(w.prefix, w.index), w.chunk, stagedAdditionalData(last))
+	w.index++
+	wipe(w.chunk)
+	w.chunk = w.chunk[:0]
+	_, err := w.file.Write(sealed)
+	return err
+}
+
+func (w *stagedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more follows, as it may be the last
+		if len(w.chunk) == stagedChunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.chunk[len(w.chunk):stagedChunkSize], p)
+		w.chunk = w.chunk[:len(w.chunk)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last chunk, which may be empty
+func (w *stagedWriter) Close() error {
+	err := w.seal(true)
+	w.release()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// stageShare writes a share downloaded from a store to dir, sealed
+func stageShare(dir, object string, data []byte) error {
+	w, err := createStaged(filepath.Join(dir, object))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// stagedFile reads a staged file, or a plain one as folder stores hold
+type stagedFile struct {
+	file *os.File
+	size int64
+
+	// nil for plain files
+	aead   cipher.AEAD
+	prefix []byte
+	chunks int64
+}
+
+// openStaged opens a staged or plain file
+func openStaged(filePath string) (*stagedFile, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	header := make([]byte, stagedHeaderSize)
+	n, _ := file.ReadAt(header, 0)
+	if n < stagedHeaderSize || string(header[:len(stagedMagic)]) != stagedMagic {
+		return &stagedFile{file: file, size: fi.Size()}, nil
+	}
+
+	aead, err := stagingCipher()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	sealedSize := fi.Size() - int64(stagedHeaderSize)
+	sealedChunk := int64(stagedChunkSize + stagedTagSize)
+	chunks := (sealedSize + sealedChunk - 1) / sealedChunk
+	if chunks == 0 || sealedSize-chunks*stagedTagSize < 0 {
+		file.Close()
+		return nil, errors.New("staged share is truncated")
+	}
+	return &stagedFile{
+		file:   file,
+		size:   sealedSize - chunks*stagedTagSize,
+		aead:   aead,
+		prefix: header[len(stagedMagic):],
+		chunks: chunks,
+	}, nil
+}
+
+// Size of the share
+func (f *stagedFile) Size() int64 {
+	return f.size
+}
+
+// ReadAt reads share bytes from off, opening the chunks they are in
+func (f *stagedFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.aead == nil {
+		return f.file.ReadAt(p, off)
+	}
+
+	read := 0
+	sealed := make([]byte, stagedChunkSize+stagedTagSize)
+	for read < len(p) {
+		if off >= f.size {
+			return read, io.EOF
+		}
+		index := off / stagedChunkSize
+		n, err := f.file.ReadAt(sealed, int64(stagedHeaderSize)+index*int64(len(sealed)))
+		if err != nil && err != io.EOF {
+			return read, err
+		}
+		chunk, err := f.aead.Open(nil, stagedNonce(f.prefix, index), sealed[:n], stagedAdditionalData(index == f.chunks-1))
+		if err != nil {
+			return read, fmt.Errorf("staged share is corrupt: %s", err)
+		}
+		n = copy(p[read:], chunk[off-index*stagedChunkSize:])
+		wipe(chunk)
+		read += n
+		off += int64(n)
+	}
+	return read, nil
+}
+
+func (f *stagedFile) Close() error {
+	return f.file.Close()
+}
+
+// readStaged reads a whole staged or plain file
+func readStaged(filePath string) ([]byte, error) {
+	f, err := openStaged(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := make([]byte, f.size)
+	if _, err := f.ReadAt(data, 0); err != nil && err != io.EOF {
+		wipe(data)
+		return nil, err
+	}
+	return data, nil
+}
+
+// readStagedObject reads an object of a restore dir
+func readStagedObject(dir, object string) ([]byte, error) {
+	return readStaged(filepath.Join(dir, object))
+}
+
+// removeStaging removes the staging dirs of a restore, leaving the dirs of
+// folder stores that were read in place
+func removeStaging(sharePaths []string) {
+	temp := absSlash(os.TempDir())
+	for _, sp := range sharePaths {
+		dir := absSlash(sp)
+		if temp != "" && path.Dir(dir) == temp && hasPrefixIn(path.Base(dir), stagingPrefixes) {
+			os.RemoveAll(sp)
+		}
+	}
+}
+
+// stagedSize is the size of the share in a staged or plain file
+func stagedSize(filePath string) (int64, error) {
+	f, err := openStaged(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Size(), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// LocalState is machine-local state kept next to the preferences. Unlike
+// the preferences it is never shared to the cloud stores
+type LocalState struct {
+	root string
+
+	// plain output for screen readers on every run, see output.go
+	PlainOutput bool `json:"plain_output,omitempty"`
+
+	// statistics of past runs, oldest first
+	Runs []RunStats `json:"runs"`
+
+	// token required by the daemon API
+	APIToken string `json:"api_token"`
+
+	// named tokens of the daemon API, limited to a scope
+	APITokens []ScopedToken `json:"api_tokens,omitempty"`
+
+	// change journal position of the last sync, nil walks the whole tree
+	Journal *JournalCursor `json:"journal,omitempty"`
+
+	// identities of tracked files, to recognize renames
+	FileIDs map[string]FileID `json:"file_ids,omitempty"`
+
+	// per remote vault, the file versions both sides held after the last
+	// replication
+	ReplicaBase map[string]map[string]string `json:"replica_base,omitempty"`
+
+	// files a sync left for the next one when it hit its deadline
+	PendingUploads map[string]bool `json:"pending_uploads,omitempty"`
+
+	// friends whose shares this daemon hosts
+	Peers []HostedPeer `json:"peers,omitempty"`
+
+	// last time every store listed each tracked file's shares
+	Listed map[string]time.Time `json:"listed,omitempty"`
+
+	// challenges left for each share uploaded to each peer store, by peer
+	// URL and object, see proof.go
+	PeerChallenges map[string]map[string][]StorageChallenge `json:"peer_challenges,omitempty"`
+
+	// base64 Ed25519 seed compliance reports are signed with
+	ReportKey string `json:"report_key,omitempty"`
+
+	// passwords, keys and tokens of the stores, by store and name, see
+	// credentials.go
+	StoreCredentials map[string]map[string]string `json:"store_credentials,omitempty"`
+
+	// checksums of the ranges of every object uploaded, by store and object,
+	// for sampled verifies
+	RangeSums map[string]map[string]RangeSums `json:"range_sums,omitempty"`
+
+	// when each primary store was first found down, while it stays down
+	StoreDownSince map[string]time.Time `json:"store_down_since,omitempty"`
+
+	// directories shares are written to instead of the store, by store,
+	// until the store is reconciled with them
+	Seeding map[string]string `json:"seeding,omitempty"`
+
+	// fleet config the vault's settings come from, nil if they are its own
+	Fleet *FleetEnrollment `json:"fleet,omitempty"`
+}
+
+var state LocalState
+
+const chasmStateFile = ".chasmstate"
+
+// LoadState loads the local state for the chasm root, if any
+func LoadState(root string) {
+	state = LocalState{}
+	stateBytes, err := ioutil.ReadFile(path.Join(root, chasmStateFile))
+	if err == nil {
+		if err := json.Unmarshal(stateBytes, &state); err != nil {
+			color.Red("Error: could not read %s: %s", chasmStateFile, err)
+		}
+	}
+	state.root = root
+}
+
+// Save saves the local state
+func (s LocalState) Save() {
+	stateFilePath := path.Join(s.root, chasmStateFile)
+	stateBytes, err := json.MarshalIndent(s, "", "    ")
+	check(err)
+
+	if err := ioutil.WriteFile(stateFilePath, stateBytes, 0600); err != nil {
+		color.Red("Error: could not write to %s: %s", stateFilePath, err)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// RunStats are the statistics of a single chasm run
+type RunStats struct {
+	Command  string        `json:"command"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Files    int           `json:"files"`
+	Bytes    int64         `json:"bytes"`
+	Errors   int           `json:"errors"`
+
+	// files examined, and what became of them: shared as new files or as
+	// updates, left as stored, or skipped
+	Examined  int `json:"examined,omitempty"`
+	Added     int `json:"added,omitempty"`
+	Updated   int `json:"updated,omitempty"`
+	Unchanged int `json:"unchanged,omitempty"`
+	Skipped   int `json:"skipped,omitempty"`
+
+	// warnings printed during the run
+	Warnings int `json:"warnings,omitempty"`
+
+	// fraction of bytes whose content was already stored unchanged
+	DedupRatio float64 `json:"dedup_ratio"`
+
+	// stopped at its deadline, leaving Pending files for the next run
+	Partial bool `json:"partial,omitempty"`
+	Pending int  `json:"pending,omitempty"`
+
+	// sizes through sharing of the files uploaded, by data class
+	Pipeline map[string]PipelineStats `json:"pipeline,omitempty"`
+
+	unchangedBytes int64
+	warnings       []string
+
+	// ends the span of the run, see telemetry.go
+	endSpan func()
+}
+
+// PipelineStats add up the size of files at each stage of sharing. chasm
+// does not compress, so the stages are the contents, the contents sealed
+// for a protected directory, and the shares uploaded to each store
+type PipelineStats struct {
+	Files    int   `json:"files"`
+	Original int64 `json:"original"`
+	Sealed   int64 `json:"sealed"`
+
+	// bytes uploaded to each store, by store number from 1
+	Stored []int64 `json:"stored"`
+}
+
+// Add adds the stages of one file
+func (p PipelineStats) Add(other PipelineStats) PipelineStats {
+	p.Files += other.Files
+	p.Original += other.Original
+	p.Sealed += other.Sealed
+	for i, stored := range other.Stored {
+		if i == len(p.Stored) {
+			p.Stored = append(p.Stored, 0)
+		}
+		p.Stored[i] += stored
+	}
+	return p
+}
+
+// TotalStored is the bytes uploaded to all stores
+func (p PipelineStats) TotalStored() int64 {
+	var total int64
+	for _, stored := range p.Stored {
+		total += stored
+	}
+	return total
+}
+
+// Overhead is the bytes stored per byte of contents
+func (p PipelineStats) Overhead() float64 {
+	if p.Original == 0 {
+		return 0
+	}
+	return float64(p.TotalStored()) / float64(p.Original)
+}
+
+// the run statistics are being collected for, nil outside of a run
+var currentRun *RunStats
+
+// print the pipeline stages of every file shared, from --verbose
+var verbose bool
+
+// StartRun starts collecting statistics for command
+func StartRun(command string) {
+	currentRun = &RunStats{Command: command, Start: time.Now(), endSpan: startSpan("chasm " + command)}
+}
+
+// FinishRun records the current run in the local state, pruning runs older
+// than the stats retention
+func FinishRun() {
+	if currentRun == nil {
+		return
+	}
+
+	currentRun.Duration = time.Since(currentRun.Start)
+	if currentRun.Bytes > 0 {
+		currentRun.DedupRatio = float64(currentRun.unchangedBytes) / float64(currentRun.Bytes)
+	}
+
+	runs := append(state.Runs, *currentRun)
+	if preferences.StatsRetentionDays > 0 {
+		cutoff := time.Now().AddDate(0, 0, -preferences.StatsRetentionDays)
+		for len(runs) > 0 && runs[0].Start.Before(cutoff) {
+			runs = runs[1:]
+		}
+	}
+
+	state.Runs = runs
+	state.Save()
+	finishRunSummary(*currentRun)
+	currentRun.endSpan()
+	currentRun = nil
+	flushTelemetry()
+}
+
+func countFile(size int64, unchanged bool) {
+	taskProgress(size, false)
+	if currentRun == nil {
+		return
+	}
+
+	currentRun.Files++
+	currentRun.Bytes += size
+	if unchanged {
+		currentRun.unchangedBytes += size
+	}
+	plainProgress()
+}
+
+// dataClass groups files for pipeline statistics, by extension
+func dataClass(filePath string) string {
+	if ext := strings.ToLower(path.Ext(filePath)); ext != "" {
+		return ext
+	}
+	return "(no extension)"
+}
+
+// countPipeline records the stages of sharing filePath, original bytes long
+func countPipeline(filePath string, original int64, uploaded uploadedShares) {
+	stages := PipelineStats{Files: 1, Original: original, Sealed: uploaded.Shared, Stored: uploaded.Sizes}
+	if verbose {
+		sizes := make([]string, len(stages.Stored))
+		for i, stored := range stages.Stored {
+			sizes[i] = fmt.Sprintf("%v) %s", i+1, formatBytes(stored))
+		}
+		color.Cyan("%s: %s, %s sealed, shares %s, x%.2f stored", filePath, formatBytes(original), formatBytes(stages.Sealed), strings.Join(sizes, " "), stages.Overhead())
+	}
+
+	if currentRun == nil {
+		return
+	}
+	if currentRun.Pipeline == nil {
+		currentRun.Pipeline = make(map[string]PipelineStats)
+	}
+	class := dataClass(filePath)
+	currentRun.Pipeline[class] = currentRun.Pipeline[class].Add(stages)
+}
+
+// countDecision counts what became of a file examined: new or update if
+// shared, unchanged if left as stored, skipped if left out
+func countDecision(decision string) {
+	if currentRun == nil {
+		return
+	}
+	switch decision {
+	case "new":
+		currentRun.Added++
+	case "update":
+		currentRun.Updated++
+	case "unchanged":
+		currentRun.Unchanged++
+	case "skipped":
+		currentRun.Skipped++
+	}
+}
+
+func countExamined() {
+	if currentRun != nil {
+		currentRun.Examined++
+	}
+}
+
+// warn prints a warning, and keeps it for the summary of the run
+func warn(format string, args ...interface{}) {
+	color.Yellow(format, args...)
+	if currentRun != nil {
+		currentRun.Warnings++
+		currentRun.warnings = append(currentRun.warnings, fmt.Sprintf(format, args...))
+	}
+}
+
+func countError() {
+	taskProgress(0, true)
+	spanFailed()
+	if currentRun != nil {
+		currentRun.Errors++
+	}
+}
+
+// Summary prints out a human-readable line about the run
+func (r RunStats) Summary() string {
+	summary := fmt.Sprintf("%s %-8s %v files, %v bytes, %v errors, %.0f%% unchanged, took %v",
+		r.Start.Format("2006-01-02 15:04:05"), r.Command, r.Files, r.Bytes, r.Errors,
+		r.DedupRatio*100, r.Duration.Round(time.Millisecond))
+	if r.Partial {
+		summary += fmt.Sprintf(", stopped at deadline with %v files left", r.Pending)
+	}
+	var shared PipelineStats
+	for _, stages := range r.Pipeline {
+		shared = shared.Add(stages)
+	}
+	if shared.Original > 0 {
+		summary += fmt.Sprintf(", shares x%.2f of contents", shared.Overhead())
+	}
+	return summary
+}
+
+// PipelineReport lists the pipeline statistics of runs by data class, with
+// what replicating every file to every store would have stored instead
+func PipelineReport(runs []RunStats) []string {
+	classes := make(map[string]PipelineStats)
+	for _, r := range runs {
+		for class, stages := range r.Pipeline {
+			classes[class] = classes[class].Add(stages)
+		}
+	}
+	names := make([]string, 0, len(classes))
+	for class := range classes {
+		names = append(names, class)
+	}
+	sort.Slice(names, func(i, j int) bool { return classes[names[i]].Original > classes[names[j]].Original })
+
+	var lines []string
+	for _, class := range names {
+		stages := classes[class]
+		sizes := make([]string, len(stages.Stored))
+		for i, stored := range stages.Stored {
+			sizes[i] = fmt.Sprintf("%v) %s", i+1, formatBytes(stored))
+		}
+		lines = append(lines, fmt.Sprintf("%-16s %v files, %s, %s sealed, %s stored (%s), x%.2f, replicating x%v",
+			class, stages.Files, formatBytes(stages.Original), formatBytes(stages.Sealed),
+			formatBytes(stages.TotalStored()), strings.Join(sizes, " "), stages.Overhead(), len(stages.Stored)))
+	}
+	return lines
+}
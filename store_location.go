@@ -0,0 +1,288 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Two stores writing to the same place look like two stores, but hold two
+// shares of every file in one place: losing that place loses both, and with
+// a threshold below the number of stores it alone may rebuild files. Stores
+// name the physical place they keep shares in as a URL-like location,
+// canonical enough to compare: resolved local paths, lowercase hosts with
+// their ports, the account or folder ID of a drive. A store is not added if
+// its location is that of a registered store or inside or around it, as a
+// listing of the outer one would include the inner one's shares. Stores
+// reached through an agent, rclone or a mount can still hide a collision.
+
+// locatable is implemented by stores that can name where their shares are
+type locatable interface {
+	physicalLocation() string
+}
+
+// admitStore checks a store about to be added: it must not share a place
+// with a registered store, and must pass the round trip test
+func admitStore(cs CloudStore) bool {
+	if other := collidingStore(cs); other != nil {
+		color.Red("Error: %s keeps shares in the same place as %s, so one place would hold two shares of every file.", cs.ShortDescription(), other.ShortDescription())
+		color.Red("The store was not added.")
+		return false
+	}
+	return probeStore(cs)
+}
+
+// collidingStore finds the registered store whose location overlaps that
+// of cs, if any
+func collidingStore(cs CloudStore) CloudStore {
+	l, ok := cs.(locatable)
+	if !ok {
+		return nil
+	}
+	location := l.physicalLocation()
+
+	stores := preferences.primaryStores()
+	if preferences.Standby != nil {
+		stores = append(stores, preferences.Standby.store())
+	}
+	for _, other := range stores {
+		if o, ok := other.(locatable); ok && locationsOverlap(location, o.physicalLocation()) {
+			return other
+		}
+	}
+	return nil
+}
+
+// locationsOverlap checks if a and b are the same location or one is
+// inside the other
+func locationsOverlap(a, b string) bool {
+	a, b = strings.TrimSuffix(a, "/"), strings.TrimSuffix(b, "/")
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// localLocation is the resolved absolute path of a local directory, folded
+// to lowercase where file names ignore case
+func localLocation(dirPath string) string {
+	abs, err := filepath.Abs(dirPath)
+	if err != nil {
+		abs = dirPath
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	}
+	abs = filepath.ToSlash(filepath.Clean(abs))
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		abs = strings.ToLower(abs)
+	}
+	return "file://" + strings.TrimPrefix(abs, "/")
+}
+
+// hostLocation is host in lowercase with its port, defaultPort if it has
+// none
+func hostLocation(host, defaultPort string) string {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		h, port = host, defaultPort
+	}
+	return net.JoinHostPort(strings.ToLower(strings.Trim(h, "[]")), port)
+}
+
+// urlLocation is rawURL with a lowercase scheme and host, the port made
+// explicit and the path cleaned
+func urlLocation(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	port := "443"
+	if u.Scheme == "http" {
+		port = "80"
+	}
+	return strings.ToLower(u.Scheme) + "://" + hostLocation(u.Host, port) + cleanLocationPath(u.Path)
+}
+
+// cleanLocationPath is p cleaned, starting with a slash unless empty
+func cleanLocationPath(p string) string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// remotePath is the location path of a directory on a server signed in to
+// as user, relative ones being in the user's home directory
+func remotePath(user, p string) string {
+	if strings.HasPrefix(p, "/") {
+		return cleanLocationPath(p)
+	}
+	return "/~" + user + cleanLocationPath(p)
+}
+
+func (f FolderStore) physicalLocation() string {
+	return localLocation(f.Path)
+}
+
+func (k KBFSStore) physicalLocation() string {
+	return localLocation(k.folder().Path)
+}
+
+// app data folders are per account
+func (g GDriveStore) physicalLocation() string {
+	return "gdrive://" + g.UserID
+}
+
+// app folders are per account
+func (d DropboxStore) physicalLocation() string {
+	return "dropbox://" + d.AccountID
+}
+
+func (o OneDriveStore) physicalLocation() string {
+	return "onedrive://" + o.UserID
+}
+
+func (b BoxStore) physicalLocation() string {
+	return "box://" + b.FolderID
+}
+
+// bucket names are global on AWS, so the region does not matter
+func (s S3Store) physicalLocation() string {
+	host := "s3.amazonaws.com"
+	if s.Endpoint != "" {
+		if u, err := url.Parse(s.Endpoint); err == nil && u.Host != "" {
+			host = hostLocation(u.Host, "443")
+		}
+	}
+	return "s3://" + host + "/" + s.Bucket + cleanLocationPath(s.Prefix)
+}
+
+func (b B2Store) physicalLocation() string {
+	return "b2://" + b.Bucket
+}
+
+func (s SFTPStore) physicalLocation() string {
+	return "sftp://" + hostLocation(s.Host, "22") + remotePath(s.User, s.Path)
+}
+
+func (f FTPStore) physicalLocation() string {
+	return "ftp://" + hostLocation(f.Host, "21") + remotePath(f.User, f.Path)
+}
+
+func (w WebDAVStore) physicalLocation() string {
+	return urlLocation(strings.TrimSuffix(w.URL, "/") + "/" + strings.Trim(w.Folder, "/"))
+}
+
+func (a AzureBlobStore) physicalLocation() string {
+	return urlLocation(a.Endpoint) + "/" + a.Container
+}
+
+func (g GCSStore) physicalLocation() string {
+	return "gs://" + g.Bucket
+}
+
+func (m MegaStore) physicalLocation() string {
+	return "mega://" + strings.ToLower(m.Email) + cleanLocationPath(m.Folder)
+}
+
+func (p PCloudStore) physicalLocation() string {
+	return "pcloud://" + p.Region + "/" + strings.ToLower(p.Email) + cleanLocationPath(p.Folder)
+}
+
+// the token is all that tells accounts apart
+func (y YandexDiskStore) physicalLocation() string {
+	return "yandex://" + y.OAuthToken + cleanLocationPath(y.Folder)
+}
+
+// share and path names ignore case on SMB
+func (s SMBStore) physicalLocation() string {
+	return strings.ToLower("smb://" + hostLocation(s.Server, "445") + "/" + s.Share + cleanLocationPath(strings.Replace(s.Path, `\`, "/", -1)))
+}
+
+func (r RcloneStore) physicalLocation() string {
+	config := r.Config
+	if config != "" {
+		config = localLocation(config)
+	}
+	remote := r.Remote
+	if i := strings.Index(remote, ":"); i >= 0 {
+		remote = remote[:i] + cleanLocationPath(remote[i+1:])
+	}
+	return "rclone://" + config + "#" + remote
+}
+
+// shares pinned on one node are gone with it
+func (s IPFSStore) physicalLocation() string {
+	return "ipfs+" + urlLocation(s.API)
+}
+
+func (s StorjStore) physicalLocation() string {
+	return "sj://" + s.satellite() + "/" + s.Bucket + cleanLocationPath(s.Prefix)
+}
+
+func (p PeerStore) physicalLocation() string {
+	return "peer+" + urlLocation(p.URL)
+}
+
+// stores an agent keeps are told apart by their number
+func (a AgentStore) physicalLocation() string {
+	return "agent+" + localLocation(a.Socket) + "#" + strconv.Itoa(a.Index)
+}
+
+// stores of one mailbox would file each other's mails from its inbox
+func (e EmailStore) physicalLocation() string {
+	return "imap://" + hostLocation(e.IMAPHost, "993") + "/" + strings.ToLower(e.User)
+}
+
+func (t TelegramStore) physicalLocation() string {
+	return "telegram://" + strings.ToLower(t.Chat)
+}
+
+// branches of one repository go with it, whichever protocol reaches it
+func (g GitStore) physicalLocation() string {
+	remote := strings.TrimSuffix(strings.TrimSuffix(g.Remote, "/"), ".git")
+	if u, err := url.Parse(remote); err == nil && u.Host != "" {
+		return "git://" + strings.ToLower(u.Hostname()) + cleanLocationPath(u.Path)
+	}
+	// scp-like user@host:path
+	if i := strings.Index(remote, ":"); i > 0 && !strings.Contains(remote[:i], "/") {
+		host := remote[:i]
+		if at := strings.LastIndex(host, "@"); at >= 0 {
+			host = host[at+1:]
+		}
+		return "git://" + strings.ToLower(host) + cleanLocationPath(remote[i+1:])
+	}
+	return "git+" + localLocation(remote)
+}
+
+// the same container may be reached as another user of the project, so the
+// user is left out
+func (s SwiftStore) physicalLocation() string {
+	return urlLocation(s.AuthURL) + "/" + s.Project + "@" + s.Region + "/" + s.Container + cleanLocationPath(s.Prefix)
+}
+
+// a PostgreSQL database is its server and name, in either DSN form
+func (d DBStore) physicalLocation() string {
+	if d.Driver == "sqlite" {
+		return localLocation(dbDSNPath(d.DSN)) + "#" + d.Table
+	}
+	if u, err := url.Parse(d.DSN); err == nil && u.Host != "" {
+		return "postgres://" + hostLocation(u.Host, "5432") + cleanLocationPath(u.Path) + "#" + d.Table
+	}
+	params := make(map[string]string)
+	for _, field := range strings.Fields(d.DSN) {
+		if i := strings.Index(field, "="); i > 0 {
+			params[field[:i]] = field[i+1:]
+		}
+	}
+	port := params["port"]
+	if port == "" {
+		port = "5432"
+	}
+	return "postgres://" + hostLocation(net.JoinHostPort(params["host"], port), "5432") + cleanLocationPath(params["dbname"]) + "#" + d.Table
+}
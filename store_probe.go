@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// A store that takes its settings can still fail the first real sync: a
+// token without write scope, a bucket policy denying deletes, a mount that
+// is read-only. Before a store is added, a test object of random bytes is
+// written to it, read back and deleted, so broken stores are refused up
+// front, and the time each step took is printed as a first measure of the
+// store's latency and throughput. The test object is named like any share,
+// so one left behind by a failed delete is removed by compaction.
+
+// size of the test object, unless the store's objects are smaller
+const probeSize = 1 << 20
+
+// probeStore runs the write, read and delete round trip on a store about to
+// be added, returning false if any step failed
+func probeStore(cs CloudStore) bool {
+	color.Cyan("Testing %s...", cs.ShortDescription())
+	timings, err := roundTrip(cs)
+	if err != nil {
+		color.Red(statusLine(true, fmt.Sprintf("%s failed the write, read and delete test: %s", cs.ShortDescription(), err)))
+		color.Red("The store was not added.")
+		return false
+	}
+	color.Green(statusLine(false, timings))
+	return true
+}
+
+// roundTrip writes, reads back and deletes a test object, describing how
+// long each took
+func roundTrip(cs CloudStore) (string, error) {
+	size := int64(probeSize)
+	if max := objectPartSize(cs); max > 0 && max < size {
+		size = max
+	}
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	share := Share{SID: RandomShareID(), Version: NewShareVersion(), Data: data}
+	object := share.ObjectName()
+
+	// Upload only prints its errors, reading back tells if it worked
+	start := time.Now()
+	cs.Upload(share)
+	write := time.Since(start)
+
+	start = time.Now()
+	var got []byte
+	var err error
+	if reader, ok := cs.(objectReader); ok {
+		got, err = reader.Read(object)
+	} else if !listed(cs, object) {
+		err = errors.New("object missing after upload")
+	} else {
+		got = data
+	}
+	read := time.Since(start)
+	if err != nil {
+		cs.Remove(object)
+		return "", fmt.Errorf("cannot read the test object back: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		cs.Remove(object)
+		return "", errors.New("the test object read back differs from the one written")
+	}
+
+	start = time.Now()
+	cs.Remove(object)
+	remove := time.Since(start)
+	if listed(cs, object) {
+		return "", errors.New("cannot delete the test object")
+	}
+
+	return fmt.Sprintf("%s: wrote %s in %v (%.1f MB/s), read it back in %v (%.1f MB/s), deleted it in %v",
+		cs.ShortDescription(), formatBytes(size), roundDuration(write), throughput(int(size), write),
+		roundDuration(read), throughput(int(size), read), roundDuration(remove)), nil
+}
+
+// listed checks if the store lists object
+func listed(cs CloudStore, object string) bool {
+	for _, name := range cs.List() {
+		if name == object {
+			return true
+		}
+	}
+	return false
+}
+
+// roundDuration rounds d to milliseconds, or microseconds below one
+func roundDuration(d time.Duration) time.Duration {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(time.Millisecond)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+
+	"github.com/fatih/color"
+)
+
+// Chasm can run as two processes, so that neither holds both the files it
+// backs up and the credentials of the stores. A store agent runs as an
+// unprivileged account with `chasm --root AGENT_DIR agent serve --socket
+// PATH`: its vault at AGENT_DIR only holds store configurations, added there
+// with the usual `chasm add` commands, and it never reads the files backed
+// up. The vault itself, run by an account that can read them, adds the
+// agent's stores with `chasm agent use PATH`, keeping none of their
+// credentials, and hands every share to the agent over the local socket.
+// The file reader then needs no network access and the agent no access to
+// the files, which SELinux or AppArmor profiles of each can enforce. Access
+// to the agent is that to its socket, readable and writable by its account
+// and group.
+
+// AgentStore is a store of a store agent, reached through its socket
+type AgentStore struct {
+	Socket string `json:"socket"`
+
+	// number of the store among the agent's, from 0
+	Index int `json:"index"`
+
+	// ShortDescription of the store in the agent
+	Name string `json:"name"`
+
+	// MaxObjectSize of the store in the agent
+	ObjectLimit int64 `json:"object_limit,omitempty"`
+}
+
+// StoreAgent serves the stores of its vault to the vault reading the files
+type StoreAgent struct{}
+
+// AgentStoreInfo describes a store of the agent
+type AgentStoreInfo struct {
+	Name        string
+	ObjectLimit int64
+}
+
+// AgentObject names an object of a store of the agent
+type AgentObject struct {
+	Index  int
+	Object string
+}
+
+// AgentRange is part of an object of a store of the agent
+type AgentRange struct {
+	AgentObject
+	Offset, Length int64
+}
+
+// AgentUpload is a share to upload to a store of the agent
+type AgentUpload struct {
+	Index int
+	Share Share
+}
+
+// agentStore is the agent's store numbered index, with the failover and
+// seeding of the agent's vault but none of the wrappers, which the vault
+// using the agent adds
+func agentStore(index int) (CloudStore, error) {
+	cloudStores := preferences.cloudStores()
+	if index < 0 || index >= len(cloudStores) {
+		return nil, fmt.Errorf("no store %d in the agent", index)
+	}
+	return cloudStores[index], nil
+}
+
+// Stores lists the stores of the agent
+func (StoreAgent) Stores(_ struct{}, reply *[]AgentStoreInfo) error {
+	for _, cs := range preferences.cloudStores() {
+		info := AgentStoreInfo{Name: cs.ShortDescription()}
+		if limited, ok := cs.(objectSizeLimited); ok {
+			info.ObjectLimit = limited.MaxObjectSize()
+		}
+		*reply = append(*reply, info)
+	}
+	return nil
+}
+
+// Upload writes a share to a store of the agent
+func (StoreAgent) Upload(args AgentUpload, reply *bool) error {
+	cs, err := agentStore(args.Index)
+	if err != nil {
+		return err
+	}
+	cs.Upload(args.Share)
+	return nil
+}
+
+// Remove deletes an object from a store of the agent
+func (StoreAgent) Remove(args AgentObject, reply *bool) error {
+	cs, err := agentStore(args.Index)
+	if err != nil {
+		return err
+	}
+	cs.Remove(args.Object)
+	return nil
+}
+
+// List lists the objects of a store of the agent
+func (StoreAgent) List(index int, reply *[]string) error {
+	cs, err := agentStore(index)
+	if err != nil {
+		return err
+	}
+	*reply = cs.List()
+	return nil
+}
+
+// Read downloads an object of a store of the agent
+func (StoreAgent) Read(args AgentObject, reply *[]byte) error {
+	cs, err := agentStore(args.Index)
+	if err != nil {
+		return err
+	}
+	reader, ok := cs.(objectReader)
+	if !ok {
+		return errors.New("store cannot download single objects")
+	}
+	*reply, err = reader.Read(args.Object)
+	return err
+}
+
+// ReadRange downloads part of an object of a store of the agent
+func (StoreAgent) ReadRange(args AgentRange, reply *[]byte) error {
+	cs, err := agentStore(args.Index)
+	if err != nil {
+		return err
+	}
+	reader, ok := cs.(rangeReader)
+	if !ok {
+		return errors.New("store cannot download parts of objects")
+	}
+	*reply, err = reader.ReadRange(args.Object, args.Offset, args.Length)
+	return err
+}
+
+// Description describes a store of the agent
+func (StoreAgent) Description(index int, reply *string) error {
+	cs, err := agentStore(index)
+	if err != nil {
+		return err
+	}
+	*reply = cs.Description()
+	return nil
+}
+
+// Clean deletes all shares from a store of the agent
+func (StoreAgent) Clean(index int, reply *bool) error {
+	cs, err := agentStore(index)
+	if err != nil {
+		return err
+	}
+	cs.Clean()
+	return nil
+}
+
+// ServeStoreAgent serves the stores of the vault on a unix socket
+func ServeStoreAgent(socket string) error {
+	server := rpc.NewServer()
+	if err := server.Register(StoreAgent{}); err != nil {
+		return err
+	}
+
+	// a socket left by an agent that stopped
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		return fmt.Errorf("a store agent is running on %s", socket)
+	}
+	os.Remove(socket)
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(socket, 0660); err != nil {
+		return err
+	}
+
+	color.Green("Serving %v stores on %s", preferences.RegisteredServices(), socket)
+	server.Accept(listener)
+	return nil
+}
+
+// callAgent calls method of the agent on socket
+func callAgent(socket, method string, args, reply interface{}) error {
+	client, err := rpc.Dial("unix", socket)
+	if err != nil {
+		return fmt.Errorf("store agent unreachable: %s", err)
+	}
+	defer client.Close()
+	return client.Call("StoreAgent."+method, args, reply)
+}
+
+// UseStoreAgent adds the stores of the agent on socket. Stores added from it
+// before keep their place, as shares are spread by the order of stores
+func UseStoreAgent(socket string) ([]AgentStore, error) {
+	var infos []AgentStoreInfo
+	if err := callAgent(socket, "Stores", struct{}{}, &infos); err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, errors.New("the store agent has no stores")
+	}
+
+	// stores after the last one added before are new
+	next := 0
+	for i, as := range preferences.AgentStores {
+		if as.Socket != socket {
+			continue
+		}
+		if as.Index >= len(infos) {
+			return nil, fmt.Errorf("the store agent no longer has %s, remove it with chasm remove first", as.Name)
+		}
+		info := infos[as.Index]
+		preferences.AgentStores[i].Name, preferences.AgentStores[i].ObjectLimit = info.Name, info.ObjectLimit
+		if as.Index >= next {
+			next = as.Index + 1
+		}
+	}
+
+	var added []AgentStore
+	for i := next; i < len(infos); i++ {
+		added = append(added, AgentStore{Socket: socket, Index: i, Name: infos[i].Name, ObjectLimit: infos[i].ObjectLimit})
+	}
+	preferences.AgentStores = append(preferences.AgentStores, added...)
+	return added, nil
+}
+
+// Upload hands the share to the agent
+func (a AgentStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading %s/%s...", a.Name, share.ObjectName()))
+	if err := callAgent(a.Socket, "Upload", AgentUpload{Index: a.Index, Share: share}, new(bool)); err != nil {
+		color.Red("%s/%s upload failed: %v", a.Name, share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// Remove permanently deletes a single object
+func (a AgentStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting %s/%s...", a.Name, object))
+	if err := callAgent(a.Socket, "Remove", AgentObject{Index: a.Index, Object: object}, new(bool)); err != nil {
+		color.Red("Error: could not delete %s from %s: %s", object, a.Name, err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all objects in the store
+func (a AgentStore) list() ([]string, error) {
+	var objects []string
+	err := callAgent(a.Socket, "List", a.Index, &objects)
+	return objects, err
+}
+
+// List returns the names of all objects in the store
+func (a AgentStore) List() []string {
+	objects, err := a.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", a.Name, err)
+		return nil
+	}
+	return objects
+}
+
+// Read downloads a single object
+func (a AgentStore) Read(object string) ([]byte, error) {
+	var data []byte
+	err := callAgent(a.Socket, "Read", AgentObject{Index: a.Index, Object: object}, &data)
+	return data, err
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (a AgentStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	var data []byte
+	args := AgentRange{AgentObject: AgentObject{Index: a.Index, Object: object}, Offset: offset, Length: length}
+	err := callAgent(a.Socket, "ReadRange", args, &data)
+	return data, err
+}
+
+// Restore downloads shares to local restore path
+func (a AgentStore) Restore() string {
+	objects, err := a.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", a.Name, err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_agent_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from %s...", a.Name)
+	for _, object := range objects {
+		data, err := a.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects in the store, as the agent describes it
+func (a AgentStore) Description() string {
+	var description string
+	if err := callAgent(a.Socket, "Description", a.Index, &description); err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", a.ShortDescription(), err)
+	}
+	return "Store Agent " + a.Socket + ": " + description
+}
+
+func (a AgentStore) ShortDescription() string {
+	return "Store Agent " + a.Socket + ": " + a.Name
+}
+
+// Clean deletes all shares from the store
+func (a AgentStore) Clean() {
+	if err := callAgent(a.Socket, "Clean", a.Index, new(bool)); err != nil {
+		color.Red("Error: could not clean %s: %s", a.Name, err)
+	}
+}
+
+// MaxObjectSize of the store in the agent
+func (a AgentStore) MaxObjectSize() int64 {
+	return a.ObjectLimit
+}
@@ -0,0 +1,254 @@
+// Package storesim emulates the object store semantics chasm relies on
+// (upload, download, delete, list, checksums) over a path-style S3 subset,
+// so store backends can be integration tested without cloud accounts.
+//
+//	PUT    /<bucket>/<key>                  upload, If-None-Match: * refuses overwrites
+//	GET    /<bucket>/<key>                  download, Range requests supported
+//	HEAD   /<bucket>/<key>                  metadata only
+//	DELETE /<bucket>/<key>                  delete, succeeds if missing
+//	GET    /<bucket>?list-type=2&prefix=... ListObjectsV2
+//
+// Server-side encryption headers (x-amz-server-side-encryption*) are recorded
+// on upload and echoed on download. Objects uploaded with an SSE-C key can
+// only be read with the same key. Requests are not authenticated. Objects live
+// in memory. Stores with APIs of their own, such as Drive, are not emulated.
+package storesim
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Object is a stored object
+type Object struct {
+	Data         []byte
+	ETag         string
+	SHA256       string
+	LastModified time.Time
+
+	// server-side encryption headers given on upload
+	SSE http.Header
+}
+
+const (
+	sseHeader            = "X-Amz-Server-Side-Encryption"
+	sseCustomerKeyHeader = "X-Amz-Server-Side-Encryption-Customer-Key"
+)
+
+// Server is an in-memory object store
+type Server struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]Object
+}
+
+// NewServer creates an empty store. Buckets are created on first upload
+func NewServer() *Server {
+	return &Server{buckets: make(map[string]map[string]Object)}
+}
+
+// Objects returns a copy of the objects in bucket, for assertions in tests
+func (s *Server) Objects(bucket string) map[string]Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	objects := make(map[string]Object)
+	for key, object := range s.buckets[bucket] {
+		objects[key] = object
+	}
+	return objects
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key := splitPath(r.URL.Path)
+	if bucket == "" {
+		http.Error(w, "missing bucket", http.StatusBadRequest)
+		return
+	}
+
+	if key == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.list(w, r, bucket)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		s.put(w, r, bucket, key)
+	case http.MethodGet, http.MethodHead:
+		s.get(w, r, bucket, key)
+	case http.MethodDelete:
+		s.delete(w, bucket, key)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func splitPath(p string) (bucket, key string) {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)
+	bucket = parts[0]
+	if len(parts) > 1 {
+		key = parts[1]
+	}
+	return
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	md5Sum := md5.Sum(data)
+	shaSum := sha256.Sum256(data)
+	object := Object{
+		Data:         data,
+		ETag:         `"` + hex.EncodeToString(md5Sum[:]) + `"`,
+		SHA256:       base64.StdEncoding.EncodeToString(shaSum[:]),
+		LastModified: time.Now().UTC(),
+	}
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, sseHeader) {
+			if object.SSE == nil {
+				object.SSE = make(http.Header)
+			}
+			object.SSE[name] = values
+		}
+	}
+
+	if expected := r.Header.Get("x-amz-checksum-sha256"); expected != "" && expected != object.SHA256 {
+		http.Error(w, "checksum mismatch", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = make(map[string]Object)
+	}
+	if _, exists := s.buckets[bucket][key]; exists && r.Header.Get("If-None-Match") == "*" {
+		http.Error(w, "object exists", http.StatusPreconditionFailed)
+		return
+	}
+	s.buckets[bucket][key] = object
+
+	echoSSE(w, object)
+	w.Header().Set("ETag", object.ETag)
+	w.Header().Set("x-amz-checksum-sha256", object.SHA256)
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	s.mu.Lock()
+	object, ok := s.buckets[bucket][key]
+	s.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "no such key", http.StatusNotFound)
+		return
+	}
+	if key := object.SSE.Get(sseCustomerKeyHeader); key != "" && r.Header.Get(sseCustomerKeyHeader) != key {
+		http.Error(w, "object is encrypted with a customer key", http.StatusBadRequest)
+		return
+	}
+
+	echoSSE(w, object)
+	w.Header().Set("ETag", object.ETag)
+	w.Header().Set("x-amz-checksum-sha256", object.SHA256)
+	http.ServeContent(w, r, key, object.LastModified, bytes.NewReader(object.Data))
+}
+
+// echoSSE returns the encryption headers of an object, except the customer key
+func echoSSE(w http.ResponseWriter, object Object) {
+	for name, values := range object.SSE {
+		if name != sseCustomerKeyHeader {
+			w.Header()[name] = values
+		}
+	}
+}
+
+func (s *Server) delete(w http.ResponseWriter, bucket, key string) {
+	s.mu.Lock()
+	delete(s.buckets[bucket], key)
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type listContents struct {
+	Key          string `xml:"Key"`
+	Size         int    `xml:"Size"`
+	ETag         string `xml:"ETag"`
+	LastModified string `xml:"LastModified"`
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	KeyCount              int            `xml:"KeyCount"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	Contents              []listContents `xml:"Contents"`
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	after := query.Get("continuation-token")
+	if after == "" {
+		after = query.Get("start-after")
+	}
+
+	maxKeys := 1000
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n > 0 && n < maxKeys {
+		maxKeys = n
+	}
+
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := listBucketResult{Name: bucket, Prefix: prefix, MaxKeys: maxKeys}
+	for _, key := range keys {
+		if len(result.Contents) == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = result.Contents[maxKeys-1].Key
+			break
+		}
+
+		object := s.buckets[bucket][key]
+		result.Contents = append(result.Contents, listContents{
+			Key:          key,
+			Size:         len(object.Data),
+			ETag:         object.ETag,
+			LastModified: object.LastModified.Format(time.RFC3339),
+		})
+	}
+	s.mu.Unlock()
+
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(result)
+}
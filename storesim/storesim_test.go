@@ -0,0 +1,85 @@
+package storesim
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func put(t *testing.T, url, body string, header http.Header) *http.Response {
+	req, err := http.NewRequest(http.MethodPut, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestPutChecksum(t *testing.T) {
+	server := httptest.NewServer(NewServer())
+	defer server.Close()
+
+	resp := put(t, server.URL+"/bucket/key", "data", http.Header{"X-Amz-Checksum-Sha256": {"bm90IHRoZSBzdW0="}})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("upload with a wrong checksum got %s", resp.Status)
+	}
+
+	resp = put(t, server.URL+"/bucket/key", "data", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload got %s", resp.Status)
+	}
+	resp = put(t, server.URL+"/bucket/key", "other", http.Header{"If-None-Match": {"*"}})
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("overwrite with If-None-Match got %s", resp.Status)
+	}
+}
+
+func TestListPages(t *testing.T) {
+	sim := NewServer()
+	server := httptest.NewServer(sim)
+	defer server.Close()
+
+	for _, key := range []string{"a/1", "a/2", "a/3", "b/1"} {
+		put(t, server.URL+"/bucket/"+key, key, nil)
+	}
+
+	var keys []string
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("listing did not end")
+		}
+		resp, err := http.Get(server.URL + "/bucket?list-type=2&prefix=a/&max-keys=2&continuation-token=" + token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		var result listBucketResult
+		if err := xml.Unmarshal(body, &result); err != nil {
+			t.Fatal(err)
+		}
+		for _, content := range result.Contents {
+			keys = append(keys, content.Key)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	if strings.Join(keys, ",") != "a/1,a/2,a/3" {
+		t.Fatalf("listed %v", keys)
+	}
+}
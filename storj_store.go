@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+	"storj.io/uplink"
+)
+
+// StorjStore keeps shares as objects in a bucket of Storj DCS, under an
+// optional key prefix. Storj erasure codes every object across independent
+// storage nodes, so a share is itself spread out the way chasm spreads
+// files. The access grant holds the satellite, an API key and the
+// passphrase that encrypts objects on the client, and is all a new machine
+// needs to read the bucket again
+type StorjStore struct {
+	// serialized access grant, as created on the satellite or with the
+	// uplink command
+	Access string `json:"-"`
+
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (s *StorjStore) credentials() map[string]*string {
+	return map[string]*string{"access": &s.Access}
+}
+
+// open projects by access grant, so a run dials the satellite once
+var (
+	storjProjectsLock sync.Mutex
+	storjProjects     = make(map[string]*uplink.Project)
+)
+
+// Setup opens the project with the access grant and creates the bucket if
+// missing
+func (s StorjStore) Setup() bool {
+	for _, ss := range preferences.StorjStores {
+		if ss.Bucket == s.Bucket && ss.Prefix == s.Prefix && s.satellite() == ss.satellite() {
+			color.Red("Storj store at %s already exists.", s.location())
+			return false
+		}
+	}
+
+	project, err := s.project()
+	if err == nil {
+		_, err = project.EnsureBucket(context.Background(), s.Bucket)
+	}
+	if err != nil {
+		color.Red("Error: cannot set up %s: %s", s.location(), err)
+		return false
+	}
+	return true
+}
+
+// satellite is the address of the satellite the access grant is for
+func (s StorjStore) satellite() string {
+	access, err := uplink.ParseAccess(s.Access)
+	if err != nil {
+		return ""
+	}
+	return access.SatelliteAddress()
+}
+
+func (s StorjStore) location() string {
+	return "sj://" + path.Join(s.Bucket, s.Prefix)
+}
+
+func (s StorjStore) key(object string) string {
+	if s.Prefix == "" {
+		return object
+	}
+	return strings.TrimSuffix(s.Prefix, "/") + "/" + object
+}
+
+// project opens the project of the access grant, once per run
+func (s StorjStore) project() (*uplink.Project, error) {
+	storjProjectsLock.Lock()
+	defer storjProjectsLock.Unlock()
+	if project, ok := storjProjects[s.Access]; ok {
+		return project, nil
+	}
+
+	access, err := uplink.ParseAccess(s.Access)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access grant: %s", err)
+	}
+	project, err := uplink.OpenProject(context.Background(), access)
+	if err != nil {
+		return nil, err
+	}
+	storjProjects[s.Access] = project
+	return project, nil
+}
+
+func (s StorjStore) upload(object string, data []byte) error {
+	project, err := s.project()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	// uploads replace objects of the same key
+	if _, err := project.StatObject(ctx, s.Bucket, s.key(object)); err == nil {
+		return errors.New("object exists")
+	} else if !errors.Is(err, uplink.ErrObjectNotFound) {
+		return err
+	}
+
+	upload, err := project.UploadObject(ctx, s.Bucket, s.key(object), nil)
+	if err != nil {
+		return err
+	}
+	if _, err := upload.Write(data); err != nil {
+		upload.Abort()
+		return err
+	}
+	return upload.Commit()
+}
+
+// Upload writes the share as a new object, refusing to overwrite one
+func (s StorjStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading %s/%s...", s.location(), share.ObjectName()))
+	if err := s.upload(share.ObjectName(), share.Data); err != nil {
+		color.Red("%s/%s upload failed: %v", s.location(), share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// Remove permanently deletes a single object
+func (s StorjStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting %s/%s...", s.location(), object))
+	project, err := s.project()
+	if err == nil {
+		_, err = project.DeleteObject(context.Background(), s.Bucket, s.key(object))
+	}
+	if err != nil {
+		color.Red("Error: could not delete %s from %s: %s", object, s.location(), err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all objects under the prefix
+func (s StorjStore) list() ([]string, error) {
+	project, err := s.project()
+	if err != nil {
+		return nil, err
+	}
+
+	options := &uplink.ListObjectsOptions{}
+	if s.Prefix != "" {
+		options.Prefix = strings.TrimSuffix(s.Prefix, "/") + "/"
+	}
+	var objects []string
+	iterator := project.ListObjects(context.Background(), s.Bucket, options)
+	for iterator.Next() {
+		item := iterator.Item()
+		if !item.IsPrefix {
+			objects = append(objects, strings.TrimPrefix(item.Key, options.Prefix))
+		}
+	}
+	return objects, iterator.Err()
+}
+
+// List returns the names of all objects under the prefix
+func (s StorjStore) List() []string {
+	objects, err := s.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", s.location(), err)
+		return nil
+	}
+	return objects
+}
+
+// download fetches length bytes of an object from offset, all of it for a
+// length of -1
+func (s StorjStore) download(object string, offset, length int64) ([]byte, error) {
+	project, err := s.project()
+	if err != nil {
+		return nil, err
+	}
+	download, err := project.DownloadObject(context.Background(), s.Bucket, s.key(object), &uplink.DownloadOptions{Offset: offset, Length: length})
+	if err != nil {
+		return nil, err
+	}
+	defer download.Close()
+	return ioutil.ReadAll(download)
+}
+
+// Read downloads a single object
+func (s StorjStore) Read(object string) ([]byte, error) {
+	return s.download(object, 0, -1)
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (s StorjStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	return s.download(object, offset, length)
+}
+
+// Restore downloads shares to local restore path
+func (s StorjStore) Restore() string {
+	objects, err := s.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", s.location(), err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_storj_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from %s...", s.location())
+	for _, object := range objects {
+		data, err := s.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects under the prefix
+func (s StorjStore) Description() string {
+	objects, err := s.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", s.ShortDescription(), err)
+	}
+
+	label := s.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (s StorjStore) ShortDescription() string {
+	return "Storj Store: " + s.location()
+}
+
+// Clean deletes all shares under the prefix
+func (s StorjStore) Clean() {
+	project, err := s.project()
+	if err != nil {
+		color.Red("Error: cannot open %s: %s", s.location(), err)
+		return
+	}
+	for _, object := range s.List() {
+		color.Yellow("Removing Storj Store: %v", object)
+		project.DeleteObject(context.Background(), s.Bucket, s.key(object))
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// SwiftStore keeps shares as objects in a container of OpenStack Swift,
+// as offered by OVHcloud, Infomaniak and other providers, under an
+// optional name prefix. It signs in to Keystone v3 with a user's password
+// and finds the object storage endpoint of the region in the service
+// catalog. Tokens last for hours and are kept for the run, and a rejected
+// one is replaced once
+type SwiftStore struct {
+	// Keystone v3 endpoint, like https://auth.cloud.ovh.net/v3
+	AuthURL  string `json:"auth_url"`
+	User     string `json:"user"`
+	Password string `json:"-"`
+
+	// domain of the user and the project, Default if empty
+	Domain  string `json:"domain,omitempty"`
+	Project string `json:"project"`
+	Region  string `json:"region"`
+
+	Container string `json:"container"`
+	Prefix    string `json:"prefix,omitempty"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (s *SwiftStore) credentials() map[string]*string {
+	return map[string]*string{"password": &s.Password}
+}
+
+const (
+	// largest object of a single PUT
+	swiftMaxObjectSize = 5 << 30
+
+	// objects listed per request
+	swiftPageSize = 1000
+)
+
+// swiftSession is a Keystone token and the object storage endpoint it is
+// for
+type swiftSession struct {
+	token    string
+	endpoint string
+}
+
+// sessions by store, for the run
+var (
+	swiftSessionsLock sync.Mutex
+	swiftSessions     = make(map[string]swiftSession)
+)
+
+type swiftError struct {
+	Status string
+	Body   string
+}
+
+func (e swiftError) Error() string {
+	if e.Body == "" {
+		return e.Status
+	}
+	return fmt.Sprintf("%s: %s", e.Status, e.Body)
+}
+
+// Setup signs in and creates the container if missing
+func (s SwiftStore) Setup() bool {
+	for _, ss := range preferences.SwiftStores {
+		if ss.AuthURL == s.AuthURL && ss.Project == s.Project && ss.Region == s.Region && ss.Container == s.Container && ss.Prefix == s.Prefix {
+			color.Red("Swift store at %s already exists.", s.location())
+			return false
+		}
+	}
+
+	_, err := s.do("PUT", "", nil, nil)
+	if err != nil {
+		color.Red("Error: cannot set up %s: %s", s.location(), err)
+		return false
+	}
+	return true
+}
+
+func (s SwiftStore) location() string {
+	return "swift://" + s.Region + "/" + path.Join(s.Container, s.Prefix)
+}
+
+func (s SwiftStore) domain() string {
+	if s.Domain == "" {
+		return "Default"
+	}
+	return s.Domain
+}
+
+func (s SwiftStore) key(object string) string {
+	if s.Prefix == "" {
+		return object
+	}
+	return strings.TrimSuffix(s.Prefix, "/") + "/" + object
+}
+
+// authenticate gets a token scoped to the project from Keystone, and the
+// public object storage endpoint of the region
+func (s SwiftStore) authenticate() (swiftSession, error) {
+	domain := map[string]string{"name": s.domain()}
+	var request struct {
+		Auth struct {
+			Identity struct {
+				Methods  []string `json:"methods"`
+				Password struct {
+					User struct {
+						Name     string            `json:"name"`
+						Domain   map[string]string `json:"domain"`
+						Password string            `json:"password"`
+					} `json:"user"`
+				} `json:"password"`
+			} `json:"identity"`
+			Scope struct {
+				Project struct {
+					Name   string            `json:"name"`
+					Domain map[string]string `json:"domain"`
+				} `json:"project"`
+			} `json:"scope"`
+		} `json:"auth"`
+	}
+	request.Auth.Identity.Methods = []string{"password"}
+	request.Auth.Identity.Password.User.Name = s.User
+	request.Auth.Identity.Password.User.Domain = domain
+	request.Auth.Identity.Password.User.Password = s.Password
+	request.Auth.Scope.Project.Name = s.Project
+	request.Auth.Scope.Project.Domain = domain
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return swiftSession{}, err
+	}
+	resp, err := storeHTTPClient().Post(strings.TrimSuffix(s.AuthURL, "/")+"/auth/tokens", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return swiftSession{}, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return swiftSession{}, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return swiftSession{}, swiftError{Status: resp.Status, Body: strings.TrimSpace(string(data))}
+	}
+
+	var reply struct {
+		Token struct {
+			Catalog []struct {
+				Type      string `json:"type"`
+				Endpoints []struct {
+					Interface string `json:"interface"`
+					Region    string `json:"region"`
+					URL       string `json:"url"`
+				} `json:"endpoints"`
+			} `json:"catalog"`
+		} `json:"token"`
+	}
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return swiftSession{}, err
+	}
+	session := swiftSession{token: resp.Header.Get("X-Subject-Token")}
+	for _, service := range reply.Token.Catalog {
+		if service.Type != "object-store" {
+			continue
+		}
+		for _, endpoint := range service.Endpoints {
+			if endpoint.Interface == "public" && (s.Region == "" || endpoint.Region == s.Region) {
+				session.endpoint = strings.TrimSuffix(endpoint.URL, "/")
+			}
+		}
+	}
+	if session.endpoint == "" {
+		return swiftSession{}, fmt.Errorf("no object storage in region %s of project %s", s.Region, s.Project)
+	}
+	return session, nil
+}
+
+// session is the run's session, signed in to if needed or if renew
+func (s SwiftStore) session(renew bool) (swiftSession, error) {
+	swiftSessionsLock.Lock()
+	defer swiftSessionsLock.Unlock()
+	id := s.AuthURL + "\n" + s.User + "\n" + s.Project + "\n" + s.Region
+	if session, ok := swiftSessions[id]; ok && !renew {
+		return session, nil
+	}
+	session, err := s.authenticate()
+	if err != nil {
+		return swiftSession{}, err
+	}
+	swiftSessions[id] = session
+	return session, nil
+}
+
+// do sends a request for an object, or the container if object is empty,
+// signing in again once if the token was rejected. It returns the response
+// body
+func (s SwiftStore) do(method, object string, body []byte, header http.Header) ([]byte, error) {
+	for renew := false; ; renew = true {
+		session, err := s.session(renew)
+		if err != nil {
+			return nil, err
+		}
+		target := session.endpoint + "/" + url.PathEscape(s.Container)
+		if object != "" {
+			target += "/" + strings.Replace(url.PathEscape(object), "%2F", "/", -1)
+		}
+		if query := header.Get("X-Chasm-Query"); query != "" {
+			target += "?" + query
+		}
+
+		req, err := http.NewRequest(method, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			if name != "X-Chasm-Query" {
+				req.Header[name] = values
+			}
+		}
+		req.Header.Set("X-Auth-Token", session.token)
+
+		resp, err := storeHTTPClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && !renew {
+			continue
+		}
+		if resp.StatusCode/100 != 2 {
+			return nil, swiftError{Status: resp.Status, Body: strings.TrimSpace(string(data))}
+		}
+		return data, nil
+	}
+}
+
+func (s SwiftStore) upload(object string, data []byte) error {
+	// the object is only written if none exists
+	_, err := s.do("PUT", s.key(object), data, http.Header{"If-None-Match": {"*"}})
+	if e, ok := err.(swiftError); ok && strings.HasPrefix(e.Status, "412") {
+		return errors.New("object exists")
+	}
+	return err
+}
+
+// Upload writes the share as a new object, refusing to overwrite one
+func (s SwiftStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading %s/%s...", s.location(), share.ObjectName()))
+	if err := s.upload(share.ObjectName(), share.Data); err != nil {
+		color.Red("%s/%s upload failed: %v", s.location(), share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// Remove permanently deletes a single object
+func (s SwiftStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting %s/%s...", s.location(), object))
+	if _, err := s.do("DELETE", s.key(object), nil, nil); err != nil {
+		color.Red("Error: could not delete %s from %s: %s", object, s.location(), err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all objects under the prefix
+func (s SwiftStore) list() ([]string, error) {
+	prefix := ""
+	if s.Prefix != "" {
+		prefix = strings.TrimSuffix(s.Prefix, "/") + "/"
+	}
+
+	var objects []string
+	marker := ""
+	for {
+		query := url.Values{
+			"format":    {"json"},
+			"prefix":    {prefix},
+			"delimiter": {"/"},
+			"limit":     {fmt.Sprint(swiftPageSize)},
+			"marker":    {marker},
+		}
+		data, err := s.do("GET", "", nil, http.Header{"X-Chasm-Query": {query.Encode()}})
+		if err != nil {
+			return nil, err
+		}
+		var listing []struct {
+			Name   string `json:"name"`
+			Subdir string `json:"subdir"`
+		}
+		if err := json.Unmarshal(data, &listing); err != nil {
+			return nil, err
+		}
+		for _, item := range listing {
+			if item.Subdir == "" {
+				objects = append(objects, strings.TrimPrefix(item.Name, prefix))
+				marker = item.Name
+			} else {
+				marker = item.Subdir
+			}
+		}
+		if len(listing) < swiftPageSize {
+			return objects, nil
+		}
+	}
+}
+
+// List returns the names of all objects under the prefix
+func (s SwiftStore) List() []string {
+	objects, err := s.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", s.location(), err)
+		return nil
+	}
+	return objects
+}
+
+// Read downloads a single object
+func (s SwiftStore) Read(object string) ([]byte, error) {
+	return s.do("GET", s.key(object), nil, nil)
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (s SwiftStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	return s.do("GET", s.key(object), nil, header)
+}
+
+// MaxObjectSize of a single PUT
+func (s SwiftStore) MaxObjectSize() int64 {
+	return swiftMaxObjectSize
+}
+
+// Restore downloads shares to local restore path
+func (s SwiftStore) Restore() string {
+	objects, err := s.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", s.location(), err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_swift_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from %s...", s.location())
+	for _, object := range objects {
+		data, err := s.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects under the prefix
+func (s SwiftStore) Description() string {
+	objects, err := s.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", s.ShortDescription(), err)
+	}
+
+	label := s.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (s SwiftStore) ShortDescription() string {
+	return "Swift Store: " + s.location()
+}
+
+// Clean deletes all shares under the prefix
+func (s SwiftStore) Clean() {
+	for _, object := range s.List() {
+		color.Yellow("Removing Swift Store: %v", object)
+		s.do("DELETE", s.key(object), nil, nil)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The daemon runs as a systemd service of Type=notify: it reports when it is
+// ready and while it is alive, for WatchdogSec=, and takes the socket of a
+// .socket unit for its API instead of listening itself. Without systemd
+// none of this does anything. SIGHUP, as sent by ExecReload=kill -HUP
+// $MAINPID, or `chasm reload` reload the preferences, fleet config and policy
+// once the change in progress is done, without stopping transfers
+//
+//	[Service]
+//	Type=notify
+//	ExecStart=/usr/local/bin/chasm --root /srv/vault serve
+//	ExecReload=/bin/kill -HUP $MAINPID
+//	WatchdogSec=60
+
+// first file descriptor passed by socket activation
+const sdListenFdsStart = 3
+
+// reloads requested while watching
+var reloadRequests = make(chan bool, 1)
+
+// apiListener is the socket systemd passed for the API, or one listening on
+// addr
+func apiListener(addr string) (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || fds < 1 {
+		return net.Listen("tcp", addr)
+	}
+
+	// daemons this one starts get sockets of their own
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	file := os.NewFile(sdListenFdsStart, "systemd socket")
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// sdNotify sends state, such as READY=1, to systemd if it supervises the
+// process
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
+
+// startWatchdog keeps telling systemd the process is alive, at half the
+// interval of WatchdogSec=
+func startWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	go func() {
+		for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
+
+// reloadOnHangup requests a reload on every SIGHUP
+func reloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			requestReload()
+		}
+	}()
+}
+
+// requestReload has the watcher reload the configuration once the change
+// in progress is done
+func requestReload() {
+	select {
+	case reloadRequests <- true:
+	default:
+		// one is pending already
+	}
+}
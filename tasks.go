@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tasks are long-running operations started over the daemon API. Each has an
+// id to poll for progress and to cancel it by, so a GUI can follow and stop
+// individual operations. Tasks run one at a time, in the order started, and
+// cancellation is checked between files.
+
+// task states
+const (
+	stateQueued   = "queued"
+	stateRunning  = "running"
+	stateDone     = "done"
+	stateFailed   = "failed"
+	stateCanceled = "canceled"
+)
+
+// finished tasks kept for polling
+const maxFinishedTasks = 100
+
+// TaskRequest is the body of POST /api/tasks
+type TaskRequest struct {
+	Type  string   `json:"type"`
+	Paths []string `json:"paths,omitempty"`
+}
+
+// Task is returned by the task endpoints
+type Task struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	Paths    []string  `json:"paths,omitempty"`
+	State    string    `json:"state"`
+	Files    int       `json:"files"`
+	Total    int       `json:"total,omitempty"` // 0 while unknown
+	Bytes    int64     `json:"bytes"`
+	Errors   int       `json:"errors"`
+	Error    string    `json:"error,omitempty"`
+	Created  time.Time `json:"created"`
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+
+	cancel bool
+}
+
+// taskRunners run each type of task, holding the preferences lock
+var taskRunners = map[string]func(t *Task) error{
+	"add":     runAddTask,
+	"restore": runRestoreTask,
+	"verify":  runVerifyTask,
+}
+
+// taskScopes are the API token scopes starting each type of task needs,
+// full for types not listed
+var taskScopes = map[string]string{
+	"add":     scopeFull,
+	"restore": scopeRestore,
+	"verify":  scopeRestore,
+}
+
+var (
+	tasksMutex sync.Mutex
+	tasks      []*Task
+	taskQueue  = make(chan *Task, 64)
+	tasksOnce  sync.Once
+
+	// the task running now, only touched by the task worker
+	activeTask *Task
+)
+
+// StartTask queues a task of type with paths
+func StartTask(req TaskRequest) (Task, error) {
+	if _, ok := taskRunners[req.Type]; !ok {
+		return Task{}, fmt.Errorf("unknown task type %q", req.Type)
+	}
+	if req.Type == "add" && len(req.Paths) == 0 {
+		return Task{}, fmt.Errorf("add needs paths")
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Task{}, err
+	}
+	t := &Task{ID: hex.EncodeToString(id), Type: req.Type, Paths: req.Paths, State: stateQueued, Created: time.Now()}
+
+	tasksOnce.Do(func() { go taskWorker() })
+
+	tasksMutex.Lock()
+	tasks = append(tasks, t)
+	pruneTasks()
+	tasksMutex.Unlock()
+
+	select {
+	case taskQueue <- t:
+	default:
+		t.finish(fmt.Errorf("too many queued tasks"))
+	}
+	return t.snapshot(), nil
+}
+
+// pruneTasks drops the oldest finished tasks over the limit
+func pruneTasks() {
+	finished := 0
+	for _, t := range tasks {
+		if !t.Finished.IsZero() {
+			finished++
+		}
+	}
+	kept := tasks[:0]
+	for _, t := range tasks {
+		if !t.Finished.IsZero() && finished > maxFinishedTasks {
+			finished--
+			continue
+		}
+		kept = append(kept, t)
+	}
+	tasks = kept
+}
+
+func taskWorker() {
+	for t := range taskQueue {
+		tasksMutex.Lock()
+		if t.cancel {
+			tasksMutex.Unlock()
+			t.finish(nil)
+			continue
+		}
+		t.State, t.Started = stateRunning, time.Now()
+		tasksMutex.Unlock()
+
+		prefsLock.Lock()
+
+		// the watcher's run carries on after the task
+		watchRun := currentRun
+		activeTask = t
+		StartRun(t.Type)
+		err := taskRunners[t.Type](t)
+		FinishRun()
+		activeTask = nil
+		currentRun = watchRun
+
+		prefsLock.Unlock()
+		t.finish(err)
+	}
+}
+
+func (t *Task) finish(err error) {
+	tasksMutex.Lock()
+	defer tasksMutex.Unlock()
+
+	t.Finished = time.Now()
+	switch {
+	case t.cancel:
+		t.State = stateCanceled
+	case err != nil:
+		t.State, t.Error = stateFailed, err.Error()
+	case t.Errors > 0:
+		t.State, t.Error = stateFailed, fmt.Sprintf("%v errors", t.Errors)
+	default:
+		t.State = stateDone
+	}
+}
+
+func (t *Task) snapshot() Task {
+	tasksMutex.Lock()
+	defer tasksMutex.Unlock()
+	return *t
+}
+
+// taskCanceled checks if the running task was asked to stop
+func taskCanceled() bool {
+	if activeTask == nil {
+		return false
+	}
+	tasksMutex.Lock()
+	defer tasksMutex.Unlock()
+	return activeTask.cancel
+}
+
+// taskTotal sets how many files the running task will go through
+func taskTotal(total int) {
+	if activeTask == nil {
+		return
+	}
+	tasksMutex.Lock()
+	activeTask.Total = total
+	tasksMutex.Unlock()
+}
+
+// taskProgress counts a file done by the running task
+func taskProgress(size int64, failed bool) {
+	if activeTask == nil {
+		return
+	}
+	tasksMutex.Lock()
+	defer tasksMutex.Unlock()
+	if failed {
+		activeTask.Errors++
+	} else {
+		activeTask.Files++
+		activeTask.Bytes += size
+	}
+}
+
+func runAddTask(t *Task) error {
+	if err := preferences.SetupProblem(); err != nil {
+		return err
+	}
+	for _, p := range t.Paths {
+		filePath, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		if taskCanceled() {
+			break
+		}
+		AddFile(filePath)
+	}
+	UploadManifest()
+	return nil
+}
+
+func runRestoreTask(t *Task) error {
+	if !preferences.HasStores() {
+		return errNotEnoughStores
+	}
+	Restore()
+	return nil
+}
+
+func runVerifyTask(t *Task) error {
+	if !preferences.HasStores() {
+		return errNotEnoughStores
+	}
+	Verify(defaultVerifyRanges)
+	return nil
+}
+
+// apiTasks serves GET /api/tasks to list tasks and POST /api/tasks to start
+// one, GET /api/tasks/<id> to poll one and POST /api/tasks/<id>/cancel
+func apiTasks(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tasks"), "/")
+
+	switch {
+	case rest == "" && r.Method == "GET":
+		tasksMutex.Lock()
+		list := make([]Task, len(tasks))
+		for i, t := range tasks {
+			list[i] = *t
+		}
+		tasksMutex.Unlock()
+		writeJSON(w, list)
+
+	case rest == "" && r.Method == "POST":
+		var req TaskRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid task request", http.StatusBadRequest)
+			return
+		}
+		want := taskScopes[req.Type]
+		if want == "" {
+			want = scopeFull
+		}
+		if !scopeAllows(requestScope(r), want) {
+			http.Error(w, "api token lacks the "+want+" scope", http.StatusForbidden)
+			return
+		}
+		t, err := StartTask(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, t)
+
+	default:
+		id, action := rest, ""
+		if i := strings.Index(rest, "/"); i >= 0 {
+			id, action = rest[:i], rest[i+1:]
+		}
+
+		if action == "cancel" && !scopeAllows(requestScope(r), scopeRestore) {
+			http.Error(w, "api token lacks the "+scopeRestore+" scope", http.StatusForbidden)
+			return
+		}
+
+		tasksMutex.Lock()
+		var found *Task
+		for _, t := range tasks {
+			if t.ID == id {
+				found = t
+			}
+		}
+		if found != nil && action == "cancel" && r.Method == "POST" && found.Finished.IsZero() {
+			found.cancel = true
+		}
+		tasksMutex.Unlock()
+
+		switch {
+		case found == nil:
+			http.Error(w, "no such task", http.StatusNotFound)
+		case action == "" && r.Method == "GET", action == "cancel" && r.Method == "POST":
+			writeJSON(w, found.snapshot())
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// TelegramStore keeps shares as documents a bot posts to a private
+// channel it is an admin of. The Bot API cannot list the messages of a
+// channel, so the store keeps an index of its documents, itself a document
+// in the channel's pinned message, which is edited as shares come and go.
+// The index must stay the latest pinned message, and with it the bot token
+// and the channel are all a new machine needs to find the shares again.
+// Bots may only download files of up to 20 MB, so larger shares are split
+// into parts, and Telegram limits how fast a bot posts, so uploads are slow
+type TelegramStore struct {
+	Token string `json:"-"`
+
+	// numeric ID of the channel, like -1001234567890
+	Chat string `json:"chat"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (t *TelegramStore) credentials() map[string]*string {
+	return map[string]*string{"token": &t.Token}
+}
+
+const (
+	telegramAPI = "https://api.telegram.org"
+
+	// largest file a bot may download
+	telegramMaxObjectSize = 20 << 20
+
+	// file name of the index document
+	telegramIndexName = "chasm-index.json"
+)
+
+var errNoTelegramIndex = errors.New("the latest pinned message of the channel is not a chasm index")
+
+// telegramObject is a document posted to the channel
+type telegramObject struct {
+	MessageID int    `json:"message_id"`
+	FileID    string `json:"file_id"`
+}
+
+// telegramIndex is the index of a channel's objects, and the message
+// holding it
+type telegramIndex struct {
+	MessageID int
+	Objects   map[string]telegramObject
+}
+
+// indexes by channel, read once per run. Operations on a channel hold the
+// lock, as each one edits its index
+var (
+	telegramLock    sync.Mutex
+	telegramIndexes = make(map[string]*telegramIndex)
+)
+
+type telegramMessage struct {
+	MessageID int `json:"message_id"`
+	Document  *struct {
+		FileID   string `json:"file_id"`
+		FileName string `json:"file_name"`
+	} `json:"document"`
+}
+
+type telegramError struct {
+	Code        int    `json:"error_code"`
+	Description string `json:"description"`
+}
+
+func (e telegramError) Error() string {
+	return fmt.Sprintf("%v %s", e.Code, e.Description)
+}
+
+// Setup checks that the bot can reach the channel, and posts and pins an
+// empty index in a channel without one
+func (t TelegramStore) Setup() bool {
+	for _, ts := range preferences.TelegramStores {
+		if ts.Chat == t.Chat {
+			color.Red("Telegram store in channel %s already exists.", t.Chat)
+			return false
+		}
+	}
+
+	telegramLock.Lock()
+	defer telegramLock.Unlock()
+	_, err := t.index()
+	if err == errNoTelegramIndex {
+		err = t.createIndex()
+	}
+	if err != nil {
+		color.Red("Error: cannot set up Telegram channel %s: %s", t.Chat, err)
+		return false
+	}
+	return true
+}
+
+// withoutToken drops the URL, and the bot token in it, from errors of the
+// http client
+func withoutToken(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err
+	}
+	return err
+}
+
+// call invokes a Bot API method with form fields and an optional file,
+// waiting out rate limits, and decodes its result into result if not nil
+func (t TelegramStore) call(method string, fields map[string]string, fileName string, file []byte, result interface{}) error {
+	for {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		for name, value := range fields {
+			form.WriteField(name, value)
+		}
+		if fileName != "" {
+			part, err := form.CreateFormFile("document", fileName)
+			if err != nil {
+				return err
+			}
+			part.Write(file)
+		}
+		if err := form.Close(); err != nil {
+			return err
+		}
+
+		resp, err := storeHTTPClient().Post(telegramAPI+"/bot"+t.Token+"/"+method, form.FormDataContentType(), &body)
+		if err != nil {
+			return withoutToken(err)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return withoutToken(err)
+		}
+
+		var reply struct {
+			OK     bool            `json:"ok"`
+			Result json.RawMessage `json:"result"`
+			telegramError
+			Parameters struct {
+				RetryAfter int `json:"retry_after"`
+			} `json:"parameters"`
+		}
+		if err := json.Unmarshal(data, &reply); err != nil {
+			return fmt.Errorf("%s: %s", resp.Status, err)
+		}
+		if reply.Parameters.RetryAfter > 0 {
+			time.Sleep(time.Duration(reply.Parameters.RetryAfter) * time.Second)
+			continue
+		}
+		if !reply.OK {
+			return reply.telegramError
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(reply.Result, result)
+	}
+}
+
+// download fetches a file posted to the channel
+func (t TelegramStore) download(fileID string) ([]byte, error) {
+	var file struct {
+		FilePath string `json:"file_path"`
+	}
+	if err := t.call("getFile", map[string]string{"file_id": fileID}, "", nil, &file); err != nil {
+		return nil, err
+	}
+
+	resp, err := storeHTTPClient().Get(telegramAPI + "/file/bot" + t.Token + "/" + file.FilePath)
+	if err != nil {
+		return nil, withoutToken(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, errors.New(resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	return data, withoutToken(err)
+}
+
+// index is the channel's index, read from its pinned message once per run.
+// Callers hold telegramLock
+func (t TelegramStore) index() (*telegramIndex, error) {
+	if index, ok := telegramIndexes[t.Chat]; ok {
+		return index, nil
+	}
+
+	var chat struct {
+		Pinned *telegramMessage `json:"pinned_message"`
+	}
+	if err := t.call("getChat", map[string]string{"chat_id": t.Chat}, "", nil, &chat); err != nil {
+		return nil, err
+	}
+	if chat.Pinned == nil || chat.Pinned.Document == nil || chat.Pinned.Document.FileName != telegramIndexName {
+		return nil, errNoTelegramIndex
+	}
+	data, err := t.download(chat.Pinned.Document.FileID)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &telegramIndex{MessageID: chat.Pinned.MessageID}
+	if err := json.Unmarshal(data, &index.Objects); err != nil {
+		return nil, fmt.Errorf("corrupt index: %s", err)
+	}
+	if index.Objects == nil {
+		index.Objects = make(map[string]telegramObject)
+	}
+	telegramIndexes[t.Chat] = index
+	return index, nil
+}
+
+// createIndex posts an empty index and pins it. Callers hold telegramLock
+func (t TelegramStore) createIndex() error {
+	var msg telegramMessage
+	err := t.call("sendDocument", map[string]string{"chat_id": t.Chat, "disable_notification": "true"}, telegramIndexName, []byte("{}"), &msg)
+	if err != nil {
+		return err
+	}
+	err = t.call("pinChatMessage", map[string]string{"chat_id": t.Chat, "message_id": strconv.Itoa(msg.MessageID), "disable_notification": "true"}, "", nil, nil)
+	if err != nil {
+		t.deleteMessage(msg.MessageID)
+		return err
+	}
+	telegramIndexes[t.Chat] = &telegramIndex{MessageID: msg.MessageID, Objects: make(map[string]telegramObject)}
+	return nil
+}
+
+// saveIndex replaces the document of the index message. Callers hold
+// telegramLock
+func (t TelegramStore) saveIndex(index *telegramIndex) error {
+	data, err := json.Marshal(index.Objects)
+	if err != nil {
+		return err
+	}
+	fields := map[string]string{
+		"chat_id":    t.Chat,
+		"message_id": strconv.Itoa(index.MessageID),
+		"media":      `{"type":"document","media":"attach://document"}`,
+	}
+	return t.call("editMessageMedia", fields, telegramIndexName, data, nil)
+}
+
+func (t TelegramStore) deleteMessage(messageID int) error {
+	return t.call("deleteMessage", map[string]string{"chat_id": t.Chat, "message_id": strconv.Itoa(messageID)}, "", nil, nil)
+}
+
+// upload posts the share and adds it to the index
+func (t TelegramStore) upload(object string, data []byte) error {
+	telegramLock.Lock()
+	defer telegramLock.Unlock()
+	index, err := t.index()
+	if err != nil {
+		return err
+	}
+	if _, ok := index.Objects[object]; ok {
+		return errors.New("object exists")
+	}
+
+	var msg telegramMessage
+	fields := map[string]string{"chat_id": t.Chat, "disable_notification": "true", "disable_content_type_detection": "true"}
+	if err := t.call("sendDocument", fields, object, data, &msg); err != nil {
+		return err
+	}
+	if msg.Document == nil {
+		t.deleteMessage(msg.MessageID)
+		return errors.New("posted without its document")
+	}
+
+	index.Objects[object] = telegramObject{MessageID: msg.MessageID, FileID: msg.Document.FileID}
+	if err := t.saveIndex(index); err != nil {
+		delete(index.Objects, object)
+		t.deleteMessage(msg.MessageID)
+		return err
+	}
+	return nil
+}
+
+// Upload posts the share as a new document, refusing to replace one
+func (t TelegramStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading Telegram/%s/%s...", t.Chat, share.ObjectName()))
+	if err := t.upload(share.ObjectName(), share.Data); err != nil {
+		color.Red("Telegram/%s/%s upload failed: %v", t.Chat, share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+// remove deletes the message of object and drops it from the index
+func (t TelegramStore) remove(object string) error {
+	telegramLock.Lock()
+	defer telegramLock.Unlock()
+	index, err := t.index()
+	if err != nil {
+		return err
+	}
+	posted, ok := index.Objects[object]
+	if !ok {
+		return nil
+	}
+
+	// messages deleted in the app are dropped from the index all the same
+	err = t.deleteMessage(posted.MessageID)
+	if e, ok := err.(telegramError); err != nil && !(ok && strings.Contains(e.Description, "not found")) {
+		return err
+	}
+	delete(index.Objects, object)
+	if err := t.saveIndex(index); err != nil {
+		index.Objects[object] = posted
+		return err
+	}
+	return nil
+}
+
+// Remove permanently deletes a single object
+func (t TelegramStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting Telegram/%s/%s...", t.Chat, object))
+	if err := t.remove(object); err != nil {
+		color.Red("Error: could not delete %s from Telegram: %s", object, err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all objects in the index
+func (t TelegramStore) list() ([]string, error) {
+	telegramLock.Lock()
+	defer telegramLock.Unlock()
+	index, err := t.index()
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]string, 0, len(index.Objects))
+	for object := range index.Objects {
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+// List returns the names of all objects in the index
+func (t TelegramStore) List() []string {
+	objects, err := t.list()
+	if err != nil {
+		color.Red("Error listing Telegram channel %s: %s", t.Chat, err)
+		return nil
+	}
+	return objects
+}
+
+// lookup finds object in the index
+func (t TelegramStore) lookup(object string) (telegramObject, error) {
+	telegramLock.Lock()
+	defer telegramLock.Unlock()
+	index, err := t.index()
+	if err != nil {
+		return telegramObject{}, err
+	}
+	posted, ok := index.Objects[object]
+	if !ok {
+		return posted, fmt.Errorf("%s is not in the index", object)
+	}
+	return posted, nil
+}
+
+// Read downloads a single object
+func (t TelegramStore) Read(object string) ([]byte, error) {
+	posted, err := t.lookup(object)
+	if err != nil {
+		return nil, err
+	}
+	return t.download(posted.FileID)
+}
+
+// ReadRange downloads length bytes of an object from offset. The Bot API
+// only serves whole files, so the whole object is read
+func (t TelegramStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	data, err := t.Read(object)
+	if err != nil {
+		return nil, err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if end := offset + length; end < int64(len(data)) {
+		data = data[:end]
+	}
+	return data[offset:], nil
+}
+
+// MaxObjectSize of a file a bot may download
+func (t TelegramStore) MaxObjectSize() int64 {
+	return telegramMaxObjectSize
+}
+
+// Restore downloads shares to local restore path
+func (t TelegramStore) Restore() string {
+	objects, err := t.list()
+	if err != nil {
+		color.Red("Error listing Telegram channel %s: %s", t.Chat, err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_telegram_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from Telegram channel %s...", t.Chat)
+	for _, object := range objects {
+		data, err := t.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects in the index
+func (t TelegramStore) Description() string {
+	objects, err := t.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", t.ShortDescription(), err)
+	}
+
+	label := t.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (t TelegramStore) ShortDescription() string {
+	return "Telegram Store: channel " + t.Chat
+}
+
+// Clean deletes all shares from the channel
+func (t TelegramStore) Clean() {
+	for _, object := range t.List() {
+		color.Yellow("Removing Telegram Store: %v", object)
+		t.remove(object)
+	}
+}
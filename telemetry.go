@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// With --otlp-endpoint, runs are exported as OpenTelemetry spans to an
+// OTLP/HTTP collector, such as Jaeger, Tempo or the OpenTelemetry Collector,
+// to find where the time goes across thousands of files and several
+// providers. A run, like chasm sync, is a span holding a span for each file
+// added or restored, which holds the stages of the file: reading, sealing
+// and sharing it then uploading to each store, or combining its shares and
+// writing it. Every call to a store is a span of its own with the store's
+// index and description, so a slow provider shows up next to the others.
+//
+// Unlike the --trace of trace.go, spans name files, relative to the root,
+// as they are only sent to the user's own collector. File contents and
+// credentials are never recorded. OTEL_EXPORTER_OTLP_HEADERS sets the
+// headers of a collector wanting a key.
+
+// spans are sent to this path of a collector given without one
+const otlpTracesPath = "/v1/traces"
+
+// the longest the end of a run waits for its spans to be sent
+const telemetryFlushTimeout = 10 * time.Second
+
+// exports spans when --otlp-endpoint is set, nil otherwise
+var telemetry *sdktrace.TracerProvider
+
+// the innermost open span, parent of the next one. Pipelines run one at a
+// time under the preferences lock, so spans nest as the calls do
+var (
+	spansLock   sync.Mutex
+	spanContext = context.Background()
+)
+
+// StartTelemetry exports spans to the collector at endpoint, like
+// http://localhost:4318
+func StartTelemetry(endpoint string) error {
+	target, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if target.Path == "" || target.Path == "/" {
+		target.Path = otlpTracesPath
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(target.String()))
+	if err != nil {
+		return err
+	}
+	telemetry = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "chasm"),
+			attribute.String("chasm.root", chasmRoot),
+		)),
+	)
+	return nil
+}
+
+// flushTelemetry sends the spans ended so far
+func flushTelemetry() {
+	if telemetry == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), telemetryFlushTimeout)
+	defer cancel()
+	telemetry.ForceFlush(ctx)
+}
+
+// StopTelemetry sends the remaining spans before chasm exits
+func StopTelemetry() {
+	if telemetry == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), telemetryFlushTimeout)
+	defer cancel()
+	telemetry.Shutdown(ctx)
+}
+
+// startSpan opens a span in the innermost open one, and returns the
+// function ending it
+func startSpan(name string, attrs ...attribute.KeyValue) func() {
+	if telemetry == nil {
+		return func() {}
+	}
+
+	spansLock.Lock()
+	defer spansLock.Unlock()
+	parent := spanContext
+	ctx, span := telemetry.Tracer("chasm").Start(parent, name, oteltrace.WithAttributes(attrs...))
+	spanContext = ctx
+	return func() {
+		span.End()
+		spansLock.Lock()
+		spanContext = parent
+		spansLock.Unlock()
+	}
+}
+
+// currentSpan is the innermost open span
+func currentSpan() oteltrace.Span {
+	spansLock.Lock()
+	defer spansLock.Unlock()
+	return oteltrace.SpanFromContext(spanContext)
+}
+
+// spanAttributes adds attributes to the innermost open span
+func spanAttributes(attrs ...attribute.KeyValue) {
+	if telemetry == nil {
+		return
+	}
+	currentSpan().SetAttributes(attrs...)
+}
+
+// spanFailed marks the innermost open span as failed, for errors counted
+// in the run
+func spanFailed() {
+	if telemetry == nil {
+		return
+	}
+	currentSpan().SetStatus(codes.Error, "")
+}
+
+// spanPath is a file as recorded in spans, relative to the root if in it
+func spanPath(filePath string) attribute.KeyValue {
+	if rel, err := filepath.Rel(chasmRoot, filePath); err == nil && !strings.HasPrefix(rel, "..") {
+		filePath = rel
+	}
+	return attribute.String("chasm.path", filePath)
+}
+
+// spanBytes is a size as recorded in spans
+func spanBytes(size int64) attribute.KeyValue {
+	return attribute.Int64("chasm.bytes", size)
+}
+
+// telemetryStore records the calls to a cloud store as spans
+type telemetryStore struct {
+	CloudStore
+	index int
+}
+
+func withTelemetry(cloudStores []CloudStore) []CloudStore {
+	if telemetry == nil {
+		return cloudStores
+	}
+
+	wrapped := make([]CloudStore, len(cloudStores))
+	for i, cs := range cloudStores {
+		wrapped[i] = telemetryStore{cs, i + 1}
+	}
+	return wrapped
+}
+
+// span opens the span of a call to the store
+func (t telemetryStore) span(op string, attrs ...attribute.KeyValue) func() {
+	attrs = append(attrs,
+		attribute.Int("chasm.store.index", t.index),
+		attribute.String("chasm.store", t.CloudStore.ShortDescription()),
+	)
+	return startSpan(op, attrs...)
+}
+
+func (t telemetryStore) Upload(share Share) {
+	defer t.span("upload", attribute.String("chasm.object", share.ObjectName()), spanBytes(int64(len(share.Data))))()
+	t.CloudStore.Upload(share)
+}
+
+func (t telemetryStore) Remove(object string) {
+	defer t.span("remove", attribute.String("chasm.object", object))()
+	t.CloudStore.Remove(object)
+}
+
+func (t telemetryStore) List() []string {
+	defer t.span("list")()
+	objects := t.CloudStore.List()
+	spanAttributes(attribute.Int("chasm.objects", len(objects)))
+	return objects
+}
+
+func (t telemetryStore) Restore() string {
+	defer t.span("download")()
+	restorePath := t.CloudStore.Restore()
+	if restorePath == "" {
+		spanFailed()
+	}
+	return restorePath
+}
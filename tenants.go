@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/fatih/color"
+)
+
+// One system service can back up every account of a shared machine. The
+// admin lists the vaults, each with the OS account owning it, in a tenants
+// file, and runs `chasm serve --tenants FILE`. The service then runs a
+// `chasm serve` of each vault as its account, so a vault's files are only
+// read with its owner's permissions and its preferences, state and API
+// token stay in the account's own files. Each daemon listens on a loopback
+// port, and the service forwards /vaults/NAME/ to it: the dashboard and API
+// of a vault are at /vaults/NAME/, open with that vault's own token, which
+// its owner gets with `chasm token`. A daemon that stops is started again.
+
+// Tenant is a vault served by the system service
+type Tenant struct {
+	Name string `json:"name"`
+
+	// OS account the vault's daemon runs as
+	User string `json:"user"`
+	Root string `json:"root"`
+
+	// loopback port of the vault's daemon
+	Port int `json:"port"`
+}
+
+// ports of tenant daemons are counted from here
+const tenantBasePort = 7460
+
+// a stopped tenant daemon is started again after this long
+const tenantRestartDelay = 10 * time.Second
+
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// tenantsFlag is the tenants file of the tenant commands
+var tenantsFlag = cli.StringFlag{
+	Name:   "tenants",
+	Value:  "/etc/chasm/tenants.json",
+	EnvVar: "CHASM_TENANTS",
+	Usage:  "Tenants file of the system service.",
+}
+
+// set by the system service on the daemons it starts
+var tenantDaemon bool
+
+// LoadTenants reads the tenants file, empty if it does not exist
+func LoadTenants(tenantsFile string) ([]Tenant, error) {
+	data, err := ioutil.ReadFile(tenantsFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tenants []Tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("%s: %s", tenantsFile, err)
+	}
+	return tenants, nil
+}
+
+func saveTenants(tenantsFile string, tenants []Tenant) error {
+	data, err := json.MarshalIndent(tenants, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(tenantsFile), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(tenantsFile, data, 0644)
+}
+
+// AddTenant adds the vault at root, owned by the OS account username, to
+// the tenants file. root defaults to Chasm in the account's home
+func AddTenant(tenantsFile, name, username, root string) (Tenant, error) {
+	if !tenantNamePattern.MatchString(name) {
+		return Tenant{}, fmt.Errorf("name %q must be lowercase letters, digits, - and _", name)
+	}
+	account, err := user.Lookup(username)
+	if err != nil {
+		return Tenant{}, err
+	}
+	if root == "" {
+		root = filepath.Join(account.HomeDir, "Chasm")
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return Tenant{}, err
+	}
+	if err := checkTenantRoot(root, account); err != nil {
+		return Tenant{}, err
+	}
+
+	tenants, err := LoadTenants(tenantsFile)
+	if err != nil {
+		return Tenant{}, err
+	}
+	port := tenantBasePort
+	for _, t := range tenants {
+		if t.Name == name {
+			return Tenant{}, fmt.Errorf("a vault named %s exists", name)
+		}
+		if t.Root == root {
+			return Tenant{}, fmt.Errorf("%s is served as %s", root, t.Name)
+		}
+		if t.Port >= port {
+			port = t.Port + 1
+		}
+	}
+
+	tenant := Tenant{Name: name, User: username, Root: root, Port: port}
+	return tenant, saveTenants(tenantsFile, append(tenants, tenant))
+}
+
+// RemoveTenant drops the vault named name from the tenants file
+func RemoveTenant(tenantsFile, name string) error {
+	tenants, err := LoadTenants(tenantsFile)
+	if err != nil {
+		return err
+	}
+	for i, t := range tenants {
+		if t.Name == name {
+			return saveTenants(tenantsFile, append(tenants[:i], tenants[i+1:]...))
+		}
+	}
+	return fmt.Errorf("no vault named %s", name)
+}
+
+// tenantCommand is the daemon of a tenant, run as its account
+func tenantCommand(t Tenant) (*exec.Cmd, error) {
+	account, err := user.Lookup(t.User)
+	if err != nil {
+		return nil, err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(executable, "--root", t.Root, "serve", "--addr", fmt.Sprintf("127.0.0.1:%d", t.Port), "--tenant-daemon")
+	cmd.Dir = account.HomeDir
+	cmd.Env = []string{
+		"HOME=" + account.HomeDir,
+		"USER=" + account.Username,
+		"LOGNAME=" + account.Username,
+		"PATH=" + os.Getenv("PATH"),
+	}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := runAsTenant(cmd, account); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// superviseTenant runs the daemon of a tenant, starting it again whenever
+// it stops
+func superviseTenant(t Tenant) {
+	for {
+		cmd, err := tenantCommand(t)
+		if err != nil {
+			color.Red("Error: cannot serve vault %s: %s", t.Name, err)
+			return
+		}
+		color.Green("Serving vault %s of %s from %s", t.Name, t.User, t.Root)
+		err = cmd.Run()
+		color.Yellow("The daemon of vault %s stopped: %v. Starting it again in %v.", t.Name, err, tenantRestartDelay)
+		time.Sleep(tenantRestartDelay)
+	}
+}
+
+// peerRequest tells if r is for the peer API of a vault, which peers call
+// with their tokens rather than client certificates
+func peerRequest(r *http.Request) bool {
+	cleaned := path.Clean(r.URL.Path)
+	if !strings.HasPrefix(cleaned, "/vaults/") {
+		return false
+	}
+	rest := strings.TrimPrefix(cleaned, "/vaults/")
+	if i := strings.Index(rest, "/"); i > 0 {
+		return strings.HasPrefix(rest[i:], "/api/peer/")
+	}
+	return false
+}
+
+// ServeTenants runs the daemon of every vault in the tenants file and
+// serves each under /vaults/NAME/ on addr, over TLS if a certificate and
+// key are given. With client CAs, requests other than those of hosted peers
+// need a client certificate signed by them. Vault daemons do not see the
+// certificate, so tokens bound to a client do not work through it
+func ServeTenants(tenantsFile, addr, certFile, keyFile, clientCAFile string) error {
+	tenants, err := LoadTenants(tenantsFile)
+	if err != nil {
+		return err
+	}
+	if len(tenants) == 0 {
+		return errors.New("no vaults in " + tenantsFile + ", add them with chasm tenant add")
+	}
+
+	mux := http.NewServeMux()
+	for _, t := range tenants {
+		target := &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", t.Port)}
+		prefix := "/vaults/" + t.Name
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, httputil.NewSingleHostReverseProxy(target)))
+		go superviseTenant(t)
+	}
+
+	if clientCAFile != "" && certFile == "" {
+		return errors.New("asking for client certificates needs --tls-cert")
+	}
+	tlsConfig, err := apiTLSConfig(clientCAFile)
+	if err != nil {
+		return err
+	}
+	var handler http.Handler = mux
+	if tlsConfig != nil {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if clientName(r) == "" && !peerRequest(r) {
+				http.Error(w, "client certificate required", http.StatusUnauthorized)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		})
+	}
+
+	listener, err := apiListener(addr)
+	if err != nil {
+		return err
+	}
+	color.Green("Serving %v vaults on %s, each at /vaults/NAME/", len(tenants), listener.Addr())
+	sdNotify("READY=1")
+	startWatchdog()
+	if certFile != "" {
+		server := &http.Server{Handler: handler, TLSConfig: tlsConfig}
+		return server.ServeTLS(listener, certFile, keyFile)
+	}
+	return http.Serve(listener, handler)
+}
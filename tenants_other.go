@@ -0,0 +1,27 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"os/user"
+)
+
+// runAsTenant only runs vaults of the account running chasm, as switching
+// accounts is unsupported on this platform. Run a service per account
+func runAsTenant(cmd *exec.Cmd, account *user.User) error {
+	current, err := user.Current()
+	if err != nil {
+		return err
+	}
+	if current.Uid != account.Uid {
+		return errors.New("serving the vaults of other accounts is unsupported on this platform, run a service per account")
+	}
+	return nil
+}
+
+// checkTenantRoot is left to the daemon, which runs as the account
+func checkTenantRoot(root string, account *user.User) error {
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPeerRequest(t *testing.T) {
+	for target, peer := range map[string]bool{
+		"/vaults/alice/api/peer/objects/abc":  true,
+		"/vaults/alice/api/status":            false,
+		"/vaults/alice/api/status?/api/peer/": false,
+		"/vaults/alice/x/api/peer/objects":    false,
+		"/vaults/alice/api/peer/../token":     false,
+		"/api/peer/objects/abc":               false,
+		"/vaults/api/peer/objects":            false,
+		"/dashboard/api/peer/":                false,
+	} {
+		if got := peerRequest(httptest.NewRequest("GET", target, nil)); got != peer {
+			t.Errorf("peerRequest(%s) = %v, want %v", target, got, peer)
+		}
+	}
+}
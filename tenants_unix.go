@@ -0,0 +1,58 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// runAsTenant makes cmd run as account, which takes root unless it is the
+// account running chasm
+func runAsTenant(cmd *exec.Cmd, account *user.User) error {
+	uid, err := strconv.ParseUint(account.Uid, 10, 32)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.ParseUint(account.Gid, 10, 32)
+	if err != nil {
+		return err
+	}
+	if uint32(uid) == uint32(os.Getuid()) {
+		return nil
+	}
+	if os.Getuid() != 0 {
+		return errors.New("serving the vaults of other accounts needs root")
+	}
+
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	groups, _ := account.GroupIds()
+	for _, group := range groups {
+		if id, err := strconv.ParseUint(group, 10, 32); err == nil {
+			credential.Groups = append(credential.Groups, uint32(id))
+		}
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	return nil
+}
+
+// checkTenantRoot checks that the vault at root, if it exists yet, belongs
+// to account
+func checkTenantRoot(root string, account *user.User) error {
+	fi, err := os.Stat(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok && strconv.FormatUint(uint64(stat.Uid), 10) != account.Uid {
+		return fmt.Errorf("%s does not belong to %s", root, account.Username)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// TraceEvent is a single recorded operation. Paths are replaced by opaque
+// tokens and file contents are never recorded, so traces can be shared
+type TraceEvent struct {
+	Seq    int           `json:"seq"`
+	Time   time.Duration `json:"t"`
+	Op     string        `json:"op"`
+	Path   string        `json:"path,omitempty"`
+	Store  int           `json:"store,omitempty"`
+	Object string        `json:"object,omitempty"`
+	Size   int           `json:"size,omitempty"`
+	Detail string        `json:"detail,omitempty"`
+}
+
+// Tracer writes trace events as JSON lines
+type Tracer struct {
+	file  *os.File
+	enc   *json.Encoder
+	start time.Time
+	seq   int
+	paths map[string]string
+}
+
+// records the current run when --trace is set, nil otherwise
+var tracer *Tracer
+
+// StartTrace starts recording a trace to tracePath
+func StartTrace(tracePath string) error {
+	file, err := os.OpenFile(tracePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	tracer = &Tracer{file: file, enc: json.NewEncoder(file), start: time.Now(), paths: make(map[string]string)}
+	return nil
+}
+
+// trace records an event if tracing is enabled
+func trace(event TraceEvent) {
+	if tracer == nil {
+		return
+	}
+
+	tracer.seq++
+	event.Seq = tracer.seq
+	event.Time = time.Since(tracer.start)
+	if err := tracer.enc.Encode(event); err != nil {
+		color.Red("Error: could not write trace: %s", err)
+	}
+}
+
+// tracePath maps a path to a stable opaque token
+func tracePath(filePath string) string {
+	if tracer == nil {
+		return ""
+	}
+
+	token, ok := tracer.paths[filePath]
+	if !ok {
+		token = fmt.Sprintf("path-%d", len(tracer.paths)+1)
+		tracer.paths[filePath] = token
+	}
+	return token
+}
+
+// traceStore records the operations that reach a cloud store
+type traceStore struct {
+	CloudStore
+	index int
+}
+
+func withTrace(cloudStores []CloudStore) []CloudStore {
+	if tracer == nil {
+		return cloudStores
+	}
+
+	wrapped := make([]CloudStore, len(cloudStores))
+	for i, cs := range cloudStores {
+		wrapped[i] = traceStore{cs, i + 1}
+	}
+	return wrapped
+}
+
+func (t traceStore) Upload(share Share) {
+	t.CloudStore.Upload(share)
+	trace(TraceEvent{Op: "upload", Store: t.index, Object: share.ObjectName(), Size: len(share.Data)})
+}
+
+func (t traceStore) Remove(object string) {
+	t.CloudStore.Remove(object)
+	trace(TraceEvent{Op: "remove", Store: t.index, Object: object})
+}
+
+func (t traceStore) List() []string {
+	objects := t.CloudStore.List()
+	trace(TraceEvent{Op: "list", Store: t.index, Size: len(objects)})
+	return objects
+}
+
+func (t traceStore) Restore() string {
+	restorePath := t.CloudStore.Restore()
+	detail := "ok"
+	if restorePath == "" {
+		detail = "failed"
+	}
+	trace(TraceEvent{Op: "restore", Store: t.index, Detail: detail})
+	return restorePath
+}
+
+// Replay replays a trace against simulated stores and reports every point
+// where the manifest references an object a store does not hold. Returns
+// the number of problems found
+func Replay(tracePath string) int {
+	file, err := os.Open(tracePath)
+	if err != nil {
+		color.Red("Cannot open trace: %s", err)
+		return 1
+	}
+	defer file.Close()
+
+	stores := make(map[int]map[string]bool)
+	manifest := make(map[string]string)
+	problems := 0
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			color.Red("Skipping unreadable trace line: %s", err)
+			continue
+		}
+
+		switch event.Op {
+		case "upload":
+			if stores[event.Store] == nil {
+				stores[event.Store] = make(map[string]bool)
+			}
+			stores[event.Store][event.Object] = true
+		case "remove":
+			delete(stores[event.Store], event.Object)
+		case "add":
+			if event.Object != "" {
+				manifest[event.Path] = event.Object
+			}
+		case "delete":
+			delete(manifest, event.Path)
+		case "manifest", "delta":
+			// every uploaded manifest must only reference stored objects
+			problems += checkReplay(event, manifest, stores)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		color.Red("Cannot read trace: %s", err)
+		problems++
+	}
+	return problems
+}
+
+func checkReplay(event TraceEvent, manifest map[string]string, stores map[int]map[string]bool) int {
+	paths := make([]string, 0, len(manifest))
+	for p := range manifest {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	problems := 0
+	for _, p := range paths {
+		for index, objects := range stores {
+			if !objects[manifest[p]] {
+				color.Red("#%d %s: %s references %s, missing from store %d", event.Seq, event.Op, p, manifest[p], index)
+				problems++
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/TheLisztomaniac/chasmOriginal/recovery"
+	"github.com/fatih/color"
+)
+
+// Verifying a vault by downloading every share costs its whole size in
+// bandwidth each time. Instead, every object is checksummed in 1 MiB ranges
+// as it is uploaded, the checksums kept in the local state, and a sampled
+// verify downloads a few random ranges of each object from stores that
+// support ranged reads and compares them. A full verify downloads whole
+// objects, checks their CRC and records the range checksums of objects
+// uploaded before they were kept.
+
+// size of the ranges objects are checksummed in
+const verifyRangeSize = 1 << 20
+
+// bytes of the SHA-256 of each range that are kept
+const rangeSumSize = 8
+
+// ranges of each object a sampled verify downloads by default
+const defaultVerifyRanges = 2
+
+// RangeSums are the range checksums of one stored object
+type RangeSums struct {
+	Size int64  `json:"size"`
+	Sums []byte `json:"sums"`
+}
+
+// rangeReader is implemented by stores that can download part of an object
+type rangeReader interface {
+	ReadRange(object string, offset, length int64) ([]byte, error)
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (f FolderStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	if !f.present() {
+		return nil, fmt.Errorf("%s is not mounted", f.volumeName())
+	}
+	file, err := os.Open(path.Join(f.Path, object))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data := make([]byte, length)
+	n, err := file.ReadAt(data, offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return data[:n], err
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (g GDriveStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	svc, err := g.service()
+	if err != nil {
+		return nil, err
+	}
+	id, err := g.objectID(svc, object)
+	if err != nil {
+		return nil, err
+	}
+
+	call := svc.Files.Get(id)
+	call.Header().Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := call.Download()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(io.LimitReader(resp.Body, length))
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (p PeerStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	return p.doWith("GET", object, nil, header)
+}
+
+// rangeSumStore records the range checksums of every object uploaded to the
+// store it wraps. It wraps the configured store directly, so split objects
+// are checksummed part by part as they are stored
+type rangeSumStore struct {
+	CloudStore
+}
+
+func withRangeSums(cloudStores []CloudStore) []CloudStore {
+	wrapped := make([]CloudStore, len(cloudStores))
+	for i, cs := range cloudStores {
+		wrapped[i] = rangeSumStore{cs}
+	}
+	return wrapped
+}
+
+func (r rangeSumStore) Upload(share Share) {
+	r.CloudStore.Upload(share)
+	if !share.Tombstone {
+		recordRangeSums(r.ShortDescription(), share.ObjectName(), share.Data)
+	}
+}
+
+func (r rangeSumStore) Remove(object string) {
+	r.CloudStore.Remove(object)
+	delete(state.RangeSums[r.ShortDescription()], object)
+}
+
+func (r rangeSumStore) Clean() {
+	r.CloudStore.Clean()
+	delete(state.RangeSums, r.ShortDescription())
+}
+
+// rangeSum is the kept part of the checksum of one range
+func rangeSum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:rangeSumSize]
+}
+
+func computeRangeSums(data []byte) RangeSums {
+	sums := RangeSums{Size: int64(len(data))}
+	for offset := 0; offset < len(data); offset += verifyRangeSize {
+		end := offset + verifyRangeSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sums.Sums = append(sums.Sums, rangeSum(data[offset:end])...)
+	}
+	return sums
+}
+
+func recordRangeSums(store, object string, data []byte) {
+	if state.RangeSums == nil {
+		state.RangeSums = make(map[string]map[string]RangeSums)
+	}
+	if state.RangeSums[store] == nil {
+		state.RangeSums[store] = make(map[string]RangeSums)
+	}
+	state.RangeSums[store][object] = computeRangeSums(data)
+}
+
+// VerifyResult counts what a verify of one store found
+type VerifyResult struct {
+	Store   string
+	Objects int
+	Ranges  int
+	Bytes   int64
+
+	// objects that could not be sampled, without checksums or ranged reads
+	Unsampled int
+
+	Missing int
+	Corrupt int
+}
+
+// Failed counts the objects that did not verify
+func (r VerifyResult) Failed() int {
+	return r.Missing + r.Corrupt
+}
+
+// verifiedObjects are the objects the manifest needs: the current version
+// of every tracked and retained deleted file, sorted, with the file each
+// belongs to
+func verifiedObjects() ([]string, map[string]FileShare) {
+	files := make(map[string]FileShare)
+	for _, fileShare := range preferences.FileMap {
+		if fileShare.Version != "" {
+			files[fileShare.ObjectName()] = fileShare
+		}
+	}
+	for _, deleted := range preferences.Deleted {
+		files[deleted.ObjectName()] = deleted.FileShare
+	}
+
+	objects := make([]string, 0, len(files))
+	for object := range files {
+		objects = append(objects, object)
+	}
+	sort.Strings(objects)
+	return objects, files
+}
+
+// storedNames groups the names in a store's listing by object, split
+// objects under the names of their parts in order
+func storedNames(listing []string) map[string][]string {
+	names := make(map[string][]string)
+	for _, name := range listing {
+		object, i, n, ok := recovery.ParsePartName(name)
+		if !ok {
+			names[name] = []string{name}
+			continue
+		}
+		if names[object] == nil {
+			names[object] = make([]string, n)
+		}
+		if i >= 1 && i <= len(names[object]) {
+			names[object][i-1] = name
+		}
+	}
+	return names
+}
+
+// Verify checks the objects of every store, sampling ranges of each, or
+// downloading them whole if ranges is 0
+func Verify(ranges int) []VerifyResult {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	objects, files := verifiedObjects()
+	cloudStores := preferences.cloudStores()
+	taskTotal(len(objects) * len(cloudStores))
+
+	var results []VerifyResult
+	for i, cs := range cloudStores {
+		result := VerifyResult{Store: cs.ShortDescription()}
+		names := storedNames(cs.List())
+
+		for _, object := range objects {
+			if taskCanceled() {
+				break
+			}
+			result.Objects++
+
+			parts := names[object]
+			complete := len(parts) > 0
+			for _, name := range parts {
+				complete = complete && name != ""
+			}
+			if !complete {
+				color.Red("%s: %s is missing", result.Store, object)
+				result.Missing++
+				countError()
+				continue
+			}
+
+			var err error
+			var size int64
+			if ranges == 0 {
+				size, err = verifyWhole(storeRef(i+1), result.Store, files[object], parts)
+			} else {
+				size, err = verifySampled(storeRef(i+1), result.Store, parts, ranges, rng, &result)
+			}
+			result.Bytes += size
+			if errors.Is(err, errArchived) {
+				// archived objects are only checked to be there until thawed
+				result.Unsampled++
+				continue
+			}
+			if err != nil {
+				color.Red("%s: %s is corrupt: %s", result.Store, object, err)
+				result.Corrupt++
+				countError()
+				continue
+			}
+			countFile(size, false)
+		}
+		results = append(results, result)
+	}
+
+	state.Save()
+	return results
+}
+
+// verifySampled compares ranges random ranges of each part of an object
+// with their checksums, returning the bytes downloaded
+func verifySampled(store interface{}, storeName string, parts []string, ranges int, rng *rand.Rand, result *VerifyResult) (int64, error) {
+	reader, ok := store.(rangeReader)
+	if !ok {
+		result.Unsampled++
+		return 0, nil
+	}
+
+	var downloaded int64
+	for _, name := range parts {
+		sums, ok := state.RangeSums[storeName][name]
+		if !ok {
+			result.Unsampled++
+			return downloaded, nil
+		}
+
+		count := len(sums.Sums) / rangeSumSize
+		for _, r := range rng.Perm(count)[:min(ranges, count)] {
+			offset := int64(r) * verifyRangeSize
+			length := min(int64(verifyRangeSize), sums.Size-offset)
+			data, err := reader.ReadRange(name, offset, length)
+			downloaded += int64(len(data))
+			if err != nil {
+				return downloaded, err
+			}
+			if int64(len(data)) != length || !bytes.Equal(rangeSum(data), sums.Sums[r*rangeSumSize:(r+1)*rangeSumSize]) {
+				return downloaded, fmt.Errorf("range at %v of %s does not match its checksum", offset, name)
+			}
+			result.Ranges++
+		}
+	}
+	return downloaded, nil
+}
+
+// verifyWhole downloads every part of an object of fileShare, checks them
+// against their range checksums if known and the share against its CRC and
+// its hash in the manifest. Checksums are recorded for parts that had none
+// once the share checks out
+func verifyWhole(store interface{}, storeName string, fileShare FileShare, parts []string) (int64, error) {
+	reader, ok := store.(objectReader)
+	if !ok {
+		return 0, fmt.Errorf("store cannot download single objects")
+	}
+
+	var object []byte
+	defer func() { wipe(object) }()
+	unknown := make(map[string][]byte)
+	for _, name := range parts {
+		data, err := reader.Read(name)
+		if err != nil {
+			return int64(len(object)), err
+		}
+		object = append(object, data...)
+		if sums, ok := state.RangeSums[storeName][name]; !ok {
+			unknown[name] = data
+		} else if computed := computeRangeSums(data); computed.Size != sums.Size || !bytes.Equal(computed.Sums, sums.Sums) {
+			return int64(len(object)), fmt.Errorf("%s does not match its checksums", name)
+		}
+	}
+
+	if bytes.HasPrefix(object, []byte(recovery.Magic)) {
+		if _, err := recovery.Decode(object); err != nil {
+			return int64(len(object)), err
+		}
+	}
+	if err := checkShare(fileShare, object); err != nil {
+		return int64(len(object)), err
+	}
+	for name, data := range unknown {
+		recordRangeSums(storeName, name, data)
+		wipe(data)
+	}
+	return int64(len(object)), nil
+}
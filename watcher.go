@@ -2,11 +2,17 @@ package main
 
 import (
 	"log"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"time"
 
 	"gopkg.in/fsnotify.v1"
 )
 
+// upload a consolidated manifest once the watched folder has been quiet this long
+const manifestConsolidateDelay = 2 * time.Minute
+
 // StartWatching a path indefinitely.
 func StartWatching(path string, subDirs map[string]bool) {
 	watcher, err := fsnotify.NewWatcher()
@@ -24,15 +30,60 @@ func StartWatching(path string, subDirs map[string]bool) {
 		watcher.Add(sub)
 	}
 
+	// manifest changes are uploaded as deltas, not on every .chasm write
+	manifestPath := filepath.Join(preferences.root, chasmPrefFile)
+	statePath := filepath.Join(preferences.root, chasmStateFile)
+	lockPath := filepath.Join(preferences.root, chasmLockFile)
+	consolidate := time.NewTimer(manifestConsolidateDelay)
+	consolidate.Stop()
+
+	// tracked paths renamed away, deleted at consolidation unless a new
+	// name picked up their entry
+	renamed := make(map[string]bool)
+
+	// changed files the policy schedules for later, by when they are due
+	scheduled := make(map[string]time.Time)
+	schedule := time.NewTicker(minSchedule)
+	defer schedule.Stop()
+
+	// decoy rounds at random times, never firing if they are off
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	decoy := time.NewTimer(time.Hour)
+	decoy.Stop()
+	if preferences.DecoyRoundsPerDay > 0 {
+		decoy.Reset(nextDecoyRound(rng, preferences.DecoyRoundsPerDay))
+	}
+
+	// friends hosting our shares prove they still hold some each day
+	challenge := time.NewTicker(peerChallengeInterval)
+	defer challenge.Stop()
+
+	StartRun("watch")
+	CheckFailover()
+
+	reloadOnHangup()
+	startWatchdog()
+	sdNotify("READY=1\nSTATUS=Watching " + preferences.root)
+
 	done := make(chan bool)
 	go func() {
 		for {
 			select {
 			case event := <-watcher.Events:
+				if event.Name == manifestPath || event.Name == statePath || event.Name == lockPath {
+					continue
+				}
+
 				log.Println("event:", event)
+				prefsLock.Lock()
 				isDir := isDir(event.Name)
 
-				if event.Op&fsnotify.Create == fsnotify.Create {
+				if dir, ok := gitBundleDir(event.Name); ok {
+					// any change in a bundled repository re-bundles it
+					addGitBundle(dir)
+				} else if event.Op&(fsnotify.Create|fsnotify.Write) != 0 && !isDir && scheduledUpload(event.Name, scheduled) {
+					log.Println("upload left to the policy's schedule:", event.Name)
+				} else if event.Op&fsnotify.Create == fsnotify.Create {
 					AddFile(event.Name)
 					if isDir {
 						watcher.Add(event.Name)
@@ -43,11 +94,90 @@ func StartWatching(path string, subDirs map[string]bool) {
 						watcher.Add(event.Name)
 					}
 				} else if event.Op&fsnotify.Rename == fsnotify.Rename {
-					DeleteFile(event.Name)
+					// the new name usually follows as a create, which moves
+					// the entry. Otherwise it is deleted with the manifest
+					if _, tracked := preferences.FileMap[event.Name]; tracked {
+						renamed[event.Name] = true
+					} else {
+						DeleteFile(event.Name)
+					}
 				} else if event.Op&fsnotify.Remove == fsnotify.Remove {
 					DeleteFile(event.Name)
 				}
 
+				UploadManifestDelta()
+				prefsLock.Unlock()
+				consolidate.Reset(manifestConsolidateDelay)
+
+			case <-consolidate.C:
+				log.Println("uploading consolidated manifest")
+				prefsLock.Lock()
+				for oldPath := range renamed {
+					if _, tracked := preferences.FileMap[oldPath]; tracked {
+						DeleteFile(oldPath)
+					}
+				}
+				renamed = make(map[string]bool)
+				UploadManifest()
+
+				// each quiet period ends a run of watched changes
+				FinishRun()
+				StartRun("watch")
+				CheckFailover()
+				prefsLock.Unlock()
+
+			case now := <-schedule.C:
+				prefsLock.Lock()
+				uploaded := 0
+				for filePath, due := range scheduled {
+					if now.Before(due) {
+						continue
+					}
+					delete(scheduled, filePath)
+					// removed since, which the watcher already handled
+					if _, err := os.Stat(filePath); err == nil {
+						AddFile(filePath)
+						uploaded++
+					}
+				}
+				if uploaded > 0 {
+					UploadManifestDelta()
+					consolidate.Reset(manifestConsolidateDelay)
+				}
+				prefsLock.Unlock()
+
+			case <-decoy.C:
+				prefsLock.Lock()
+				FinishRun()
+				StartRun("decoy")
+				DecoyRound(rng)
+				FinishRun()
+				StartRun("watch")
+				prefsLock.Unlock()
+				decoy.Reset(nextDecoyRound(rng, preferences.DecoyRoundsPerDay))
+
+			case <-challenge.C:
+				prefsLock.Lock()
+				for _, result := range ChallengePeers(defaultPeerChallenges) {
+					log.Printf("peer %s: %v proven, %v failed, %v challenges left, error: %v", result.Peer, result.Proven, result.Failed, result.Left, result.Err)
+				}
+				prefsLock.Unlock()
+
+			case <-reloadRequests:
+				sdNotify("RELOADING=1")
+				prefsLock.Lock()
+				log.Println("reloading the configuration")
+				ReloadChasm()
+				for sub := range preferences.DirMap {
+					watcher.Add(sub)
+				}
+				prefsLock.Unlock()
+				decoy.Stop()
+				if preferences.DecoyRoundsPerDay > 0 {
+					decoy.Reset(nextDecoyRound(rng, preferences.DecoyRoundsPerDay))
+				}
+				sdNotify("READY=1\nSTATUS=Watching " + preferences.root)
+
 			case err := <-watcher.Errors:
 				log.Println("error:", err)
 			}
@@ -57,6 +187,22 @@ func StartWatching(path string, subDirs map[string]bool) {
 	<-done
 }
 
+// scheduledUpload checks if the policy holds back the upload of a changed
+// file, to a sync or to when its schedule is due, noted in scheduled
+func scheduledUpload(filePath string, scheduled map[string]time.Time) bool {
+	period, manual := scheduleFor(filePath)
+	if manual {
+		return true
+	}
+	if period == 0 {
+		return false
+	}
+	if _, ok := scheduled[filePath]; !ok {
+		scheduled[filePath] = time.Now().Add(period)
+	}
+	return true
+}
+
 func isDir(filePath string) bool {
 	file, err := os.Open(filePath)
 	if err != nil {
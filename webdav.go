@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// WebDAVStore keeps shares in a folder of a WebDAV server, such as a
+// self-hosted Nextcloud or ownCloud, signed in with a username and an app
+// password
+type WebDAVStore struct {
+	// WebDAV root of the account, for Nextcloud
+	// https://host/remote.php/dav/files/USER
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"-"`
+
+	// folder under the root holding the shares
+	Folder string `json:"folder"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (w *WebDAVStore) credentials() map[string]*string {
+	return map[string]*string{"password": &w.Password}
+}
+
+// webdavMultistatus is the part of a PROPFIND response listing uses
+type webdavMultistatus struct {
+	Responses []struct {
+		Href       string    `xml:"href"`
+		Collection *struct{} `xml:"propstat>prop>resourcetype>collection"`
+	} `xml:"response"`
+}
+
+const webdavPropfind = `<?xml version="1.0" encoding="utf-8"?><d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/></d:prop></d:propfind>`
+
+// Setup creates the folder, and each folder above it, if missing
+func (w *WebDAVStore) Setup() bool {
+	w.URL = strings.TrimSuffix(w.URL, "/")
+	w.Folder = strings.Trim(w.Folder, "/")
+	for _, ws := range preferences.WebDAVStores {
+		if ws.location() == w.location() {
+			color.Red("WebDAV folder %s already exists.", w.location())
+			return false
+		}
+	}
+
+	if _, err := url.Parse(w.URL); err != nil {
+		color.Red("Error: bad WebDAV URL %s: %s", w.URL, err)
+		return false
+	}
+
+	folder := ""
+	for _, name := range strings.Split(w.Folder, "/") {
+		folder = path.Join(folder, name)
+		resp, err := w.do("MKCOL", w.URL+"/"+webdavEscape(folder)+"/", nil, nil)
+		if err != nil {
+			color.Red("Error: cannot reach %s: %s", w.URL, err)
+			return false
+		}
+		resp.Body.Close()
+
+		// 405 if the folder exists
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			color.Red("Error: cannot create %s: %s", w.location(), resp.Status)
+			return false
+		}
+	}
+
+	if _, err := w.list(); err != nil {
+		color.Red("Error: cannot list %s: %s", w.location(), err)
+		return false
+	}
+	return true
+}
+
+func (w WebDAVStore) location() string {
+	return strings.TrimSuffix(w.URL, "/") + "/" + strings.Trim(w.Folder, "/")
+}
+
+// webdavEscape escapes each name of a slash separated path
+func webdavEscape(p string) string {
+	names := strings.Split(p, "/")
+	for i, name := range names {
+		names[i] = url.PathEscape(name)
+	}
+	return strings.Join(names, "/")
+}
+
+func (w WebDAVStore) objectURL(object string) string {
+	return w.URL + "/" + webdavEscape(w.Folder) + "/" + url.PathEscape(object)
+}
+
+func (w WebDAVStore) do(method, target string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.SetBasicAuth(w.Username, w.Password)
+	return storeHTTPClient().Do(req)
+}
+
+// webdavError is the status of a failed request
+func webdavError(resp *http.Response) error {
+	data, _ := ioutil.ReadAll(resp.Body)
+	if message := strings.TrimSpace(string(data)); message != "" && len(message) < 512 {
+		return fmt.Errorf("%s: %s", resp.Status, message)
+	}
+	return errors.New(resp.Status)
+}
+
+// Upload puts the share, refusing to replace an existing file
+func (w WebDAVStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading %s/%s...", w.location(), share.ObjectName()))
+
+	resp, err := w.do("PUT", w.objectURL(share.ObjectName()), http.Header{"If-None-Match": {"*"}}, share.Data)
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = webdavError(resp)
+		}
+	}
+	if err != nil {
+		color.Red("%s/%s upload failed: %v", w.location(), share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+func (w WebDAVStore) remove(object string) error {
+	resp, err := w.do("DELETE", w.objectURL(object), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return webdavError(resp)
+	}
+	return nil
+}
+
+// Remove permanently deletes a single object
+func (w WebDAVStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting %s/%s...", w.location(), object))
+	if err := w.remove(object); err != nil {
+		color.Red("Error: could not delete %s from %s: %s", object, w.location(), err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of the files in the folder
+func (w WebDAVStore) list() ([]string, error) {
+	folderURL := w.URL + "/" + webdavEscape(w.Folder) + "/"
+	header := http.Header{"Depth": {"1"}, "Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := w.do("PROPFIND", folderURL, header, []byte(webdavPropfind))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, webdavError(resp)
+	}
+
+	var listing webdavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return nil, err
+	}
+	var objects []string
+	for _, response := range listing.Responses {
+		// the folder itself and any folders in it
+		if response.Collection != nil {
+			continue
+		}
+		href, err := url.PathUnescape(response.Href)
+		if err != nil {
+			continue
+		}
+		objects = append(objects, path.Base(href))
+	}
+	return objects, nil
+}
+
+// List returns the names of all objects in the folder
+func (w WebDAVStore) List() []string {
+	objects, err := w.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", w.location(), err)
+		return nil
+	}
+	return objects
+}
+
+func (w WebDAVStore) download(object string, header http.Header) ([]byte, error) {
+	resp, err := w.do("GET", w.objectURL(object), header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, webdavError(resp)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Read downloads a single object
+func (w WebDAVStore) Read(object string) ([]byte, error) {
+	return w.download(object, nil)
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (w WebDAVStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	resp, err := w.do("GET", w.objectURL(object), header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return ioutil.ReadAll(resp.Body)
+	case http.StatusOK:
+		// servers without range support send the whole file
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if offset >= int64(len(data)) {
+			return nil, nil
+		}
+		if end := offset + length; end < int64(len(data)) {
+			return data[offset:end], nil
+		}
+		return data[offset:], nil
+	default:
+		return nil, webdavError(resp)
+	}
+}
+
+// Restore downloads shares to local restore path
+func (w WebDAVStore) Restore() string {
+	objects, err := w.list()
+	if err != nil {
+		color.Red("Error listing %s: %s", w.location(), err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_webdav_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from %s...", w.location())
+	for _, object := range objects {
+		data, err := w.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects in the folder
+func (w WebDAVStore) Description() string {
+	objects, err := w.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", w.ShortDescription(), err)
+	}
+
+	label := w.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (w WebDAVStore) ShortDescription() string {
+	return "WebDAV Store: " + w.location()
+}
+
+// Clean deletes all shares from the folder
+func (w WebDAVStore) Clean() {
+	for _, object := range w.List() {
+		color.Yellow("Removing WebDAV Store: %v", object)
+		w.remove(object)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// YandexDiskStore keeps shares in a folder of a Yandex Disk, through its
+// REST API, with an OAuth token of an app given access to the disk. Uploads
+// and downloads go to links the API hands out for each object
+type YandexDiskStore struct {
+	OAuthToken string `json:"-"`
+
+	// e.g. disk:/chasm, or app:/ for the folder of the app
+	Folder string `json:"folder"`
+}
+
+// credentials are kept in the local state, see credentials.go
+func (y *YandexDiskStore) credentials() map[string]*string {
+	return map[string]*string{"oauth_token": &y.OAuthToken}
+}
+
+const (
+	yandexAPI = "https://cloud-api.yandex.net/v1/disk"
+
+	// objects listed per request
+	yandexPageSize = 1000
+)
+
+type yandexError struct {
+	Status      string
+	Description string `json:"description"`
+	Code        string `json:"error"`
+}
+
+func (e yandexError) Error() string {
+	if e.Description == "" {
+		return e.Status
+	}
+	return fmt.Sprintf("%s: %s", e.Status, e.Description)
+}
+
+// yandexLink is where to upload or download an object
+type yandexLink struct {
+	Href   string `json:"href"`
+	Method string `json:"method"`
+}
+
+// Setup checks the token and creates the folder if missing
+func (y YandexDiskStore) Setup() bool {
+	for _, ys := range preferences.YandexDiskStores {
+		if ys.OAuthToken == y.OAuthToken && ys.Folder == y.Folder {
+			color.Red("Yandex Disk folder %s already exists.", y.Folder)
+			return false
+		}
+	}
+
+	if _, err := y.list(); err == nil {
+		return true
+	}
+	_, err := y.do("PUT", yandexAPI+"/resources?"+url.Values{"path": {y.Folder}}.Encode(), nil, nil)
+	if err != nil {
+		color.Red("Error: cannot set up Yandex Disk folder %s: %s", y.Folder, err)
+		return false
+	}
+	color.Yellow("Created Yandex Disk folder %s", y.Folder)
+	return true
+}
+
+// do sends a request, authorized if it goes to the API, returning the
+// response body
+func (y YandexDiskStore) do(method, target string, body []byte, header http.Header) ([]byte, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if strings.HasPrefix(target, yandexAPI) {
+		req.Header.Set("Authorization", "OAuth "+y.OAuthToken)
+	}
+
+	resp, err := storeHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		yandexErr := yandexError{Status: resp.Status}
+		json.Unmarshal(data, &yandexErr)
+		return nil, yandexErr
+	}
+	return data, nil
+}
+
+func (y YandexDiskStore) objectPath(object string) string {
+	return strings.TrimSuffix(y.Folder, "/") + "/" + object
+}
+
+// link asks the API where to upload or download an object
+func (y YandexDiskStore) link(operation string, query url.Values) (yandexLink, error) {
+	var link yandexLink
+	data, err := y.do("GET", yandexAPI+"/resources/"+operation+"?"+query.Encode(), nil, nil)
+	if err == nil {
+		err = json.Unmarshal(data, &link)
+	}
+	return link, err
+}
+
+func (y YandexDiskStore) upload(object string, data []byte) error {
+	link, err := y.link("upload", url.Values{"path": {y.objectPath(object)}, "overwrite": {"false"}})
+	if e, ok := err.(yandexError); ok && e.Code == "DiskResourceAlreadyExistsError" {
+		return errors.New("object exists")
+	}
+	if err != nil {
+		return err
+	}
+	if link.Method == "" {
+		link.Method = "PUT"
+	}
+	_, err = y.do(link.Method, link.Href, data, nil)
+	return err
+}
+
+// Upload writes the share as a new object, refusing to overwrite one
+func (y YandexDiskStore) Upload(share Share) {
+	fmt.Print(color.MagentaString("Uploading Yandex/%s/%s...", y.Folder, share.ObjectName()))
+	if err := y.upload(share.ObjectName(), share.Data); err != nil {
+		color.Red("Yandex/%s/%s upload failed: %v", y.Folder, share.ObjectName(), err)
+		return
+	}
+	fmt.Print(color.MagentaString(doneMark()))
+}
+
+func (y YandexDiskStore) remove(object string) error {
+	query := url.Values{"path": {y.objectPath(object)}, "permanently": {"true"}}
+	_, err := y.do("DELETE", yandexAPI+"/resources?"+query.Encode(), nil, nil)
+	return err
+}
+
+// Remove permanently deletes a single object
+func (y YandexDiskStore) Remove(object string) {
+	fmt.Print(color.YellowString("Deleting Yandex/%s/%s...", y.Folder, object))
+	if err := y.remove(object); err != nil {
+		color.Red("Error: could not delete %s from Yandex Disk: %s", object, err)
+		return
+	}
+	fmt.Print(color.YellowString(doneMark()))
+}
+
+// list returns the names of all files in the folder
+func (y YandexDiskStore) list() ([]string, error) {
+	var objects []string
+	for offset := 0; ; offset += yandexPageSize {
+		query := url.Values{
+			"path":   {y.Folder},
+			"limit":  {fmt.Sprint(yandexPageSize)},
+			"offset": {fmt.Sprint(offset)},
+			"fields": {"_embedded.items.name,_embedded.items.type,_embedded.total"},
+		}
+		data, err := y.do("GET", yandexAPI+"/resources?"+query.Encode(), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var listing struct {
+			Embedded struct {
+				Items []struct {
+					Name string `json:"name"`
+					Type string `json:"type"`
+				} `json:"items"`
+				Total int `json:"total"`
+			} `json:"_embedded"`
+		}
+		if err := json.Unmarshal(data, &listing); err != nil {
+			return nil, err
+		}
+		for _, item := range listing.Embedded.Items {
+			if item.Type == "file" {
+				objects = append(objects, item.Name)
+			}
+		}
+		if len(listing.Embedded.Items) < yandexPageSize || offset+yandexPageSize >= listing.Embedded.Total {
+			return objects, nil
+		}
+	}
+}
+
+// List returns the names of all objects in the folder
+func (y YandexDiskStore) List() []string {
+	objects, err := y.list()
+	if err != nil {
+		color.Red("Error listing Yandex Disk: %s", err)
+		return nil
+	}
+	return objects
+}
+
+// download fetches an object from its download link, with the Range header
+// if set
+func (y YandexDiskStore) download(object string, header http.Header) ([]byte, error) {
+	link, err := y.link("download", url.Values{"path": {y.objectPath(object)}})
+	if err != nil {
+		return nil, err
+	}
+	return y.do("GET", link.Href, nil, header)
+}
+
+// Read downloads a single object
+func (y YandexDiskStore) Read(object string) ([]byte, error) {
+	return y.download(object, nil)
+}
+
+// ReadRange downloads length bytes of an object from offset
+func (y YandexDiskStore) ReadRange(object string, offset, length int64) ([]byte, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	return y.download(object, header)
+}
+
+// Restore downloads shares to local restore path
+func (y YandexDiskStore) Restore() string {
+	objects, err := y.list()
+	if err != nil {
+		color.Red("Error listing Yandex Disk: %s", err)
+		return ""
+	}
+
+	restoreDir, err := ioutil.TempDir("", "chasm_yandex_restore")
+	if err != nil {
+		color.Red("Error cannot create temp dir: %v", err)
+		return ""
+	}
+
+	color.Yellow("Downloading shares from Yandex Disk...")
+	for _, object := range objects {
+		data, err := y.Read(object)
+		if err != nil {
+			color.Yellow("Error downloading share %s: %v", object, err)
+			continue
+		}
+		stageShare(restoreDir, object, data)
+		fmt.Println("\t - got share ", object)
+	}
+
+	return restoreDir
+}
+
+// Description lists the objects in the folder
+func (y YandexDiskStore) Description() string {
+	objects, err := y.list()
+	if err != nil {
+		return fmt.Sprintf("%s (unreachable: %s)", y.ShortDescription(), err)
+	}
+
+	label := y.ShortDescription()
+	for _, object := range objects {
+		label += fmt.Sprintf("\n\t%s %s", color.YellowString("-"), object)
+	}
+	return label
+}
+
+func (y YandexDiskStore) ShortDescription() string {
+	return "Yandex Disk Store: " + y.Folder
+}
+
+// Clean deletes all shares from the folder
+func (y YandexDiskStore) Clean() {
+	for _, object := range y.List() {
+		color.Yellow("Removing Yandex Disk Store: %v", object)
+		y.remove(object)
+	}
+}